@@ -0,0 +1,146 @@
+// Package clientip finds the IP address of the callers behind the trusted proxies.
+//
+// The X-Forwarded-For and X-Real-Ip headers are set by the callers as they like, they are only read when the
+// request comes from a trusted proxy. The addresses of the header are then read from the right, the first one
+// which is not a trusted proxy is the caller. Without trusted proxies the caller is the peer of the connection.
+package clientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+type contextKey struct{}
+
+// trusted are the proxies given to Trust
+var trusted []*net.IPNet
+
+// Trust sets the proxies, IP addresses or CIDR ranges, whose forwarded headers are believed
+func Trust(proxies []string) error {
+	nets, err := ParseProxies(proxies)
+	if err != nil {
+		return err
+	}
+
+	trusted = nets
+	return nil
+}
+
+// ParseProxies reads IP addresses and CIDR ranges, an address is a range of its own
+func ParseProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, errors.Errorf("%q is not an IP address nor a CIDR range", p)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, errors.Errorf("%q is not an IP address nor a CIDR range", p)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// Middleware finds the IP address of the caller once, for the handlers and the storage calls of the request
+func Middleware(c *gin.Context) {
+	ip := Resolve(c.Request, trusted)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), contextKey{}, ip))
+	c.Next()
+}
+
+// Get returns the IP address of the caller of a request
+func Get(c *gin.Context) string {
+	if ip := FromContext(c.Request.Context()); ip != "" {
+		return ip
+	}
+
+	return Resolve(c.Request, trusted)
+}
+
+// FromContext returns the IP address of the caller of the request of the context, empty out of a request
+func FromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(contextKey{}).(string)
+	return ip
+}
+
+// Resolve returns the IP address of the caller of the request, behind the proxies
+func Resolve(r *http.Request, proxies []*net.IPNet) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	if !isTrusted(remote, proxies) {
+		return remote
+	}
+
+	var hops []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+
+	if len(hops) == 0 {
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-Ip")); net.ParseIP(ip) != nil {
+			return ip
+		}
+
+		return remote
+	}
+
+	// the nearest hops are the last ones, the first address not added by a trusted proxy is the caller
+	caller := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+
+		caller = hop
+		if !isTrusted(hop, proxies) {
+			break
+		}
+	}
+
+	return caller
+}
+
+func isTrusted(addr string, proxies []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -11,15 +11,75 @@ var (
 	ErrUsernameExisted                  = CustomError("ErrUsernameExisted", "username is existed")
 	ErrEmailExisted                     = CustomError("ErrEmailExisted", "email is existed")
 	ErrFbIdCannotBeEmpty                = CustomError("ErrFbIdCannotBeEmpty", "Facebook id cannot be empty")
-	ErrAKIdCannotBeEmpty                = CustomError("ErrAKIdCannotBeEmpty", "AccountKit id cannot be empty")
 	ErrAppleIdCannotBeEmpty             = CustomError("ErrAppleIdCannotBeEmpty", "Apple id cannot be empty")
+	ErrIdTokenCannotBeEmpty             = CustomError("ErrIdTokenCannotBeEmpty", "id token cannot be empty")
+	ErrIdTokenInvalid                   = CustomError("ErrIdTokenInvalid", "id token is invalid")
+	ErrFbAccessTokenCannotBeEmpty       = CustomError("ErrFbAccessTokenCannotBeEmpty", "facebook access token cannot be empty")
+	ErrFbAccessTokenInvalid             = CustomError("ErrFbAccessTokenInvalid", "facebook access token is invalid")
+	ErrFbUnavailable                    = CustomError("ErrFbUnavailable", "facebook cannot check the access token, try again later")
+	ErrConnectorNotFound                = CustomError("ErrConnectorNotFound", "identity provider not found")
+	ErrConnectorStateInvalid            = CustomError("ErrConnectorStateInvalid", "login at the identity provider is invalid or expired")
+	ErrIdentityProviderNotLinkable      = CustomError("ErrIdentityProviderNotLinkable", "identity provider cannot be linked")
+	ErrIdentityAlreadyLinked            = CustomError("ErrIdentityAlreadyLinked", "identity is already linked to another user")
+	ErrLastLoginMethod                  = CustomError("ErrLastLoginMethod", "cannot remove the last login method of the user")
+	ErrPasswordNotCorrect               = CustomError("ErrPasswordNotCorrect", "password is not correct")
 	ErrPhonePrefixCannotBeEmpty         = CustomError("ErrPhonePrefixCannotBeEmpty", "phone prefix cannot be empty")
+	ErrPhoneInvalid                     = CustomError("ErrPhoneInvalid", "phone is not a valid number of the region of the prefix")
+	ErrPhoneExisted                     = CustomError("ErrPhoneExisted", "phone is existed")
 	ErrEmailCannotBeEmpty               = CustomError("ErrEmailCannotBeEmpty", "email cannot be empty")
 	ErrPhoneAndEmailCannotBeEmpty       = CustomError("ErrPhoneAndEmailCannotBeEmpty", "phone or email must be have a value")
 	ErrEmailInvalid                     = CustomError("ErrEmailInvalid", "email is not valid format example@email.com")
 	ErrUsernameCannotBeEmpty            = CustomError("ErrUsernameCannotBeEmpty", "username cannot be empty")
 	ErrOTPExpired                       = CustomError("ErrOTPExpired", "otp expired")
+	ErrOTPInvalid                       = CustomError("ErrOTPInvalid", "otp is not valid")
+	ErrOTPTooManyAttempts               = CustomError("ErrOTPTooManyAttempts", "too many wrong otp, request a new one")
+	ErrOTPNoDeliveryChannel             = CustomError("ErrOTPNoDeliveryChannel", "user has no phone or email to receive the otp")
+	ErrOTPCannotBeSent                  = CustomError("ErrOTPCannotBeSent", "otp cannot be sent")
+	ErrMFARequired                      = CustomError("ErrMFARequired", "multi-factor authentication is required")
+	ErrMFAAlreadyEnabled                = CustomError("ErrMFAAlreadyEnabled", "multi-factor authentication is already enabled")
+	ErrMFANotEnrolled                   = CustomError("ErrMFANotEnrolled", "multi-factor authentication is not enrolled")
+	ErrMFACodeInvalid                   = CustomError("ErrMFACodeInvalid", "mfa code is not valid")
+	ErrMFATokenInvalid                  = CustomError("ErrMFATokenInvalid", "mfa token is invalid or expired")
+	ErrRecoveryCodeInvalid              = CustomError("ErrRecoveryCodeInvalid", "recovery code is invalid or already used")
+	ErrEmailAlreadyVerified             = CustomError("ErrEmailAlreadyVerified", "email is already verified")
+	ErrEmailNotVerified                 = CustomError("ErrEmailNotVerified", "email is not verified")
+	ErrEmailCannotBeSent                = CustomError("ErrEmailCannotBeSent", "email cannot be sent")
+	ErrVerificationTokenInvalid         = CustomError("ErrVerificationTokenInvalid", "verification token is invalid or expired")
+	ErrResetTokenInvalid                = CustomError("ErrResetTokenInvalid", "reset token is invalid or expired")
+	ErrEmailOrPhoneRequired             = CustomError("ErrEmailOrPhoneRequired", "email or phone is required")
+	ErrEmailOwnershipUnverified         = CustomError("ErrEmailOwnershipUnverified", "an account with this email exists, sign in to it and link the provider from the account")
+	ErrWebAuthnUnavailable              = CustomError("ErrWebAuthnUnavailable", "webauthn is not configured")
+	ErrWebAuthnSessionInvalid           = CustomError("ErrWebAuthnSessionInvalid", "webauthn session is invalid, expired or already used")
+	ErrWebAuthnFailed                   = CustomError("ErrWebAuthnFailed", "webauthn verification failed")
+	ErrWebAuthnNoCredential             = CustomError("ErrWebAuthnNoCredential", "user has no webauthn credential")
+	ErrWebAuthnCloned                   = CustomError("ErrWebAuthnCloned", "webauthn authenticator may be cloned")
+	ErrReauthenticationRequired         = CustomError("ErrReauthenticationRequired", "a fresh proof is required: the password, an mfa or otp code, a passkey or a linked identity")
 	ErrCannotLogin                      = CustomError("ErrCannotLogin", "cannot login, wrong credential")
+	ErrScopeNameInvalid                 = CustomError("ErrScopeNameInvalid", "scope name cannot be empty or contain whitespaces")
+	ErrScopeExisted                     = CustomError("ErrScopeExisted", "scope is existed")
+	ErrUnknownScope                     = CustomError("ErrUnknownScope", "scope is not defined in the scope catalog")
+	ErrClientIdCannotBeEmpty            = CustomError("ErrClientIdCannotBeEmpty", "client id cannot be empty")
+	ErrClientSecretCannotBeEmpty        = CustomError("ErrClientSecretCannotBeEmpty", "client secret cannot be empty")
+	ErrClientExisted                    = CustomError("ErrClientExisted", "client is existed")
+	ErrClientNotFound                   = CustomError("ErrClientNotFound", "client not found")
+	ErrWebhookURLInvalid                = CustomError("ErrWebhookURLInvalid", "webhook url must be an absolute http or https url")
+	ErrWebhookEventUnknown              = CustomError("ErrWebhookEventUnknown", "webhook event is not a known user event")
+	ErrAuditCursorInvalid               = CustomError("ErrAuditCursorInvalid", "audit cursor is not valid")
+	ErrRoleNameCannotBeEmpty            = CustomError("ErrRoleNameCannotBeEmpty", "role name cannot be empty")
+	ErrRoleNotFound                     = CustomError("ErrRoleNotFound", "role is not defined for this client")
+	ErrPasswordCannotBeEmpty            = CustomError("ErrPasswordCannotBeEmpty", "password cannot be empty")
+	ErrPasswordTooShort                 = CustomError("ErrPasswordTooShort", "password is too short")
+	ErrPasswordNeedsUpper               = CustomError("ErrPasswordNeedsUpper", "password must contain an uppercase letter")
+	ErrPasswordNeedsLower               = CustomError("ErrPasswordNeedsLower", "password must contain a lowercase letter")
+	ErrPasswordNeedsDigit               = CustomError("ErrPasswordNeedsDigit", "password must contain a digit")
+	ErrPasswordNeedsSymbol              = CustomError("ErrPasswordNeedsSymbol", "password must contain a symbol")
+	ErrPasswordBreached                 = CustomError("ErrPasswordBreached", "password is found in a list of breached passwords")
+	ErrPasswordReused                   = CustomError("ErrPasswordReused", "password has been used recently")
+	ErrScopeNotGranted                  = CustomError("ErrScopeNotGranted", "access token is not granted the required scope")
+	ErrTokenNotOwner                    = CustomError("ErrTokenNotOwner", "access token does not belong to the user")
+	ErrAccountLocked                    = CustomError("ErrAccountLocked", "account is temporarily locked after too many failed logins")
+	ErrTooManyLoginAttempts             = CustomError("ErrTooManyLoginAttempts", "too many failed logins, try again later")
+	ErrTooManyRequests                  = CustomError("ErrTooManyRequests", "too many requests, try again later")
 )
 
 type customError struct {
@@ -38,3 +98,25 @@ func (ce *customError) Key() string {
 func CustomError(k, v string) *customError {
 	return &customError{k, v}
 }
+
+// FieldError is a validation error of a request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+// FieldErrors turns custom errors into validation errors of a field
+func FieldErrors(field string, errs ...error) []FieldError {
+	result := make([]FieldError, 0, len(errs))
+
+	for _, err := range errs {
+		fe := FieldError{Field: field, Key: "ErrInvalidField", Message: err.Error()}
+		if ke, ok := err.(interface{ Key() string }); ok {
+			fe.Key = ke.Key()
+		}
+		result = append(result, fe)
+	}
+
+	return result
+}
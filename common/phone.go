@@ -0,0 +1,64 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// Phone is a number in its canonical forms, the E.164 number is the identity of the phone
+type Phone struct {
+	// Prefix is the country calling code, e.g. +84
+	Prefix string
+	// National is the national significant number, without the trunk prefix
+	National string
+	E164     string
+}
+
+// NormalizePhone parses a number as typed by an user. The region is taken from the prefix,
+// a calling code (+84, 84) or a region code (VN), unless the number is international (+84..., 0084...).
+func NormalizePhone(prefix, phone string) (*Phone, error) {
+	phone = strings.TrimSpace(phone)
+	prefix = strings.TrimSpace(prefix)
+
+	if strings.HasPrefix(phone, "00") {
+		phone = "+" + phone[2:]
+	}
+
+	region := "ZZ"
+
+	if !strings.HasPrefix(phone, "+") {
+		switch code := strings.TrimPrefix(prefix, "+"); {
+		case code == "":
+			return nil, ErrPhonePrefixCannotBeEmpty
+		case isDigits(code):
+			n, _ := strconv.Atoi(code)
+			region = phonenumbers.GetRegionCodeForCountryCode(n)
+		default:
+			region = strings.ToUpper(code)
+		}
+	}
+
+	num, err := phonenumbers.Parse(phone, region)
+	if err != nil || !phonenumbers.IsValidNumber(num) {
+		return nil, ErrPhoneInvalid
+	}
+
+	return &Phone{
+		Prefix:   fmt.Sprintf("+%d", num.GetCountryCode()),
+		National: phonenumbers.GetNationalSignificantNumber(num),
+		E164:     phonenumbers.Format(num, phonenumbers.E164),
+	}, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return s != ""
+}
@@ -4,11 +4,24 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"flag"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/baozhenglab/oauth-service/connector"
 	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/sender"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/oauth-service/webhook"
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/ory/fosite"
 	"github.com/ory/fosite/compose"
+	"github.com/pkg/errors"
 )
 
+// Storage types: the users are kept in SQL, the clients, tokens and the other data of the service
+// in the database of the storage type. The memory store is not supported by the service.
 const (
 	StorageTypeMem      = "mem"
 	StorageTypeMongo    = "mongo"
@@ -16,6 +29,48 @@ const (
 	StorageTypeMySQL    = "mysql"
 )
 
+const (
+	ScopeStrategyHierarchic = "hierarchic"
+	ScopeStrategyWildcard   = "wildcard"
+	ScopeStrategyExact      = "exact"
+)
+
+// Rate limited routes
+const (
+	RateLimitToken       = "token"
+	RateLimitGenerateOTP = "generate-otp"
+	RateLimitLoginOTP    = "login-otp"
+	RateLimitCreateUser  = "create-user"
+	RateLimitForgotPass  = "forgot-password"
+	RateLimitResetPass   = "reset-password"
+	RateLimitSignUpPhone = "signup-phone"
+)
+
+const (
+	RateLimitStoreMem = "mem"
+	RateLimitStoreDB  = "db"
+)
+
+const (
+	OTPSenderConsole = "console"
+	OTPSenderFile    = "file"
+)
+
+const (
+	MailerConsole = "console"
+	MailerFile    = "file"
+)
+
+// Built-in secrets and credentials, for development only: the service refuses them in production
+const (
+	builtinSystemSecret = "mrFPTI7EYOzt8CbcQVcUo2rIoLg97HI2"
+	builtinRootUsername = "admin"
+	builtinRootPassword = "Admin@2019"
+	builtinClientSecret = "secret-cannot-tell"
+	// RSA private key encrypted with the built-in system secret
+	builtinPrivateKey = `1jtPrI4HqpQzut00vvzcvdDteYGgcX1qhOqbl01KCt2iCz6ZkBGpBrlrquk1eFmtyZ3yQPtPMR6-Nmto5OPXiefWfWAdfpu0YW1DjuUCoMBzw3Mr4Ts_-wYV8ULnkWt1SW-IB-AD6bycEzivM7tz2f_rgPcOwzMAMaZqbX75aci5RgG0mMmg2yIwPR1iNara8uxebd4TNqzCXmkaXO-knB9RMVCXNb3bXZn3FVaEWxArtbQcpVfxxyFU807nS3Qe8b8_A-0JFYwUeXLwsWihtARtThltMffjtgMfQyUeKsxGSduwWfnUOV0C-hTKWuCas4BdMAmCBr8ZUrQfeGDYNdeXCX8lgh4SsOaa3DxZIr4VQD7Q_PHutvQ0II8nMODIhj1i2TMgc3XkvncTvCODNaK7gal_ljwiXyUIuXTvre9ATcQWS97YrgaDaC5ho8zoSOxtJWxy3fUmdPudT9uhhtvpXC7s6jtytqqXx03-IvYgiHUDL40d4YXXjGGa5cQuUfmNgs8YvHJQW8JjVPIxhAOAgaom2amz5UE-byhEEZQHfLhKhxooaaMEN2IuHor85Xo8Tamr4TAdGnMqM3MvGjX6nVgreT-zxNpVSnJ0k4FwBmB--u1EEH_RswZKiDFl73ScrzZKog9DydcNZUUnf73eQKjz8B7RtWXuWdJneRz_QlxnmBCy8v-gEWhPcLNm0wm-0332jAkZTm-kbMVI6Ww0hcdy-aRlyHCO8a07UC39ExxYD-ydl9qU18GRNBYpuq7_ri4Xq4hG_PklNeh7kNpdG1WimNqsy_J5l2zgPatpodHuUJm_Y70f-1uiMAtQZ8FQPzCsScrI4qnzJw==`
+)
+
 type Config struct {
 	// 32 bytes string system secret
 	SystemSecret string
@@ -25,6 +80,72 @@ type Config struct {
 	aes *secure.AES
 	// Private Key (base64 encoded from AES Cipher)
 	privateKey string
+	// PEM file of the private key, replaces the built-in key
+	privateKeyFile string
+	// YAML or JSON file of the settings
+	configFile string
+	// Scope strategy: hierarchic/wildcard/exact
+	scopeStrategy string
+	// Rules for new passwords
+	passwordPolicy *secure.PasswordPolicy
+	// Brute-force protection of the password checks
+	lockout *secure.Lockout
+	// Rate limits per route, formatted as <limit>/<period>
+	rateLimits map[string]*string
+	// Rate limit buckets storage: mem/db
+	rateLimitStore string
+	// Proxies whose forwarded headers give the IP address of the callers, comma separated
+	trustedProxies string
+	// One-time passwords lifecycle and delivery
+	otpPolicy     *secure.OTPPolicy
+	otpSenderType string
+	otpSenderFile string
+	otpSender     sender.OTPSender
+	// Emails delivery and verification
+	mailerType           string
+	mailerFile           string
+	mailer               sender.Mailer
+	emailVerificationTTL time.Duration
+	emailVerificationURL string
+	passwordResetTTL     time.Duration
+	passwordResetURL     string
+	// Multi-factor authentication
+	mfaIssuer   string
+	mfaTokenTTL time.Duration
+	// how long a trusted device skips the second factor, 0 disables the trusted devices
+	mfaTrustedDeviceTTL time.Duration
+	// WebAuthn relying party
+	webAuthnRPID     string
+	webAuthnRPOrigin string
+	webAuthnRPName   string
+	webAuthn         *webauthn.WebAuthn
+	webAuthnErr      error
+	webAuthnOnce     sync.Once
+	// Sign in with Google and Apple: our client ids at the providers (comma separated) and their signing keys
+	googleClientIDs string
+	googleJWKSURL   string
+	appleClientIDs  string
+	appleJWKSURL    string
+	googleVerifier  *secure.IDTokenVerifier
+	appleVerifier   *secure.IDTokenVerifier
+	verifiersOnce   sync.Once
+	// Facebook login: our app at Facebook and the Graph API checking its user access tokens
+	facebookAppID     string
+	facebookAppSecret string
+	facebookGraphURL  string
+	facebookVerifier  *secure.FacebookVerifier
+	// Upstream OpenID Connect and OAuth2 providers of the hosted login
+	connectorsFile       string
+	connectorCallbackURL string
+	connectors           connector.Registry
+	connectorsErr        error
+	connectorsOnce       sync.Once
+	// Delivery of the user events to the webhooks of the clients
+	webhookPolicy *webhook.Policy
+	// Export of the spans
+	tracing *tracing.Config
+	// how long a readiness check may take
+	healthCheckTimeout time.Duration
 	// Fosite config
 	FC *compose.Config
 
@@ -40,15 +161,98 @@ type Config struct {
 func SystemConfig() *Config {
 	cf := &Config{
 		StorageType: StorageTypeMySQL,
-		privateKey:  `1jtPrI4HqpQzut00vvzcvdDteYGgcX1qhOqbl01KCt2iCz6ZkBGpBrlrquk1eFmtyZ3yQPtPMR6-Nmto5OPXiefWfWAdfpu0YW1DjuUCoMBzw3Mr4Ts_-wYV8ULnkWt1SW-IB-AD6bycEzivM7tz2f_rgPcOwzMAMaZqbX75aci5RgG0mMmg2yIwPR1iNara8uxebd4TNqzCXmkaXO-knB9RMVCXNb3bXZn3FVaEWxArtbQcpVfxxyFU807nS3Qe8b8_A-0JFYwUeXLwsWihtARtThltMffjtgMfQyUeKsxGSduwWfnUOV0C-hTKWuCas4BdMAmCBr8ZUrQfeGDYNdeXCX8lgh4SsOaa3DxZIr4VQD7Q_PHutvQ0II8nMODIhj1i2TMgc3XkvncTvCODNaK7gal_ljwiXyUIuXTvre9ATcQWS97YrgaDaC5ho8zoSOxtJWxy3fUmdPudT9uhhtvpXC7s6jtytqqXx03-IvYgiHUDL40d4YXXjGGa5cQuUfmNgs8YvHJQW8JjVPIxhAOAgaom2amz5UE-byhEEZQHfLhKhxooaaMEN2IuHor85Xo8Tamr4TAdGnMqM3MvGjX6nVgreT-zxNpVSnJ0k4FwBmB--u1EEH_RswZKiDFl73ScrzZKog9DydcNZUUnf73eQKjz8B7RtWXuWdJneRz_QlxnmBCy8v-gEWhPcLNm0wm-0332jAkZTm-kbMVI6Ww0hcdy-aRlyHCO8a07UC39ExxYD-ydl9qU18GRNBYpuq7_ri4Xq4hG_PklNeh7kNpdG1WimNqsy_J5l2zgPatpodHuUJm_Y70f-1uiMAtQZ8FQPzCsScrI4qnzJw==`,
+		privateKey:  builtinPrivateKey,
 		FC:          new(compose.Config),
+
+		passwordPolicy: new(secure.PasswordPolicy),
+		lockout:        &secure.Lockout{Counter: secure.NewMemoryCounter()},
+		rateLimits:     map[string]*string{},
+		otpPolicy:      new(secure.OTPPolicy),
+		webhookPolicy:  new(webhook.Policy),
+		tracing:        new(tracing.Config),
 	}
 
-	flag.StringVar(&cf.SystemSecret, "secret", "mrFPTI7EYOzt8CbcQVcUo2rIoLg97HI2", "oauth system secret key")
-	flag.StringVar(&cf.initRootUsername, "init-root-username", "admin", "init root username for client oauth")
-	flag.StringVar(&cf.initRootPassword, "init-root-password", "Admin@2019", "init root password for client oauth")
+	flag.StringVar(&cf.configFile, "config-file", "", "YAML or JSON file of the settings named as the flags, overridden by the environment and the command line")
+	flag.StringVar(&cf.StorageType, "storage-type", StorageTypeMySQL, "storage of the clients and the tokens: mongo | postgres | mysql, the users are kept in SQL")
+	flag.StringVar(&cf.SystemSecret, "secret", builtinSystemSecret, "oauth system secret key (32 bytes)")
+	flag.StringVar(&cf.privateKeyFile, "private-key-file", "", "PEM file of the RSA private key signing the tokens, the built-in key is used when empty")
+	flag.StringVar(&cf.initRootUsername, "init-root-username", builtinRootUsername, "init root username for client oauth")
+	flag.StringVar(&cf.initRootPassword, "init-root-password", builtinRootPassword, "init root password for client oauth")
 	flag.StringVar(&cf.initClientID, "init-client-id", "200lab", "init client id for oauth")
-	flag.StringVar(&cf.initClientSecret, "init-client-secret", "secret-cannot-tell", "init client secret for oauth")
+	flag.StringVar(&cf.initClientSecret, "init-client-secret", builtinClientSecret, "init client secret for oauth")
+	flag.DurationVar(&cf.FC.AccessTokenLifespan, "access-token-lifespan", time.Hour, "validity of the access tokens")
+	flag.DurationVar(&cf.FC.RefreshTokenLifespan, "refresh-token-lifespan", 30*24*time.Hour, "validity of the refresh tokens")
+	flag.DurationVar(&cf.FC.AuthorizeCodeLifespan, "authorize-code-lifespan", 15*time.Minute, "validity of the authorization codes")
+	flag.StringVar(&cf.scopeStrategy, "scope-strategy", ScopeStrategyWildcard, "scope matching strategy: wildcard | hierarchic | exact")
+
+	pp := cf.passwordPolicy
+	flag.IntVar(&pp.MinLength, "password-min-length", 8, "minimum length of new passwords")
+	flag.BoolVar(&pp.RequireUpper, "password-require-upper", true, "new passwords must contain an uppercase letter")
+	flag.BoolVar(&pp.RequireLower, "password-require-lower", true, "new passwords must contain a lowercase letter")
+	flag.BoolVar(&pp.RequireDigit, "password-require-digit", true, "new passwords must contain a digit")
+	flag.BoolVar(&pp.RequireSymbol, "password-require-symbol", false, "new passwords must contain a symbol")
+	flag.StringVar(&pp.BreachedList, "password-breached-list", "", "path of a file of breached passwords (one per line) which are refused")
+	flag.IntVar(&pp.History, "password-history", 5, "number of last passwords which cannot be reused, 0 to disable")
+
+	flag.StringVar(&cf.trustedProxies, "trusted-proxies", "", "comma separated IP addresses and CIDR ranges of the proxies whose X-Forwarded-For gives the caller IP, none when empty")
+
+	lo := cf.lockout
+	flag.IntVar(&lo.Account.MaxAttempts, "lockout-max-attempts", 5, "failed password checks before an account is locked, 0 to disable")
+	flag.DurationVar(&lo.Account.Backoff, "lockout-backoff", time.Second, "delay after a failed password check of an account, doubled for every failure")
+	flag.DurationVar(&lo.Account.Duration, "lockout-duration", 15*time.Minute, "how long an account stays locked")
+	flag.IntVar(&lo.IP.MaxAttempts, "lockout-ip-max-attempts", 50, "failed password checks before an IP address is locked, 0 to disable")
+	flag.DurationVar(&lo.IP.Backoff, "lockout-ip-backoff", 0, "delay after a failed password check from an IP address, doubled for every failure")
+	flag.DurationVar(&lo.IP.Duration, "lockout-ip-duration", 15*time.Minute, "how long an IP address stays locked")
+
+	for _, rl := range []struct{ route, limit string }{
+		{RateLimitToken, "60/m"},
+		{RateLimitGenerateOTP, "5/m"},
+		{RateLimitLoginOTP, "10/m"},
+		{RateLimitCreateUser, "10/m"},
+		{RateLimitForgotPass, "5/m"},
+		{RateLimitResetPass, "10/m"},
+		{RateLimitSignUpPhone, "5/m"},
+	} {
+		cf.rateLimits[rl.route] = flag.String("rate-limit-"+rl.route, rl.limit, "rate limit of the "+rl.route+" route per client and IP or target user (<limit>/<period>, 0 to disable)")
+	}
+	flag.StringVar(&cf.rateLimitStore, "rate-limit-store", RateLimitStoreMem, "rate limit buckets storage: mem | db (shared by all replicas)")
+
+	flag.IntVar(&cf.otpPolicy.Length, "otp-length", 6, "number of digits of the one-time passwords")
+	flag.DurationVar(&cf.otpPolicy.TTL, "otp-ttl", time.Minute, "validity of the one-time passwords")
+	flag.IntVar(&cf.otpPolicy.MaxAttempts, "otp-max-attempts", 5, "wrong one-time passwords before the code is revoked")
+	flag.StringVar(&cf.otpSenderType, "otp-sender", OTPSenderConsole, "one-time passwords delivery stand-in when no provider is set: console | file")
+	flag.StringVar(&cf.otpSenderFile, "otp-sender-file", "otp.log", "file of the one-time passwords with the file sender")
+	flag.StringVar(&cf.mailerType, "mailer", MailerConsole, "emails delivery stand-in when no provider is set: console | file")
+	flag.StringVar(&cf.mailerFile, "mailer-file", "mail.log", "file of the emails with the file mailer")
+	flag.DurationVar(&cf.emailVerificationTTL, "email-verification-ttl", 24*time.Hour, "validity of the email verification links")
+	flag.StringVar(&cf.emailVerificationURL, "email-verification-url", "http://localhost:3000/oauth2/verify-email", "page of the email verification links, the token is added as the token parameter")
+	flag.DurationVar(&cf.passwordResetTTL, "password-reset-ttl", 30*time.Minute, "validity of the password reset tokens")
+	flag.StringVar(&cf.passwordResetURL, "password-reset-url", "http://localhost:3000/oauth2/reset-password", "page of the password reset links, the token and the email are added as parameters")
+	flag.StringVar(&cf.mfaIssuer, "mfa-issuer", "200lab", "issuer name shown in the authenticator apps")
+	flag.DurationVar(&cf.mfaTokenTTL, "mfa-token-ttl", 5*time.Minute, "validity of the mfa token given after the password check")
+	flag.DurationVar(&cf.mfaTrustedDeviceTTL, "mfa-trusted-device-ttl", 30*24*time.Hour, "how long a remembered device skips the second factor, 0 to disable")
+	flag.StringVar(&cf.webAuthnRPID, "webauthn-rp-id", "localhost", "WebAuthn relying party id, the domain of the hosted login")
+	flag.StringVar(&cf.webAuthnRPOrigin, "webauthn-rp-origin", "http://localhost:3000", "WebAuthn origin of the hosted login")
+	flag.StringVar(&cf.webAuthnRPName, "webauthn-rp-name", "200lab", "WebAuthn relying party name shown by the authenticators")
+	flag.StringVar(&cf.googleClientIDs, "google-client-ids", "", "comma separated client ids of the apps at Google, the audiences of the Google id tokens")
+	flag.StringVar(&cf.googleJWKSURL, "google-jwks-url", "https://www.googleapis.com/oauth2/v3/certs", "keys of the Google id tokens")
+	flag.StringVar(&cf.appleClientIDs, "apple-client-ids", "", "comma separated bundle and services ids of the apps at Apple, the audiences of the Apple id tokens")
+	flag.StringVar(&cf.appleJWKSURL, "apple-jwks-url", "https://appleid.apple.com/auth/keys", "keys of the Apple id tokens")
+	flag.StringVar(&cf.facebookAppID, "facebook-app-id", "", "id of the app at Facebook, the app of the accepted user access tokens")
+	flag.StringVar(&cf.facebookAppSecret, "facebook-app-secret", "", "secret of the app at Facebook")
+	flag.StringVar(&cf.facebookGraphURL, "facebook-graph-url", "https://graph.facebook.com/v18.0", "base url of the Facebook Graph API")
+	flag.StringVar(&cf.connectorsFile, "connectors-file", "", "JSON file of the upstream OpenID Connect and OAuth2 providers of the hosted login")
+	flag.StringVar(&cf.connectorCallbackURL, "connector-callback-url", "http://localhost:3000/oauth2/connectors", "public url of the connector routes, the providers redirect to <url>/<id>/callback")
+	flag.DurationVar(&cf.webhookPolicy.PollInterval, "webhook-poll-interval", 5*time.Second, "how often the outbox of the webhook events is polled")
+	flag.DurationVar(&cf.webhookPolicy.Timeout, "webhook-timeout", 10*time.Second, "timeout of a request to a webhook")
+	flag.IntVar(&cf.webhookPolicy.MaxAttempts, "webhook-max-attempts", 10, "delivery attempts of a webhook event before it is given up")
+	flag.DurationVar(&cf.webhookPolicy.Backoff, "webhook-backoff", 30*time.Second, "delay before the first retry of a webhook event, doubled for every failure")
+	flag.StringVar(&cf.tracing.Exporter, "trace-exporter", tracing.ExporterNone, "exporter of the spans: none | stdout | otlp")
+	flag.StringVar(&cf.tracing.Endpoint, "trace-endpoint", "localhost:4318", "host:port of the OTLP/HTTP collector of the spans")
+	flag.BoolVar(&cf.tracing.Insecure, "trace-insecure", false, "send the spans to the collector over plain HTTP")
+	flag.Float64Var(&cf.tracing.SampleRatio, "trace-sample-ratio", 1, "share of the new traces that are sampled, the decision of the caller is followed")
+	flag.StringVar(&cf.tracing.ServiceName, "trace-service-name", "oauth-service", "service name of the spans")
+	flag.DurationVar(&cf.healthCheckTimeout, "health-check-timeout", 2*time.Second, "timeout of each readiness check")
 
 	return cf
 }
@@ -60,7 +264,12 @@ func (c *Config) GetAES() *secure.AES {
 	return c.aes
 }
 
+// GetPrivateKey returns the key of the private-key-file setting, or the built-in key
 func (c *Config) GetPrivateKey() (key *rsa.PrivateKey, err error) {
+	if c.privateKeyFile != "" {
+		return readPrivateKey(c.privateKeyFile)
+	}
+
 	pk, err := c.GetAES().Decrypt(c.privateKey)
 
 	if err != nil {
@@ -70,6 +279,215 @@ func (c *Config) GetPrivateKey() (key *rsa.PrivateKey, err error) {
 	return x509.ParsePKCS1PrivateKey(pk)
 }
 
+// GetScopeStrategy returns the fosite scope strategy from the scope-strategy setting.
+// Unknown values fall back to the wildcard strategy, the default of fosite the grants have always used.
+func (c *Config) GetScopeStrategy() fosite.ScopeStrategy {
+	switch c.scopeStrategy {
+	case ScopeStrategyHierarchic:
+		return fosite.HierarchicScopeStrategy
+	case ScopeStrategyExact:
+		return fosite.ExactScopeStrategy
+	default:
+		return fosite.WildcardScopeStrategy
+	}
+}
+
+func (c *Config) GetPasswordPolicy() *secure.PasswordPolicy {
+	return c.passwordPolicy
+}
+
+// GetLockout returns the brute-force protection, its counters are kept in memory
+// until a shared backend is set with SetAttemptCounter
+func (c *Config) GetLockout() *secure.Lockout {
+	return c.lockout
+}
+
+func (c *Config) SetAttemptCounter(counter secure.AttemptCounter) {
+	c.lockout.Counter = counter
+}
+
+// GetRateLimit returns the rate limit of a route, a disabled limit for unknown routes
+func (c *Config) GetRateLimit(route string) (secure.RateLimit, error) {
+	limit, ok := c.rateLimits[route]
+	if !ok {
+		return secure.RateLimit{}, nil
+	}
+
+	return secure.ParseRateLimit(*limit)
+}
+
+// GetRateLimits returns the rate limits of the routes
+func (c *Config) GetRateLimits() (map[string]secure.RateLimit, error) {
+	limits := make(map[string]secure.RateLimit, len(c.rateLimits))
+	for route := range c.rateLimits {
+		limit, err := c.GetRateLimit(route)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rate-limit-%s", route)
+		}
+
+		limits[route] = limit
+	}
+
+	return limits, nil
+}
+
+func (c *Config) GetRateLimitStore() string {
+	return c.rateLimitStore
+}
+
+// GetTrustedProxies returns the proxies whose forwarded headers are believed
+func (c *Config) GetTrustedProxies() []string {
+	return splitList(c.trustedProxies)
+}
+
+func (c *Config) GetOTPPolicy() *secure.OTPPolicy {
+	return c.otpPolicy
+}
+
+// GetOTPSender returns the provider set with SetOTPSender,
+// or the console/file stand-in from the otp-sender setting
+func (c *Config) GetOTPSender() sender.OTPSender {
+	if c.otpSender == nil {
+		switch c.otpSenderType {
+		case OTPSenderFile:
+			c.otpSender = sender.NewFileSender(c.otpSenderFile)
+		default:
+			c.otpSender = sender.NewConsoleSender()
+		}
+	}
+
+	return c.otpSender
+}
+
+// SetOTPSender plugs a SMS/email provider
+func (c *Config) SetOTPSender(s sender.OTPSender) {
+	c.otpSender = s
+}
+
+// GetMailer returns the provider set with SetMailer,
+// or the console/file stand-in from the mailer setting
+func (c *Config) GetMailer() sender.Mailer {
+	if c.mailer == nil {
+		switch c.mailerType {
+		case MailerFile:
+			c.mailer = sender.NewFileMailer(c.mailerFile)
+		default:
+			c.mailer = sender.NewConsoleMailer()
+		}
+	}
+
+	return c.mailer
+}
+
+// SetMailer plugs an email provider
+func (c *Config) SetMailer(m sender.Mailer) {
+	c.mailer = m
+}
+
+func (c *Config) GetEmailVerificationTTL() time.Duration {
+	return c.emailVerificationTTL
+}
+
+func (c *Config) GetEmailVerificationURL() string {
+	return c.emailVerificationURL
+}
+
+func (c *Config) GetPasswordResetTTL() time.Duration {
+	return c.passwordResetTTL
+}
+
+func (c *Config) GetPasswordResetURL() string {
+	return c.passwordResetURL
+}
+
+func (c *Config) GetMFAIssuer() string {
+	return c.mfaIssuer
+}
+
+func (c *Config) GetMFATokenTTL() time.Duration {
+	return c.mfaTokenTTL
+}
+
+func (c *Config) GetMFATrustedDeviceTTL() time.Duration {
+	return c.mfaTrustedDeviceTTL
+}
+
+// GetWebAuthn returns the WebAuthn relying party of the hosted login
+func (c *Config) GetWebAuthn() (*webauthn.WebAuthn, error) {
+	c.webAuthnOnce.Do(func() {
+		c.webAuthn, c.webAuthnErr = webauthn.New(&webauthn.Config{
+			RPID:          c.webAuthnRPID,
+			RPOrigin:      c.webAuthnRPOrigin,
+			RPDisplayName: c.webAuthnRPName,
+		})
+	})
+
+	return c.webAuthn, c.webAuthnErr
+}
+
+func (c *Config) initIDTokenVerifiers() {
+	c.verifiersOnce.Do(func() {
+		c.googleVerifier = secure.NewIDTokenVerifier(c.googleJWKSURL, secure.GoogleIssuers, splitList(c.googleClientIDs))
+		c.appleVerifier = secure.NewIDTokenVerifier(c.appleJWKSURL, secure.AppleIssuers, splitList(c.appleClientIDs))
+		c.facebookVerifier = secure.NewFacebookVerifier(c.facebookGraphURL, c.facebookAppID, c.facebookAppSecret)
+	})
+}
+
+// GetGoogleIDTokenVerifier returns the verifier of the id tokens of Sign in with Google
+func (c *Config) GetGoogleIDTokenVerifier() *secure.IDTokenVerifier {
+	c.initIDTokenVerifiers()
+	return c.googleVerifier
+}
+
+// GetAppleIDTokenVerifier returns the verifier of the id tokens of Sign in with Apple
+func (c *Config) GetAppleIDTokenVerifier() *secure.IDTokenVerifier {
+	c.initIDTokenVerifiers()
+	return c.appleVerifier
+}
+
+// GetFacebookVerifier returns the verifier of the user access tokens of Facebook login
+func (c *Config) GetFacebookVerifier() *secure.FacebookVerifier {
+	c.initIDTokenVerifiers()
+	return c.facebookVerifier
+}
+
+// GetConnectors returns the upstream providers of the connectors file
+func (c *Config) GetConnectors() (connector.Registry, error) {
+	c.connectorsOnce.Do(func() {
+		c.connectors, c.connectorsErr = connector.Load(c.connectorsFile)
+	})
+
+	return c.connectors, c.connectorsErr
+}
+
+// GetConnectorCallbackURL returns the redirect uri registered at the provider of a connector
+func (c *Config) GetConnectorCallbackURL(id string) string {
+	return strings.TrimRight(c.connectorCallbackURL, "/") + "/" + url.PathEscape(id) + "/callback"
+}
+
+func (c *Config) GetWebhookPolicy() *webhook.Policy {
+	return c.webhookPolicy
+}
+
+func (c *Config) GetTracing() *tracing.Config {
+	return c.tracing
+}
+
+func (c *Config) GetHealthCheckTimeout() time.Duration {
+	return c.healthCheckTimeout
+}
+
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
 // Implement InitConfig
 func (c *Config) GetSystemSecret() string {
 	return c.SystemSecret
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Load reads the settings, each source overriding the previous one: the defaults, the file of the config-file setting,
+// the environment variables and the command line. Then it validates them, the service must not start on an error.
+//
+// The file is YAML or JSON, its keys are the names of the flags, nested keys are joined with a dash:
+//
+//	secret: ...
+//	webhook:
+//	  timeout: 30s
+func (c *Config) Load(args []string) error {
+	fs := flag.CommandLine
+
+	if err := fs.Parse(args); err != nil {
+		return errors.WithStack(err)
+	}
+
+	fromArgs := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { fromArgs[f.Name] = true })
+
+	if !fromArgs["config-file"] {
+		if path, ok := os.LookupEnv(envName("config-file")); ok {
+			c.configFile = path
+		}
+	}
+
+	if c.configFile != "" {
+		settings, err := readConfigFile(c.configFile)
+		if err != nil {
+			return err
+		}
+
+		names := make([]string, 0, len(settings))
+		for name := range settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if fs.Lookup(name) == nil {
+				return errors.Errorf("%s: unknown setting %q", c.configFile, name)
+			}
+
+			if _, ok := os.LookupEnv(envName(name)); ok || fromArgs[name] {
+				continue
+			}
+
+			if err := fs.Set(name, settings[name]); err != nil {
+				return errors.Wrapf(err, "%s: setting %q", c.configFile, name)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || fromArgs[f.Name] || err != nil {
+			return
+		}
+
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = errors.Wrapf(setErr, "environment variable %s", envName(f.Name))
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return c.Validate()
+}
+
+// envName is the environment variable of a flag, named as the service reads them: webhook-timeout is WEBHOOK_TIMEOUT
+func envName(name string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+// readConfigFile returns the settings of the file by flag name, JSON is read as YAML
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrapf(err, "%s", path)
+	}
+
+	settings := map[string]string{}
+	if err := flattenSettings("", doc, settings); err != nil {
+		return nil, errors.Wrapf(err, "%s", path)
+	}
+
+	return settings, nil
+}
+
+func flattenSettings(prefix string, doc map[string]interface{}, settings map[string]string) error {
+	for key, value := range doc {
+		name := key
+		if prefix != "" {
+			name = prefix + "-" + key
+		}
+
+		switch v := value.(type) {
+		case map[interface{}]interface{}:
+			nested := make(map[string]interface{}, len(v))
+			for k, nv := range v {
+				nested[fmt.Sprint(k)] = nv
+			}
+
+			if err := flattenSettings(name, nested, settings); err != nil {
+				return err
+			}
+		case []interface{}:
+			// lists are given to the flags as comma separated values
+			items := make([]string, len(v))
+			for i := range v {
+				items[i] = fmt.Sprint(v[i])
+			}
+			settings[name] = strings.Join(items, ",")
+		case nil:
+			return errors.Errorf("setting %q has no value", name)
+		default:
+			settings[name] = fmt.Sprint(v)
+		}
+	}
+
+	return nil
+}
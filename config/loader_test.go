@@ -0,0 +1,132 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// the flags are global: the settings are registered once, with the app-env flag of the entry point
+var testConfig = SystemConfig()
+
+func init() {
+	flag.String("app-env", "dev", "environment of the service")
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+webhook:
+  timeout: 30s
+  backoff: 1m
+  max-attempts: 3
+`)
+
+	t.Setenv("WEBHOOK_BACKOFF", "2m")
+	t.Setenv("WEBHOOK_MAX_ATTEMPTS", "4")
+
+	if err := testConfig.Load([]string{"-config-file", path, "-webhook-max-attempts", "5"}); err != nil {
+		t.Fatalf("Load: %+v", err)
+	}
+
+	policy := testConfig.webhookPolicy
+	if policy.Timeout != 30*time.Second {
+		t.Errorf("webhook-timeout = %s, want the value of the file", policy.Timeout)
+	}
+	if policy.Backoff != 2*time.Minute {
+		t.Errorf("webhook-backoff = %s, want the value of the environment", policy.Backoff)
+	}
+	if policy.MaxAttempts != 5 {
+		t.Errorf("webhook-max-attempts = %d, want the value of the command line", policy.MaxAttempts)
+	}
+}
+
+func TestLoadUnknownSetting(t *testing.T) {
+	path := writeConfigFile(t, "unknown-setting: 1\n")
+
+	if err := testConfig.Load([]string{"-config-file", path}); err == nil || !strings.Contains(err.Error(), "unknown-setting") {
+		t.Errorf("Load = %v, want the unknown setting refused", err)
+	}
+}
+
+func TestFlattenSettings(t *testing.T) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal([]byte(`
+secret: abc
+otp:
+  length: 8
+  sender:
+    file: otp.log
+google-client-ids:
+  - a.apps.googleusercontent.com
+  - b.apps.googleusercontent.com
+`), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := map[string]string{}
+	if err := flattenSettings("", doc, settings); err != nil {
+		t.Fatalf("flattenSettings: %+v", err)
+	}
+
+	for name, want := range map[string]string{
+		"secret":            "abc",
+		"otp-length":        "8",
+		"otp-sender-file":   "otp.log",
+		"google-client-ids": "a.apps.googleusercontent.com,b.apps.googleusercontent.com",
+	} {
+		if settings[name] != want {
+			t.Errorf("%s = %q, want %q", name, settings[name], want)
+		}
+	}
+
+	if len(settings) != 4 {
+		t.Errorf("settings = %v", settings)
+	}
+}
+
+func TestFlattenSettingsWithoutValue(t *testing.T) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal([]byte("webhook:\n  timeout:\n"), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := flattenSettings("", doc, map[string]string{}); err == nil {
+		t.Error("a setting without value is accepted")
+	}
+}
+
+// TestLoadProductionRefusesBuiltins runs last: APP_ENV is set on the app-env flag by Load
+func TestLoadProductionRefusesBuiltins(t *testing.T) {
+	t.Setenv("APP_ENV", AppEnvProduction)
+
+	if !testConfig.Production() {
+		t.Fatal("APP_ENV is hidden by the default of the app-env flag")
+	}
+
+	err := testConfig.Load([]string{"-config-file", ""})
+	if err == nil {
+		t.Fatal("the built-in secrets are accepted in production")
+	}
+
+	for _, name := range []string{"secret", "private-key-file", "init-root-password", "init-client-secret"} {
+		if !strings.Contains(err.Error(), name+":") {
+			t.Errorf("%s is not refused: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package config
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/clientip"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/pkg/errors"
+)
+
+// AppEnvProduction is the app-env of the service in production
+const AppEnvProduction = "prd"
+
+// Production tells whether the service runs in production, from the app-env setting of the service.
+// A value given to the flag wins, then the environment variable: the default of the flag does not hide APP_ENV.
+func (c *Config) Production() bool {
+	env, set := os.LookupEnv(envName("app-env"))
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "app-env" {
+			env, set = f.Value.String(), true
+		}
+	})
+
+	if !set {
+		if f := flag.Lookup("app-env"); f != nil {
+			env = f.Value.String()
+		}
+	}
+
+	return env == AppEnvProduction
+}
+
+// problems collects the invalid settings, all of them are reported at once
+type problems []string
+
+func (p *problems) add(name, format string, args ...interface{}) {
+	*p = append(*p, name+": "+fmt.Sprintf(format, args...))
+}
+
+func (p *problems) oneOf(name, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	p.add(name, "%q is not one of %s", value, strings.Join(allowed, " | "))
+}
+
+func (p *problems) positive(name string, d time.Duration) {
+	if d <= 0 {
+		p.add(name, "must be positive, got %s", d)
+	}
+}
+
+func (p *problems) notNegative(name string, n int) {
+	if n < 0 {
+		p.add(name, "must not be negative, got %d", n)
+	}
+}
+
+func (p *problems) absoluteURL(name, value string) {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		p.add(name, "%q is not an absolute url", value)
+	}
+}
+
+func (p *problems) readable(name, path string) {
+	if path == "" {
+		return
+	}
+	if f, err := os.Open(path); err != nil {
+		p.add(name, "%v", err)
+	} else {
+		f.Close()
+	}
+}
+
+// Validate checks every setting, and refuses the built-in secrets and credentials in production
+func (c *Config) Validate() error {
+	var p problems
+
+	p.oneOf("storage-type", c.StorageType, StorageTypeMongo, StorageTypePostgres, StorageTypeMySQL)
+	if len(c.SystemSecret) != 32 {
+		p.add("secret", "must be 32 bytes, got %d", len(c.SystemSecret))
+	} else if _, err := c.GetPrivateKey(); err != nil {
+		if c.privateKeyFile != "" {
+			p.add("private-key-file", "%v", err)
+		} else {
+			p.add("secret", "cannot decrypt the built-in private key, set private-key-file")
+		}
+	}
+	p.oneOf("scope-strategy", c.scopeStrategy, ScopeStrategyHierarchic, ScopeStrategyWildcard, ScopeStrategyExact)
+
+	p.positive("access-token-lifespan", c.FC.AccessTokenLifespan)
+	p.positive("refresh-token-lifespan", c.FC.RefreshTokenLifespan)
+	p.positive("authorize-code-lifespan", c.FC.AuthorizeCodeLifespan)
+
+	if c.initRootUsername == "" {
+		p.add("init-root-username", "must not be empty")
+	}
+	if c.initRootPassword == "" {
+		p.add("init-root-password", "must not be empty")
+	}
+	if c.initClientID == "" {
+		p.add("init-client-id", "must not be empty")
+	}
+	if c.initClientSecret == "" {
+		p.add("init-client-secret", "must not be empty")
+	}
+
+	pp := c.passwordPolicy
+	if pp.MinLength < 1 {
+		p.add("password-min-length", "must be at least 1, got %d", pp.MinLength)
+	}
+	p.notNegative("password-history", pp.History)
+	// the list is read here once, a file which disappears later does not break the password changes
+	if err := pp.Load(); err != nil {
+		p.add("password-breached-list", "%v", err)
+	}
+
+	if _, err := clientip.ParseProxies(c.GetTrustedProxies()); err != nil {
+		p.add("trusted-proxies", "%v", err)
+	}
+
+	for _, lp := range []struct {
+		prefix string
+		policy secure.LockoutPolicy
+	}{{"lockout", c.lockout.Account}, {"lockout-ip", c.lockout.IP}} {
+		p.notNegative(lp.prefix+"-max-attempts", lp.policy.MaxAttempts)
+		if lp.policy.Backoff < 0 {
+			p.add(lp.prefix+"-backoff", "must not be negative, got %s", lp.policy.Backoff)
+		}
+		if lp.policy.MaxAttempts > 0 {
+			p.positive(lp.prefix+"-duration", lp.policy.Duration)
+		}
+	}
+
+	for route := range c.rateLimits {
+		if _, err := c.GetRateLimit(route); err != nil {
+			p.add("rate-limit-"+route, "%v", err)
+		}
+	}
+	p.oneOf("rate-limit-store", c.rateLimitStore, RateLimitStoreMem, RateLimitStoreDB)
+
+	if c.otpPolicy.Length < 4 || c.otpPolicy.Length > 10 {
+		p.add("otp-length", "must be between 4 and 10, got %d", c.otpPolicy.Length)
+	}
+	p.positive("otp-ttl", c.otpPolicy.TTL)
+	if c.otpPolicy.MaxAttempts < 1 {
+		p.add("otp-max-attempts", "must be at least 1, got %d", c.otpPolicy.MaxAttempts)
+	}
+	p.oneOf("otp-sender", c.otpSenderType, OTPSenderConsole, OTPSenderFile)
+	if c.otpSenderType == OTPSenderFile && c.otpSenderFile == "" {
+		p.add("otp-sender-file", "must not be empty with the file sender")
+	}
+	p.oneOf("mailer", c.mailerType, MailerConsole, MailerFile)
+	if c.mailerType == MailerFile && c.mailerFile == "" {
+		p.add("mailer-file", "must not be empty with the file mailer")
+	}
+
+	p.positive("email-verification-ttl", c.emailVerificationTTL)
+	p.absoluteURL("email-verification-url", c.emailVerificationURL)
+	p.positive("password-reset-ttl", c.passwordResetTTL)
+	p.absoluteURL("password-reset-url", c.passwordResetURL)
+
+	if c.mfaIssuer == "" {
+		p.add("mfa-issuer", "must not be empty")
+	}
+	p.positive("mfa-token-ttl", c.mfaTokenTTL)
+	if c.mfaTrustedDeviceTTL < 0 {
+		p.add("mfa-trusted-device-ttl", "must not be negative, got %s", c.mfaTrustedDeviceTTL)
+	}
+
+	if c.webAuthnRPID == "" {
+		p.add("webauthn-rp-id", "must not be empty")
+	}
+	p.absoluteURL("webauthn-rp-origin", c.webAuthnRPOrigin)
+	p.absoluteURL("google-jwks-url", c.googleJWKSURL)
+	p.absoluteURL("apple-jwks-url", c.appleJWKSURL)
+	p.absoluteURL("facebook-graph-url", c.facebookGraphURL)
+	if c.facebookAppID != "" && c.facebookAppSecret == "" {
+		p.add("facebook-app-secret", "must be set with facebook-app-id")
+	}
+	p.readable("connectors-file", c.connectorsFile)
+	p.absoluteURL("connector-callback-url", c.connectorCallbackURL)
+
+	p.positive("webhook-poll-interval", c.webhookPolicy.PollInterval)
+	p.positive("webhook-timeout", c.webhookPolicy.Timeout)
+	if c.webhookPolicy.MaxAttempts < 1 {
+		p.add("webhook-max-attempts", "must be at least 1, got %d", c.webhookPolicy.MaxAttempts)
+	}
+	p.positive("webhook-backoff", c.webhookPolicy.Backoff)
+
+	p.oneOf("trace-exporter", c.tracing.Exporter, tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP)
+	if c.tracing.Exporter == tracing.ExporterOTLP && c.tracing.Endpoint == "" {
+		p.add("trace-endpoint", "must not be empty with the otlp exporter")
+	}
+	if c.tracing.SampleRatio < 0 || c.tracing.SampleRatio > 1 {
+		p.add("trace-sample-ratio", "must be between 0 and 1, got %v", c.tracing.SampleRatio)
+	}
+	p.positive("health-check-timeout", c.healthCheckTimeout)
+
+	if c.Production() {
+		if c.SystemSecret == builtinSystemSecret {
+			p.add("secret", "the built-in secret is refused in production")
+		}
+		if c.privateKeyFile == "" {
+			p.add("private-key-file", "the built-in private key is refused in production")
+		}
+		if c.initRootPassword == builtinRootPassword {
+			p.add("init-root-password", "the built-in root password is refused in production")
+		}
+		if c.initClientSecret == builtinClientSecret {
+			p.add("init-client-secret", "the built-in client secret is refused in production")
+		}
+	}
+
+	if len(p) > 0 {
+		return errors.Errorf("invalid configuration:\n  %s", strings.Join(p, "\n  "))
+	}
+
+	return nil
+}
+
+// readPrivateKey reads a PEM encoded RSA private key, PKCS #1 or PKCS #8
+func readPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("%s: no PEM block", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s", path)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("%s: not an RSA private key", path)
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,347 @@
+// Package connector signs users in with upstream OpenID Connect and OAuth2 identity providers.
+//
+// The providers are configured in a JSON file, without code:
+//
+//	[
+//	  {"id": "microsoft", "name": "Microsoft", "issuer": "https://login.microsoftonline.com/<tenant>/v2.0",
+//	   "client_id": "...", "client_secret": "...", "scopes": ["openid", "email", "profile"]},
+//	  {"id": "github", "name": "GitHub",
+//	   "authorization_url": "https://github.com/login/oauth/authorize",
+//	   "token_url": "https://github.com/login/oauth/access_token",
+//	   "userinfo_url": "https://api.github.com/user",
+//	   "client_id": "...", "client_secret": "...", "scopes": ["read:user", "user:email"],
+//	   "claims": {"subject": "id", "name": "login"}}
+//	]
+//
+// With an issuer the endpoints are discovered from its openid-configuration.
+// The id token is verified with the keys of the provider, the userinfo endpoint completes its claims.
+package connector
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrUnknownConnector = errors.New("unknown connector")
+	ErrExchangeFailed   = errors.New("cannot exchange the authorization code")
+)
+
+// ClaimMapping names the claims of the provider holding the fields of an identity
+type ClaimMapping struct {
+	Subject       string `json:"subject"`
+	Email         string `json:"email"`
+	EmailVerified string `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// Config is an upstream provider, either an OpenID Connect issuer or explicit OAuth2 endpoints
+type Config struct {
+	Id               string       `json:"id"`
+	Name             string       `json:"name"`
+	Issuer           string       `json:"issuer"`
+	AuthorizationURL string       `json:"authorization_url"`
+	TokenURL         string       `json:"token_url"`
+	UserInfoURL      string       `json:"userinfo_url"`
+	JWKSURL          string       `json:"jwks_url"`
+	ClientId         string       `json:"client_id"`
+	ClientSecret     string       `json:"client_secret"`
+	Scopes           []string     `json:"scopes"`
+	Claims           ClaimMapping `json:"claims"`
+	// TrustEmail treats the emails of the provider as verified when it has no email_verified claim
+	TrustEmail bool `json:"trust_email"`
+}
+
+// Connector is a configured upstream provider
+type Connector struct {
+	Config
+
+	client   *http.Client
+	mu       sync.Mutex
+	ready    bool
+	verifier *secure.IDTokenVerifier
+}
+
+// Registry holds the connectors by id
+type Registry map[string]*Connector
+
+// Load reads the connectors of a JSON file, an empty path gives no connector
+func Load(path string) (Registry, error) {
+	registry := Registry{}
+	if path == "" {
+		return registry, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var configs []Config
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, errors.Wrap(err, "cannot decode the connectors")
+	}
+
+	for _, cfg := range configs {
+		if cfg.Id == "" || cfg.ClientId == "" {
+			return nil, errors.Errorf("connector %q: id and client_id are required", cfg.Id)
+		}
+
+		if cfg.Issuer == "" && (cfg.AuthorizationURL == "" || cfg.TokenURL == "") {
+			return nil, errors.Errorf("connector %q: issuer or authorization_url and token_url are required", cfg.Id)
+		}
+
+		if _, ok := registry[cfg.Id]; ok {
+			return nil, errors.Errorf("connector %q is declared twice", cfg.Id)
+		}
+
+		registry[cfg.Id] = New(cfg)
+	}
+
+	return registry, nil
+}
+
+func New(cfg Config) *Connector {
+	m := &cfg.Claims
+	for field, def := range map[*string]string{&m.Subject: "sub", &m.Email: "email", &m.EmailVerified: "email_verified", &m.Name: "name"} {
+		if *field == "" {
+			*field = def
+		}
+	}
+
+	if len(cfg.Scopes) == 0 && cfg.Issuer != "" {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	return &Connector{Config: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (r Registry) Get(id string) (*Connector, error) {
+	c, ok := r[id]
+	if !ok {
+		return nil, ErrUnknownConnector
+	}
+
+	return c, nil
+}
+
+// init discovers the missing endpoints of an issuer, a failed discovery is retried by the next login
+func (c *Connector) init(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ready {
+		return nil
+	}
+
+	if c.Issuer != "" && (c.AuthorizationURL == "" || c.TokenURL == "" || c.JWKSURL == "") {
+		var discovery struct {
+			AuthorizationURL string `json:"authorization_endpoint"`
+			TokenURL         string `json:"token_endpoint"`
+			UserInfoURL      string `json:"userinfo_endpoint"`
+			JWKSURL          string `json:"jwks_uri"`
+		}
+
+		wellKnown := strings.TrimRight(c.Issuer, "/") + "/.well-known/openid-configuration"
+		if err := c.get(ctx, wellKnown, "", &discovery); err != nil {
+			return err
+		}
+
+		for field, value := range map[*string]string{
+			&c.AuthorizationURL: discovery.AuthorizationURL,
+			&c.TokenURL:         discovery.TokenURL,
+			&c.UserInfoURL:      discovery.UserInfoURL,
+			&c.JWKSURL:          discovery.JWKSURL,
+		} {
+			if *field == "" {
+				*field = value
+			}
+		}
+	}
+
+	// the id tokens are only verified for an issuer, plain OAuth2 providers give the userinfo
+	if c.Issuer != "" && c.JWKSURL != "" {
+		c.verifier = secure.NewIDTokenVerifier(c.JWKSURL, []string{c.Issuer}, []string{c.ClientId})
+	}
+
+	c.ready = true
+	return nil
+}
+
+// AuthCodeURL returns the authorization url of the provider, with a S256 PKCE challenge of the verifier
+func (c *Connector) AuthCodeURL(ctx context.Context, redirectURI, state, verifier, nonce string) (string, error) {
+	if err := c.init(ctx); err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.ClientId},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Join(c.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	if c.verifier != nil {
+		params.Set("nonce", nonce)
+	}
+
+	sep := "?"
+	if strings.Contains(c.AuthorizationURL, "?") {
+		sep = "&"
+	}
+
+	return c.AuthorizationURL + sep + params.Encode(), nil
+}
+
+// Exchange trades the authorization code for the tokens of the user and maps its claims to an identity
+func (c *Connector) Exchange(ctx context.Context, redirectURI, code, verifier, nonce string) (*model.UserIdentity, error) {
+	if err := c.init(ctx); err != nil {
+		return nil, err
+	}
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IdToken     string `json:"id_token"`
+		Error       string `json:"error"`
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {c.ClientId},
+		"client_secret": {c.ClientSecret},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if err := c.do(req.WithContext(ctx), &tokens); err != nil {
+		return nil, errors.Wrap(ErrExchangeFailed, err.Error())
+	}
+
+	if tokens.Error != "" || (tokens.AccessToken == "" && tokens.IdToken == "") {
+		return nil, errors.WithMessage(ErrExchangeFailed, tokens.Error)
+	}
+
+	claims := map[string]interface{}{}
+
+	if tokens.IdToken != "" && c.verifier != nil {
+		if _, err := c.verifier.Verify(ctx, tokens.IdToken, nonce, &claims); err != nil {
+			return nil, err
+		}
+	}
+
+	// the userinfo claims complete those of the id token, the subject must be the same
+	if c.UserInfoURL != "" && tokens.AccessToken != "" {
+		userInfo := map[string]interface{}{}
+		if err := c.get(ctx, c.UserInfoURL, tokens.AccessToken, &userInfo); err != nil {
+			return nil, err
+		}
+
+		if sub, ok := claims[c.Claims.Subject]; ok && claimString(userInfo[c.Claims.Subject]) != claimString(sub) {
+			return nil, errors.New("the userinfo subject is not the subject of the id token")
+		}
+
+		for k, v := range userInfo {
+			if _, ok := claims[k]; !ok {
+				claims[k] = v
+			}
+		}
+	}
+
+	identity := &model.UserIdentity{
+		Provider: c.Id,
+		Subject:  claimString(claims[c.Claims.Subject]),
+		Email:    strings.ToLower(claimString(claims[c.Claims.Email])),
+		Name:     claimString(claims[c.Claims.Name]),
+	}
+
+	if identity.Subject == "" {
+		return nil, errors.Errorf("the %s claim of the subject is missing", c.Claims.Subject)
+	}
+
+	if verified, ok := claims[c.Claims.EmailVerified]; ok {
+		identity.EmailVerified = claimString(verified) == "true"
+	} else {
+		identity.EmailVerified = c.TrustEmail
+	}
+
+	identity.EmailVerified = identity.EmailVerified && identity.Email != ""
+
+	return identity, nil
+}
+
+func (c *Connector) get(ctx context.Context, u, accessToken string, dest interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	return c.do(req.WithContext(ctx), dest)
+}
+
+func (c *Connector) do(req *http.Request, dest interface{}) error {
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "connector %s", c.Id)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("connector %s: %s returned %s", c.Id, req.URL.Path, resp.Status)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+
+	if err := decoder.Decode(dest); err != nil {
+		return errors.Wrapf(err, "connector %s", c.Id)
+	}
+
+	return nil
+}
+
+// claimString formats a claim, the numeric ids of some providers included
+func claimString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case float64:
+		return fmt.Sprintf("%.0f", t)
+	default:
+		return fmt.Sprint(t)
+	}
+}
@@ -3,6 +3,7 @@ module github.com/baozhenglab/oauth-service
 require (
 	github.com/baozhenglab/go-sdk v1.0.2
 	github.com/baozhenglab/sdkcm v1.0.1
+	github.com/duo-labs/webauthn v0.0.0-20220815211337-00c9fb5711f5
 	github.com/gin-gonic/gin v1.5.0
 	github.com/globalsign/mgo v0.0.0-20181015135952-eeefdecb41b8
 	github.com/go-errors/errors v1.0.1
@@ -11,11 +12,21 @@ require (
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/mohae/deepcopy v0.0.0-20170929034955-c48cc78d4826
+	github.com/nyaruka/phonenumbers v1.0.55
 	github.com/ory/fosite v0.29.7
 	github.com/ory/go-convenience v0.1.0
 	github.com/pkg/errors v0.9.1
-	github.com/spf13/cobra v0.0.5
+	github.com/prometheus/client_golang v1.10.0
+	github.com/spf13/cobra v1.1.3
+	go.opentelemetry.io/otel v1.19.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.19.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.19.0
+	go.opentelemetry.io/otel/sdk v1.19.0
+	go.opentelemetry.io/otel/trace v1.19.0
+	golang.org/x/crypto v0.11.0
 	gopkg.in/go-playground/validator.v8 v8.18.2 // indirect
+	gopkg.in/square/go-jose.v2 v2.1.9
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 go 1.13
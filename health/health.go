@@ -0,0 +1,169 @@
+// Package health serves the probes of the orchestrator.
+//
+// /health/alive answers as long as the process serves requests. /health/ready runs the checks of the dependencies
+// (database, signing key, setup) and answers 503 with the failing checks until they all pass.
+package health
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Statuses of the service and of the checks
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Check tells whether a dependency of the service works
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a check
+type Result struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+// Report is the readiness of the service, with the result of every check
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs the readiness checks, each one within the timeout
+type Checker struct {
+	timeout time.Duration
+	checks  []namedCheck
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Register adds a readiness check, registered before the routes are served
+func (ch *Checker) Register(name string, check Check) {
+	ch.checks = append(ch.checks, namedCheck{name, check})
+}
+
+// Run runs the checks concurrently, the service is ready when they all pass
+func (ch *Checker) Run(ctx context.Context) *Report {
+	report := &Report{Status: StatusOK, Checks: make([]Result, len(ch.checks))}
+
+	var wg sync.WaitGroup
+	for i := range ch.checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			report.Checks[i] = ch.run(ctx, ch.checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, r := range report.Checks {
+		if r.Status != StatusOK {
+			report.Status = StatusUnavailable
+		}
+	}
+
+	sort.Slice(report.Checks, func(i, j int) bool { return report.Checks[i].Name < report.Checks[j].Name })
+	return report
+}
+
+// run runs a check, a check which does not end within the timeout fails
+func (ch *Checker) run(ctx context.Context, nc namedCheck) Result {
+	ctx, cancel := context.WithTimeout(ctx, ch.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- nc.check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errors.Errorf("no answer within %s", ch.timeout)
+	}
+
+	r := Result{Name: nc.name, Status: StatusOK, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		r.Status = StatusUnavailable
+		// the errors of the drivers may hold addresses and credentials
+		r.Error = logging.Redact(err.Error())
+	}
+
+	return r
+}
+
+// AliveHandler answers as long as the process serves requests
+func AliveHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": StatusOK})
+}
+
+// ReadyHandler answers 200 when every check passes, 503 with the failing checks otherwise
+func (ch *Checker) ReadyHandler(c *gin.Context) {
+	report := ch.Run(c.Request.Context())
+
+	if report.Status != StatusOK {
+		logging.FromContext(c.Request.Context()).With("checks", report.Checks).Warn("The service is not ready")
+		c.JSON(http.StatusServiceUnavailable, report)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// SQL pings the database
+func SQL(db *gorm.DB) Check {
+	return func(ctx context.Context) error {
+		return errors.WithStack(db.DB().PingContext(ctx))
+	}
+}
+
+// Mongo pings the database on a copy of the session. mgo does not take a context,
+// the timeouts of the copy end the ping with the deadline of ctx and the check returns when ctx is done.
+func Mongo(session *mgo.Session) Check {
+	return func(ctx context.Context) error {
+		s := session.Copy()
+
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout := time.Until(deadline)
+			if timeout <= 0 {
+				s.Close()
+				return errors.WithStack(ctx.Err())
+			}
+
+			s.SetSyncTimeout(timeout)
+			s.SetSocketTimeout(timeout)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			done <- s.Ping()
+		}()
+
+		select {
+		case err := <-done:
+			return errors.WithStack(err)
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		}
+	}
+}
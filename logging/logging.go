@@ -0,0 +1,144 @@
+// Package logging writes structured logs through the logger of the service, its level is the LOG_LEVEL setting.
+//
+// Every request gets an id, taken from the X-Request-Id header or generated, and a logger carrying it.
+// The logger is passed in the context to the handlers, the user repository and the storage:
+//
+//	logging.FromContext(ctx).WithError(err).Error("cannot create the access request")
+//
+// Passwords, secrets, tokens and one-time passwords are redacted, both from the fields and from the messages.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/baozhenglab/go-sdk/logger"
+)
+
+const redacted = "[REDACTED]"
+
+type Fields = logger.Fields
+
+// Logger redacts the sensitive values before they reach the logger of the service
+type Logger struct {
+	l logger.Logger
+}
+
+var (
+	baseOnce sync.Once
+	base     *Logger
+)
+
+// Base returns the logger of the service, without request
+func Base() *Logger {
+	baseOnce.Do(func() {
+		// the service initializes the same logger, this only matters before it runs
+		if logger.GetCurrent() == nil {
+			logger.InitServLogger(false)
+		}
+		base = &Logger{logger.GetCurrent().GetLogger("oauth")}
+	})
+
+	return base
+}
+
+type ctxKey struct{}
+
+// NewContext returns a context carrying the logger
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger of the request of the context, or the base logger
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(ctxKey{}).(*Logger); ok {
+			return l
+		}
+	}
+
+	return Base()
+}
+
+// With adds a field, its value is redacted when the key names a secret
+func (l *Logger) With(key string, value interface{}) *Logger {
+	return &Logger{l.l.With(key, redactValue(key, value))}
+}
+
+// Withs adds the fields, their values are redacted when their keys name a secret
+func (l *Logger) Withs(fields Fields) *Logger {
+	safe := make(Fields, len(fields))
+	for k, v := range fields {
+		safe[k] = redactValue(k, v)
+	}
+
+	return &Logger{l.l.Withs(safe)}
+}
+
+// WithError adds the error with its stack, the secrets in its message are redacted
+func (l *Logger) WithError(err error) *Logger {
+	return &Logger{l.l.With("error", Redact(fmt.Sprintf("%+v", err)))}
+}
+
+func (l *Logger) Debug(msg string) { l.l.Debug(Redact(msg)) }
+func (l *Logger) Info(msg string)  { l.l.Info(Redact(msg)) }
+func (l *Logger) Warn(msg string)  { l.l.Warn(Redact(msg)) }
+func (l *Logger) Error(msg string) { l.l.Error(Redact(msg)) }
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.Debug(fmt.Sprintf(format, args...)) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.Info(fmt.Sprintf(format, args...)) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.Warn(fmt.Sprintf(format, args...)) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.Error(fmt.Sprintf(format, args...)) }
+
+// keys whose values are never logged, matched without case
+var (
+	sensitiveKeyParts = []string{"password", "secret", "token", "otp", "assertion", "recovery"}
+	sensitiveKeys     = map[string]bool{"code": true, "authorization": true, "cookie": true, "set-cookie": true}
+)
+
+// IsSensitive tells whether the key names a secret
+func IsSensitive(key string) bool {
+	key = strings.ToLower(key)
+	if sensitiveKeys[key] {
+		return true
+	}
+
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func redactValue(key string, value interface{}) interface{} {
+	if IsSensitive(key) {
+		return redacted
+	}
+
+	if s, ok := value.(string); ok {
+		return Redact(s)
+	}
+
+	return value
+}
+
+var (
+	// key=value, key: value and "key":"value" of the sensitive keys
+	secretAssignment = regexp.MustCompile(`(?i)((?:password|secret|token|otp|code|assertion)\w*["']?\s*[:=]\s*)("[^"]*"|'[^']*'|[^\s&"',;}]+)`)
+	// credentials of the Authorization header
+	secretScheme = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9\-._~+/]+=*`)
+	// JSON web tokens
+	secretJWT = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+)
+
+// Redact replaces the secrets found in a message
+func Redact(msg string) string {
+	msg = secretJWT.ReplaceAllString(msg, redacted)
+	msg = secretScheme.ReplaceAllString(msg, "$1 "+redacted)
+	return secretAssignment.ReplaceAllString(msg, "${1}"+redacted)
+}
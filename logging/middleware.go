@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries the id of a request, it is given back in the response
+const RequestIDHeader = "X-Request-Id"
+
+// ids accepted from the callers, the others are replaced so they cannot forge the log lines
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Middleware gives the request an id and a logger carrying it, with the trace id when the request is traced,
+// then logs the request once it is served.
+// The route is logged, not the path, which may hold tokens in its query.
+func Middleware(c *gin.Context) {
+	start := time.Now()
+
+	id := c.GetHeader(RequestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = newRequestID()
+	}
+
+	c.Header(RequestIDHeader, id)
+	c.Set("request_id", id)
+
+	l := Base().With("request_id", id)
+	if sc := trace.SpanContextFromContext(c.Request.Context()); sc.HasTraceID() {
+		l = l.With("trace_id", sc.TraceID().String())
+	}
+	c.Request = c.Request.WithContext(NewContext(c.Request.Context(), l))
+
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+
+	l = l.Withs(Fields{
+		"method":     c.Request.Method,
+		"route":      route,
+		"status":     c.Writer.Status(),
+		"latency_ms": time.Since(start).Milliseconds(),
+		"ip":         c.ClientIP(),
+	})
+
+	if c.Writer.Status() >= 500 {
+		l.Error("request")
+	} else {
+		l.Info("request")
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,107 @@
+// Package metrics exposes the activity of the authorization server to Prometheus.
+//
+// The labels only take bounded values: grant types, client ids, error keys, routes and storage methods.
+// User ids, usernames, tokens and raw request values are never used as labels.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "oauth"
+
+// Stores of the storage latency
+const (
+	StoreSQL       = "sql"
+	StoreMongo     = "mongo"
+	StoreUserSQL   = "user_sql"
+	StoreUserMongo = "user_mongo"
+)
+
+var (
+	TokensIssued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_issued_total",
+		Help:      "Tokens issued by the token endpoint, by grant type and client.",
+	}, []string{"grant_type", "client_id"})
+
+	TokenFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_failures_total",
+		Help:      "Refused token requests, by grant type and error.",
+	}, []string{"grant_type", "reason"})
+
+	Introspections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "introspections_total",
+		Help:      "Token introspections, by result: active or the error of the token.",
+	}, []string{"result"})
+
+	Revocations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "revocations_total",
+		Help:      "Token revocations, by result: success or the error.",
+	}, []string{"result"})
+
+	LoginFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_failures_total",
+		Help:      "Failed logins of all the login methods, by error.",
+	}, []string{"reason"})
+
+	OTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "otp_requests_total",
+		Help:      "One-time password requests, by purpose and result: success or the error.",
+	}, []string{"purpose", "result"})
+
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests, by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	StorageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_duration_seconds",
+		Help:      "Latency of the storage calls, by store and method.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"store", "method"})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware observes the latency of the requests, the route is the registered path, not the requested one
+func Middleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+
+	RequestDuration.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).
+		Observe(time.Since(start).Seconds())
+}
+
+// StorageTimer starts timing a storage call, the returned func ends it:
+//
+//	defer metrics.StorageTimer(metrics.StoreSQL, "GetClient")()
+func StorageTimer(store, method string) func() {
+	start := time.Now()
+	return func() {
+		StorageDuration.WithLabelValues(store, method).Observe(time.Since(start).Seconds())
+	}
+}
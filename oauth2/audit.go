@@ -0,0 +1,155 @@
+package oauth2
+
+// Audit log of the authentication and account events.
+// The entries are written by the handlers, which know the caller, when the grant storage implements AuditStorage.
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/clientip"
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+const (
+	auditDefaultLimit = 50
+	auditMaxLimit     = 500
+)
+
+// AuditStorage is optionally implemented by the grant storage to keep the audit log
+type AuditStorage interface {
+	AddAuditEvent(ctx context.Context, event *model.AuditEvent) error
+	FindAuditEvents(ctx context.Context, filter *model.AuditFilter) ([]model.AuditEvent, *model.AuditCursor, error)
+}
+
+// auditLog is the audit storage of the store given to InitOAuth2Provider, nil without audit log
+var auditLog AuditStorage
+
+// recordAudit completes the event with the caller of the request and the outcome of err, then appends it.
+// The actor defaults to the user of the access token of the request.
+// The metrics of the event are counted even without audit log.
+// A failure to write the entry does not fail the request.
+func recordAudit(c *gin.Context, event *model.AuditEvent, err error) {
+	countAudit(event, err)
+
+	if auditLog == nil {
+		return
+	}
+
+	event.Outcome = model.AuditSuccess
+	if err != nil {
+		event.Outcome = model.AuditFailure
+		if event.Detail != "" {
+			event.Detail += ": " + auditReason(err)
+		} else {
+			event.Detail = auditReason(err)
+		}
+	}
+
+	if event.ClientId == "" {
+		if cid, ok := c.Get("client_id"); ok {
+			event.ClientId, _ = cid.(string)
+		} else {
+			event.ClientId = requestClientId(c)
+		}
+	}
+
+	if event.ActorId == "" {
+		if sub, ok := c.Get("subject"); ok {
+			event.ActorId, _ = sub.(string)
+		}
+	}
+
+	event.IP = clientip.Get(c)
+	event.UserAgent = c.Request.UserAgent()
+	event.OccurredAt = time.Now().UTC()
+
+	if err := auditLog.AddAuditEvent(c.Request.Context(), event); err != nil {
+		logging.FromContext(c.Request.Context()).WithError(err).Error("Error occurred in audit log")
+	}
+}
+
+// auditReason is the key of an error, never its debug information
+func auditReason(err error) string {
+	switch e := errors.Cause(err).(type) {
+	case sdkcmn.AppError:
+		return e.Code
+	case *fosite.RFC6749Error:
+		return e.Name
+	case sdkcmn.ErrorWithKey:
+		return e.Key()
+	case *MFARequiredError:
+		return "mfa_required"
+	default:
+		return "error"
+	}
+}
+
+// requestClientId is the client of a request authenticated by the client credentials
+func requestClientId(c *gin.Context) string {
+	if id, _, ok := c.Request.BasicAuth(); ok {
+		return id
+	}
+
+	return c.PostForm("client_id")
+}
+
+// ListAuditEventsHandler queries the audit log, this handler must be protected by the root scope.
+// The paging has the cursor of the next page, it is empty on the last page.
+func ListAuditEventsHandler(c *gin.Context) {
+	var filter model.AuditFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		cErr := sdkcmn.ErrInvalidRequest(err)
+		c.JSON(cErr.StatusCode, cErr)
+		return
+	}
+
+	if filter.Limit <= 0 {
+		filter.Limit = auditDefaultLimit
+	}
+
+	if filter.Limit > auditMaxLimit {
+		filter.Limit = auditMaxLimit
+	}
+
+	if filter.Cursor != "" {
+		after, err := model.ParseAuditCursor(filter.Cursor)
+		if err != nil {
+			cErr := sdkcmn.ErrCustom(err, common.ErrAuditCursorInvalid)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		filter.After = after
+	}
+
+	events := []model.AuditEvent{}
+	nextCursor := ""
+
+	if auditLog != nil {
+		found, next, err := auditLog.FindAuditEvents(c.Request.Context(), &filter)
+		if err != nil {
+			cErr, ok := errors.Cause(err).(sdkcmn.AppError)
+			if !ok {
+				cErr = sdkcmn.ErrCannotFetchData(err)
+			}
+
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		events = found
+		if next != nil {
+			nextCursor = next.String()
+		}
+	}
+
+	c.JSON(http.StatusOK, sdkcmn.ResponseWithPaging(events, nil, gin.H{"limit": filter.Limit, "next_cursor": nextCursor}))
+}
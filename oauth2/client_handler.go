@@ -0,0 +1,111 @@
+package oauth2
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/gin-gonic/gin"
+)
+
+type ClientStorage interface {
+	CreateClient(ctx context.Context, client *model.Client) error
+	ScopeStorage
+}
+
+// Create a new OAuth client, all of its scopes must be defined in the scope catalog
+func CreateClientHandler(cs ClientStorage) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var client model.Client
+		if err := c.ShouldBind(&client); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		client.ClientID = strings.TrimSpace(client.ClientID)
+		client.Scope = normalizeScope(client.Scope)
+
+		if client.ClientID == "" {
+			cErr := sdkcmn.ErrCustom(nil, common.ErrClientIdCannotBeEmpty)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		if client.Secret == "" {
+			cErr := sdkcmn.ErrCustom(nil, common.ErrClientSecretCannotBeEmpty)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		if err := ValidateScopes(c.Request.Context(), cs, client.GetScopes()); err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		secret, err := GetHasher().Hash(c.Request.Context(), []byte(client.Secret))
+		if err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+		client.Secret = string(secret)
+
+		err = cs.CreateClient(c.Request.Context(), &client)
+		recordAudit(c, &model.AuditEvent{Type: model.AuditClientCreated, Detail: client.ClientID}, err)
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		// the secret is never shown again
+		client.Secret = ""
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(client))
+	}
+}
+
+// List the scope catalog
+func ListScopesHandler(ss ScopeStorage) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		scopes, err := ss.GetScopes(c.Request.Context())
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(scopes))
+	}
+}
+
+// Add a scope to the catalog
+func CreateScopeHandler(ss ScopeStorage) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var scope model.Scope
+		if err := c.ShouldBind(&scope); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		scope.Name = strings.TrimSpace(scope.Name)
+		if scope.Name == "" || strings.ContainsAny(scope.Name, " \t\n") {
+			cErr := sdkcmn.ErrCustom(nil, common.ErrScopeNameInvalid)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		if err := ss.CreateScope(c.Request.Context(), &scope); err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(scope))
+	}
+}
@@ -0,0 +1,386 @@
+package oauth2
+
+// Upstream identity providers of the hosted login (see the connector package).
+// The login page links to GET/POST /oauth2/connectors/:id/login with the query of the authorize request,
+// the user is sent to the provider with a state and a PKCE challenge kept in a sealed cookie,
+// then the provider redirects to GET /oauth2/connectors/:id/callback which provisions or links the user
+// and resumes the authorize request.
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/connector"
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
+	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+)
+
+const (
+	connectorCookie     = "connector_session"
+	connectorSessionTTL = 10 * time.Minute
+)
+
+// connectors are the upstream providers of the config given to InitOAuth2Provider
+var (
+	connectors           connector.Registry
+	connectorCallbackURL func(id string) string
+)
+
+// connectorSession is the state of a login at a provider, sealed in a cookie of the browser
+type connectorSession struct {
+	ConnectorId string     `json:"cid"`
+	State       string     `json:"st"`
+	Verifier    string     `json:"cv"`
+	Nonce       string     `json:"n"`
+	Authorize   url.Values `json:"ar"`
+	Scopes      []string   `json:"sc"`
+	// MfaToken is set when the user must give its second factor, see ConnectorMFAHandler
+	MfaToken  string `json:"mfa,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func sealConnectorSession(s *connectorSession) (string, error) {
+	s.ExpiresAt = time.Now().Add(connectorSessionTTL).Unix()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+
+	return mfaAES.Encrypt(data)
+}
+
+func openConnectorSession(token, connectorId string) (*connectorSession, bool) {
+	data, err := mfaAES.Decrypt(token)
+	if err != nil {
+		return nil, false
+	}
+
+	var s connectorSession
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, false
+	}
+
+	return &s, s.ConnectorId == connectorId && time.Now().Unix() <= s.ExpiresAt
+}
+
+// setConnectorSession keeps the session in the cookie of the routes of its connector
+func setConnectorSession(c *gin.Context, s *connectorSession) error {
+	sealed, err := sealConnectorSession(s)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     connectorCookie,
+		Value:    sealed,
+		Path:     "/oauth2/connectors/" + s.ConnectorId,
+		MaxAge:   int(connectorSessionTTL.Seconds()),
+		Secure:   c.Request.TLS != nil,
+		HttpOnly: true,
+		// the callback is a top-level redirect of the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// ListConnectorsHandler lists the providers the hosted login can offer
+func ListConnectorsHandler(c *gin.Context) {
+	result := make([]gin.H, 0, len(connectors))
+	for id, cn := range connectors {
+		result = append(result, gin.H{"id": id, "name": cn.Name})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i]["id"].(string) < result[j]["id"].(string) })
+
+	c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(result))
+}
+
+// ConnectorLoginHandler checks the authorize request then redirects the user to the provider,
+// the scopes the user consented to on the login page are kept for the callback
+func ConnectorLoginHandler(c *gin.Context) {
+	rw, req := c.Writer, c.Request
+	ctx := c.Request.Context()
+
+	cn, err := connectors.Get(c.Param("id"))
+	if err != nil {
+		cErr := sdkcmn.ErrCustom(err, common.ErrConnectorNotFound)
+		c.JSON(cErr.StatusCode, cErr)
+		return
+	}
+
+	ar, err := oauth2.NewAuthorizeRequest(ctx, req)
+	if err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in NewAuthorizeRequest")
+		oauth2.WriteAuthorizeError(rw, ar, err)
+		return
+	}
+
+	authorize := url.Values{}
+	for k, v := range ar.GetRequestForm() {
+		if k != "scopes" {
+			authorize[k] = v
+		}
+	}
+
+	session := &connectorSession{
+		ConnectorId: cn.Id,
+		State:       secure.GenerateResetToken(),
+		Verifier:    secure.GenerateResetToken(),
+		Nonce:       secure.GenerateResetToken(),
+		Authorize:   authorize,
+		Scopes:      req.PostForm["scopes"],
+	}
+
+	redirect, err := cn.AuthCodeURL(req.Context(), connectorCallbackURL(cn.Id), session.State, session.Verifier, session.Nonce)
+	if err != nil {
+		logging.FromContext(ctx).With("connector", cn.Id).WithError(err).Error("Error occurred in connector")
+		oauth2.WriteAuthorizeError(rw, ar, fosite.ErrTemporarilyUnavailable.WithDebug(err.Error()))
+		return
+	}
+
+	if err := setConnectorSession(c, session); err != nil {
+		oauth2.WriteAuthorizeError(rw, ar, fosite.ErrServerError.WithDebug(err.Error()))
+		return
+	}
+
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// ConnectorCallbackHandler ends the login at the provider, the user is provisioned or linked just in time
+// and the authorize request is resumed for the user. An user enrolled in MFA gives its second factor first,
+// see ConnectorMFAHandler.
+func ConnectorCallbackHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		rw, req := c.Writer, c.Request
+		ctx := c.Request.Context()
+
+		cn, err := connectors.Get(c.Param("id"))
+		if err != nil {
+			cErr := sdkcmn.ErrCustom(err, common.ErrConnectorNotFound)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		cookie, _ := c.Cookie(connectorCookie)
+		http.SetCookie(rw, &http.Cookie{Name: connectorCookie, Path: "/oauth2/connectors/" + cn.Id, MaxAge: -1})
+
+		session, ok := openConnectorSession(cookie, cn.Id)
+		if !ok || session.MfaToken != "" || subtle.ConstantTimeCompare([]byte(session.State), []byte(c.Query("state"))) != 1 {
+			cErr := sdkcmn.ErrCustom(nil, common.ErrConnectorStateInvalid)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		ar, ok := resumeAuthorizeRequest(c, session)
+		if !ok {
+			return
+		}
+
+		if e := c.Query("error"); e != "" {
+			oauth2.WriteAuthorizeError(rw, ar, fosite.ErrAccessDenied.WithDebug(cn.Id+": "+e))
+			return
+		}
+
+		identity, err := cn.Exchange(req.Context(), connectorCallbackURL(cn.Id), c.Query("code"), session.Verifier, session.Nonce)
+		if err != nil {
+			logging.FromContext(ctx).With("connector", cn.Id).WithError(err).Error("Error occurred in connector")
+			oauth2.WriteAuthorizeError(rw, ar, fosite.ErrAccessDenied.WithDebug(err.Error()))
+			return
+		}
+
+		user, err := ur.LoginWithIdentity(req.Context(), ar.GetClient().GetID(), identity)
+		login := &model.AuditEvent{Type: model.AuditLogin, ClientId: ar.GetClient().GetID(), Detail: cn.Id}
+		if err == nil {
+			login.ActorId, login.SubjectId = user.UserId, user.UserId
+		}
+
+		if err != nil {
+			recordAudit(c, login, err)
+			oauth2.WriteAuthorizeError(rw, ar, fosite.ErrAccessDenied.WithDebug(err.Error()))
+			return
+		}
+
+		if emailVerificationRequired(ar.GetClient(), user) {
+			recordAudit(c, login, common.ErrEmailNotVerified)
+			oauth2.WriteAuthorizeError(rw, ar, fosite.ErrAccessDenied.WithDebug(common.ErrEmailNotVerified.Error()))
+			return
+		}
+
+		// the provider is the first factor only, like a password
+		if user.HasMFA() && !isTrustedDevice(ctx, user.UserId, requestDeviceToken(c, "")) {
+			session.MfaToken, err = secure.IssueMFAToken(mfaAES, user.UserId, ar.GetClient().GetID(), mfaTokenTTL)
+			if err == nil {
+				err = setConnectorSession(c, session)
+			}
+
+			if err != nil {
+				oauth2.WriteAuthorizeError(rw, ar, fosite.ErrServerError.WithDebug(err.Error()))
+				return
+			}
+
+			writeConnectorMFAPage(rw, cn.Id, "")
+			return
+		}
+
+		completeConnectorLogin(c, ar, session, user, login)
+	}
+}
+
+// ConnectorMFAHandler is the second step of a connector login of an user enrolled in MFA,
+// the form of the MFA page posts a TOTP code or a recovery code
+func ConnectorMFAHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		rw := c.Writer
+		ctx := c.Request.Context()
+
+		cookie, _ := c.Cookie(connectorCookie)
+		session, ok := openConnectorSession(cookie, c.Param("id"))
+		if !ok || session.MfaToken == "" {
+			cErr := sdkcmn.ErrCustom(nil, common.ErrConnectorStateInvalid)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		ar, ok := resumeAuthorizeRequest(c, session)
+		if !ok {
+			return
+		}
+
+		token, err := secure.ParseMFAToken(mfaAES, session.MfaToken)
+		if err != nil || token.ClientId != ar.GetClient().GetID() {
+			oauth2.WriteAuthorizeError(rw, ar, fosite.ErrAccessDenied.WithDebug(common.ErrMFATokenInvalid.Error()))
+			return
+		}
+
+		var p model.MFACode
+		if err := c.ShouldBind(&p); err != nil {
+			writeConnectorMFAPage(rw, session.ConnectorId, common.ErrMFACodeInvalid.Error())
+			return
+		}
+
+		var user *model.User
+		if p.Code == "" && p.RecoveryCode != "" {
+			user, err = ur.LoginWithRecoveryCode(ctx, token.UserId, p.RecoveryCode)
+		} else {
+			user, err = ur.LoginWithTOTP(ctx, token.UserId, p.Code)
+		}
+
+		login := &model.AuditEvent{Type: model.AuditLogin, ClientId: token.ClientId, ActorId: token.UserId, SubjectId: token.UserId, Detail: session.ConnectorId}
+		if err != nil {
+			recordAudit(c, login, err)
+			// the user may try again until the MFA token expires
+			writeConnectorMFAPage(rw, session.ConnectorId, err.Error())
+			return
+		}
+
+		http.SetCookie(rw, &http.Cookie{Name: connectorCookie, Path: "/oauth2/connectors/" + session.ConnectorId, MaxAge: -1})
+
+		if p.RememberDevice {
+			deviceToken, err := trustDevice(ctx, user.UserId, token.ClientId, p.DeviceName)
+			if err != nil {
+				oauth2.WriteAuthorizeError(rw, ar, fosite.ErrServerError.WithDebug(err.Error()))
+				return
+			}
+
+			if deviceToken != "" {
+				setTrustedDeviceCookie(c, deviceToken)
+			}
+		}
+
+		completeConnectorLogin(c, ar, session, user, login)
+	}
+}
+
+// resumeAuthorizeRequest checks the authorize request of the session again, the client may have changed in the meantime
+func resumeAuthorizeRequest(c *gin.Context, session *connectorSession) (fosite.AuthorizeRequester, bool) {
+	ctx := c.Request.Context()
+
+	resumed, err := http.NewRequest(http.MethodGet, "/oauth2/auth?"+session.Authorize.Encode(), nil)
+	if err != nil {
+		cErr := sdkcmn.ErrCustom(err, common.ErrConnectorStateInvalid)
+		c.JSON(cErr.StatusCode, cErr)
+		return nil, false
+	}
+
+	ar, err := oauth2.NewAuthorizeRequest(ctx, resumed)
+	if err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in NewAuthorizeRequest")
+		oauth2.WriteAuthorizeError(c.Writer, ar, err)
+		return nil, false
+	}
+
+	return ar, true
+}
+
+// completeConnectorLogin grants the scopes the user consented to and answers the authorize request
+func completeConnectorLogin(c *gin.Context, ar fosite.AuthorizeRequester, session *connectorSession, user *model.User, login *model.AuditEvent) {
+	rw := c.Writer
+	ctx := c.Request.Context()
+
+	requestDefaultScopes(ctx, ar)
+	if err := grantConsent(ctx, ar, session.Scopes); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in resource indicators")
+		oauth2.WriteAuthorizeError(rw, ar, err)
+		return
+	}
+
+	mySessionData := newSessionForPasswordGrant(user.UserId, user.UserId)
+	setVerifiedClaims(mySessionData, user)
+
+	response, err := oauth2.NewAuthorizeResponse(ctx, ar, mySessionData)
+	recordAudit(c, login, err)
+	if err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in NewAuthorizeResponse")
+		oauth2.WriteAuthorizeError(rw, ar, err)
+		return
+	}
+
+	oauth2.WriteAuthorizeResponse(rw, ar, response)
+}
+
+// writeConnectorMFAPage asks the second factor of a connector login
+func writeConnectorMFAPage(rw http.ResponseWriter, connectorId, message string) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Write([]byte(`<h1>Two-factor authentication</h1>`))
+	rw.Write([]byte(fmt.Sprintf(`
+		<p>%s</p>
+		<form method="post" action="/oauth2/connectors/%s/mfa">
+			<input type="text" name="code" autocomplete="one-time-code" placeholder="code of your authenticator app" /><br>
+			<input type="text" name="recovery_code" placeholder="or a recovery code" /><br>
+			<label><input type="checkbox" name="remember_device" value="true" /> remember this device</label><br>
+			<input type="submit">
+		</form>
+	`, html.EscapeString(message), url.PathEscape(connectorId))))
+}
+
+// grantConsent grants the requested scopes the user consented to, the scopes which do not require consent
+// and the requested resources
+func grantConsent(ctx context.Context, ar fosite.AuthorizeRequester, consented []string) error {
+	for _, scope := range consented {
+		if ar.GetRequestedScopes().Has(scope) {
+			ar.GrantScope(scope)
+		}
+	}
+
+	for name, s := range describeScopes(ctx, ar.GetRequestedScopes()) {
+		if !s.ConsentRequired {
+			ar.GrantScope(name)
+		}
+	}
+
+	return grantResources(ar)
+}
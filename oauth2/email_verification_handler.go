@@ -0,0 +1,81 @@
+package oauth2
+
+import (
+	"net/http"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+)
+
+// verifiedUser is implemented by the users which know if their email and phone are verified
+type verifiedUser interface {
+	IsEmailVerified() bool
+	IsPhoneVerified() bool
+}
+
+// setVerifiedClaims puts the verified flags of the user into the token
+func setVerifiedClaims(session *model.Session, user interface{}) {
+	if vu, ok := user.(verifiedUser); ok {
+		session.SetEmailVerified(vu.IsEmailVerified())
+		session.SetPhoneVerified(vu.IsPhoneVerified())
+	}
+}
+
+// emailVerificationRequired tells if the client refuses the tokens of the user until its email is verified
+func emailVerificationRequired(client fosite.Client, user interface{}) bool {
+	mc, ok := client.(*model.Client)
+	if !ok || !mc.RequireVerifiedEmail {
+		return false
+	}
+
+	vu, ok := user.(verifiedUser)
+	return !ok || !vu.IsEmailVerified()
+}
+
+func SendEmailVerificationHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := ur.SendEmailVerification(c.Request.Context(), c.Param("id")); err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse("ok"))
+	}
+}
+
+// VerifyEmailHandler confirms the token of a verification link, given as the token parameter
+func VerifyEmailHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var p struct {
+			Token string `json:"token" form:"token"`
+		}
+
+		if err := c.ShouldBind(&p); err != nil || p.Token == "" {
+			cErr := sdkcmn.ErrCustom(err, common.ErrVerificationTokenInvalid)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		user, err := ur.VerifyEmail(c.Request.Context(), p.Token)
+		event := &model.AuditEvent{Type: model.AuditEmailVerified}
+		if err == nil {
+			event.ActorId, event.SubjectId = user.UserId, user.UserId
+		}
+		recordAudit(c, event, err)
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(gin.H{
+			"id":             user.UserId,
+			"email":          user.Email,
+			"email_verified": user.EmailVerified,
+		}))
+	}
+}
@@ -0,0 +1,76 @@
+package oauth2
+
+import (
+	"net/http"
+
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
+	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/gin-gonic/gin"
+)
+
+// NonceHandler issues the nonce of a login with the id token of Google or Apple,
+// the client gives it to the provider then sends it back with the id token, a nonce is accepted once
+func NonceHandler(c *gin.Context) {
+	cid, _ := c.Get("client_id")
+
+	nonce, err := secure.IssueLoginNonce(mfaAES, cid.(string))
+	if err != nil {
+		cErr := sdkcmn.ErrInvalidRequest(err)
+		c.JSON(cErr.StatusCode, cErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(gin.H{
+		"nonce":      nonce,
+		"expires_in": int(secure.LoginNonceTTL.Seconds()),
+	}))
+}
+
+func ListIdentitiesHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		identities, err := ur.ListIdentities(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(identities))
+	}
+}
+
+// LinkIdentityHandler links an account of Facebook, Google or Apple to the user
+func LinkIdentityHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		cid, _ := c.Get("client_id")
+
+		var p model.IdentityLink
+		if err := c.ShouldBind(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		identity, err := ur.LinkIdentity(c.Request.Context(), cid.(string), c.Param("id"), &p)
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(identity))
+	}
+}
+
+func UnlinkIdentityHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := ur.UnlinkIdentity(c.Request.Context(), c.Param("id"), c.Param("provider"), c.Param("subject")); err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse("ok"))
+	}
+}
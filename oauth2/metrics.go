@@ -0,0 +1,66 @@
+package oauth2
+
+import (
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/ory/fosite"
+)
+
+// grant types counted under their own name, the others are counted as "other"
+var metricGrantTypes = map[string]bool{
+	"authorization_code": true,
+	"client_credentials": true,
+	"refresh_token":      true,
+	"password":           true,
+	MFAOTPGrantType:      true,
+}
+
+// metricGrantType bounds the grant type of the request, it is given by the caller
+func metricGrantType(grantType string) string {
+	if metricGrantTypes[grantType] {
+		return grantType
+	}
+	return "other"
+}
+
+// metricResult is success or the key of the error
+func metricResult(err error) string {
+	if err == nil {
+		return "success"
+	}
+	return auditReason(err)
+}
+
+// countAudit updates the counters of the audited events, with or without audit log
+func countAudit(event *model.AuditEvent, err error) {
+	switch event.Type {
+	case model.AuditLogin:
+		if err != nil {
+			metrics.LoginFailures.WithLabelValues(auditReason(err)).Inc()
+		}
+	case model.AuditOTPGenerated:
+		metrics.OTPRequests.WithLabelValues(event.Detail, metricResult(err)).Inc()
+	case model.AuditTokenRevoked:
+		metrics.Revocations.WithLabelValues(metricResult(err)).Inc()
+	}
+}
+
+// countToken counts a token request, the client of a refused request is not counted as it may be unknown
+func countToken(grantType string, ar fosite.AccessRequester, err error) {
+	if err != nil {
+		metrics.TokenFailures.WithLabelValues(metricGrantType(grantType), auditReason(err)).Inc()
+		return
+	}
+
+	metrics.TokensIssued.WithLabelValues(metricGrantType(grantType), ar.GetClient().GetID()).Inc()
+}
+
+// countIntrospection counts an introspection by active or the error of the token
+func countIntrospection(err error) {
+	result := "active"
+	if err != nil {
+		result = auditReason(err)
+	}
+
+	metrics.Introspections.WithLabelValues(result).Inc()
+}
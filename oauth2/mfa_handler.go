@@ -0,0 +1,193 @@
+package oauth2
+
+import (
+	"net/http"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
+	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/gin-gonic/gin"
+)
+
+// TOTP enrollment, the secret is shown once and MFA is enabled when the first code is confirmed.
+// Both steps take a fresh proof of the user in the body, see model.Reauthentication
+func EnrollTOTPHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var p model.Reauthentication
+		if err := c.ShouldBind(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		enrollment, err := ur.EnrollTOTP(c.Request.Context(), c.Param("id"), &p)
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(enrollment))
+	}
+}
+
+func ConfirmTOTPHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var p model.TOTPConfirmation
+		if err := c.ShouldBind(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		codes, err := ur.ConfirmTOTP(c.Request.Context(), c.Param("id"), &p)
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(codes))
+	}
+}
+
+// MFA is disabled with a code of the authenticator, or a recovery code when it is lost
+func DisableTOTPHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var p model.MFACode
+		if err := c.ShouldBind(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		if err := ur.DisableTOTP(c.Request.Context(), c.Param("id"), p.Code, p.RecoveryCode); err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse("ok"))
+	}
+}
+
+// Second step of the hosted login, the MFA token is exchanged with a TOTP code or a recovery code
+func LoginWithMFA(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		cid, _ := c.Get("client_id")
+		clientId := cid.(string)
+
+		var p model.MFACode
+		if err := c.ShouldBind(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		token, err := secure.ParseMFAToken(mfaAES, p.MfaToken)
+		if err != nil || token.ClientId != clientId {
+			cErr := sdkcmn.ErrCustom(err, common.ErrMFATokenInvalid)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		// the client IP of the context counts the failed codes (see clientip.Middleware)
+		ctx := c.Request.Context()
+
+		var user *model.User
+		if p.Code == "" && p.RecoveryCode != "" {
+			user, err = ur.LoginWithRecoveryCode(ctx, token.UserId, p.RecoveryCode)
+		} else {
+			user, err = ur.LoginWithTOTP(ctx, token.UserId, p.Code)
+		}
+
+		if err != nil {
+			recordAudit(c, &model.AuditEvent{Type: model.AuditLogin, ActorId: token.UserId, SubjectId: token.UserId, Detail: "mfa"}, err)
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		if !p.RememberDevice {
+			responseUserToken(ur, user, c)
+			return
+		}
+
+		deviceToken, err := trustDevice(ctx, user.UserId, clientId, p.DeviceName)
+		if err != nil {
+			cErr := sdkcmn.ErrDB(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		if deviceToken == "" {
+			responseUserToken(ur, user, c)
+			return
+		}
+
+		setTrustedDeviceCookie(c, deviceToken)
+		responseUserTokenWithExtra(ur, user, c, gin.H{"device_token": deviceToken})
+	}
+}
+
+// Recovery codes replace the previous ones, they are shown once.
+// A code of the authenticator is required.
+func GenerateRecoveryCodesHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var p model.MFACode
+		if err := c.ShouldBind(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		codes, err := ur.GenerateRecoveryCodes(c.Request.Context(), c.Param("id"), p.Code)
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(codes))
+	}
+}
+
+func CountRecoveryCodesHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		count, err := ur.CountRecoveryCodes(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(gin.H{"remaining": count}))
+	}
+}
+
+func ListTrustedDevicesHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		devices, err := ur.ListTrustedDevices(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(devices))
+	}
+}
+
+// RevokeTrustedDeviceHandler revokes the :device_id device, or all the devices of the user without it
+func RevokeTrustedDeviceHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := ur.RevokeTrustedDevice(c.Request.Context(), c.Param("id"), c.Param("device_id")); err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse("ok"))
+	}
+}
@@ -0,0 +1,90 @@
+package model
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Types of the audit events
+const (
+	AuditLogin           = "login"
+	AuditTokenIssued     = "token.issued"
+	AuditTokenRevoked    = "token.revoked"
+	AuditOTPGenerated    = "otp.generated"
+	AuditPasswordChanged = "password.changed"
+	AuditPasswordReset   = "password.reset"
+	AuditEmailChanged    = "email.changed"
+	AuditEmailVerified   = "email.verified"
+	AuditUserCreated     = "user.created"
+	AuditUserDeleted     = "user.deleted"
+	AuditClientCreated   = "client.created"
+)
+
+// Outcomes of the audit events
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEvent is an entry of the audit log, the entries are never updated.
+// The actor is the user who performed the action, it is empty when the client acted on its own behalf.
+// The subject is the user the event is about.
+type AuditEvent struct {
+	Type       string    `json:"type" bson:"type" gorm:"column:type"`
+	Outcome    string    `json:"outcome" bson:"outcome" gorm:"column:outcome"`
+	ActorId    string    `json:"actor_id,omitempty" bson:"actor_id" gorm:"column:actor_id"`
+	SubjectId  string    `json:"subject_id,omitempty" bson:"subject_id" gorm:"column:subject_id"`
+	ClientId   string    `json:"client_id,omitempty" bson:"client_id" gorm:"column:client_id"`
+	IP         string    `json:"ip,omitempty" bson:"ip" gorm:"column:ip"`
+	UserAgent  string    `json:"user_agent,omitempty" bson:"user_agent" gorm:"column:user_agent"`
+	Detail     string    `json:"detail,omitempty" bson:"detail" gorm:"column:detail"`
+	OccurredAt time.Time `json:"occurred_at" bson:"occurred_at" gorm:"column:occurred_at"`
+}
+
+// AuditFilter selects the audit events, UserId matches the actor or the subject.
+// The newest events come first, From is inclusive and To exclusive.
+// A page ends with the cursor of its last event, the cursor is given back for the next page.
+type AuditFilter struct {
+	UserId   string       `json:"user_id" form:"user_id"`
+	ClientId string       `json:"client_id" form:"client_id"`
+	Type     string       `json:"type" form:"type"`
+	From     *time.Time   `json:"from" form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	To       *time.Time   `json:"to" form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+	Cursor   string       `json:"cursor" form:"cursor"`
+	Limit    int          `json:"limit" form:"limit"`
+	After    *AuditCursor `json:"-" form:"-"`
+}
+
+// AuditCursor is the position of an event in the audit log: its time then its id in the storage,
+// the events of the same time are still paged one by one
+type AuditCursor struct {
+	OccurredAt time.Time
+	Id         string
+}
+
+// String is the opaque form of the cursor given to the clients
+func (c *AuditCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.OccurredAt.UTC().Format(time.RFC3339Nano) + " " + c.Id))
+}
+
+func ParseAuditCursor(s string) (*AuditCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	parts := strings.SplitN(string(data), " ", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.New("invalid audit cursor")
+	}
+
+	occurredAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &AuditCursor{OccurredAt: occurredAt, Id: parts[1]}, nil
+}
@@ -79,6 +79,9 @@ type Client struct {
 	// for this client, typically email addresses.
 	Contacts []string `json:"contacts"`
 
+	// RequireVerifiedEmail refuses the tokens of the users whose email is not verified.
+	RequireVerifiedEmail bool `json:"require_verified_email"`
+
 	// CreatedAt returns the timestamp of the client's creation.
 	CreatedAt time.Time `json:"created_at,omitempty"`
 
@@ -0,0 +1,31 @@
+package model
+
+// Providers of the built-in logins, the connectors use their own id
+const (
+	IdentityFacebook   = "facebook"
+	IdentityAccountKit = "account-kit"
+	IdentityApple      = "apple"
+	IdentityGoogle     = "google"
+)
+
+// UserIdentity links an user to its account at an external identity provider,
+// an identity is unique by provider and subject
+type UserIdentity struct {
+	Provider      string `json:"provider" bson:"provider" gorm:"column:provider"`
+	Subject       string `json:"subject" bson:"subject" gorm:"column:subject"`
+	UserId        string `json:"user_id" bson:"user_id" gorm:"column:user_id"`
+	Email         string `json:"email,omitempty" bson:"email" gorm:"column:email"`
+	EmailVerified bool   `json:"email_verified" bson:"email_verified" gorm:"column:email_verified"`
+	Name          string `json:"name,omitempty" bson:"name" gorm:"column:name"`
+}
+
+// IdentityLink adds an external account to a signed in user, the account is proven with a token of the provider
+// and the user gives a fresh proof of its own.
+// The nonce of an id token is issued by /oauth2/nonce and given to Google or Apple with the login.
+type IdentityLink struct {
+	Provider    string `json:"provider" form:"provider"`
+	AccessToken string `json:"access_token" form:"access_token"`
+	IdToken     string `json:"id_token" form:"id_token"`
+	Nonce       string `json:"nonce" form:"nonce"`
+	Reauthentication
+}
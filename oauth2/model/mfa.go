@@ -0,0 +1,48 @@
+package model
+
+import "time"
+
+// TOTPEnrollment is returned when an user enrolls an authenticator app,
+// URI is meant to be shown as a QR code
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TOTPConfirmation is the first code of the enrolled authenticator, with the fresh proof of the user
+type TOTPConfirmation struct {
+	Code string `json:"code" form:"code"`
+	Reauthentication
+}
+
+// MFACode is a TOTP code or a recovery code, with the MFA token given by a login.
+// With RememberDevice the second factor is skipped on this device for a while.
+type MFACode struct {
+	MfaToken       string `json:"mfa_token" form:"mfa_token"`
+	Code           string `json:"code" form:"code"`
+	RecoveryCode   string `json:"recovery_code" form:"recovery_code"`
+	RememberDevice bool   `json:"remember_device" form:"remember_device"`
+	DeviceName     string `json:"device_name" form:"device_name"`
+}
+
+// RecoveryCodes are shown once when they are generated, only their hashes are stored
+type RecoveryCodes struct {
+	Codes []string `json:"codes"`
+}
+
+// RecoveryCode is a stored single-use recovery code
+type RecoveryCode struct {
+	UserId   string     `json:"user_id" bson:"user_id" gorm:"column:user_id"`
+	CodeHash string     `json:"-" bson:"code_hash" gorm:"column:code_hash"`
+	UsedAt   *time.Time `json:"used_at" bson:"used_at" gorm:"column:used_at"`
+}
+
+// TrustedDevice skips the second factor of an user until it expires or is revoked
+type TrustedDevice struct {
+	DeviceId   string     `json:"device_id" bson:"device_id" gorm:"column:device_id"`
+	UserId     string     `json:"user_id" bson:"user_id" gorm:"column:user_id"`
+	ClientId   string     `json:"client_id" bson:"client_id" gorm:"column:client_id"`
+	Name       string     `json:"name" bson:"name" gorm:"column:name"`
+	ExpiredAt  time.Time  `json:"expired_at" bson:"expired_at" gorm:"column:expired_at"`
+	LastUsedAt *time.Time `json:"last_used_at" bson:"last_used_at" gorm:"column:last_used_at"`
+}
@@ -0,0 +1,9 @@
+package model
+
+// PasswordHistory is a previous password hash of an user
+type PasswordHistory struct {
+	UserId       string `json:"user_id" bson:"user_id" gorm:"column:user_id"`
+	Password     string `json:"-" bson:"password" gorm:"column:password"`
+	Salt         string `json:"-" bson:"salt" gorm:"column:salt"`
+	PasswordAlgo string `json:"-" bson:"password_algo" gorm:"column:password_algo"`
+}
@@ -0,0 +1,50 @@
+package model
+
+// ForgotPassword asks for a reset token, sent by email or by SMS when the user is identified by phone
+type ForgotPassword struct {
+	Email       *string `json:"email" form:"email"`
+	PhonePrefix *string `json:"phone_prefix" form:"phone_prefix"`
+	Phone       *string `json:"phone" form:"phone"`
+	ClientId    string  `json:"-"`
+}
+
+// PasswordReset sets a new password with the reset token
+type PasswordReset struct {
+	Email                *string `json:"email" form:"email"`
+	PhonePrefix          *string `json:"phone_prefix" form:"phone_prefix"`
+	Phone                *string `json:"phone" form:"phone"`
+	Token                string  `json:"token" form:"token"`
+	NewPassword          string  `json:"new_password" form:"new_password"`
+	PasswordConfirmation string  `json:"password_confirmation" form:"password_confirmation"`
+	ClientId             string  `json:"-"`
+}
+
+// filterByEmailOrPhone finds the user of the email or the phone within the client
+func filterByEmailOrPhone(email, phone *string, clientId string) map[string]interface{} {
+	filter := map[string]interface{}{"client_id": clientId}
+
+	if phone != nil && *phone != "" {
+		filter["phone"] = *phone
+	} else if email != nil && *email != "" {
+		filter["email"] = *email
+	}
+
+	return filter
+}
+
+func (fp *ForgotPassword) Map() map[string]interface{} {
+	return filterByEmailOrPhone(fp.Email, fp.Phone, fp.ClientId)
+}
+
+func (pr *PasswordReset) Map() map[string]interface{} {
+	return filterByEmailOrPhone(pr.Email, pr.Phone, pr.ClientId)
+}
+
+// ByPhone tells if the token was sent by SMS
+func (pr *PasswordReset) ByPhone() bool {
+	return pr.Phone != nil && *pr.Phone != ""
+}
+
+func (fp *ForgotPassword) ByPhone() bool {
+	return fp.Phone != nil && *fp.Phone != ""
+}
@@ -0,0 +1,23 @@
+package model
+
+import "encoding/json"
+
+// Reauthentication is the fresh proof of the user required by the sensitive changes of an account,
+// one factor is enough:
+//   - the password
+//   - a code of the authenticator app
+//   - a one-time password sent by /oauth2/generate-otp
+//   - an assertion of a passkey of the user, the session is started by /oauth2/users/:id/webauthn/reauthenticate
+//   - a token of a provider already linked to the user: the access token of Facebook,
+//     or the id token of Google or Apple with its nonce
+type Reauthentication struct {
+	Password            string          `json:"password" form:"password"`
+	MfaCode             string          `json:"mfa_code" form:"mfa_code"`
+	OTPCode             string          `json:"otp_code" form:"otp_code"`
+	WebAuthnSession     string          `json:"webauthn_session" form:"webauthn_session"`
+	WebAuthnAssertion   json.RawMessage `json:"webauthn_assertion" form:"-"`
+	IdentityProvider    string          `json:"identity_provider" form:"identity_provider"`
+	IdentityAccessToken string          `json:"identity_access_token" form:"identity_access_token"`
+	IdentityIdToken     string          `json:"identity_id_token" form:"identity_id_token"`
+	IdentityNonce       string          `json:"identity_nonce" form:"identity_nonce"`
+}
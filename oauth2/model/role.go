@@ -0,0 +1,32 @@
+package model
+
+// Role is a named set of permissions defined within a client
+type Role struct {
+	Name        string   `json:"name" form:"name"`
+	ClientId    string   `json:"client_id" form:"client_id"`
+	Permissions []string `json:"permissions" form:"permissions"`
+}
+
+// UserAccess is the result of the role assignments of an user within a client
+type UserAccess struct {
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// NewUserAccess merges the permissions of the roles, without duplicates
+func NewUserAccess(roles []Role) *UserAccess {
+	access := &UserAccess{Roles: []string{}, Permissions: []string{}}
+	seen := map[string]bool{}
+
+	for _, r := range roles {
+		access.Roles = append(access.Roles, r.Name)
+		for _, p := range r.Permissions {
+			if !seen[p] {
+				seen[p] = true
+				access.Permissions = append(access.Permissions, p)
+			}
+		}
+	}
+
+	return access
+}
@@ -0,0 +1,18 @@
+package model
+
+// Scope is an entry of the scope catalog.
+// Clients can only be registered with scopes which are defined in the catalog.
+type Scope struct {
+	// Name is the scope value as used in the "scope" parameter, for example "offline".
+	Name string `json:"name" form:"name" bson:"name" gorm:"column:name"`
+
+	// Description is shown to the end-user on the consent page.
+	Description string `json:"description" form:"description" bson:"description" gorm:"column:description"`
+
+	// IsDefault scopes are requested for the client when a request does not contain any scope.
+	IsDefault bool `json:"is_default" form:"is_default" bson:"is_default" gorm:"column:is_default"`
+
+	// ConsentRequired scopes must be approved by the end-user,
+	// the others are granted without asking.
+	ConsentRequired bool `json:"consent_required" form:"consent_required" bson:"consent_required" gorm:"column:consent_required"`
+}
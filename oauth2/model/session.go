@@ -83,6 +83,48 @@ func (s *Session) SetUsername(username string) {
 	s.Extra["username"] = username
 }
 
+func (s *Session) SetEmailVerified(verified bool) {
+	s.Extra["email_verified"] = verified
+}
+
+func (s *Session) SetPhoneVerified(verified bool) {
+	s.Extra["phone_verified"] = verified
+}
+
+func (s *Session) SetUserAccess(access *UserAccess) {
+	if access == nil {
+		return
+	}
+	s.Extra["roles"] = access.Roles
+	s.Extra["permissions"] = access.Permissions
+}
+
+func (s *Session) GetRoles() []string {
+	return s.getStrings("roles")
+}
+
+func (s *Session) GetPermissions() []string {
+	return s.getStrings("permissions")
+}
+
+// Extra values are []interface{} once the session has been loaded from the storage
+func (s *Session) getStrings(key string) []string {
+	switch v := s.Extra[key].(type) {
+	case []string:
+		return v
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, i := range v {
+			if str, ok := i.(string); ok {
+				result = append(result, str)
+			}
+		}
+		return result
+	}
+
+	return nil
+}
+
 func (s *Session) GetUserID() string {
 	uid, ok := s.Extra["user_id"]
 	if ok {
@@ -23,17 +23,27 @@ type User struct {
 	Username            *string     `json:"username" gorm:"username"`
 	Password            string      `json:"-"`
 	Salt                string      `json:"-"`
+	PasswordAlgo        string      `json:"-" bson:"password_algo" gorm:"column:password_algo"`
 	Email               *string     `json:"email"`
+	EmailVerified       bool        `json:"email_verified" bson:"email_verified" gorm:"column:email_verified"`
 	PhonePrefix         *string     `json:"phone_prefix" bson:"phone_prefix,omitempty" gorm:"phone_prefix"`
 	Phone               *string     `json:"phone" bson:"phone,omitempty"`
+	PhoneNumber         *string     `json:"phone_number" bson:"phone_number,omitempty" gorm:"column:phone_number"`
+	PhoneVerified       bool        `json:"phone_verified" bson:"phone_verified" gorm:"column:phone_verified"`
 	AccountType         AccountType `json:"account_type" bson:"account_type" gorm:"account_type"`
-	FBId                *string     `json:"fb_id,omitempty" bson:"fb_id" gorm:"fb_id"`
-	AKId                string      `json:"ak_id" bson:"account_kit_id" gorm:"column:account_kit_id"`
-	AppleId             *string     `json:"apple_id" bson:"apple_id" gorm:"apple_id"`
 	ClientId            string      `json:"client_id" bson:"client_id"`
 	IsNew               bool        `json:"is_new" bson:"-" gorm:"-"`
-	OtpCode             *string     `json:"otp_code" bson:"otp_code" gorm:"otp_code"`
-	OtpCodeExpiredAt    *time.Time  `json:"otp_code_expired_at" bson:"otp_code_expired_at" gorm:"otp_code_expired_at"`
+	OtpCode             *string     `json:"-" bson:"otp_code" gorm:"otp_code"`
+	OtpCodeExpiredAt    *time.Time  `json:"-" bson:"otp_code_expired_at" gorm:"otp_code_expired_at"`
+	OtpAttempts         int         `json:"-" bson:"otp_attempts" gorm:"column:otp_attempts"`
+	OtpChannel          *string     `json:"-" bson:"otp_channel" gorm:"column:otp_channel"`
+	OtpSentTo           *string     `json:"-" bson:"otp_sent_to" gorm:"column:otp_sent_to"`
+	ResetToken          *string     `json:"-" bson:"reset_token" gorm:"column:reset_token"`
+	ResetTokenExpiredAt *time.Time  `json:"-" bson:"reset_token_expired_at" gorm:"column:reset_token_expired_at"`
+	ResetAttempts       int         `json:"-" bson:"reset_attempts" gorm:"column:reset_attempts"`
+	MfaSecret           string      `json:"-" bson:"mfa_secret" gorm:"column:mfa_secret"`
+	MfaEnabled          bool        `json:"mfa_enabled" bson:"mfa_enabled" gorm:"column:mfa_enabled"`
+	MfaLastStep         int64       `json:"-" bson:"mfa_last_step" gorm:"column:mfa_last_step"`
 	HasUsernamePassword bool        `json:"has_username_password" bson:"-" gorm:"-"`
 }
 
@@ -51,18 +61,51 @@ func (u User) GetEmail() string {
 	return *u.Email
 }
 
+// GetPhoneNumber returns the E.164 number of the user, or the number as typed when it was not normalized
+func (u User) GetPhoneNumber() string {
+	if u.PhoneNumber != nil && *u.PhoneNumber != "" {
+		return *u.PhoneNumber
+	}
+
+	if u.Phone == nil || *u.Phone == "" {
+		return ""
+	}
+
+	if u.PhonePrefix != nil {
+		return *u.PhonePrefix + *u.Phone
+	}
+
+	return *u.Phone
+}
+
 func (u User) GetUserID() string {
 	return u.UserId
 }
 
+func (u User) IsEmailVerified() bool {
+	return u.EmailVerified
+}
+
+func (u User) IsPhoneVerified() bool {
+	return u.PhoneVerified
+}
+
+// HasMFA tells if a second factor is required after the password
+func (u User) HasMFA() bool {
+	return u.MfaEnabled
+}
+
 type CredentialAndPassword struct {
-	Id       string  `json:"id" gorm:"id"`
-	Username string  `json:"username" form:"username" gorm:"username"`
-	Password *string `json:"password" form:"password" gorm:"password"`
-	Salt     *string `json:"salt" gorm:"salt"`
-	Email    *string `json:"email" form:"email"`
-	Phone    *string `json:"phone" form:"phone" bson:"phone,omitempty"`
-	ClientId string  `json:"client_id" gorm:"client_id"`
+	Id           string  `json:"id" gorm:"id"`
+	Username     string  `json:"username" form:"username" gorm:"username"`
+	Password     *string `json:"password" form:"password" gorm:"password"`
+	Salt         *string `json:"salt" gorm:"salt"`
+	PasswordAlgo *string `json:"-" gorm:"column:password_algo"`
+	Email        *string `json:"email" form:"email"`
+	Phone        *string `json:"phone" form:"phone" bson:"phone,omitempty"`
+	ClientId     string  `json:"client_id" gorm:"client_id"`
+	// DeviceToken is given by a trusted device to skip the second factor
+	DeviceToken string `json:"device_token" form:"device_token" gorm:"-" bson:"-"`
 }
 
 func (up *CredentialAndPassword) Map() map[string]interface{} {
@@ -75,6 +118,7 @@ func (up *CredentialAndPassword) Map() map[string]interface{} {
 	if up.Password != nil {
 		result["password"] = up.Password
 		result["salt"] = up.Salt
+		result["password_algo"] = up.PasswordAlgo
 	}
 
 	if up.Email != nil {
@@ -94,11 +138,12 @@ type UserFilter struct {
 	Email       *string `json:"email" form:"email"`
 	PhonePrefix *string `json:"phone_prefix" form:"phone_prefix" bson:"phone_prefix,omitempty" gorm:"phone_prefix"`
 	Phone       *string `json:"phone" form:"phone" bson:"phone,omitempty"`
-	FBId        *string `json:"fb_id" form:"fb_id" bson:"fb_id" gorm:"fb_id"`
-	AKId        *string `json:"ak_id" form:"ak_id" bson:"account_kit_id" gorm:"column:account_kit_id"`
-	AppleId     *string `json:"apple_id" form:"apple_id" bson:"apple_id" gorm:"apple_id"`
 	OTPCode     *string `json:"otp_code" form:"otp_code" bson:"otp_code" gorm:"otp_code"`
 	ClientId    *string `json:"client_id" form:"client_id" bson:"client_id"`
+	// the external ids are looked up in the identities of the users
+	FBId    *string `json:"fb_id" form:"fb_id" bson:"-" gorm:"-"`
+	AKId    *string `json:"ak_id" form:"ak_id" bson:"-" gorm:"-"`
+	AppleId *string `json:"apple_id" form:"apple_id" bson:"-" gorm:"-"`
 }
 
 func (uf *UserFilter) Map() map[string]interface{} {
@@ -120,17 +165,20 @@ func (uf *UserFilter) Map() map[string]interface{} {
 		result["phone"] = v
 	}
 
-	if v := uf.FBId; v != nil {
-		result["fb_id"] = v
-	}
-
-	if v := uf.AppleId; v != nil {
-		result["apple_id"] = v
-	}
+	return result
+}
 
-	if v := uf.OTPCode; v != nil {
-		result["otp_code"] = v
+// Identity returns the external identity the filter looks for
+func (uf *UserFilter) Identity() (provider, subject string, ok bool) {
+	for provider, id := range map[string]*string{
+		IdentityFacebook:   uf.FBId,
+		IdentityAccountKit: uf.AKId,
+		IdentityApple:      uf.AppleId,
+	} {
+		if id != nil && *id != "" {
+			return provider, *id, true
+		}
 	}
 
-	return result
+	return "", "", false
 }
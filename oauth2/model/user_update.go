@@ -13,13 +13,15 @@ type UserUpdate struct {
 	Email                *string      `json:"email,omitempty" form:"email" gorm:"email"`
 	PhonePrefix          *string      `json:"phone_prefix" form:"phone_prefix" bson:"phone_prefix,omitempty" gorm:"phone_prefix"`
 	Phone                *string      `json:"phone" form:"phone" bson:"phone,omitempty" gorm:"phone"`
+	PhoneNumber          *string      `json:"-" bson:"phone_number,omitempty" gorm:"column:phone_number"`
 	AccountType          *AccountType `json:"account_type" form:"account_type" bson:"account_type" gorm:"account_type"`
-	FBId                 *string      `json:"fb_id" form:"fb_id" bson:"fb_id" gorm:"fb_id"`
-	AKId                 *string      `json:"ak_id" form:"ak_id" bson:"account_kit_id" gorm:"column:account_kit_id"`
-	AppleId              *string      `json:"apple_id" form:"apple_id" bson:"apple_id" gorm:"apple_id"`
 	ClientId             *string      `json:"client_id" form:"client_id" bson:"client_id"`
 	Status               *int         `json:"status" form:"status" gorm:"status"`
 	Salt                 *string      `json:"-" gorm:"salt"`
+	PasswordAlgo         *string      `json:"-" gorm:"column:password_algo"`
+	// the verified flags are reset when the email or the phone changes
+	EmailVerified *bool `json:"-" bson:"email_verified,omitempty" gorm:"column:email_verified"`
+	PhoneVerified *bool `json:"-" bson:"phone_verified,omitempty" gorm:"column:phone_verified"`
 }
 
 func (u *UserUpdate) Validate() error {
@@ -0,0 +1,24 @@
+package model
+
+import "encoding/json"
+
+// WebAuthnCredential is a passkey or a security key registered by an user
+type WebAuthnCredential struct {
+	// CredentialId is the base64url encoded raw credential id
+	CredentialId    string `json:"credential_id" bson:"credential_id" gorm:"column:credential_id"`
+	UserId          string `json:"user_id" bson:"user_id" gorm:"column:user_id"`
+	Name            string `json:"name" bson:"name" gorm:"column:name"`
+	PublicKey       []byte `json:"-" bson:"public_key" gorm:"column:public_key"`
+	AttestationType string `json:"attestation_type" bson:"attestation_type" gorm:"column:attestation_type"`
+	AAGUID          []byte `json:"aaguid" bson:"aaguid" gorm:"column:aaguid"`
+	// SignCount is the last signature counter of the authenticator, it detects cloned authenticators
+	SignCount uint32 `json:"sign_count" bson:"sign_count" gorm:"column:sign_count"`
+}
+
+// WebAuthnFinish ends a ceremony with the session given by its start, it is posted in the body to stay out of the logs.
+// Credential is the PublicKeyCredential created by the authenticator for a registration, its assertion for a login.
+type WebAuthnFinish struct {
+	Session    string          `json:"session" binding:"required"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential" binding:"required"`
+}
@@ -0,0 +1,83 @@
+package model
+
+import "time"
+
+// Types of the user events delivered to the webhooks
+const (
+	EventUserCreated         = "user.created"
+	EventUserUpdated         = "user.updated"
+	EventUserDeleted         = "user.deleted"
+	EventUserPasswordChanged = "user.password_changed"
+	EventTokenRevoked        = "token.revoked"
+)
+
+// WebhookEvents are the event types a webhook can subscribe to
+var WebhookEvents = []string{
+	EventUserCreated,
+	EventUserUpdated,
+	EventUserDeleted,
+	EventUserPasswordChanged,
+	EventTokenRevoked,
+}
+
+// States of the outbox events
+const (
+	OutboxPending   = "pending"
+	OutboxDelivered = "delivered"
+	OutboxFailed    = "failed"
+)
+
+// Webhook is an endpoint of a client receiving the events of its users, it receives every event when Events is empty.
+// The payloads are signed with the secret, it is stored encrypted and only shown when the webhook is created.
+type Webhook struct {
+	WebhookId string   `json:"webhook_id" bson:"webhook_id" gorm:"column:webhook_id"`
+	ClientId  string   `json:"client_id" bson:"client_id" gorm:"column:client_id"`
+	URL       string   `json:"url" form:"url" bson:"url" gorm:"column:url"`
+	Events    []string `json:"events" form:"events" bson:"events" gorm:"-"`
+	Secret    string   `json:"secret,omitempty" bson:"secret" gorm:"column:secret"`
+}
+
+// Accepts tells whether the webhook subscribes to the event type
+func (w *Webhook) Accepts(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OutboxEvent is the delivery of an user event to a webhook.
+// It is written in the transaction of the change, so an event exists if and only if its change is committed,
+// then the dispatcher delivers it. The event id is shared by the deliveries of an event to several webhooks
+// and lets the receivers drop the duplicates.
+type OutboxEvent struct {
+	DeliveryId    string     `json:"delivery_id" bson:"delivery_id" gorm:"column:delivery_id"`
+	EventId       string     `json:"event_id" bson:"event_id" gorm:"column:event_id"`
+	Type          string     `json:"type" bson:"type" gorm:"column:type"`
+	ClientId      string     `json:"client_id" bson:"client_id" gorm:"column:client_id"`
+	UserId        string     `json:"user_id" bson:"user_id" gorm:"column:user_id"`
+	WebhookId     string     `json:"webhook_id" bson:"webhook_id" gorm:"column:webhook_id"`
+	Payload       string     `json:"payload" bson:"payload" gorm:"column:payload"`
+	State         string     `json:"state" bson:"state" gorm:"column:state"`
+	Attempts      int        `json:"attempts" bson:"attempts" gorm:"column:attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" bson:"next_attempt_at" gorm:"column:next_attempt_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty" bson:"delivered_at" gorm:"column:delivered_at"`
+	LastError     string     `json:"last_error,omitempty" bson:"last_error" gorm:"column:last_error"`
+	OccurredAt    time.Time  `json:"occurred_at" bson:"occurred_at" gorm:"column:occurred_at"`
+}
+
+// WebhookPayload is the body posted to the webhooks, Data is the user after the change when there is one
+type WebhookPayload struct {
+	Id         string      `json:"id"`
+	Type       string      `json:"type"`
+	ClientId   string      `json:"client_id"`
+	UserId     string      `json:"user_id"`
+	OccurredAt time.Time   `json:"occurred_at"`
+	Data       interface{} `json:"data,omitempty"`
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/baozhenglab/oauth-service/config"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
 	"github.com/ory/fosite"
 
 	"github.com/ory/fosite/compose"
@@ -30,15 +31,38 @@ var oauth2 fosite.OAuth2Provider
 
 func InitOAuth2Provider(config *config.Config, store interface{}) {
 	strat := getStrategy(config)
+	config.FC.ScopeStrategy = config.GetScopeStrategy()
+	scopeStorage, _ = store.(ScopeStorage)
 
-	oauth2 = compose.Compose(
+	// counters are shared through the store when it supports them
+	if counter, ok := store.(secure.AttemptCounter); ok {
+		config.SetAttemptCounter(counter)
+	}
+	lockout = config.GetLockout()
+
+	mfaAES = config.GetAES()
+	mfaTokenTTL = config.GetMFATokenTTL()
+	mfaTrustedDeviceTTL = config.GetMFATrustedDeviceTTL()
+	trustedDevices, _ = store.(TrustedDeviceStorage)
+	auditLog, _ = store.(AuditStorage)
+
+	var err error
+	if connectors, err = config.GetConnectors(); err != nil {
+		panic(err)
+	}
+	connectorCallbackURL = config.GetConnectorCallbackURL
+
+	// the default hasher of fosite, traced
+	hasher := tracedHasher{&fosite.BCrypt{WorkFactor: config.FC.GetHashCost()}}
+
+	provider := compose.Compose(
 		config.FC,
 		store,
 		strat,
-		nil,
+		hasher,
 
 		// enabled handlers
-		compose.OAuth2AuthorizeExplicitFactory,
+		ResourceAuthorizeExplicitFactory, // resource indicators
 		compose.OAuth2AuthorizeImplicitFactory,
 		compose.OAuth2ClientCredentialsGrantFactory,
 		compose.OAuth2RefreshTokenGrantFactory,
@@ -53,10 +77,12 @@ func InitOAuth2Provider(config *config.Config, store interface{}) {
 		//compose.OpenIDConnectHybridFactory,
 		//compose.OpenIDConnectRefreshFactory,
 	)
+
+	oauth2 = tracedProvider{provider.(*fosite.Fosite)}
 }
 
 func GetHasher() fosite.Hasher {
-	return oauth2.(*fosite.Fosite).Hasher
+	return oauth2.(tracedProvider).Hasher
 }
 
 func newSession(subject string) *model.Session {
@@ -73,6 +99,15 @@ func newSession(subject string) *model.Session {
 	}
 }
 
+// sessionUserID is the user of the login of a token, empty for the tokens of a client
+func sessionUserID(ar fosite.Requester) string {
+	if s, ok := ar.GetSession().(interface{ GetUserID() string }); ok {
+		return s.GetUserID()
+	}
+
+	return ""
+}
+
 func newSessionForPasswordGrant(subject string, userID string) *model.Session {
 	s := newSession(subject)
 	s.Extra["user_id"] = userID
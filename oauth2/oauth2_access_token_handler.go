@@ -1,15 +1,19 @@
 package oauth2
 
 import (
+	"time"
+
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
 	"github.com/gin-gonic/gin"
 	"github.com/ory/fosite"
-	"log"
-	"time"
+	"github.com/pkg/errors"
 )
 
 func AccessTokenHandler(c *gin.Context) {
 	// This context will be passed to all methods.
-	ctx := fosite.NewContext()
+	// The client IP of the context is used to count failed password grants (see clientip.Middleware).
+	ctx := c.Request.Context()
 
 	// Create an empty session object which will be passed to the request handlers
 	mySessionData := newSession(c.PostForm("username"))
@@ -20,23 +24,33 @@ func AccessTokenHandler(c *gin.Context) {
 	// * unknown client
 	// * invalid redirect
 	// * ...
+	if mfaErr, ok := errors.Cause(err).(*MFARequiredError); ok {
+		writeMFARequired(c, mfaErr)
+		return
+	}
+
 	if err != nil {
-		log.Printf("Error occurred in NewAccessRequest: %+v", err)
+		recordTokenAudit(c, nil, err)
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in NewAccessRequest")
 		oauth2.WriteAccessError(c.Writer, accessRequest, err)
 		return
 	}
 
 	// If this is a client_credentials grant, grant all scopes the client is allowed to perform.
+	// The token is the one of the client: the posted username is not checked, the subject is the client.
 	if accessRequest.GetGrantTypes().Exact("client_credentials") {
+		mySessionData.Subject = accessRequest.GetClient().GetID()
+		mySessionData.Username = ""
 		accessRequest.GetSession().SetExpiresAt(fosite.AccessToken, time.Now().Add(time.Hour*24*365))
+		requestDefaultScopes(ctx, accessRequest)
 		for _, scope := range accessRequest.GetRequestedScopes() {
-			if fosite.HierarchicScopeStrategy(accessRequest.GetClient().GetScopes(), scope) {
+			if scopeStrategy()(accessRequest.GetClient().GetScopes(), scope) {
 				accessRequest.GrantScope(scope)
 			}
 		}
 	}
 
-	if accessRequest.GetGrantTypes().Exact("password") {
+	if accessRequest.GetGrantTypes().Exact("password") || accessRequest.GetGrantTypes().Exact(MFAOTPGrantType) {
 		accessRequest.GrantScope("offline")
 	}
 
@@ -44,11 +58,30 @@ func AccessTokenHandler(c *gin.Context) {
 		accessRequest.GetSession().SetExpiresAt(fosite.AccessToken, time.Now().Add(time.Hour*24*45))
 	}
 
+	// Resource indicators (RFC 8707): new grants get the requested resources as audience,
+	// grants based on a previous authorization can only narrow the audience down.
+	// The authorization_code grant is narrowed by its handler (see ResourceAuthorizeExplicitFactory).
+	switch {
+	case accessRequest.GetGrantTypes().Exact("authorization_code"):
+	case accessRequest.GetGrantTypes().Exact("refresh_token"):
+		err = narrowResources(accessRequest.(*fosite.AccessRequest))
+	default:
+		err = grantResources(accessRequest)
+	}
+
+	if err != nil {
+		recordTokenAudit(c, accessRequest, err)
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in resource indicators")
+		oauth2.WriteAccessError(c.Writer, accessRequest, err)
+		return
+	}
+
 	// Next we create a response for the access request. Again, we iterate through the TokenEndpointHandlers
 	// and aggregate the result in response.
 	response, err := oauth2.NewAccessResponse(ctx, accessRequest)
+	recordTokenAudit(c, accessRequest, err)
 	if err != nil {
-		log.Printf("Error occurred in NewAccessResponse: %+v", err)
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in NewAccessResponse")
 		oauth2.WriteAccessError(c.Writer, accessRequest, err)
 		return
 	}
@@ -56,3 +89,33 @@ func AccessTokenHandler(c *gin.Context) {
 	// All done, send the response.
 	oauth2.WriteAccessResponse(c.Writer, accessRequest, response)
 }
+
+// recordTokenAudit records a token request, the password grants are logins too
+func recordTokenAudit(c *gin.Context, ar fosite.AccessRequester, err error) {
+	grantType := c.PostForm("grant_type")
+	countToken(grantType, ar, err)
+
+	event := &model.AuditEvent{Type: model.AuditTokenIssued}
+	if ar != nil && ar.GetClient() != nil {
+		event.ClientId = ar.GetClient().GetID()
+	}
+
+	// the session of a failed request is not trusted
+	if err == nil {
+		event.SubjectId = ar.GetSession().GetSubject()
+		event.ActorId = event.SubjectId
+		event.Detail = grantType
+	}
+
+	if grantType == "password" || grantType == MFAOTPGrantType {
+		login := *event
+		login.Type = model.AuditLogin
+		recordAudit(c, &login, err)
+
+		if err != nil {
+			return
+		}
+	}
+
+	recordAudit(c, event, err)
+}
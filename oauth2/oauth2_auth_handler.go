@@ -2,30 +2,72 @@ package oauth2
 
 import (
 	"fmt"
+	"github.com/baozhenglab/oauth-service/logging"
 	"github.com/gin-gonic/gin"
-	"github.com/ory/fosite"
-	"log"
+	"html"
+	"net/url"
+	"sort"
 )
 
+// connectorButtons offers the upstream providers, the consented scopes are posted with the authorize request
+func connectorButtons(query string) string {
+	ids := make([]string, 0, len(connectors))
+	for id := range connectors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var buttons string
+	for _, id := range ids {
+		action := "/oauth2/connectors/" + url.PathEscape(id) + "/login?" + query
+		buttons += fmt.Sprintf(`<br><button type="submit" formaction="%s">Sign in with %s</button>`,
+			html.EscapeString(action), html.EscapeString(connectors[id].Name))
+	}
+
+	return buttons
+}
+
 func AuthHandler(c *gin.Context) {
 	rw := c.Writer
 	req := c.Request
 	// This context will be passed to all methods.
-	ctx := fosite.NewContext()
+	ctx := c.Request.Context()
 
 	// Let's create an AuthorizeRequest object!
 	// It will analyze the request and extract important information like scopes, response type and others.
 	ar, err := oauth2.NewAuthorizeRequest(ctx, req)
 	if err != nil {
-		log.Printf("Error occurred in NewAuthorizeRequest: %+v", err)
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in NewAuthorizeRequest")
 		oauth2.WriteAuthorizeError(rw, ar, err)
 		return
 	}
 	// You have now access to authorizeRequest, Code ResponseTypes, Scopes ...
 
+	// Check the requested resources (RFC 8707) before asking for consent
+	if _, err := requestedResources(ar.GetRequestForm()); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in resource indicators")
+		oauth2.WriteAuthorizeError(rw, ar, err)
+		return
+	}
+
+	// Without any requested scope the client gets the default scopes of the catalog
+	requestDefaultScopes(ctx, ar)
+	catalog := describeScopes(ctx, ar.GetRequestedScopes())
+
 	var requestedScopes string
 	for _, this := range ar.GetRequestedScopes() {
-		requestedScopes += fmt.Sprintf(`<li><input type="checkbox" name="scopes" value="%s">%s</li>`, this, this)
+		description := this
+		if s, ok := catalog[this]; ok && s.Description != "" {
+			description = s.Description
+		}
+
+		// scopes which do not require consent are only listed
+		if s, ok := catalog[this]; ok && !s.ConsentRequired {
+			requestedScopes += fmt.Sprintf(`<li>%s</li>`, html.EscapeString(description))
+			continue
+		}
+
+		requestedScopes += fmt.Sprintf(`<li><input type="checkbox" name="scopes" value="%s">%s</li>`, html.EscapeString(this), html.EscapeString(description))
 	}
 
 	// Normally, this would be the place where you would check if the user is logged in and gives his consent.
@@ -43,14 +85,18 @@ func AuthHandler(c *gin.Context) {
 				</p>
 				<input type="text" name="username" /> <small>try admin</small><br>
 				<input type="submit">
+				%s
 			</form>
-		`, requestedScopes)))
+		`, requestedScopes, connectorButtons(req.URL.RawQuery))))
 		return
 	}
 
-	// let's see what scopes the user gave consent to
-	for _, scope := range req.PostForm["scopes"] {
-		ar.GrantScope(scope)
+	// let's grant the scopes the user gave consent to, those which do not require consent
+	// and the resources the token is meant for
+	if err := grantConsent(ctx, ar, req.PostForm["scopes"]); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in resource indicators")
+		oauth2.WriteAuthorizeError(rw, ar, err)
+		return
 	}
 
 	// Now that the user is authorized, we set up a session:
@@ -87,7 +133,7 @@ func AuthHandler(c *gin.Context) {
 	// * invalid redirect
 	// * ...
 	if err != nil {
-		log.Printf("Error occurred in NewAuthorizeResponse: %+v", err)
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in NewAuthorizeResponse")
 		oauth2.WriteAuthorizeError(rw, ar, err)
 		return
 	}
@@ -8,7 +8,9 @@ import (
 	"context"
 	"time"
 
+	"github.com/baozhenglab/oauth-service/common"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/compose"
 	foauth2 "github.com/ory/fosite/handler/oauth2"
@@ -27,6 +29,19 @@ type UserCredential interface {
 	GetEmail() string
 }
 
+// UserAccessStorage gives the roles and permissions of the user within the client, put into the token
+type UserAccessStorage interface {
+	GetUserAccess(ctx context.Context, clientID, userID string) (*model.UserAccess, error)
+}
+
+// userAccess is the storage of the roles given to SetUserAccessStorage, the tokens carry no roles without it
+var userAccess UserAccessStorage
+
+// SetUserAccessStorage sets where the password grant reads the roles of the users, the user repository
+func SetUserAccessStorage(s UserAccessStorage) {
+	userAccess = s
+}
+
 type ResourceOwnerPasswordCredentialsGrantHandler struct {
 	// ResourceOwnerPasswordCredentialsGrantStorage is used to persist session data across requests.
 	ResourceOwnerPasswordCredentialsGrantStorage ResourceOwnerPasswordCredentialsGrantStorage
@@ -41,8 +56,8 @@ type ResourceOwnerPasswordCredentialsGrantHandler struct {
 // HandleTokenEndpointRequest implements https://tools.ietf.org/html/rfc6749#section-4.3.2
 func (c *ResourceOwnerPasswordCredentialsGrantHandler) HandleTokenEndpointRequest(ctx context.Context, request fosite.AccessRequester) error {
 	// grant_type REQUIRED.
-	// Value MUST be set to "password".
-	if !request.GetGrantTypes().Exact("password") {
+	// Value MUST be set to "password", or "mfa-otp" for the second step of an user enrolled in MFA.
+	if !request.GetGrantTypes().Exact("password") && !request.GetGrantTypes().Exact(MFAOTPGrantType) {
 		return errors.WithStack(fosite.ErrUnknownRequest)
 	}
 
@@ -61,27 +76,38 @@ func (c *ResourceOwnerPasswordCredentialsGrantHandler) HandleTokenEndpointReques
 		return err
 	}
 
-	username := request.GetRequestForm().Get("username")
-	password := request.GetRequestForm().Get("password")
 	var user UserCredential
 	var err error
 
-	if username == "" || password == "" {
-		return errors.WithStack(fosite.ErrInvalidRequest.WithHint("Username or password are missing from the POST body."))
-	} else if user, err = c.ResourceOwnerPasswordCredentialsGrantStorage.Authenticate(ctx, username, password); errors.Cause(err) == fosite.ErrNotFound {
-		return errors.WithStack(fosite.ErrRequestUnauthorized.WithHint("Unable to authenticate the provided username and password credentials.").WithDebug(err.Error()))
-	} else if err != nil {
-		return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+	if request.GetGrantTypes().Exact(MFAOTPGrantType) {
+		user, err = c.authenticateMFA(ctx, request)
+	} else {
+		user, err = c.authenticatePassword(ctx, request)
 	}
 
-	// Credentials must not be passed around, potentially leaking to the database!
-	delete(request.GetRequestForm(), "password")
+	if err != nil {
+		return err
+	}
 
 	mSession := request.GetSession().(*model.Session)
 	mSession.Subject = user.GetUserID()
 	mSession.SetUserID(user.GetUserID())
 	mSession.SetUserEmail(user.GetEmail())
 	mSession.SetUsername(user.GetUsername())
+	setVerifiedClaims(mSession, user)
+
+	if emailVerificationRequired(client, user) {
+		return errors.WithStack(fosite.ErrAccessDenied.WithHint(common.ErrEmailNotVerified.Error()))
+	}
+
+	if userAccess != nil {
+		access, err := userAccess.GetUserAccess(ctx, client.GetID(), user.GetUserID())
+		if err != nil {
+			return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+		}
+		mSession.SetUserAccess(access)
+	}
+
 	//request.GetSession().SetExpiresAt(fosite.Token, time.Now().UTC().Add(c.AccessTokenLifespan).Round(time.Second))
 	if c.RefreshTokenLifespan > -1 {
 		request.GetSession().SetExpiresAt(fosite.RefreshToken, time.Now().UTC().Add(c.RefreshTokenLifespan).Round(time.Second))
@@ -90,9 +116,93 @@ func (c *ResourceOwnerPasswordCredentialsGrantHandler) HandleTokenEndpointReques
 	return nil
 }
 
+func (c *ResourceOwnerPasswordCredentialsGrantHandler) authenticatePassword(ctx context.Context, request fosite.AccessRequester) (UserCredential, error) {
+	username := request.GetRequestForm().Get("username")
+	password := request.GetRequestForm().Get("password")
+
+	if username == "" || password == "" {
+		return nil, errors.WithStack(fosite.ErrInvalidRequest.WithHint("Username or password are missing from the POST body."))
+	}
+
+	lockKeys := loginLockKeys(ctx, request.GetClient().GetID(), username)
+	if err := checkLockout(ctx, lockKeys); err != nil {
+		return nil, err
+	}
+
+	user, err := c.ResourceOwnerPasswordCredentialsGrantStorage.Authenticate(ctx, username, password)
+	if errors.Cause(err) == fosite.ErrNotFound {
+		recordLoginFailure(ctx, lockKeys)
+		return nil, errors.WithStack(fosite.ErrRequestUnauthorized.WithHint("Unable to authenticate the provided username and password credentials.").WithDebug(err.Error()))
+	} else if err != nil {
+		return nil, errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+	}
+
+	recordLoginSuccess(ctx, lockKeys)
+
+	// Credentials must not be passed around, potentially leaking to the database!
+	delete(request.GetRequestForm(), "password")
+
+	// the second step is only required when the storage can verify it, and skipped on the trusted devices
+	if mu, ok := user.(mfaUser); ok && mu.HasMFA() && !isTrustedDevice(ctx, user.GetUserID(), request.GetRequestForm().Get("device_token")) {
+		if _, ok := c.ResourceOwnerPasswordCredentialsGrantStorage.(MFAStorage); ok {
+			return nil, newMFARequiredError(user.GetUserID(), request.GetClient().GetID())
+		}
+	}
+
+	return user, nil
+}
+
+func (c *ResourceOwnerPasswordCredentialsGrantHandler) authenticateMFA(ctx context.Context, request fosite.AccessRequester) (UserCredential, error) {
+	ms, ok := c.ResourceOwnerPasswordCredentialsGrantStorage.(MFAStorage)
+	if !ok {
+		return nil, errors.WithStack(fosite.ErrUnsupportedGrantType)
+	}
+
+	token, err := secure.ParseMFAToken(mfaAES, request.GetRequestForm().Get("mfa_token"))
+	if err != nil || token.ClientId != request.GetClient().GetID() {
+		return nil, errors.WithStack(fosite.ErrInvalidGrant.WithHint(common.ErrMFATokenInvalid.Error()))
+	}
+
+	code := request.GetRequestForm().Get("code")
+	recoveryCode := request.GetRequestForm().Get("recovery_code")
+	rs, hasRecovery := c.ResourceOwnerPasswordCredentialsGrantStorage.(RecoveryCodeStorage)
+
+	if code == "" && (recoveryCode == "" || !hasRecovery) {
+		return nil, errors.WithStack(fosite.ErrInvalidRequest.WithHint("The TOTP code is missing from the POST body."))
+	}
+
+	lockKeys := []string{secure.MFALockKey(token.UserId)}
+	if err := checkLockout(ctx, lockKeys); err != nil {
+		return nil, err
+	}
+
+	var user UserCredential
+	invalidHint := common.ErrMFACodeInvalid.Error()
+
+	if code != "" {
+		user, err = ms.VerifyMFA(ctx, token.UserId, code)
+	} else {
+		user, err = rs.UseRecoveryCode(ctx, token.UserId, recoveryCode)
+		invalidHint = common.ErrRecoveryCodeInvalid.Error()
+	}
+
+	if errors.Cause(err) == fosite.ErrNotFound {
+		recordLoginFailure(ctx, lockKeys)
+		return nil, errors.WithStack(fosite.ErrRequestUnauthorized.WithHint(invalidHint))
+	} else if err != nil {
+		return nil, errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+	}
+
+	recordLoginSuccess(ctx, lockKeys)
+	delete(request.GetRequestForm(), "code")
+	delete(request.GetRequestForm(), "recovery_code")
+
+	return user, nil
+}
+
 // PopulateTokenEndpointResponse implements https://tools.ietf.org/html/rfc6749#section-4.3.3
 func (c *ResourceOwnerPasswordCredentialsGrantHandler) PopulateTokenEndpointResponse(ctx context.Context, requester fosite.AccessRequester, responder fosite.AccessResponder) error {
-	if !requester.GetGrantTypes().Exact("password") {
+	if !requester.GetGrantTypes().Exact("password") && !requester.GetGrantTypes().Exact(MFAOTPGrantType) {
 		return errors.WithStack(fosite.ErrUnknownRequest)
 	}
 
@@ -111,6 +221,18 @@ func (c *ResourceOwnerPasswordCredentialsGrantHandler) PopulateTokenEndpointResp
 		return err
 	}
 
+	// the device of the second step is remembered on demand
+	if requester.GetGrantTypes().Exact(MFAOTPGrantType) && requester.GetRequestForm().Get("remember_device") == "true" {
+		deviceToken, err := trustDevice(ctx, requester.GetSession().GetSubject(), requester.GetClient().GetID(), requester.GetRequestForm().Get("device_name"))
+		if err != nil {
+			return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+		}
+
+		if deviceToken != "" {
+			responder.SetExtra("device_token", deviceToken)
+		}
+	}
+
 	if refresh != "" {
 		responder.SetExtra("refresh_token", refresh)
 	}
@@ -12,9 +12,10 @@ import (
 )
 
 func IntrospectionHandler(c *gin.Context) {
-	ctx := fosite.NewContext()
+	ctx := c.Request.Context()
 	mySessionData := newSession("introspect")
 	ir, err := oauth2.NewIntrospectionRequest(ctx, c.Request, mySessionData)
+	countIntrospection(err)
 	if err != nil {
 		//log.Printf("Error occurred in NewAuthorizeRequest: %+v", err)
 		//log.Println(err.(*errors.withStack).Cause())
@@ -42,20 +43,24 @@ func WriteIntrospectionResponse(rw http.ResponseWriter, r fosite.IntrospectionRe
 	type s interface {
 		GetUserID() string
 		GetEmail() string
+		GetRoles() []string
+		GetPermissions() []string
 	}
 
 	rw.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(rw).Encode(struct {
-		Active    bool     `json:"active"`
-		ClientID  string   `json:"client_id,omitempty"`
-		Scope     string   `json:"scope,omitempty"`
-		Audience  []string `json:"aud,omitempty"`
-		ExpiresAt int64    `json:"exp,omitempty"`
-		IssuedAt  int64    `json:"iat,omitempty"`
-		Subject   string   `json:"sub,omitempty"`
-		Username  string   `json:"username,omitempty"`
-		Email     string   `json:"email"`
-		UserId    string   `json:"user_id"`
+		Active      bool     `json:"active"`
+		ClientID    string   `json:"client_id,omitempty"`
+		Scope       string   `json:"scope,omitempty"`
+		Audience    []string `json:"aud,omitempty"`
+		ExpiresAt   int64    `json:"exp,omitempty"`
+		IssuedAt    int64    `json:"iat,omitempty"`
+		Subject     string   `json:"sub,omitempty"`
+		Username    string   `json:"username,omitempty"`
+		Email       string   `json:"email"`
+		UserId      string   `json:"user_id"`
+		Roles       []string `json:"roles,omitempty"`
+		Permissions []string `json:"permissions,omitempty"`
 		// Session is not included per default because it might expose sensitive information.
 	}{
 		Active:    true,
@@ -67,8 +72,10 @@ func WriteIntrospectionResponse(rw http.ResponseWriter, r fosite.IntrospectionRe
 		Audience:  r.GetAccessRequester().GetGrantedAudience(),
 		Username:  r.GetAccessRequester().GetSession().GetUsername(),
 		// Session is not included because it might expose sensitive information.
-		Email:  r.GetAccessRequester().GetSession().(s).GetEmail(),
-		UserId: r.GetAccessRequester().GetSession().(s).GetUserID(),
+		Email:       r.GetAccessRequester().GetSession().(s).GetEmail(),
+		UserId:      r.GetAccessRequester().GetSession().(s).GetUserID(),
+		Roles:       r.GetAccessRequester().GetSession().(s).GetRoles(),
+		Permissions: r.GetAccessRequester().GetSession().(s).GetPermissions(),
 	})
 }
 
@@ -0,0 +1,88 @@
+package oauth2
+
+// Brute-force protection of the password grant.
+// Failed attempts are counted per account and per IP address,
+// see secure.Lockout for the backoff and lockout rules.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/baozhenglab/oauth-service/clientip"
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+var ErrAccountLocked = &fosite.RFC6749Error{
+	Name:        common.ErrAccountLocked.Key(),
+	Description: common.ErrAccountLocked.Error(),
+	Code:        http.StatusTooManyRequests,
+}
+
+var ErrTooManyLoginAttempts = &fosite.RFC6749Error{
+	Name:        common.ErrTooManyLoginAttempts.Key(),
+	Description: common.ErrTooManyLoginAttempts.Error(),
+	Code:        http.StatusTooManyRequests,
+}
+
+// lockout is the brute-force protection of the config given to InitOAuth2Provider
+var lockout *secure.Lockout
+
+func loginLockKeys(ctx context.Context, clientId, username string) []string {
+	keys := []string{secure.AccountLockKey(clientId, username)}
+
+	if ip := clientip.FromContext(ctx); ip != "" {
+		keys = append(keys, secure.IPLockKey(ip))
+	}
+
+	return keys
+}
+
+// checkLockout refuses the password check when the account or the IP address is blocked
+func checkLockout(ctx context.Context, keys []string) error {
+	if lockout == nil {
+		return nil
+	}
+
+	state, err := lockout.Check(ctx, keys...)
+	if err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+	}
+
+	if state == nil {
+		return nil
+	}
+
+	hint := fmt.Sprintf("Retry in %d seconds.", int(state.RetryAfter.Seconds())+1)
+	if state.Locked {
+		return errors.WithStack(ErrAccountLocked.WithHint(hint))
+	}
+
+	return errors.WithStack(ErrTooManyLoginAttempts.WithHint(hint))
+}
+
+func recordLoginFailure(ctx context.Context, keys []string) {
+	if lockout == nil {
+		return
+	}
+
+	if err := lockout.Fail(ctx, keys...); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in recording a failed login")
+	}
+}
+
+// recordLoginSuccess clears the account counter, the IP counter is kept
+// so an attacker cannot reset it with an account of its own
+func recordLoginSuccess(ctx context.Context, keys []string) {
+	if lockout == nil {
+		return
+	}
+
+	if err := lockout.Reset(ctx, keys[0]); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in resetting the failed logins")
+	}
+}
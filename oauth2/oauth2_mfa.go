@@ -0,0 +1,150 @@
+package oauth2
+
+// Multi-factor authentication of the password and social logins.
+// When the user is enrolled in MFA, the first factor answers an "mfa_required" error with an MFA token,
+// the token is exchanged with a TOTP code, or a recovery code when the authenticator is lost:
+//   - by the password grant: grant_type=mfa-otp&mfa_token=...&code=... (or &recovery_code=...)
+//   - by the hosted login: POST /oauth2/login-mfa
+// The logins through a connector ask the code on a page of the connector instead (see ConnectorMFAHandler).
+// With remember_device=true the response has a device token, also set as the mfa_device cookie.
+// The second factor is skipped while the device token is given back with the password (device_token or the cookie).
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
+	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/gin-gonic/gin"
+)
+
+// MFAOTPGrantType exchanges an MFA token and a TOTP code for an access token
+const MFAOTPGrantType = "mfa-otp"
+
+// MFAStorage is optionally implemented by the grant storage to support the second step of the password grant
+type MFAStorage interface {
+	VerifyMFA(ctx context.Context, userID string, code string) (UserCredential, error)
+}
+
+// RecoveryCodeStorage is optionally implemented by the grant storage to accept the recovery codes in the second step
+type RecoveryCodeStorage interface {
+	UseRecoveryCode(ctx context.Context, userID string, code string) (UserCredential, error)
+}
+
+// TrustedDeviceStorage is optionally implemented by the grant storage to remember the devices after the second step
+type TrustedDeviceStorage interface {
+	AddTrustedDevice(ctx context.Context, device *model.TrustedDevice) error
+	TouchTrustedDevice(ctx context.Context, userID, deviceID string) (bool, error)
+}
+
+// trustedDeviceCookie keeps the device token in the browsers
+const trustedDeviceCookie = "mfa_device"
+
+// mfaUser is implemented by the users which can be enrolled in MFA
+type mfaUser interface {
+	HasMFA() bool
+}
+
+var (
+	mfaAES              *secure.AES
+	mfaTokenTTL         time.Duration
+	mfaTrustedDeviceTTL time.Duration
+	trustedDevices      TrustedDeviceStorage
+)
+
+// MFARequiredError stops a password login until the TOTP code is given with Token
+type MFARequiredError struct {
+	Token string
+}
+
+func (e *MFARequiredError) Error() string {
+	return common.ErrMFARequired.Error()
+}
+
+func newMFARequiredError(userID, clientID string) error {
+	token, err := secure.IssueMFAToken(mfaAES, userID, clientID, mfaTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	return &MFARequiredError{Token: token}
+}
+
+func writeMFARequired(c *gin.Context, err *MFARequiredError) {
+	c.JSON(http.StatusForbidden, gin.H{
+		"error":             "mfa_required",
+		"error_description": err.Error(),
+		"mfa_token":         err.Token,
+	})
+}
+
+// challengeMFA answers mfa_required when the user is enrolled in MFA and the device is not trusted,
+// it returns false when the login must stop there
+func challengeMFA(c *gin.Context, user *model.User, clientID, deviceToken string) bool {
+	if !user.HasMFA() || isTrustedDevice(c.Request.Context(), user.UserId, requestDeviceToken(c, deviceToken)) {
+		return true
+	}
+
+	err := newMFARequiredError(user.UserId, clientID)
+	if mfaErr, ok := err.(*MFARequiredError); ok {
+		writeMFARequired(c, mfaErr)
+		return false
+	}
+
+	cErr := sdkcmn.ErrInvalidRequest(err)
+	c.JSON(cErr.StatusCode, cErr)
+	return false
+}
+
+// requestDeviceToken returns the device token given in the request, or kept in the cookie
+func requestDeviceToken(c *gin.Context, token string) string {
+	if token != "" {
+		return token
+	}
+
+	token, _ = c.Cookie(trustedDeviceCookie)
+	return token
+}
+
+func setTrustedDeviceCookie(c *gin.Context, token string) {
+	c.SetCookie(trustedDeviceCookie, token, int(mfaTrustedDeviceTTL.Seconds()), "/", "", c.Request.TLS != nil, true)
+}
+
+// isTrustedDevice checks a device token against the devices of the user
+func isTrustedDevice(ctx context.Context, userID, token string) bool {
+	if trustedDevices == nil {
+		return false
+	}
+
+	device, ok := secure.ParseDeviceToken(mfaAES, token, userID)
+	if !ok {
+		return false
+	}
+
+	trusted, err := trustedDevices.TouchTrustedDevice(ctx, userID, device.DeviceId)
+	return err == nil && trusted
+}
+
+// trustDevice remembers a device of the user, it returns an empty token when the trusted devices are disabled
+func trustDevice(ctx context.Context, userID, clientID, name string) (string, error) {
+	if trustedDevices == nil || mfaTrustedDeviceTTL <= 0 {
+		return "", nil
+	}
+
+	device := &model.TrustedDevice{
+		DeviceId:  secure.GenerateDeviceId(),
+		UserId:    userID,
+		ClientId:  clientID,
+		Name:      name,
+		ExpiredAt: time.Now().UTC().Add(mfaTrustedDeviceTTL),
+	}
+
+	if err := trustedDevices.AddTrustedDevice(ctx, device); err != nil {
+		return "", err
+	}
+
+	return secure.IssueDeviceToken(mfaAES, device.DeviceId, userID, device.ExpiredAt)
+}
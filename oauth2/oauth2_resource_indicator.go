@@ -0,0 +1,191 @@
+package oauth2
+
+// This file implements Resource Indicators for OAuth 2.0 (https://tools.ietf.org/html/rfc8707)
+// The "resource" parameter is checked against the client audience whitelist
+// and granted as the audience of the token, so it ends up in the JWT "aud" claim
+// and in the introspection response.
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	foauth2 "github.com/ory/fosite/handler/oauth2"
+	"github.com/pkg/errors"
+)
+
+const resourceParameter = "resource"
+
+var ErrInvalidTarget = &fosite.RFC6749Error{
+	Name:        "invalid_target",
+	Description: "The requested resource is invalid, missing, unknown, or malformed",
+	Code:        http.StatusBadRequest,
+}
+
+// requestedResources returns all "resource" values of a request form.
+// Each value must be an absolute URI without a fragment component.
+func requestedResources(form url.Values) (fosite.Arguments, error) {
+	var resources fosite.Arguments
+
+	for _, r := range form[resourceParameter] {
+		if r == "" {
+			continue
+		}
+
+		u, err := url.Parse(r)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return nil, errors.WithStack(ErrInvalidTarget.WithHintf(`Resource "%s" must be an absolute URI without a fragment.`, r))
+		}
+
+		if !resources.Has(r) {
+			resources = append(resources, r)
+		}
+	}
+
+	return resources, nil
+}
+
+// grantResources validates the requested resources against the client audience and grants them.
+// It is used at the authorization endpoint and for grants which have no previous authorization
+// (password, client_credentials).
+func grantResources(ar fosite.Requester) error {
+	resources, err := requestedResources(ar.GetRequestForm())
+	if err != nil {
+		return err
+	}
+
+	if len(resources) == 0 {
+		return nil
+	}
+
+	if err := oauth2.(tracedProvider).AudienceMatchingStrategy(ar.GetClient().GetAudience(), resources); err != nil {
+		return errors.WithStack(ErrInvalidTarget.WithHint("The OAuth 2.0 Client is not allowed to request the resource.").WithDebug(err.Error()))
+	}
+
+	requested := ar.GetRequestedAudience()
+	for _, r := range resources {
+		if !requested.Has(r) {
+			requested = append(requested, r)
+		}
+		ar.GrantAudience(r)
+	}
+	ar.SetRequestedAudience(requested)
+
+	return nil
+}
+
+// narrowResources restricts the audience of a token issued from a refresh token to the requested resources.
+// A resource which has not been granted by the original authorization is refused.
+func narrowResources(ar *fosite.AccessRequest) error {
+	resources, err := requestedResources(ar.GetRequestForm())
+	if err != nil {
+		return err
+	}
+
+	if len(resources) == 0 {
+		return nil
+	}
+
+	if err := checkGranted(ar.GetGrantedAudience(), resources); err != nil {
+		return err
+	}
+
+	ar.SetRequestedAudience(resources)
+	ar.GrantedAudience = resources
+
+	return nil
+}
+
+func checkGranted(granted, resources fosite.Arguments) error {
+	for _, r := range resources {
+		if !granted.Has(r) {
+			return errors.WithStack(ErrInvalidTarget.WithHintf(`Resource "%s" has not been granted by the original authorization.`, r))
+		}
+	}
+
+	return nil
+}
+
+// ResourceAuthorizeExplicitFactory creates the authorization code grant handler of fosite,
+// with the audience of the tokens narrowed to the requested resources
+func ResourceAuthorizeExplicitFactory(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
+	return &ResourceAuthorizeExplicitGrantHandler{
+		compose.OAuth2AuthorizeExplicitFactory(config, storage, strategy).(*foauth2.AuthorizeExplicitGrantHandler),
+	}
+}
+
+// ResourceAuthorizeExplicitGrantHandler narrows the audience of the authorization_code grant.
+// fosite grants the audience of the authorize request while it issues the tokens,
+// so the narrowing is done on the authorize request it reads from the storage.
+type ResourceAuthorizeExplicitGrantHandler struct {
+	*foauth2.AuthorizeExplicitGrantHandler
+}
+
+// HandleTokenEndpointRequest refuses the resources which have not been granted by the authorize request
+func (c *ResourceAuthorizeExplicitGrantHandler) HandleTokenEndpointRequest(ctx context.Context, request fosite.AccessRequester) error {
+	if err := c.AuthorizeExplicitGrantHandler.HandleTokenEndpointRequest(ctx, request); err != nil {
+		return err
+	}
+
+	resources, err := requestedResources(request.GetRequestForm())
+	if err != nil || len(resources) == 0 {
+		return err
+	}
+
+	signature := c.AuthorizeCodeStrategy.AuthorizeCodeSignature(request.GetRequestForm().Get("code"))
+	authorizeRequest, err := c.CoreStorage.GetAuthorizeCodeSession(ctx, signature, request.GetSession())
+	if err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+	}
+
+	if err := checkGranted(authorizeRequest.GetGrantedAudience(), resources); err != nil {
+		return err
+	}
+
+	request.SetRequestedAudience(resources)
+
+	return nil
+}
+
+// PopulateTokenEndpointResponse issues the tokens for the requested resources only
+func (c *ResourceAuthorizeExplicitGrantHandler) PopulateTokenEndpointResponse(ctx context.Context, requester fosite.AccessRequester, responder fosite.AccessResponder) error {
+	resources, err := requestedResources(requester.GetRequestForm())
+	if err != nil {
+		return err
+	}
+
+	if len(resources) == 0 || !requester.GetGrantTypes().Exact("authorization_code") {
+		return c.AuthorizeExplicitGrantHandler.PopulateTokenEndpointResponse(ctx, requester, responder)
+	}
+
+	narrowed := *c.AuthorizeExplicitGrantHandler
+	narrowed.CoreStorage = narrowedCodeStorage{CoreStorage: c.CoreStorage, audience: resources}
+
+	return narrowed.PopulateTokenEndpointResponse(ctx, requester, responder)
+}
+
+// narrowedCodeStorage reads the authorize requests with the given audience as granted audience
+type narrowedCodeStorage struct {
+	foauth2.CoreStorage
+	audience fosite.Arguments
+}
+
+func (s narrowedCodeStorage) GetAuthorizeCodeSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	ar, err := s.CoreStorage.GetAuthorizeCodeSession(ctx, signature, session)
+	if err != nil {
+		return ar, err
+	}
+
+	return narrowedRequester{Requester: ar, audience: s.audience}, nil
+}
+
+type narrowedRequester struct {
+	fosite.Requester
+	audience fosite.Arguments
+}
+
+func (r narrowedRequester) GetGrantedAudience() fosite.Arguments {
+	return r.audience
+}
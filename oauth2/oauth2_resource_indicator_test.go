@@ -0,0 +1,206 @@
+package oauth2
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/storage"
+)
+
+const (
+	resourceA         = "https://a.example.com"
+	resourceB         = "https://b.example.com"
+	resourceClientURI = "https://client.example.com/callback"
+)
+
+func newResourceProvider(t *testing.T) fosite.OAuth2Provider {
+	t.Helper()
+
+	config := &compose.Config{HashCost: 4}
+	secret, err := (&fosite.BCrypt{WorkFactor: 4}).Hash(context.Background(), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := storage.NewMemoryStore()
+	store.Clients["client"] = &fosite.DefaultClient{
+		ID:            "client",
+		Secret:        secret,
+		RedirectURIs:  []string{resourceClientURI},
+		ResponseTypes: []string{"code"},
+		GrantTypes:    []string{"authorization_code", "refresh_token"},
+		Scopes:        []string{"offline"},
+		Audience:      []string{resourceA, resourceB},
+	}
+
+	return compose.Compose(
+		config,
+		store,
+		compose.NewOAuth2HMACStrategy(config, []byte("some-secret-of-thirty-two-bytes!"), nil),
+		nil,
+		ResourceAuthorizeExplicitFactory,
+		compose.OAuth2RefreshTokenGrantFactory,
+		compose.OAuth2TokenIntrospectionFactory,
+	)
+}
+
+// authorizeCode returns a code granting both resources
+func authorizeCode(t *testing.T, provider fosite.OAuth2Provider) string {
+	t.Helper()
+	ctx := context.Background()
+
+	req, _ := http.NewRequest(http.MethodGet, "/oauth2/auth?"+url.Values{
+		"client_id":     {"client"},
+		"response_type": {"code"},
+		"redirect_uri":  {resourceClientURI},
+		"state":         {"some-long-state"},
+		"scope":         {"offline"},
+	}.Encode(), nil)
+
+	ar, err := provider.NewAuthorizeRequest(ctx, req)
+	if err != nil {
+		t.Fatalf("NewAuthorizeRequest: %+v", err)
+	}
+
+	ar.GrantScope("offline")
+	ar.GrantAudience(resourceA)
+	ar.GrantAudience(resourceB)
+
+	resp, err := provider.NewAuthorizeResponse(ctx, ar, &fosite.DefaultSession{Subject: "1"})
+	if err != nil {
+		t.Fatalf("NewAuthorizeResponse: %+v", err)
+	}
+
+	return resp.GetCode()
+}
+
+// exchange runs a token request, the granted audience of the access token is returned
+func exchange(t *testing.T, provider fosite.OAuth2Provider, form url.Values) (fosite.Arguments, string, error) {
+	t.Helper()
+	ctx := context.Background()
+
+	req, _ := http.NewRequest(http.MethodPost, "/oauth2/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("client", "secret")
+
+	ar, err := provider.NewAccessRequest(ctx, req, &fosite.DefaultSession{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if ar.GetGrantTypes().Exact("refresh_token") {
+		if err := narrowResources(ar.(*fosite.AccessRequest)); err != nil {
+			return nil, "", err
+		}
+	}
+
+	resp, err := provider.NewAccessResponse(ctx, ar)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, token, err := provider.IntrospectToken(ctx, resp.GetAccessToken(), fosite.AccessToken, &fosite.DefaultSession{})
+	if err != nil {
+		t.Fatalf("IntrospectToken: %+v", err)
+	}
+
+	refresh, _ := resp.GetExtra("refresh_token").(string)
+	return token.GetGrantedAudience(), refresh, nil
+}
+
+func isInvalidTarget(err error) bool {
+	return err != nil && fosite.ErrorToRFC6749Error(err).Name == ErrInvalidTarget.Name
+}
+
+func sameArguments(got fosite.Arguments, want ...string) bool {
+	return len(got) == len(want) && got.Has(want...)
+}
+
+func TestAuthorizationCodeWithoutResource(t *testing.T) {
+	provider := newResourceProvider(t)
+
+	audience, _, err := exchange(t, provider, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorizeCode(t, provider)},
+		"redirect_uri": {resourceClientURI},
+	})
+	if err != nil {
+		t.Fatalf("exchange: %+v", err)
+	}
+
+	if !sameArguments(audience, resourceA, resourceB) {
+		t.Errorf("audience = %v, want both resources", audience)
+	}
+}
+
+func TestAuthorizationCodeNarrowsToResource(t *testing.T) {
+	provider := newResourceProvider(t)
+
+	audience, refresh, err := exchange(t, provider, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorizeCode(t, provider)},
+		"redirect_uri": {resourceClientURI},
+		"resource":     {resourceA},
+	})
+	if err != nil {
+		t.Fatalf("exchange: %+v", err)
+	}
+
+	if !sameArguments(audience, resourceA) {
+		t.Errorf("audience = %v, want %s only", audience, resourceA)
+	}
+
+	// a refresh token cannot widen the audience again
+	if _, _, err := exchange(t, provider, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refresh},
+		"resource":      {resourceB},
+	}); !isInvalidTarget(err) {
+		t.Errorf("refresh with a resource not granted: err = %v, want invalid_target", err)
+	}
+}
+
+func TestAuthorizationCodeRefusesResourceNotGranted(t *testing.T) {
+	provider := newResourceProvider(t)
+
+	_, _, err := exchange(t, provider, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorizeCode(t, provider)},
+		"redirect_uri": {resourceClientURI},
+		"resource":     {"https://c.example.com"},
+	})
+	if !isInvalidTarget(err) {
+		t.Errorf("err = %v, want invalid_target", err)
+	}
+}
+
+func TestRefreshTokenNarrowsToResource(t *testing.T) {
+	provider := newResourceProvider(t)
+
+	_, refresh, err := exchange(t, provider, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorizeCode(t, provider)},
+		"redirect_uri": {resourceClientURI},
+	})
+	if err != nil {
+		t.Fatalf("exchange: %+v", err)
+	}
+
+	audience, _, err := exchange(t, provider, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refresh},
+		"resource":      {resourceB},
+	})
+	if err != nil {
+		t.Fatalf("refresh: %+v", err)
+	}
+
+	if !sameArguments(audience, resourceB) {
+		t.Errorf("audience = %v, want %s only", audience, resourceB)
+	}
+}
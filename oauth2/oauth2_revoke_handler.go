@@ -1,17 +1,48 @@
 package oauth2
 
 import (
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
 	"github.com/gin-gonic/gin"
 	"github.com/ory/fosite"
 )
 
-func RevokeHandler(c *gin.Context) {
-	// This context will be passed to all methods.
-	ctx := fosite.NewContext()
+// RevokeHandler revokes an access or refresh token of the client (RFC 7009),
+// the webhooks of the client are told when the token of an user is revoked
+func RevokeHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		// This context will be passed to all methods.
+		ctx := c.Request.Context()
 
-	// This will accept the token revocation request and validate various parameters.
-	err := oauth2.NewRevocationRequest(ctx, c.Request)
+		// the user of the token is read before the token is gone
+		uid := revokedUserId(c)
 
-	// All done, send the response.
-	oauth2.WriteRevocationResponse(c.Writer, err)
+		// This will accept the token revocation request and validate various parameters.
+		err := oauth2.NewRevocationRequest(ctx, c.Request)
+		recordAudit(c, &model.AuditEvent{Type: model.AuditTokenRevoked, SubjectId: uid}, err)
+
+		if err == nil && uid != "" {
+			if err := ur.TokenRevoked(ctx, uid); err != nil {
+				logging.FromContext(ctx).WithError(err).Error("Error occurred in announcing a revoked token")
+			}
+		}
+
+		// All done, send the response.
+		oauth2.WriteRevocationResponse(c.Writer, err)
+	}
+}
+
+// revokedUserId is the user of the token of a revocation request, empty for the tokens of a client
+func revokedUserId(c *gin.Context) string {
+	tokenType := fosite.AccessToken
+	if c.PostForm("token_type_hint") == "refresh_token" {
+		tokenType = fosite.RefreshToken
+	}
+
+	_, ar, err := oauth2.IntrospectToken(c.Request.Context(), c.PostForm("token"), tokenType, newSession("introspect"))
+	if err != nil {
+		return ""
+	}
+
+	return sessionUserID(ar)
 }
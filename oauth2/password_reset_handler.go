@@ -0,0 +1,62 @@
+package oauth2
+
+import (
+	"net/http"
+
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/gin-gonic/gin"
+)
+
+// ForgotPasswordHandler sends a reset token to the email or the phone of an user of the client.
+// The response is the same whether the user exists or not.
+func ForgotPasswordHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		cid, _ := c.Get("client_id")
+
+		var p model.ForgotPassword
+		if err := c.ShouldBind(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		p.ClientId = cid.(string)
+
+		err := ur.ForgotPassword(c.Request.Context(), &p)
+		recordAudit(c, &model.AuditEvent{Type: model.AuditPasswordReset, Detail: "requested"}, err)
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse("ok"))
+	}
+}
+
+// ResetPasswordHandler sets the new password with the reset token, the tokens of the user are revoked
+func ResetPasswordHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		cid, _ := c.Get("client_id")
+
+		var p model.PasswordReset
+		if err := c.ShouldBind(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		p.ClientId = cid.(string)
+
+		err := ur.ResetPassword(c.Request.Context(), &p)
+		recordAudit(c, &model.AuditEvent{Type: model.AuditPasswordReset}, err)
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse("ok"))
+	}
+}
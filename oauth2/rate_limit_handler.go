@@ -0,0 +1,113 @@
+package oauth2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/baozhenglab/oauth-service/clientip"
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/secure"
+	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitMiddleware limits the requests of a route with token buckets keyed by client and IP address
+// (behind the trusted proxies, see clientip),
+// and by client and target user when the request names one (username, email, phone or the :id parameter).
+// It must be used after CheckTokenMiddleware when the route requires a token.
+func RateLimitMiddleware(store secure.RateLimitStore, route string, limit secure.RateLimit) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if !limit.Enabled() {
+			c.Next()
+			return
+		}
+
+		clientId := rateLimitClientId(c)
+		keys := []string{fmt.Sprintf("rl:%s:%s:ip:%s", route, clientId, clientip.Get(c))}
+
+		if user := rateLimitTargetUser(c); user != "" {
+			keys = append(keys, fmt.Sprintf("rl:%s:%s:user:%s", route, clientId, user))
+		}
+
+		for _, key := range keys {
+			wait, err := store.Take(c.Request.Context(), key, limit)
+			if err != nil {
+				// the limits must not take the service down with their storage
+				logging.FromContext(c.Request.Context()).WithError(err).Error("Error occurred in rate limiting")
+				continue
+			}
+
+			if wait > 0 {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+
+				cErr := sdkcmn.ErrCustom(nil, common.ErrTooManyRequests)
+				cErr.StatusCode = http.StatusTooManyRequests
+				c.AbortWithStatusJSON(cErr.StatusCode, cErr)
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+func rateLimitClientId(c *gin.Context) string {
+	if cid, ok := c.Get("client_id"); ok {
+		return cid.(string)
+	}
+
+	if clientId, _, ok := c.Request.BasicAuth(); ok {
+		return clientId
+	}
+
+	return c.PostForm("client_id")
+}
+
+// rateLimitTargetUser returns the user a request is about, the body is left untouched for the handler
+func rateLimitTargetUser(c *gin.Context) string {
+	if id := c.Param("id"); id != "" {
+		return id
+	}
+
+	fields := []string{"username", "email", "phone"}
+
+	if c.ContentType() != gin.MIMEJSON {
+		for _, field := range fields {
+			if v := strings.TrimSpace(c.PostForm(field)); v != "" {
+				return strings.ToLower(v)
+			}
+		}
+
+		return ""
+	}
+
+	if c.Request.Body == nil {
+		return ""
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return ""
+	}
+
+	for _, field := range fields {
+		if v, ok := data[field].(string); ok && strings.TrimSpace(v) != "" {
+			return strings.ToLower(strings.TrimSpace(v))
+		}
+	}
+
+	return ""
+}
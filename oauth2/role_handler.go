@@ -0,0 +1,113 @@
+package oauth2
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/gin-gonic/gin"
+)
+
+// Role management, these handlers must be protected by the root scope.
+// Roles belong to the client given by the client_id parameter, default to the client of the access token.
+
+func roleClientId(c *gin.Context) string {
+	if clientId := strings.TrimSpace(c.Query("client_id")); clientId != "" {
+		return clientId
+	}
+
+	if clientId := strings.TrimSpace(c.PostForm("client_id")); clientId != "" {
+		return clientId
+	}
+
+	cid, _ := c.Get("client_id")
+	return cid.(string)
+}
+
+func ListRolesHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		roles, err := ur.ListRoles(c.Request.Context(), roleClientId(c))
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(roles))
+	}
+}
+
+// Create a role or replace its permissions
+func SaveRoleHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var role model.Role
+		if err := c.ShouldBind(&role); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		if role.ClientId == "" {
+			role.ClientId = roleClientId(c)
+		}
+
+		if err := ur.SaveRole(c.Request.Context(), &role); err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(role))
+	}
+}
+
+func FindUserRolesHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		access, err := ur.GetUserAccess(c.Request.Context(), roleClientId(c), c.Param("id"))
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(access))
+	}
+}
+
+func AssignRoleHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		type param struct {
+			Role string `json:"role" form:"role"`
+		}
+
+		var p param
+		if err := c.ShouldBind(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		err := ur.AssignRole(c.Request.Context(), roleClientId(c), c.Param("id"), strings.TrimSpace(p.Role))
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse("ok"))
+	}
+}
+
+func UnassignRoleHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		err := ur.UnassignRole(c.Request.Context(), roleClientId(c), c.Param("id"), c.Param("role"))
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse("ok"))
+	}
+}
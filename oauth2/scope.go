@@ -0,0 +1,105 @@
+package oauth2
+
+import (
+	"context"
+	"strings"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/ory/fosite"
+)
+
+// RootScope grants access to the administration endpoints
+const RootScope = "root"
+
+// ScopeStorage gives access to the scope catalog
+type ScopeStorage interface {
+	// GetScopes returns the catalog entries of names, or the whole catalog when names is empty
+	GetScopes(ctx context.Context, names ...string) ([]model.Scope, error)
+	CreateScope(ctx context.Context, scope *model.Scope) error
+}
+
+// scopeStorage is the catalog of the store given to InitOAuth2Provider, nil if the store has no catalog
+var scopeStorage ScopeStorage
+
+func scopeStrategy() fosite.ScopeStrategy {
+	return oauth2.(tracedProvider).ScopeStrategy
+}
+
+// ValidateScopes refuses scopes which are not defined in the catalog.
+// A scope is known when the catalog contains it, or when it covers a catalog scope
+// with the configured scope strategy (e.g. "photos.*" with the wildcard strategy).
+func ValidateScopes(ctx context.Context, ss ScopeStorage, scopes []string) error {
+	if len(scopes) == 0 {
+		return nil
+	}
+
+	catalog, err := ss.GetScopes(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range scopes {
+		known := false
+		for _, s := range catalog {
+			if s.Name == scope || scopeStrategy()([]string{scope}, s.Name) {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			err := common.ErrUnknownScope
+			return sdkcm.ErrInvalidRequestWithMessage(err, err.Error()+": "+scope)
+		}
+	}
+
+	return nil
+}
+
+// describeScopes returns the catalog entries of the given scopes by name.
+func describeScopes(ctx context.Context, scopes []string) map[string]model.Scope {
+	result := map[string]model.Scope{}
+
+	if scopeStorage == nil || len(scopes) == 0 {
+		return result
+	}
+
+	catalog, err := scopeStorage.GetScopes(ctx, scopes...)
+	if err != nil {
+		return result
+	}
+
+	for _, s := range catalog {
+		result[s.Name] = s
+	}
+
+	return result
+}
+
+// requestDefaultScopes requests the default catalog scopes the client is allowed to use,
+// when the request does not contain any scope.
+func requestDefaultScopes(ctx context.Context, ar fosite.Requester) {
+	if scopeStorage == nil || len(ar.GetRequestedScopes()) > 0 {
+		return
+	}
+
+	catalog, err := scopeStorage.GetScopes(ctx)
+	if err != nil {
+		return
+	}
+
+	var scopes fosite.Arguments
+	for _, s := range catalog {
+		if s.IsDefault && scopeStrategy()(ar.GetClient().GetScopes(), s.Name) {
+			scopes = append(scopes, s.Name)
+		}
+	}
+
+	ar.SetRequestedScopes(scopes)
+}
+
+func normalizeScope(scope string) string {
+	return strings.Join(strings.Fields(scope), " ")
+}
@@ -3,8 +3,10 @@ package storage
 import (
 	"context"
 
+	"github.com/baozhenglab/oauth-service/metrics"
 	"github.com/baozhenglab/oauth-service/oauth2"
 	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/tracing"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/ory/fosite"
@@ -15,6 +17,23 @@ const (
 	UsersCollection        = "users"
 	AuthCodesCollection    = "authorize_codes"
 	AccessTokensCollection = "access_tokens"
+	ScopesCollection       = "scopes"
+	RolesCollection        = "roles"
+	UserRolesCollection    = "user_roles"
+
+	PasswordHistoriesCollection = "password_histories"
+	LoginAttemptsCollection     = "login_attempts"
+	RateLimitsCollection        = "rate_limits"
+
+	WebAuthnCredentialsCollection = "webauthn_credentials"
+	MFARecoveryCodesCollection    = "mfa_recovery_codes"
+	TrustedDevicesCollection      = "trusted_devices"
+
+	UserIdentitiesCollection = "user_identities"
+	AuditEventsCollection    = "audit_events"
+
+	WebhooksCollection     = "webhooks"
+	OutboxEventsCollection = "outbox_events"
 )
 
 type MgoConnectionManage interface {
@@ -45,7 +64,9 @@ type AuthorizeCode struct {
 	MgoModel  `bson:",inline"`
 }
 
-func (store *mongoStore) GetClient(_ context.Context, id string) (fosite.Client, error) {
+func (store *mongoStore) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "GetClient")()
+
 	s := store.s.GetSession()
 	defer s.Close()
 
@@ -57,7 +78,9 @@ func (store *mongoStore) GetClient(_ context.Context, id string) (fosite.Client,
 	return clientMongo.toClient(), nil
 }
 
-func (store *mongoStore) CreateAuthorizeCodeSession(_ context.Context, code string, req fosite.Requester) error {
+func (store *mongoStore) CreateAuthorizeCodeSession(ctx context.Context, code string, req fosite.Requester) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "CreateAuthorizeCodeSession")()
+
 	s := store.s.GetSession()
 	defer s.Close()
 
@@ -76,7 +99,9 @@ func (store *mongoStore) CreateAuthorizeCodeSession(_ context.Context, code stri
 	return nil
 }
 
-func (store *mongoStore) GetAuthorizeCodeSession(_ context.Context, code string, session fosite.Session) (fosite.Requester, error) {
+func (store *mongoStore) GetAuthorizeCodeSession(ctx context.Context, code string, session fosite.Session) (fosite.Requester, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "GetAuthorizeCodeSession")()
+
 	s := store.s.GetSession()
 	defer s.Close()
 
@@ -86,7 +111,7 @@ func (store *mongoStore) GetAuthorizeCodeSession(_ context.Context, code string,
 		return nil, err
 	}
 
-	req, err := authorizeCode.Requester.toRequester(store.eas, session, ClientManager(store))
+	req, err := authorizeCode.Requester.toRequester(ctx, store.eas, session, ClientManager(store))
 
 	if err != nil {
 		return nil, err
@@ -100,6 +125,8 @@ func (store *mongoStore) GetAuthorizeCodeSession(_ context.Context, code string,
 }
 
 func (store *mongoStore) InvalidateAuthorizeCodeSession(ctx context.Context, code string) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "InvalidateAuthorizeCodeSession")()
+
 	s := store.s.GetSession()
 	defer s.Close()
 
@@ -114,7 +141,9 @@ func (store *mongoStore) InvalidateAuthorizeCodeSession(ctx context.Context, cod
 	return nil
 }
 
-func (store *mongoStore) DeleteAuthorizeCodeSession(_ context.Context, code string) error {
+func (store *mongoStore) DeleteAuthorizeCodeSession(ctx context.Context, code string) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "DeleteAuthorizeCodeSession")()
+
 	s := store.s.GetSession()
 	defer s.Close()
 
@@ -145,14 +174,20 @@ func (store *mongoStore) DeleteAuthorizeCodeSession(_ context.Context, code stri
 //}
 
 func (store *mongoStore) CreateAccessTokenSession(ctx context.Context, signature string, req fosite.Requester) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "CreateAccessTokenSession")()
+
 	return store.createToken(ctx, signature, req, fosite.AccessToken)
 }
 
 func (store *mongoStore) GetAccessTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "GetAccessTokenSession")()
+
 	return store.getTokenSession(ctx, signature, session)
 }
 
-func (store *mongoStore) DeleteAccessTokenSession(_ context.Context, signature string) error {
+func (store *mongoStore) DeleteAccessTokenSession(ctx context.Context, signature string) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "DeleteAccessTokenSession")()
+
 	s := store.s.GetSession()
 	defer s.Close()
 
@@ -161,14 +196,20 @@ func (store *mongoStore) DeleteAccessTokenSession(_ context.Context, signature s
 }
 
 func (store *mongoStore) CreateRefreshTokenSession(ctx context.Context, signature string, req fosite.Requester) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "CreateRefreshTokenSession")()
+
 	return store.createToken(ctx, signature, req, fosite.RefreshToken)
 }
 
 func (store *mongoStore) GetRefreshTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "GetRefreshTokenSession")()
+
 	return store.getTokenSession(ctx, signature, session)
 }
 
-func (store *mongoStore) DeleteRefreshTokenSession(_ context.Context, signature string) error {
+func (store *mongoStore) DeleteRefreshTokenSession(ctx context.Context, signature string) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "DeleteRefreshTokenSession")()
+
 	s := store.s.GetSession()
 	defer s.Close()
 
@@ -179,12 +220,16 @@ func (store *mongoStore) DeleteRefreshTokenSession(_ context.Context, signature
 	return nil
 }
 
-func (store *mongoStore) CreateImplicitAccessTokenSession(_ context.Context, code string, req fosite.Requester) error {
+func (store *mongoStore) CreateImplicitAccessTokenSession(ctx context.Context, code string, req fosite.Requester) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "CreateImplicitAccessTokenSession")()
+
 	store.Implicit[code] = req
 	return nil
 }
 
-func (store *mongoStore) Authenticate(context context.Context, name string, secret string) (oauth2.UserCredential, error) {
+func (store *mongoStore) Authenticate(ctx context.Context, name string, secret string) (oauth2.UserCredential, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "Authenticate")()
+
 	s := store.s.GetSession()
 	defer s.Close()
 
@@ -196,25 +241,37 @@ func (store *mongoStore) Authenticate(context context.Context, name string, secr
 
 	u.UserId = u.PK.Hex()
 
-	passHash := secure.ComputeHmac256(secret, u.Salt, store.secretKey)
-	if passHash != u.Password {
+	if !secure.VerifyPassword(ctx, secret, u.Password, u.Salt, u.PasswordAlgo, store.secretKey) {
 		return nil, fosite.ErrNotFound
 	}
 
+	// Legacy hashes are replaced on the next successful login,
+	// a failure here must not prevent the user from logging in
+	if secure.PasswordNeedsRehash(u.PasswordAlgo) {
+		hash, salt, algo := secure.HashPassword(ctx, secret)
+		_ = s.DB("").C(UsersCollection).UpdateId(u.PK, bson.M{
+			"$set": bson.M{"password": hash, "salt": salt, "password_algo": algo},
+		})
+	}
+
 	u.Password = ""
 	u.Salt = ""
 	return u.User, nil
 }
 
 func (store *mongoStore) RevokeRefreshToken(ctx context.Context, requestID string) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "RevokeRefreshToken")()
+
 	return store.revoke(ctx, requestID)
 }
 
 func (store *mongoStore) RevokeAccessToken(ctx context.Context, requestID string) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "RevokeAccessToken")()
+
 	return store.revoke(ctx, requestID)
 }
 
-func (store *mongoStore) createToken(_ context.Context, signature string, req fosite.Requester, tkt fosite.TokenType) error {
+func (store *mongoStore) createToken(ctx context.Context, signature string, req fosite.Requester, tkt fosite.TokenType) error {
 	s := store.s.GetSession()
 	defer s.Close()
 
@@ -241,7 +298,7 @@ func (store *mongoStore) createToken(_ context.Context, signature string, req fo
 	return nil
 }
 
-func (store *mongoStore) getTokenSession(_ context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+func (store *mongoStore) getTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
 	s := store.s.GetSession()
 	defer s.Close()
 
@@ -251,7 +308,7 @@ func (store *mongoStore) getTokenSession(_ context.Context, signature string, se
 		return nil, fosite.ErrNotFound
 	}
 
-	req, err := atm.Requester.toRequester(store.eas, session, store)
+	req, err := atm.Requester.toRequester(ctx, store.eas, session, store)
 	if err != nil {
 		return nil, err
 	}
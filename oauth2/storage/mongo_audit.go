@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+)
+
+// AddAuditEvent appends an entry to the audit log
+func (store *mongoStore) AddAuditEvent(ctx context.Context, event *model.AuditEvent) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "AddAuditEvent")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	data := AuditEventMongo{AuditEvent: *event}
+	data.PrepareForInsert()
+
+	return errors.WithStack(s.DB("").C(AuditEventsCollection).Insert(&data))
+}
+
+// FindAuditEvents returns the entries of the filter, the newest first, and the cursor of the next page
+func (store *mongoStore) FindAuditEvents(ctx context.Context, filter *model.AuditFilter) ([]model.AuditEvent, *model.AuditCursor, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "FindAuditEvents")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	cond := bson.M{}
+
+	if filter.UserId != "" {
+		cond["$or"] = []bson.M{{"actor_id": filter.UserId}, {"subject_id": filter.UserId}}
+	}
+
+	if filter.ClientId != "" {
+		cond["client_id"] = filter.ClientId
+	}
+
+	if filter.Type != "" {
+		cond["type"] = filter.Type
+	}
+
+	occurred := bson.M{}
+	if filter.From != nil {
+		occurred["$gte"] = *filter.From
+	}
+
+	if filter.To != nil {
+		occurred["$lt"] = *filter.To
+	}
+
+	if len(occurred) > 0 {
+		cond["occurred_at"] = occurred
+	}
+
+	if filter.After != nil {
+		if !bson.IsObjectIdHex(filter.After.Id) {
+			return nil, nil, sdkcm.ErrCustom(nil, common.ErrAuditCursorInvalid)
+		}
+
+		// $and keeps the $or of the user
+		at := filter.After.OccurredAt
+		cond["$and"] = []bson.M{{"$or": []bson.M{
+			{"occurred_at": bson.M{"$lt": at}},
+			{"occurred_at": at, "_id": bson.M{"$lt": bson.ObjectIdHex(filter.After.Id)}},
+		}}}
+	}
+
+	var rows []AuditEventMongo
+	if err := s.DB("").C(AuditEventsCollection).Find(cond).Sort("-occurred_at", "-_id").Limit(filter.Limit).All(&rows); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	events := make([]model.AuditEvent, len(rows))
+	for i := range rows {
+		events[i] = rows[i].AuditEvent
+	}
+
+	var next *model.AuditCursor
+	if len(rows) > 0 && len(rows) == filter.Limit {
+		last := rows[len(rows)-1]
+		next = &model.AuditCursor{OccurredAt: last.OccurredAt, Id: last.PK.Hex()}
+	}
+
+	return events, next, nil
+}
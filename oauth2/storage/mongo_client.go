@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Client and scope catalog management
+
+func (store *mongoStore) CreateClient(ctx context.Context, c *model.Client) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "CreateClient")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	n, err := s.DB("").C(ClientsCollection).Find(bson.M{"id": c.ClientID}).Count()
+	if err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if n > 0 {
+		return sdkcm.ErrCustom(nil, common.ErrClientExisted)
+	}
+
+	client := toClientMongo(c)
+	client.PrepareForInsert()
+
+	if err := s.DB("").C(ClientsCollection).Insert(client); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
+
+// GetScopes returns the catalog entries of the given names, or the whole catalog when no name is given.
+// Unknown names are ignored.
+func (store *mongoStore) GetScopes(ctx context.Context, names ...string) ([]model.Scope, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "GetScopes")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	cond := bson.M{}
+	if len(names) > 0 {
+		cond["name"] = bson.M{"$in": names}
+	}
+
+	var rows []ScopeMongo
+	if err := s.DB("").C(ScopesCollection).Find(cond).Sort("name").All(&rows); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	scopes := make([]model.Scope, len(rows))
+	for i := range rows {
+		scopes[i] = rows[i].Scope
+	}
+
+	return scopes, nil
+}
+
+func (store *mongoStore) CreateScope(ctx context.Context, scope *model.Scope) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "CreateScope")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	n, err := s.DB("").C(ScopesCollection).Find(bson.M{"name": scope.Name}).Count()
+	if err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if n > 0 {
+		return sdkcm.ErrCustom(nil, common.ErrScopeExisted)
+	}
+
+	data := ScopeMongo{Scope: *scope}
+	data.PrepareForInsert()
+
+	if err := s.DB("").C(ScopesCollection).Insert(&data); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/baozhenglab/oauth-service/oauth2/model"
 	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/tracing"
 	"github.com/globalsign/mgo/bson"
 	"github.com/ory/fosite"
 	"github.com/ory/go-convenience/stringsx"
@@ -47,27 +48,29 @@ type ClientMongo struct {
 	LogoURI           string   `bson:"logo_uri"`
 	Contacts          []string `bson:"contacts"`
 	SecretExpiresAt   int      `bson:"client_secret_expires_at"`
+	RequireVerified   bool     `bson:"require_verified_email"`
 	MgoModel          `bson:",inline"`
 }
 
 func (cm *ClientMongo) toClient() *model.Client {
 	c := &model.Client{
-		ClientID:          cm.ID,
-		Name:              cm.Name,
-		Secret:            cm.Secret,
-		Audience:          cm.Audience,
-		RedirectURIs:      cm.RedirectURIs,
-		GrantTypes:        cm.GrantTypes,
-		ResponseTypes:     cm.ResponseTypes,
-		Scope:             cm.Scope,
-		Owner:             cm.OwnerID,
-		PolicyURI:         cm.PolicyURI,
-		TermsOfServiceURI: cm.TermsOfServiceURI,
-		ClientURI:         cm.ClientURI,
-		LogoURI:           cm.LogoURI,
-		Contacts:          cm.Contacts,
-		CreatedAt:         cm.CreatedAt,
-		UpdatedAt:         cm.UpdatedAt,
+		ClientID:             cm.ID,
+		Name:                 cm.Name,
+		Secret:               cm.Secret,
+		Audience:             cm.Audience,
+		RedirectURIs:         cm.RedirectURIs,
+		GrantTypes:           cm.GrantTypes,
+		ResponseTypes:        cm.ResponseTypes,
+		Scope:                cm.Scope,
+		Owner:                cm.OwnerID,
+		PolicyURI:            cm.PolicyURI,
+		TermsOfServiceURI:    cm.TermsOfServiceURI,
+		ClientURI:            cm.ClientURI,
+		LogoURI:              cm.LogoURI,
+		Contacts:             cm.Contacts,
+		RequireVerifiedEmail: cm.RequireVerified,
+		CreatedAt:            cm.CreatedAt,
+		UpdatedAt:            cm.UpdatedAt,
 	}
 
 	return c
@@ -89,6 +92,7 @@ func toClientMongo(c *model.Client) *ClientMongo {
 		ClientURI:         c.ClientURI,
 		LogoURI:           c.LogoURI,
 		Contacts:          c.Contacts,
+		RequireVerified:   c.RequireVerifiedEmail,
 		MgoModel: MgoModel{
 			CreatedAt: c.CreatedAt,
 			UpdatedAt: c.UpdatedAt,
@@ -113,14 +117,17 @@ type RequesterMongo struct {
 	*MgoModel         `bson:",inline"`
 }
 
-func (rm *RequesterMongo) toRequester(_ *secure.AES, session fosite.Session, clm ClientManager) (*fosite.Request, error) {
+func (rm *RequesterMongo) toRequester(ctx context.Context, _ *secure.AES, session fosite.Session, clm ClientManager) (*fosite.Request, error) {
+	ctx, span := tracing.Start(ctx, "storage.toRequester")
+	defer span.End()
+
 	if session != nil {
 		if err := json.Unmarshal(rm.Session.Data, session); err != nil {
 			return nil, errors.WithStack(err)
 		}
 	}
 
-	c, err := clm.GetClient(context.Background(), rm.Client)
+	c, err := clm.GetClient(ctx, rm.Client)
 	if err != nil {
 		return nil, err
 	}
@@ -184,3 +191,89 @@ type UserMongo struct {
 	model.User `bson:",inline"`
 	MgoModel   `bson:",inline"`
 }
+
+type ScopeMongo struct {
+	model.Scope `bson:",inline"`
+	MgoModel    `bson:",inline"`
+}
+
+type RoleMongo struct {
+	Name        string   `bson:"name"`
+	ClientId    string   `bson:"client_id"`
+	Permissions []string `bson:"permissions"`
+	MgoModel    `bson:",inline"`
+}
+
+func (r *RoleMongo) ToRole() model.Role {
+	return model.Role{
+		Name:        r.Name,
+		ClientId:    r.ClientId,
+		Permissions: r.Permissions,
+	}
+}
+
+// UserRoleMongo is a role assignment of an user within a client
+type UserRoleMongo struct {
+	UserId   string `bson:"user_id"`
+	ClientId string `bson:"client_id"`
+	Role     string `bson:"role"`
+	MgoModel `bson:",inline"`
+}
+
+type PasswordHistoryMongo struct {
+	model.PasswordHistory `bson:",inline"`
+	MgoModel              `bson:",inline"`
+}
+
+type LoginAttemptMongo struct {
+	Key           string    `bson:"key"`
+	Failures      int       `bson:"failures"`
+	LastFailureAt time.Time `bson:"last_failure_at"`
+	ExpiredAt     time.Time `bson:"expired_at"`
+}
+
+func (a *LoginAttemptMongo) ToLoginAttempts() *secure.LoginAttempts {
+	return &secure.LoginAttempts{Key: a.Key, Failures: a.Failures, LastFailure: a.LastFailureAt}
+}
+
+type RateLimitMongo struct {
+	Key string `bson:"key"`
+	// theoretical arrival time in unix nanoseconds, see secure.RateLimit
+	Tat       int64     `bson:"tat"`
+	ExpiredAt time.Time `bson:"expired_at"`
+}
+
+type WebAuthnCredentialMongo struct {
+	model.WebAuthnCredential `bson:",inline"`
+	MgoModel                 `bson:",inline"`
+}
+
+type RecoveryCodeMongo struct {
+	model.RecoveryCode `bson:",inline"`
+	MgoModel           `bson:",inline"`
+}
+
+type TrustedDeviceMongo struct {
+	model.TrustedDevice `bson:",inline"`
+	MgoModel            `bson:",inline"`
+}
+
+type UserIdentityMongo struct {
+	model.UserIdentity `bson:",inline"`
+	MgoModel           `bson:",inline"`
+}
+
+type AuditEventMongo struct {
+	model.AuditEvent `bson:",inline"`
+	MgoModel         `bson:",inline"`
+}
+
+type WebhookMongo struct {
+	model.Webhook `bson:",inline"`
+	MgoModel      `bson:",inline"`
+}
+
+type OutboxEventMongo struct {
+	model.OutboxEvent `bson:",inline"`
+	MgoModel          `bson:",inline"`
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+)
+
+// Failed login counters, shared by all replicas using the same database
+
+func (store *mongoStore) GetAttempts(ctx context.Context, key string) (*secure.LoginAttempts, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "GetAttempts")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	var row LoginAttemptMongo
+	err := s.DB("").C(LoginAttemptsCollection).Find(bson.M{
+		"key":        key,
+		"expired_at": bson.M{"$gt": time.Now().UTC()},
+	}).One(&row)
+
+	if err == mgo.ErrNotFound {
+		return &secure.LoginAttempts{Key: key}, nil
+	}
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return row.ToLoginAttempts(), nil
+}
+
+func (store *mongoStore) AddFailure(ctx context.Context, key string, ttl time.Duration) (*secure.LoginAttempts, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "AddFailure")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	c := s.DB("").C(LoginAttemptsCollection)
+	now := time.Now().UTC()
+
+	// an expired counter starts again from zero
+	if _, err := c.RemoveAll(bson.M{"key": key, "expired_at": bson.M{"$lte": now}}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	change := mgo.Change{
+		Update: bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"last_failure_at": now, "expired_at": now.Add(ttl)},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+
+	var row LoginAttemptMongo
+	if _, err := c.Find(bson.M{"key": key}).Apply(change, &row); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return row.ToLoginAttempts(), nil
+}
+
+func (store *mongoStore) ResetAttempts(ctx context.Context, key string) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "ResetAttempts")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	_, err := s.DB("").C(LoginAttemptsCollection).RemoveAll(bson.M{"key": key})
+	return errors.WithStack(err)
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+// VerifyMFA checks a TOTP code of an user enrolled in MFA, it is the second step of the password grant
+func (store *mongoStore) VerifyMFA(ctx context.Context, userID string, code string) (oauth2.UserCredential, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "VerifyMFA")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	if !bson.IsObjectIdHex(userID) {
+		return nil, fosite.ErrNotFound
+	}
+
+	var u UserMongo
+
+	if err := s.DB("").C(UsersCollection).FindId(bson.ObjectIdHex(userID)).One(&u); err != nil || !u.MfaEnabled {
+		return nil, fosite.ErrNotFound
+	}
+
+	step, ok, err := secure.CheckTOTP(store.eas, u.MfaSecret, code, u.MfaLastStep)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fosite.ErrNotFound
+	}
+
+	// a code cannot be used twice, even by concurrent requests
+	err = s.DB("").C(UsersCollection).Update(
+		bson.M{"_id": u.PK, "mfa_last_step": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"mfa_last_step": step}},
+	)
+	if err == mgo.ErrNotFound {
+		return nil, fosite.ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	u.UserId = u.PK.Hex()
+	u.Password = ""
+	u.Salt = ""
+	return u.User, nil
+}
+
+// UseRecoveryCode checks a recovery code of an user enrolled in MFA, the code cannot be used again
+func (store *mongoStore) UseRecoveryCode(ctx context.Context, userID string, code string) (oauth2.UserCredential, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "UseRecoveryCode")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	if !bson.IsObjectIdHex(userID) {
+		return nil, fosite.ErrNotFound
+	}
+
+	var u UserMongo
+
+	if err := s.DB("").C(UsersCollection).FindId(bson.ObjectIdHex(userID)).One(&u); err != nil || !u.MfaEnabled {
+		return nil, fosite.ErrNotFound
+	}
+
+	hash := secure.HashRecoveryCode(code, userID, store.secretKey)
+	err := s.DB("").C(MFARecoveryCodesCollection).Update(
+		bson.M{"user_id": userID, "code_hash": hash, "used_at": nil},
+		bson.M{"$set": bson.M{"used_at": time.Now().UTC()}},
+	)
+	if err == mgo.ErrNotFound {
+		return nil, fosite.ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	u.UserId = u.PK.Hex()
+	u.Password = ""
+	u.Salt = ""
+	return u.User, nil
+}
+
+func (store *mongoStore) AddTrustedDevice(ctx context.Context, device *model.TrustedDevice) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "AddTrustedDevice")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	data := TrustedDeviceMongo{TrustedDevice: *device}
+	data.PrepareForInsert()
+
+	return errors.WithStack(s.DB("").C(TrustedDevicesCollection).Insert(&data))
+}
+
+// TouchTrustedDevice records the use of a device, it returns false when the device is not trusted anymore
+func (store *mongoStore) TouchTrustedDevice(ctx context.Context, userID, deviceID string) (bool, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "TouchTrustedDevice")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	now := time.Now().UTC()
+	err := s.DB("").C(TrustedDevicesCollection).Update(
+		bson.M{"user_id": userID, "device_id": deviceID, "expired_at": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"last_used_at": now}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+)
+
+// Rate limit buckets, shared by all replicas using the same database.
+// A bucket is updated only if it has not been changed by another replica meanwhile.
+
+func (store *mongoStore) Take(ctx context.Context, key string, limit secure.RateLimit) (time.Duration, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "Take")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	c := s.DB("").C(RateLimitsCollection)
+
+	for i := 0; i < 3; i++ {
+		now := time.Now().UTC()
+
+		var row RateLimitMongo
+		err := c.Find(bson.M{"key": key}).One(&row)
+
+		if err == mgo.ErrNotFound {
+			tat, wait := limit.Allow(time.Time{}, now)
+			if wait > 0 {
+				return wait, nil
+			}
+
+			if err := c.Insert(&RateLimitMongo{Key: key, Tat: tat.UnixNano(), ExpiredAt: tat}); err == nil {
+				return 0, nil
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+
+		tat, wait := limit.Allow(time.Unix(0, row.Tat).UTC(), now)
+		if wait > 0 {
+			return wait, nil
+		}
+
+		err = c.Update(bson.M{"key": key, "tat": row.Tat}, bson.M{"$set": bson.M{"tat": tat.UnixNano(), "expired_at": tat}})
+		if err == nil {
+			return 0, nil
+		}
+
+		if err != mgo.ErrNotFound {
+			return 0, errors.WithStack(err)
+		}
+	}
+
+	// too many concurrent requests on the same bucket
+	return limit.Period / time.Duration(limit.Limit), nil
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+)
+
+// Webhooks of the clients and delivery of their outbox events
+
+// CreateWebhook adds a webhook to an existing client, the secret is stored encrypted
+func (store *mongoStore) CreateWebhook(ctx context.Context, webhook *model.Webhook) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "CreateWebhook")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	n, err := s.DB("").C(ClientsCollection).Find(bson.M{"id": webhook.ClientId}).Count()
+	if err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if n == 0 {
+		return sdkcm.ErrCustom(nil, common.ErrClientNotFound)
+	}
+
+	secret, err := store.eas.Encrypt([]byte(webhook.Secret))
+	if err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	data := WebhookMongo{Webhook: *webhook}
+	data.Secret = secret
+	data.PrepareForInsert()
+
+	if err := s.DB("").C(WebhooksCollection).Insert(&data); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
+
+// FindWebhooks returns the webhooks of the client without their secret
+func (store *mongoStore) FindWebhooks(ctx context.Context, clientId string) ([]model.Webhook, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "FindWebhooks")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	var rows []WebhookMongo
+	if err := s.DB("").C(WebhooksCollection).Find(bson.M{"client_id": clientId}).Sort("created_at").All(&rows); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	webhooks := make([]model.Webhook, len(rows))
+	for i := range rows {
+		webhooks[i] = rows[i].Webhook
+		webhooks[i].Secret = ""
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhook removes the webhook of the client and drops its pending deliveries
+func (store *mongoStore) DeleteWebhook(ctx context.Context, clientId, webhookId string) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "DeleteWebhook")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	if err := s.DB("").C(WebhooksCollection).Remove(bson.M{"client_id": clientId, "webhook_id": webhookId}); err != nil {
+		if err == mgo.ErrNotFound {
+			return sdkcm.ErrCustom(nil, common.ErrDataNotFound)
+		}
+		return sdkcm.ErrDB(err)
+	}
+
+	if _, err := s.DB("").C(OutboxEventsCollection).RemoveAll(bson.M{"webhook_id": webhookId, "state": model.OutboxPending}); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
+
+// FindWebhook returns the webhook with its decrypted secret
+func (store *mongoStore) FindWebhook(ctx context.Context, webhookId string) (*model.Webhook, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "FindWebhook")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	var row WebhookMongo
+	if err := s.DB("").C(WebhooksCollection).Find(bson.M{"webhook_id": webhookId}).One(&row); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	secret, err := store.eas.Decrypt(row.Secret)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	webhook := row.Webhook
+	webhook.Secret = string(secret)
+
+	return &webhook, nil
+}
+
+// FindDueOutboxEvents returns the pending deliveries whose next attempt is due, the oldest first
+func (store *mongoStore) FindDueOutboxEvents(ctx context.Context, now time.Time, limit int) ([]model.OutboxEvent, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "FindDueOutboxEvents")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	var rows []OutboxEventMongo
+	if err := s.DB("").C(OutboxEventsCollection).
+		Find(bson.M{"state": model.OutboxPending, "next_attempt_at": bson.M{"$lte": now}}).
+		Sort("next_attempt_at", "_id").Limit(limit).All(&rows); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	events := make([]model.OutboxEvent, len(rows))
+	for i := range rows {
+		events[i] = rows[i].OutboxEvent
+	}
+
+	return events, nil
+}
+
+// ClaimOutboxEvent postpones a due delivery until the given time, it returns false when
+// another dispatcher claimed it first
+func (store *mongoStore) ClaimOutboxEvent(ctx context.Context, deliveryId string, now, until time.Time) (bool, error) {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "ClaimOutboxEvent")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	err := s.DB("").C(OutboxEventsCollection).Update(
+		bson.M{"delivery_id": deliveryId, "state": model.OutboxPending, "next_attempt_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"next_attempt_at": until}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return true, nil
+}
+
+// SaveOutboxAttempt records the outcome of a delivery attempt
+func (store *mongoStore) SaveOutboxAttempt(ctx context.Context, event *model.OutboxEvent) error {
+	defer tracing.Storage(ctx, metrics.StoreMongo, "SaveOutboxAttempt")()
+
+	s := store.s.GetSession()
+	defer s.Close()
+
+	return errors.WithStack(s.DB("").C(OutboxEventsCollection).Update(
+		bson.M{"delivery_id": event.DeliveryId},
+		bson.M{"$set": bson.M{
+			"state":           event.State,
+			"attempts":        event.Attempts,
+			"next_attempt_at": event.NextAttemptAt,
+			"delivered_at":    event.DeliveredAt,
+			"last_error":      event.LastError,
+			"updated_at":      time.Now().UTC(),
+		}},
+	))
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/baozhenglab/oauth-service/metrics"
 	"github.com/baozhenglab/oauth-service/oauth2"
 	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/tracing"
 	"github.com/baozhenglab/sdkcm"
 	"github.com/jinzhu/gorm"
 	"github.com/ory/fosite"
@@ -16,6 +18,23 @@ const (
 	TbUser        = "oauth_users"
 	TbAuthCode    = "oauth_authorize_codes"
 	TbAccessToken = "oauth_access_tokens"
+	TbScope       = "oauth_scopes"
+	TbRole        = "oauth_roles"
+	TbUserRole    = "oauth_user_roles"
+
+	TbPasswordHistory = "oauth_password_histories"
+	TbLoginAttempt    = "oauth_login_attempts"
+	TbRateLimit       = "oauth_rate_limits"
+
+	TbWebAuthnCredential = "oauth_webauthn_credentials"
+	TbMFARecoveryCode    = "oauth_mfa_recovery_codes"
+	TbTrustedDevice      = "oauth_trusted_devices"
+
+	TbUserIdentity = "oauth_user_identities"
+	TbAuditEvent   = "oauth_audit_events"
+
+	TbWebhook     = "oauth_webhooks"
+	TbOutboxEvent = "oauth_outbox_events"
 )
 
 type DbConnectionManager interface {
@@ -28,6 +47,8 @@ type sqlStore struct {
 	eas       *secure.AES
 	secretKey string
 	Implicit  map[string]fosite.Requester // still not converted to mongo yet
+	// counts the rate limit takes, the full buckets are deleted from time to time
+	rateLimitTakes uint32
 }
 
 func NewSqlStore(db DbConnectionManager, eas *secure.AES, secretKey string) *sqlStore {
@@ -47,7 +68,9 @@ type AuthorizeCodeSql struct {
 	sdkcm.SQLModel `json:",inline"`
 }
 
-func (store *sqlStore) GetClient(_ context.Context, id string) (fosite.Client, error) {
+func (store *sqlStore) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "GetClient")()
+
 	db := store.db.GetDB()
 
 	if store.db.GetRDB() != nil {
@@ -65,7 +88,9 @@ func (store *sqlStore) GetClient(_ context.Context, id string) (fosite.Client, e
 	return client.toClient(), nil
 }
 
-func (store *sqlStore) CreateAuthorizeCodeSession(_ context.Context, code string, req fosite.Requester) error {
+func (store *sqlStore) CreateAuthorizeCodeSession(ctx context.Context, code string, req fosite.Requester) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "CreateAuthorizeCodeSession")()
+
 	db := store.db.GetDB().New()
 
 	reqSql, err := toRequesterSql(req, code)
@@ -83,7 +108,9 @@ func (store *sqlStore) CreateAuthorizeCodeSession(_ context.Context, code string
 	return nil
 }
 
-func (store *sqlStore) GetAuthorizeCodeSession(_ context.Context, code string, session fosite.Session) (fosite.Requester, error) {
+func (store *sqlStore) GetAuthorizeCodeSession(ctx context.Context, code string, session fosite.Session) (fosite.Requester, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "GetAuthorizeCodeSession")()
+
 	db := store.db.GetDB()
 
 	if store.db.GetRDB() != nil {
@@ -98,7 +125,7 @@ func (store *sqlStore) GetAuthorizeCodeSession(_ context.Context, code string, s
 		return nil, err
 	}
 
-	req, err := authorizeCode.Requester.toRequester(store.eas, session, ClientManager(store))
+	req, err := authorizeCode.Requester.toRequester(ctx, store.eas, session, ClientManager(store))
 
 	if err != nil {
 		return nil, err
@@ -112,6 +139,8 @@ func (store *sqlStore) GetAuthorizeCodeSession(_ context.Context, code string, s
 }
 
 func (store *sqlStore) InvalidateAuthorizeCodeSession(ctx context.Context, code string) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "InvalidateAuthorizeCodeSession")()
+
 	db := store.db.GetDB().New()
 
 	if err := db.Table(TbAuthCode).
@@ -122,44 +151,62 @@ func (store *sqlStore) InvalidateAuthorizeCodeSession(ctx context.Context, code
 	return nil
 }
 
-func (store *sqlStore) DeleteAuthorizeCodeSession(_ context.Context, code string) error {
+func (store *sqlStore) DeleteAuthorizeCodeSession(ctx context.Context, code string) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "DeleteAuthorizeCodeSession")()
+
 	db := store.db.GetDB().New()
 	return db.Table(TbAuthCode).Where("code = ?", code).Delete(nil).Error
 }
 
 func (store *sqlStore) CreateAccessTokenSession(ctx context.Context, signature string, req fosite.Requester) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "CreateAccessTokenSession")()
+
 	return store.createToken(ctx, signature, req, fosite.AccessToken)
 }
 
 func (store *sqlStore) GetAccessTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "GetAccessTokenSession")()
+
 	return store.getTokenSession(ctx, signature, session)
 }
 
-func (store *sqlStore) DeleteAccessTokenSession(_ context.Context, signature string) error {
+func (store *sqlStore) DeleteAccessTokenSession(ctx context.Context, signature string) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "DeleteAccessTokenSession")()
+
 	db := store.db.GetDB().New()
 	return db.Table(TbAccessToken).Where("signature = ?", signature).Delete(nil).Error
 }
 
 func (store *sqlStore) CreateRefreshTokenSession(ctx context.Context, signature string, req fosite.Requester) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "CreateRefreshTokenSession")()
+
 	return store.createToken(ctx, signature, req, fosite.RefreshToken)
 }
 
 func (store *sqlStore) GetRefreshTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "GetRefreshTokenSession")()
+
 	return store.getTokenSession(ctx, signature, session)
 }
 
-func (store *sqlStore) DeleteRefreshTokenSession(_ context.Context, signature string) error {
+func (store *sqlStore) DeleteRefreshTokenSession(ctx context.Context, signature string) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "DeleteRefreshTokenSession")()
+
 	db := store.db.GetDB().New()
 
 	return db.Table(TbAccessToken).Where("signature = ?", signature).Delete(nil).Error
 }
 
-func (store *sqlStore) CreateImplicitAccessTokenSession(_ context.Context, code string, req fosite.Requester) error {
+func (store *sqlStore) CreateImplicitAccessTokenSession(ctx context.Context, code string, req fosite.Requester) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "CreateImplicitAccessTokenSession")()
+
 	store.Implicit[code] = req
 	return nil
 }
 
-func (store *sqlStore) Authenticate(context context.Context, name string, secret string) (oauth2.UserCredential, error) {
+func (store *sqlStore) Authenticate(ctx context.Context, name string, secret string) (oauth2.UserCredential, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "Authenticate")()
+
 	db := store.db.GetDB()
 
 	if store.db.GetRDB() != nil {
@@ -176,25 +223,36 @@ func (store *sqlStore) Authenticate(context context.Context, name string, secret
 
 	u.UserId = fmt.Sprintf("%d", u.SQLModel.ID)
 
-	passHash := secure.ComputeHmac256(secret, u.Salt, store.secretKey)
-	if passHash != u.Password {
+	if !secure.VerifyPassword(ctx, secret, u.Password, u.Salt, u.PasswordAlgo, store.secretKey) {
 		return nil, fosite.ErrNotFound
 	}
 
+	// Legacy hashes are replaced on the next successful login,
+	// a failure here must not prevent the user from logging in
+	if secure.PasswordNeedsRehash(u.PasswordAlgo) {
+		hash, salt, algo := secure.HashPassword(ctx, secret)
+		store.db.GetDB().New().Table(TbUser).Where("id = ?", u.ID).
+			Update(map[string]interface{}{"password": hash, "salt": salt, "password_algo": algo})
+	}
+
 	u.Password = ""
 	u.Salt = ""
 	return u.User, nil
 }
 
 func (store *sqlStore) RevokeRefreshToken(ctx context.Context, requestID string) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "RevokeRefreshToken")()
+
 	return store.revoke(ctx, requestID)
 }
 
 func (store *sqlStore) RevokeAccessToken(ctx context.Context, requestID string) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "RevokeAccessToken")()
+
 	return store.revoke(ctx, requestID)
 }
 
-func (store *sqlStore) createToken(_ context.Context, signature string, req fosite.Requester, tkt fosite.TokenType) error {
+func (store *sqlStore) createToken(ctx context.Context, signature string, req fosite.Requester, tkt fosite.TokenType) error {
 	db := store.db.GetDB().New()
 
 	reqSql, err := toRequesterSql(req, "")
@@ -234,7 +292,7 @@ func (store *sqlStore) createToken(_ context.Context, signature string, req fosi
 	return nil
 }
 
-func (store *sqlStore) getTokenSession(_ context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+func (store *sqlStore) getTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
 	db := store.db.GetDB()
 
 	if store.db.GetRDB() != nil {
@@ -249,7 +307,7 @@ func (store *sqlStore) getTokenSession(_ context.Context, signature string, sess
 		return nil, fosite.ErrNotFound
 	}
 
-	req, err := atm.Requester.toRequester(store.eas, session, store)
+	req, err := atm.Requester.toRequester(ctx, store.eas, session, store)
 	if err != nil {
 		return nil, err
 	}
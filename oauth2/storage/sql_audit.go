@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/pkg/errors"
+)
+
+// AddAuditEvent appends an entry to the audit log
+func (store *sqlStore) AddAuditEvent(ctx context.Context, event *model.AuditEvent) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "AddAuditEvent")()
+
+	data := AuditEventSql{AuditEvent: *event, SQLModel: *sdkcm.NewSQLModelWithStatus(1)}
+
+	return errors.WithStack(store.db.GetDB().New().Table(TbAuditEvent).Create(&data).Error)
+}
+
+// FindAuditEvents returns the entries of the filter, the newest first, and the cursor of the next page
+func (store *sqlStore) FindAuditEvents(ctx context.Context, filter *model.AuditFilter) ([]model.AuditEvent, *model.AuditCursor, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "FindAuditEvents")()
+
+	db := store.db.GetDB()
+
+	if store.db.GetRDB() != nil {
+		db = store.db.GetRDB()
+	}
+
+	db = db.New().Table(TbAuditEvent)
+
+	if filter.UserId != "" {
+		db = db.Where("actor_id = ? OR subject_id = ?", filter.UserId, filter.UserId)
+	}
+
+	if filter.ClientId != "" {
+		db = db.Where("client_id = ?", filter.ClientId)
+	}
+
+	if filter.Type != "" {
+		db = db.Where("type = ?", filter.Type)
+	}
+
+	if filter.From != nil {
+		db = db.Where("occurred_at >= ?", *filter.From)
+	}
+
+	if filter.To != nil {
+		db = db.Where("occurred_at < ?", *filter.To)
+	}
+
+	if filter.After != nil {
+		id, err := strconv.ParseUint(filter.After.Id, 10, 32)
+		if err != nil {
+			return nil, nil, sdkcm.ErrCustom(err, common.ErrAuditCursorInvalid)
+		}
+
+		at := filter.After.OccurredAt
+		db = db.Where("occurred_at < ? OR (occurred_at = ? AND id < ?)", at, at, id)
+	}
+
+	var rows []AuditEventSql
+	if err := db.Order("occurred_at DESC, id DESC").Limit(filter.Limit).Find(&rows).Error; err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	events := make([]model.AuditEvent, len(rows))
+	for i := range rows {
+		events[i] = rows[i].AuditEvent
+	}
+
+	var next *model.AuditCursor
+	if len(rows) > 0 && len(rows) == filter.Limit {
+		last := rows[len(rows)-1]
+		next = &model.AuditCursor{OccurredAt: last.OccurredAt, Id: strconv.FormatUint(uint64(last.ID), 10)}
+	}
+
+	return events, next, nil
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/jinzhu/gorm"
+)
+
+// Client and scope catalog management
+
+func (store *sqlStore) CreateClient(ctx context.Context, c *model.Client) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "CreateClient")()
+
+	db := store.db.GetDB().New()
+
+	var n int
+	if err := db.Table(TbClient).Where("client_id = ?", c.ClientID).Count(&n).Error; err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if n > 0 {
+		return sdkcm.ErrCustom(nil, common.ErrClientExisted)
+	}
+
+	client := toClientSQL(c)
+	client.SQLModel = *sdkcm.NewSQLModelWithStatus(1)
+
+	if err := db.Table(TbClient).Create(client).Error; err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
+
+// GetScopes returns the catalog entries of the given names, or the whole catalog when no name is given.
+// Unknown names are ignored.
+func (store *sqlStore) GetScopes(ctx context.Context, names ...string) ([]model.Scope, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "GetScopes")()
+
+	db := store.db.GetDB()
+
+	if store.db.GetRDB() != nil {
+		db = store.db.GetRDB()
+	}
+
+	db = db.New().Table(TbScope)
+
+	if len(names) > 0 {
+		db = db.Where("name in (?)", names)
+	}
+
+	var rows []ScopeSQL
+	if err := db.Order("name").Find(&rows).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	scopes := make([]model.Scope, len(rows))
+	for i := range rows {
+		scopes[i] = rows[i].Scope
+	}
+
+	return scopes, nil
+}
+
+func (store *sqlStore) CreateScope(ctx context.Context, scope *model.Scope) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "CreateScope")()
+
+	db := store.db.GetDB().New()
+
+	var n int
+	if err := db.Table(TbScope).Where("name = ?", scope.Name).Count(&n).Error; err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if n > 0 {
+		return sdkcm.ErrCustom(nil, common.ErrScopeExisted)
+	}
+
+	data := ScopeSQL{Scope: *scope, SQLModel: *sdkcm.NewSQLModelWithStatus(1)}
+
+	if err := db.Table(TbScope).Create(&data).Error; err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
@@ -6,11 +6,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/baozhenglab/oauth-service/oauth2/model"
 	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/tracing"
 	"github.com/baozhenglab/sdkcm"
 	"github.com/ory/fosite"
 	"github.com/ory/go-convenience/stringsx"
@@ -33,6 +35,7 @@ type ClientSQL struct {
 	LogoURI           *sdkcm.Image `gorm:"column:logo"`
 	Contacts          string       `gorm:"column:contacts"`
 	SecretExpiresAt   int          `gorm:"column:client_secret_expires_at"`
+	RequireVerified   bool         `gorm:"column:require_verified_email"`
 	sdkcm.SQLModel    `json:",inline"`
 }
 
@@ -41,7 +44,7 @@ func (c *ClientSQL) toClient() *model.Client {
 		ClientID:          c.ClientID,
 		Name:              c.Name,
 		Secret:            c.Secret,
-		Audience:          strings.Split(c.Audience, ","),
+		Audience:          splitAudiences(c.Audience),
 		RedirectURIs:      strings.Split(c.RedirectURIs, ","),
 		GrantTypes:        strings.Split(c.GrantTypes, ","),
 		ResponseTypes:     strings.Split(c.ResponseTypes, ","),
@@ -51,12 +54,45 @@ func (c *ClientSQL) toClient() *model.Client {
 		TermsOfServiceURI: c.TermsOfServiceURI,
 		ClientURI:         c.ClientURI,
 		//LogoURI:           c.LogoURI,
-		Contacts: strings.Split(c.Contacts, ","),
+		Contacts:             strings.Split(c.Contacts, ","),
+		RequireVerifiedEmail: c.RequireVerified,
 	}
 
 	return clt
 }
 
+func toClientSQL(c *model.Client) *ClientSQL {
+	ownerID, _ := strconv.ParseUint(c.Owner, 10, 32)
+
+	return &ClientSQL{
+		ClientID:          c.ClientID,
+		Name:              c.Name,
+		Secret:            c.Secret,
+		Audience:          strings.Join(c.Audience, ","),
+		RedirectURIs:      strings.Join(c.RedirectURIs, ","),
+		GrantTypes:        strings.Join(c.GrantTypes, ","),
+		ResponseTypes:     strings.Join(c.ResponseTypes, ","),
+		Scope:             c.Scope,
+		OwnerID:           uint32(ownerID),
+		PolicyURI:         c.PolicyURI,
+		TermsOfServiceURI: c.TermsOfServiceURI,
+		ClientURI:         c.ClientURI,
+		Contacts:          strings.Join(c.Contacts, ","),
+		RequireVerified:   c.RequireVerifiedEmail,
+	}
+}
+
+// splitAudiences parses the comma-joined audiences column, ignoring blanks
+func splitAudiences(audiences string) []string {
+	result := []string{}
+	for _, a := range strings.Split(audiences, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
 type RequesterSql struct {
 	Signature         string    `json:"signature"`
 	Request           string    `json:"request_id"`
@@ -71,14 +107,17 @@ type RequesterSql struct {
 	Session           []byte    `json:"session_data"`
 }
 
-func (rs *RequesterSql) toRequester(_ *secure.AES, session fosite.Session, clm ClientManager) (*fosite.Request, error) {
+func (rs *RequesterSql) toRequester(ctx context.Context, _ *secure.AES, session fosite.Session, clm ClientManager) (*fosite.Request, error) {
+	ctx, span := tracing.Start(ctx, "storage.toRequester")
+	defer span.End()
+
 	if session != nil {
 		if err := json.Unmarshal(rs.Session, session); err != nil {
 			return nil, errors.WithStack(err)
 		}
 	}
 
-	c, err := clm.GetClient(context.Background(), rs.Client)
+	c, err := clm.GetClient(ctx, rs.Client)
 	if err != nil {
 		return nil, err
 	}
@@ -139,10 +178,10 @@ func toRequesterSql(requester fosite.Requester, signature string) (*RequesterSql
 		Signature:         signature,
 		RequestedAt:       requester.GetRequestedAt(),
 		Client:            requester.GetClient().GetID(),
-		Scopes:            strings.Join([]string(requester.GetRequestedScopes()), ","),
-		GrantedScope:      strings.Join([]string(requester.GetGrantedScopes()), ","),
-		GrantedAudience:   strings.Join([]string(requester.GetGrantedAudience()), ","),
-		RequestedAudience: strings.Join([]string(requester.GetRequestedAudience()), ","),
+		Scopes:            strings.Join([]string(requester.GetRequestedScopes()), "|"),
+		GrantedScope:      strings.Join([]string(requester.GetGrantedScopes()), "|"),
+		GrantedAudience:   strings.Join([]string(requester.GetGrantedAudience()), "|"),
+		RequestedAudience: strings.Join([]string(requester.GetRequestedAudience()), "|"),
 		Form:              requester.GetRequestForm().Encode(),
 		Session:           sessionData,
 		Subject:           subject,
@@ -165,3 +204,108 @@ type UserSql struct {
 	model.User     `js:",inline"`
 	sdkcm.SQLModel `js:",inline"`
 }
+
+type ScopeSQL struct {
+	model.Scope    `json:",inline"`
+	sdkcm.SQLModel `json:",inline"`
+}
+
+type RoleSql struct {
+	Name           string `gorm:"column:name"`
+	ClientId       string `gorm:"column:client_id"`
+	Permissions    string `gorm:"column:permissions"`
+	sdkcm.SQLModel `json:",inline"`
+}
+
+func (r *RoleSql) ToRole() model.Role {
+	return model.Role{
+		Name:        r.Name,
+		ClientId:    r.ClientId,
+		Permissions: stringsx.Splitx(r.Permissions, ","),
+	}
+}
+
+func ToRoleSql(r *model.Role) *RoleSql {
+	return &RoleSql{
+		Name:        r.Name,
+		ClientId:    r.ClientId,
+		Permissions: strings.Join(r.Permissions, ","),
+	}
+}
+
+// UserRoleSql is a role assignment of an user within a client
+type UserRoleSql struct {
+	UserId         string `gorm:"column:user_id"`
+	ClientId       string `gorm:"column:client_id"`
+	Role           string `gorm:"column:role"`
+	sdkcm.SQLModel `json:",inline"`
+}
+
+type PasswordHistorySql struct {
+	model.PasswordHistory `json:",inline"`
+	sdkcm.SQLModel        `json:",inline"`
+}
+
+type LoginAttemptSql struct {
+	Key           string    `gorm:"column:attempt_key;primary_key"`
+	Failures      int       `gorm:"column:failures"`
+	LastFailureAt time.Time `gorm:"column:last_failure_at"`
+	ExpiredAt     time.Time `gorm:"column:expired_at"`
+}
+
+func (a *LoginAttemptSql) ToLoginAttempts() *secure.LoginAttempts {
+	return &secure.LoginAttempts{Key: a.Key, Failures: a.Failures, LastFailure: a.LastFailureAt}
+}
+
+type RateLimitSql struct {
+	Key string `gorm:"column:bucket_key;primary_key"`
+	// theoretical arrival time in unix nanoseconds, see secure.RateLimit
+	Tat int64 `gorm:"column:tat"`
+}
+
+type WebAuthnCredentialSql struct {
+	model.WebAuthnCredential `json:",inline"`
+	sdkcm.SQLModel           `json:",inline"`
+}
+
+type RecoveryCodeSql struct {
+	model.RecoveryCode `json:",inline"`
+	sdkcm.SQLModel     `json:",inline"`
+}
+
+type TrustedDeviceSql struct {
+	model.TrustedDevice `json:",inline"`
+	sdkcm.SQLModel      `json:",inline"`
+}
+
+type UserIdentitySql struct {
+	model.UserIdentity `json:",inline"`
+	sdkcm.SQLModel     `json:",inline"`
+}
+
+type AuditEventSql struct {
+	model.AuditEvent `json:",inline"`
+	sdkcm.SQLModel   `json:",inline"`
+}
+
+// WebhookSql keeps the events of the webhook comma separated
+type WebhookSql struct {
+	model.Webhook  `json:",inline"`
+	EventList      string `gorm:"column:events"`
+	sdkcm.SQLModel `json:",inline"`
+}
+
+func ToWebhookSql(w *model.Webhook) *WebhookSql {
+	return &WebhookSql{Webhook: *w, EventList: strings.Join(w.Events, ",")}
+}
+
+func (w *WebhookSql) ToWebhook() model.Webhook {
+	webhook := w.Webhook
+	webhook.Events = splitAudiences(w.EventList)
+	return webhook
+}
+
+type OutboxEventSql struct {
+	model.OutboxEvent `json:",inline"`
+	sdkcm.SQLModel    `json:",inline"`
+}
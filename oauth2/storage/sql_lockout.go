@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Failed login counters, shared by all replicas using the same database
+
+func (store *sqlStore) GetAttempts(ctx context.Context, key string) (*secure.LoginAttempts, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "GetAttempts")()
+
+	db := store.db.GetDB().New()
+
+	var row LoginAttemptSql
+	err := db.Table(TbLoginAttempt).Where("attempt_key = ? AND expired_at > ?", key, time.Now().UTC()).First(&row).Error
+
+	if err == gorm.ErrRecordNotFound {
+		return &secure.LoginAttempts{Key: key}, nil
+	}
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return row.ToLoginAttempts(), nil
+}
+
+func (store *sqlStore) AddFailure(ctx context.Context, key string, ttl time.Duration) (*secure.LoginAttempts, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "AddFailure")()
+
+	db := store.db.GetDB().New()
+	now := time.Now().UTC()
+
+	// an expired counter starts again from zero
+	if err := db.Table(TbLoginAttempt).Where("attempt_key = ? AND expired_at <= ?", key, now).Delete(nil).Error; err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	update := map[string]interface{}{
+		"failures":        gorm.Expr("failures + 1"),
+		"last_failure_at": now,
+		"expired_at":      now.Add(ttl),
+	}
+
+	for i := 0; i < 2; i++ {
+		res := db.Table(TbLoginAttempt).Where("attempt_key = ?", key).Updates(update)
+		if res.Error != nil {
+			return nil, errors.WithStack(res.Error)
+		}
+
+		if res.RowsAffected > 0 {
+			break
+		}
+
+		row := LoginAttemptSql{Key: key, Failures: 1, LastFailureAt: now, ExpiredAt: now.Add(ttl)}
+
+		// the insert fails when another replica has just created the counter, it is updated on the next loop
+		if err := db.Table(TbLoginAttempt).Create(&row).Error; err == nil {
+			break
+		}
+	}
+
+	return store.GetAttempts(ctx, key)
+}
+
+func (store *sqlStore) ResetAttempts(ctx context.Context, key string) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "ResetAttempts")()
+
+	db := store.db.GetDB().New()
+
+	return errors.WithStack(db.Table(TbLoginAttempt).Where("attempt_key = ?", key).Delete(nil).Error)
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+// VerifyMFA checks a TOTP code of an user enrolled in MFA, it is the second step of the password grant
+func (store *sqlStore) VerifyMFA(ctx context.Context, userID string, code string) (oauth2.UserCredential, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "VerifyMFA")()
+
+	db := store.db.GetDB().New()
+
+	var u UserSql
+
+	if err := db.Table(TbUser).Where("id = ?", userID).First(&u).Error; err != nil || !u.MfaEnabled {
+		return nil, fosite.ErrNotFound
+	}
+
+	step, ok, err := secure.CheckTOTP(store.eas, u.MfaSecret, code, u.MfaLastStep)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fosite.ErrNotFound
+	}
+
+	// a code cannot be used twice, even by concurrent requests
+	res := db.Table(TbUser).Where("id = ? AND mfa_last_step < ?", u.ID, step).Update("mfa_last_step", step)
+	if res.Error != nil {
+		return nil, errors.WithStack(res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, fosite.ErrNotFound
+	}
+
+	u.UserId = fmt.Sprintf("%d", u.SQLModel.ID)
+	u.Password = ""
+	u.Salt = ""
+	return u.User, nil
+}
+
+// UseRecoveryCode checks a recovery code of an user enrolled in MFA, the code cannot be used again
+func (store *sqlStore) UseRecoveryCode(ctx context.Context, userID string, code string) (oauth2.UserCredential, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "UseRecoveryCode")()
+
+	db := store.db.GetDB().New()
+
+	var u UserSql
+
+	if err := db.Table(TbUser).Where("id = ?", userID).First(&u).Error; err != nil || !u.MfaEnabled {
+		return nil, fosite.ErrNotFound
+	}
+
+	hash := secure.HashRecoveryCode(code, userID, store.secretKey)
+	res := db.Table(TbMFARecoveryCode).Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash).
+		Update("used_at", time.Now().UTC())
+	if res.Error != nil {
+		return nil, errors.WithStack(res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, fosite.ErrNotFound
+	}
+
+	u.UserId = fmt.Sprintf("%d", u.SQLModel.ID)
+	u.Password = ""
+	u.Salt = ""
+	return u.User, nil
+}
+
+func (store *sqlStore) AddTrustedDevice(ctx context.Context, device *model.TrustedDevice) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "AddTrustedDevice")()
+
+	data := TrustedDeviceSql{TrustedDevice: *device, SQLModel: *sdkcm.NewSQLModelWithStatus(1)}
+
+	return errors.WithStack(store.db.GetDB().New().Table(TbTrustedDevice).Create(&data).Error)
+}
+
+// TouchTrustedDevice records the use of a device, it returns false when the device is not trusted anymore
+func (store *sqlStore) TouchTrustedDevice(ctx context.Context, userID, deviceID string) (bool, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "TouchTrustedDevice")()
+
+	now := time.Now().UTC()
+
+	res := store.db.GetDB().New().Table(TbTrustedDevice).
+		Where("user_id = ? AND device_id = ? AND expired_at > ?", userID, deviceID, now).
+		Update("last_used_at", now)
+	if res.Error != nil {
+		return false, errors.WithStack(res.Error)
+	}
+
+	return res.RowsAffected > 0, nil
+}
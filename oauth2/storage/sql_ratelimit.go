@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Rate limit buckets, shared by all replicas using the same database.
+// A bucket is updated only if it has not been changed by another replica meanwhile.
+
+// rateLimitPruneEvery is the number of takes between two deletions of the full buckets
+const rateLimitPruneEvery = 1000
+
+func (store *sqlStore) Take(ctx context.Context, key string, limit secure.RateLimit) (time.Duration, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "Take")()
+
+	db := store.db.GetDB().New()
+
+	if atomic.AddUint32(&store.rateLimitTakes, 1)%rateLimitPruneEvery == 0 {
+		store.pruneRateLimits(ctx, time.Now().UTC())
+	}
+
+	for i := 0; i < 3; i++ {
+		now := time.Now().UTC()
+
+		var row RateLimitSql
+		err := db.Table(TbRateLimit).Where("bucket_key = ?", key).First(&row).Error
+
+		if err == gorm.ErrRecordNotFound {
+			tat, wait := limit.Allow(time.Time{}, now)
+			if wait > 0 {
+				return wait, nil
+			}
+
+			if err := db.Table(TbRateLimit).Create(&RateLimitSql{Key: key, Tat: tat.UnixNano()}).Error; err == nil {
+				return 0, nil
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+
+		tat, wait := limit.Allow(time.Unix(0, row.Tat).UTC(), now)
+		if wait > 0 {
+			return wait, nil
+		}
+
+		res := db.Table(TbRateLimit).Where("bucket_key = ? AND tat = ?", key, row.Tat).Update("tat", tat.UnixNano())
+		if res.Error != nil {
+			return 0, errors.WithStack(res.Error)
+		}
+
+		if res.RowsAffected > 0 {
+			return 0, nil
+		}
+	}
+
+	// too many concurrent requests on the same bucket
+	return limit.Period / time.Duration(limit.Limit), nil
+}
+
+// pruneRateLimits deletes the buckets which are full again at now, a missing bucket is a full one.
+// A take racing with the deletion does not update the deleted bucket and creates it again.
+func (store *sqlStore) pruneRateLimits(ctx context.Context, now time.Time) {
+	db := store.db.GetDB().New()
+
+	if err := db.Table(TbRateLimit).Where("tat < ?", now.UnixNano()).Delete(nil).Error; err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in pruning the rate limit buckets")
+	}
+}
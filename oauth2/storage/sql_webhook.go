@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Webhooks of the clients and delivery of their outbox events
+
+// CreateWebhook adds a webhook to an existing client, the secret is stored encrypted
+func (store *sqlStore) CreateWebhook(ctx context.Context, webhook *model.Webhook) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "CreateWebhook")()
+
+	db := store.db.GetDB().New()
+
+	var n int
+	if err := db.Table(TbClient).Where("client_id = ?", webhook.ClientId).Count(&n).Error; err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if n == 0 {
+		return sdkcm.ErrCustom(nil, common.ErrClientNotFound)
+	}
+
+	secret, err := store.eas.Encrypt([]byte(webhook.Secret))
+	if err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	data := ToWebhookSql(webhook)
+	data.Secret = secret
+	data.SQLModel = *sdkcm.NewSQLModelWithStatus(1)
+
+	if err := db.Table(TbWebhook).Create(data).Error; err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
+
+// FindWebhooks returns the webhooks of the client without their secret
+func (store *sqlStore) FindWebhooks(ctx context.Context, clientId string) ([]model.Webhook, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "FindWebhooks")()
+
+	db := store.db.GetDB()
+
+	if store.db.GetRDB() != nil {
+		db = store.db.GetRDB()
+	}
+
+	var rows []WebhookSql
+	if err := db.New().Table(TbWebhook).Where("client_id = ?", clientId).Order("id").Find(&rows).Error; err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	webhooks := make([]model.Webhook, len(rows))
+	for i := range rows {
+		webhooks[i] = rows[i].ToWebhook()
+		webhooks[i].Secret = ""
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhook removes the webhook of the client and drops its pending deliveries
+func (store *sqlStore) DeleteWebhook(ctx context.Context, clientId, webhookId string) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "DeleteWebhook")()
+
+	res := store.db.GetDB().New().Table(TbWebhook).
+		Where("client_id = ? AND webhook_id = ?", clientId, webhookId).Delete(nil)
+	if res.Error != nil {
+		return sdkcm.ErrDB(res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return sdkcm.ErrCustom(nil, common.ErrDataNotFound)
+	}
+
+	if err := store.db.GetDB().New().Table(TbOutboxEvent).
+		Where("webhook_id = ? AND state = ?", webhookId, model.OutboxPending).Delete(nil).Error; err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
+
+// FindWebhook returns the webhook with its decrypted secret
+func (store *sqlStore) FindWebhook(ctx context.Context, webhookId string) (*model.Webhook, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "FindWebhook")()
+
+	var row WebhookSql
+	if err := store.db.GetDB().New().Table(TbWebhook).Where("webhook_id = ?", webhookId).First(&row).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	secret, err := store.eas.Decrypt(row.Secret)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	webhook := row.ToWebhook()
+	webhook.Secret = string(secret)
+
+	return &webhook, nil
+}
+
+// FindDueOutboxEvents returns the pending deliveries whose next attempt is due, the oldest first
+func (store *sqlStore) FindDueOutboxEvents(ctx context.Context, now time.Time, limit int) ([]model.OutboxEvent, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "FindDueOutboxEvents")()
+
+	var rows []OutboxEventSql
+	if err := store.db.GetDB().New().Table(TbOutboxEvent).
+		Where("state = ? AND next_attempt_at <= ?", model.OutboxPending, now).
+		Order("next_attempt_at, id").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	events := make([]model.OutboxEvent, len(rows))
+	for i := range rows {
+		events[i] = rows[i].OutboxEvent
+	}
+
+	return events, nil
+}
+
+// ClaimOutboxEvent postpones a due delivery until the given time, it returns false when
+// another dispatcher claimed it first
+func (store *sqlStore) ClaimOutboxEvent(ctx context.Context, deliveryId string, now, until time.Time) (bool, error) {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "ClaimOutboxEvent")()
+
+	res := store.db.GetDB().New().Table(TbOutboxEvent).
+		Where("delivery_id = ? AND state = ? AND next_attempt_at <= ?", deliveryId, model.OutboxPending, now).
+		Update("next_attempt_at", until)
+	if res.Error != nil {
+		return false, errors.WithStack(res.Error)
+	}
+
+	return res.RowsAffected == 1, nil
+}
+
+// SaveOutboxAttempt records the outcome of a delivery attempt
+func (store *sqlStore) SaveOutboxAttempt(ctx context.Context, event *model.OutboxEvent) error {
+	defer tracing.Storage(ctx, metrics.StoreSQL, "SaveOutboxAttempt")()
+
+	return errors.WithStack(store.db.GetDB().New().Table(TbOutboxEvent).
+		Where("delivery_id = ?", event.DeliveryId).
+		Updates(map[string]interface{}{
+			"state":           event.State,
+			"attempts":        event.Attempts,
+			"next_attempt_at": event.NextAttemptAt,
+			"delivered_at":    event.DeliveredAt,
+			"last_error":      event.LastError,
+		}).Error)
+}
@@ -0,0 +1,83 @@
+package oauth2
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/ory/fosite"
+)
+
+// tracedProvider records a span for every request handled by fosite,
+// the storage calls made by fosite are recorded as its children
+type tracedProvider struct {
+	*fosite.Fosite
+}
+
+func (p tracedProvider) NewAuthorizeRequest(ctx context.Context, req *http.Request) (fosite.AuthorizeRequester, error) {
+	ctx, span := tracing.Start(ctx, "fosite.NewAuthorizeRequest")
+	ar, err := p.Fosite.NewAuthorizeRequest(ctx, req)
+	tracing.End(span, err)
+	return ar, err
+}
+
+func (p tracedProvider) NewAuthorizeResponse(ctx context.Context, ar fosite.AuthorizeRequester, session fosite.Session) (fosite.AuthorizeResponder, error) {
+	ctx, span := tracing.Start(ctx, "fosite.NewAuthorizeResponse")
+	resp, err := p.Fosite.NewAuthorizeResponse(ctx, ar, session)
+	tracing.End(span, err)
+	return resp, err
+}
+
+func (p tracedProvider) NewAccessRequest(ctx context.Context, req *http.Request, session fosite.Session) (fosite.AccessRequester, error) {
+	ctx, span := tracing.Start(ctx, "fosite.NewAccessRequest")
+	ar, err := p.Fosite.NewAccessRequest(ctx, req, session)
+	tracing.End(span, err)
+	return ar, err
+}
+
+func (p tracedProvider) NewAccessResponse(ctx context.Context, ar fosite.AccessRequester) (fosite.AccessResponder, error) {
+	ctx, span := tracing.Start(ctx, "fosite.NewAccessResponse")
+	resp, err := p.Fosite.NewAccessResponse(ctx, ar)
+	tracing.End(span, err)
+	return resp, err
+}
+
+func (p tracedProvider) NewRevocationRequest(ctx context.Context, req *http.Request) error {
+	ctx, span := tracing.Start(ctx, "fosite.NewRevocationRequest")
+	err := p.Fosite.NewRevocationRequest(ctx, req)
+	tracing.End(span, err)
+	return err
+}
+
+func (p tracedProvider) IntrospectToken(ctx context.Context, token string, tokenType fosite.TokenType, session fosite.Session, scope ...string) (fosite.TokenType, fosite.AccessRequester, error) {
+	ctx, span := tracing.Start(ctx, "fosite.IntrospectToken")
+	tt, ar, err := p.Fosite.IntrospectToken(ctx, token, tokenType, session, scope...)
+	tracing.End(span, err)
+	return tt, ar, err
+}
+
+func (p tracedProvider) NewIntrospectionRequest(ctx context.Context, req *http.Request, session fosite.Session) (fosite.IntrospectionResponder, error) {
+	ctx, span := tracing.Start(ctx, "fosite.NewIntrospectionRequest")
+	ir, err := p.Fosite.NewIntrospectionRequest(ctx, req, session)
+	tracing.End(span, err)
+	return ir, err
+}
+
+// tracedHasher records a span for every hash of the client secrets
+type tracedHasher struct {
+	fosite.Hasher
+}
+
+func (h tracedHasher) Compare(ctx context.Context, hash, data []byte) error {
+	ctx, span := tracing.Start(ctx, "fosite.Hasher.Compare")
+	err := h.Hasher.Compare(ctx, hash, data)
+	tracing.End(span, err)
+	return err
+}
+
+func (h tracedHasher) Hash(ctx context.Context, data []byte) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "fosite.Hasher.Hash")
+	hash, err := h.Hasher.Hash(ctx, data)
+	tracing.End(span, err)
+	return hash, err
+}
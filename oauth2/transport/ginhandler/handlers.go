@@ -1,40 +1,209 @@
 package ginhandler
 
 import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/clientip"
 	"github.com/baozhenglab/oauth-service/config"
+	"github.com/baozhenglab/oauth-service/health"
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/metrics"
 	"github.com/baozhenglab/oauth-service/oauth2"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
 	"github.com/baozhenglab/oauth-service/oauth2/usrrepo"
 	userStorage "github.com/baozhenglab/oauth-service/oauth2/usrrepo/storage"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/setup"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/oauth-service/webhook"
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
 )
 
+// DbConnectionManager gives the connections of the SQL storage of the users,
+// it also implements storage.MgoConnectionManage for the mongo storage type
 type DbConnectionManager interface {
 	GetDB() *gorm.DB
 	GetRDB() *gorm.DB
 }
 
+// grantStore is the storage of the clients, the scopes, the webhooks and the rate limits
+type grantStore interface {
+	oauth2.ClientStorage
+	oauth2.WebhookStorage
+	webhook.Storage
+	secure.RateLimitStore
+}
+
+// newGrantStore opens the grant storage of the storage-type setting, the users are kept in SQL whatever the type
+func newGrantStore(db DbConnectionManager, cfg *config.Config) (grantStore, error) {
+	switch cfg.StorageType {
+	case config.StorageTypeMongo:
+		mgoConn, ok := db.(storage.MgoConnectionManage)
+		if !ok {
+			return nil, errors.New("storage-type mongo: the connection manager has no mongo session")
+		}
+
+		return storage.NewMongoStore(mgoConn, cfg.GetAES(), cfg.SystemSecret), nil
+	case config.StorageTypePostgres, config.StorageTypeMySQL:
+		return storage.NewSqlStore(db, cfg.GetAES(), cfg.SystemSecret), nil
+	default:
+		return nil, errors.Errorf("storage-type %q is not supported by the service", cfg.StorageType)
+	}
+}
+
+// Service is the oauth2 service: the routes of the engine and the workers running beside them,
+// the workers run between Start and Stop
+type Service struct {
+	routes     func(engine *gin.Engine)
+	dispatcher *webhook.Dispatcher
+	flushSpans func(context.Context) error
+}
+
+// Routes registers the routes of the service on the engine
+func (s *Service) Routes(engine *gin.Engine) {
+	s.routes(engine)
+}
+
+// Start starts the workers: the dispatcher of the user events written to the outbox by the user repository
+func (s *Service) Start() {
+	s.dispatcher.Start()
+}
+
+// Stop stops the workers and waits for them until ctx is done, then flushes the spans
+func (s *Service) Stop(ctx context.Context) error {
+	if err := s.dispatcher.Stop(ctx); err != nil {
+		return err
+	}
+
+	return s.flushSpans(ctx)
+}
+
+// Oauth2Handlers builds the service and starts its workers, they run until the process exits.
+// The service cannot be served on an error of NewService, it panics.
+//
+// Deprecated: use NewService, its errors are returned and its workers are stopped by Stop.
 func Oauth2Handlers(db DbConnectionManager, cfg *config.Config) func(engine *gin.Engine) {
+	s, err := NewService(db, cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	s.Start()
+	return s.Routes
+}
+
+// NewService builds the service on the storage of the storage-type setting.
+// The config is read and validated by config.Load first, the entry point does not start on its error.
+func NewService(db DbConnectionManager, cfg *config.Config) (*Service, error) {
+	clientStore, err := newGrantStore(db, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// the users of a previous version are upgraded on every start, the service is ready after it
+	if err := setup.Migrate(setup.NewSQL(cfg, db, nil)); err != nil {
+		return nil, err
+	}
+
 	userRepo := usrrepo.New(userStorage.NewSQL(db), cfg)
 
-	return func(engine *gin.Engine) {
+	// the password grant puts the roles of the user into the token
+	oauth2.SetUserAccessStorage(userRepo)
+
+	var rateLimitStore secure.RateLimitStore = secure.NewMemoryRateLimitStore()
+	if cfg.GetRateLimitStore() == config.RateLimitStoreDB {
+		rateLimitStore = clientStore
+	}
+
+	limits, err := cfg.GetRateLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimit := func(route string) func(c *gin.Context) {
+		return oauth2.RateLimitMiddleware(rateLimitStore, route, limits[route])
+	}
+
+	// the forwarded headers are only believed from the trusted proxies
+	if err := clientip.Trust(cfg.GetTrustedProxies()); err != nil {
+		return nil, err
+	}
+
+	// the pending spans are flushed by Stop
+	flushSpans, err := tracing.Init(cfg.GetTracing())
+	if err != nil {
+		return nil, err
+	}
+
+	readiness := health.NewChecker(cfg.GetHealthCheckTimeout())
+	readiness.Register("database", health.SQL(db.GetDB()))
+	if mgoConn, ok := db.(storage.MgoConnectionManage); ok && cfg.StorageType == config.StorageTypeMongo {
+		readiness.Register("mongo", health.Mongo(mgoConn.GetSession()))
+	}
+	readiness.Register("signing_key", func(context.Context) error {
+		_, err := cfg.GetPrivateKey()
+		return errors.Wrap(err, "cannot load the private key")
+	})
+	readiness.Register("setup", func(context.Context) error {
+		if !setup.Finished() {
+			return errors.New("the setup of the storage has not finished")
+		}
+		return nil
+	})
+
+	routes := func(engine *gin.Engine) {
+		// the probes are registered before the middlewares, they are neither traced, logged nor measured
+		engine.GET("/health/alive", health.AliveHandler)
+		engine.GET("/health/ready", readiness.ReadyHandler)
+
+		engine.Use(clientip.Middleware, tracing.Middleware, logging.Middleware, metrics.Middleware)
+		engine.GET("/metrics", gin.WrapH(metrics.Handler()))
+
 		g := engine.Group("oauth2")
 		{
 			g.GET("/auth", oauth2.AuthHandler)
 			g.POST("/auth", oauth2.AuthHandler)
-			g.POST("/token", oauth2.AccessTokenHandler)
+			g.POST("/token", rateLimit(config.RateLimitToken), oauth2.AccessTokenHandler)
 			g.POST("/introspect", oauth2.IntrospectionHandler)
+			g.POST("/revoke", oauth2.RevokeHandler(userRepo))
 			g.POST("/find-user", oauth2.FindUserHandler(userRepo))
+			g.GET("/verify-email", oauth2.VerifyEmailHandler(userRepo))
+			g.POST("/verify-email", oauth2.VerifyEmailHandler(userRepo))
 
-			g.POST("/generate-otp", oauth2.CheckTokenMiddleware, oauth2.GenerateOTP(userRepo))
-			g.POST("/login-otp", oauth2.CheckTokenMiddleware, oauth2.LoginWithOTP(userRepo))
+			g.POST("/generate-otp", oauth2.CheckTokenMiddleware, rateLimit(config.RateLimitGenerateOTP), oauth2.GenerateOTP(userRepo))
+			g.POST("/signup-phone", oauth2.CheckTokenMiddleware, rateLimit(config.RateLimitSignUpPhone), oauth2.SignUpWithPhone(userRepo))
+			g.POST("/login-otp", oauth2.CheckTokenMiddleware, rateLimit(config.RateLimitLoginOTP), oauth2.LoginWithOTP(userRepo))
 			g.POST("/login", oauth2.CheckTokenMiddleware, oauth2.LoginOtherCredential(userRepo))
+			g.POST("/nonce", oauth2.CheckTokenMiddleware, oauth2.NonceHandler)
+			g.POST("/login-mfa", oauth2.CheckTokenMiddleware, oauth2.LoginWithMFA(userRepo))
+			g.POST("/forgot-password", oauth2.CheckTokenMiddleware, rateLimit(config.RateLimitForgotPass), oauth2.ForgotPasswordHandler(userRepo))
+			g.POST("/reset-password", oauth2.CheckTokenMiddleware, rateLimit(config.RateLimitResetPass), oauth2.ResetPasswordHandler(userRepo))
+
+			connectors := g.Group("/connectors")
+			{
+				connectors.GET("", oauth2.ListConnectorsHandler)
+				connectors.GET("/:id/login", oauth2.ConnectorLoginHandler)
+				connectors.POST("/:id/login", oauth2.ConnectorLoginHandler)
+				connectors.GET("/:id/callback", oauth2.ConnectorCallbackHandler(userRepo))
+				connectors.POST("/:id/mfa", oauth2.ConnectorMFAHandler(userRepo))
+			}
+
+			webAuthn := g.Group("/webauthn")
+			{
+				webAuthn.Use(oauth2.CheckTokenMiddleware)
+				webAuthn.POST("/login/begin", oauth2.BeginWebAuthnLoginHandler(userRepo))
+				webAuthn.POST("/login/finish", oauth2.FinishWebAuthnLoginHandler(userRepo))
+				webAuthn.POST("/mfa/begin", oauth2.BeginWebAuthnMFAHandler(userRepo))
+				webAuthn.POST("/mfa/finish", oauth2.FinishWebAuthnLoginHandler(userRepo))
+			}
 
 			users := g.Group("/users")
 			{
 				users.Use(oauth2.CheckTokenMiddleware)
 				users.GET("/:id", oauth2.FindUserHandlerById(userRepo))
-				users.POST("", oauth2.CreateUserHandler(userRepo))
+				users.POST("", rateLimit(config.RateLimitCreateUser), oauth2.CreateUserHandler(userRepo))
 				users.PUT("/:id/update", oauth2.UpdateUserHandler(userRepo))
 				users.POST("/:id/update", oauth2.UpdateUserHandler(userRepo))
 				users.PUT("/:id/change-password", oauth2.ChangePasswordHandler(userRepo))
@@ -42,7 +211,64 @@ func Oauth2Handlers(db DbConnectionManager, cfg *config.Config) func(engine *gin
 				users.POST("/:id/set-username-password", oauth2.SetUsernamePasswordHandler(userRepo))
 				users.DELETE("/:id", oauth2.DeleteUserHandler(userRepo))
 				users.POST("/:id", oauth2.DeleteUserHandler(userRepo))
+
+				users.GET("/:id/roles", oauth2.RequireScopeMiddleware(oauth2.RootScope), oauth2.FindUserRolesHandler(userRepo))
+				users.POST("/:id/roles", oauth2.RequireScopeMiddleware(oauth2.RootScope), oauth2.AssignRoleHandler(userRepo))
+				users.DELETE("/:id/roles/:role", oauth2.RequireScopeMiddleware(oauth2.RootScope), oauth2.UnassignRoleHandler(userRepo))
+				users.POST("/:id/verify-email", oauth2.SendEmailVerificationHandler(userRepo))
+				users.POST("/:id/unlock", oauth2.RequireScopeMiddleware(oauth2.RootScope), oauth2.UnlockUserHandler(userRepo))
+
+				users.POST("/:id/mfa/totp", oauth2.RequireOwnerMiddleware, oauth2.EnrollTOTPHandler(userRepo))
+				users.POST("/:id/mfa/totp/confirm", oauth2.RequireOwnerMiddleware, oauth2.ConfirmTOTPHandler(userRepo))
+				users.POST("/:id/mfa/totp/disable", oauth2.RequireOwnerMiddleware, oauth2.DisableTOTPHandler(userRepo))
+				users.DELETE("/:id/mfa/totp", oauth2.RequireOwnerMiddleware, oauth2.DisableTOTPHandler(userRepo))
+				users.GET("/:id/mfa/recovery-codes", oauth2.RequireOwnerMiddleware, oauth2.CountRecoveryCodesHandler(userRepo))
+				users.POST("/:id/mfa/recovery-codes", oauth2.RequireOwnerMiddleware, oauth2.GenerateRecoveryCodesHandler(userRepo))
+				users.GET("/:id/mfa/trusted-devices", oauth2.RequireOwnerMiddleware, oauth2.ListTrustedDevicesHandler(userRepo))
+				users.DELETE("/:id/mfa/trusted-devices", oauth2.RequireOwnerMiddleware, oauth2.RevokeTrustedDeviceHandler(userRepo))
+				users.DELETE("/:id/mfa/trusted-devices/:device_id", oauth2.RequireOwnerMiddleware, oauth2.RevokeTrustedDeviceHandler(userRepo))
+
+				users.GET("/:id/webauthn", oauth2.RequireOwnerMiddleware, oauth2.ListWebAuthnCredentialsHandler(userRepo))
+				users.POST("/:id/webauthn/register/begin", oauth2.RequireOwnerMiddleware, oauth2.BeginWebAuthnRegistrationHandler(userRepo))
+				users.POST("/:id/webauthn/register/finish", oauth2.RequireOwnerMiddleware, oauth2.FinishWebAuthnRegistrationHandler(userRepo))
+				users.DELETE("/:id/webauthn/:credential_id", oauth2.RequireOwnerMiddleware, oauth2.RemoveWebAuthnCredentialHandler(userRepo))
+				users.POST("/:id/webauthn/reauthenticate", oauth2.RequireOwnerMiddleware, oauth2.BeginWebAuthnReauthenticationHandler(userRepo))
+
+				users.GET("/:id/identities", oauth2.RequireOwnerMiddleware, oauth2.ListIdentitiesHandler(userRepo))
+				users.POST("/:id/identities", oauth2.RequireOwnerMiddleware, oauth2.LinkIdentityHandler(userRepo))
+				users.DELETE("/:id/identities/:provider/:subject", oauth2.RequireOwnerMiddleware, oauth2.UnlinkIdentityHandler(userRepo))
+			}
+
+			roles := g.Group("/roles")
+			{
+				roles.Use(oauth2.CheckTokenMiddleware, oauth2.RequireScopeMiddleware(oauth2.RootScope))
+				roles.GET("", oauth2.ListRolesHandler(userRepo))
+				roles.POST("", oauth2.SaveRoleHandler(userRepo))
+			}
+
+			clients := g.Group("/clients")
+			{
+				clients.Use(oauth2.CheckTokenMiddleware, oauth2.RequireScopeMiddleware(oauth2.RootScope))
+				clients.POST("", oauth2.CreateClientHandler(clientStore))
+				clients.GET("/:id/webhooks", oauth2.ListWebhooksHandler(clientStore))
+				clients.POST("/:id/webhooks", oauth2.CreateWebhookHandler(clientStore))
+				clients.DELETE("/:id/webhooks/:webhook_id", oauth2.DeleteWebhookHandler(clientStore))
+			}
+
+			g.GET("/audit-events", oauth2.CheckTokenMiddleware, oauth2.RequireScopeMiddleware(oauth2.RootScope), oauth2.ListAuditEventsHandler)
+
+			scopes := g.Group("/scopes")
+			{
+				scopes.Use(oauth2.CheckTokenMiddleware)
+				scopes.GET("", oauth2.ListScopesHandler(clientStore))
+				scopes.POST("", oauth2.RequireScopeMiddleware(oauth2.RootScope), oauth2.CreateScopeHandler(clientStore))
 			}
 		}
 	}
+
+	return &Service{
+		routes:     routes,
+		dispatcher: webhook.NewDispatcher(clientStore, cfg.GetWebhookPolicy()),
+		flushSpans: flushSpans,
+	}, nil
 }
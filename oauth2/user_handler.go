@@ -2,13 +2,15 @@ package oauth2
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"strings"
 
+	"github.com/baozhenglab/oauth-service/logging"
 	//"github.com/200lab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/common"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
 	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/duo-labs/webauthn/protocol"
 	"github.com/gin-gonic/gin"
 	"github.com/ory/fosite"
 )
@@ -16,17 +18,48 @@ import (
 type UserRepo interface {
 	Find(ctx context.Context, filter *model.UserFilter) (u *model.User, err error)
 	Create(ctx context.Context, user *model.User) (u *model.User, err error)
-	CreateWithFacebook(ctx context.Context, fbId, email, clientId string) (u *model.User, err error)
-	CreateWithAccountKit(ctx context.Context, akId, email, prefix, phone, clientId string) (u *model.User, err error)
-	CreateWithGmail(ctx context.Context, email, clientId string) (u *model.User, err error)
-	CreateWithApple(ctx context.Context, appleId, email, clientId string) (u *model.User, err error)
+	CreateWithFacebook(ctx context.Context, accessToken, clientId string) (u *model.User, err error)
+	SignUpWithPhone(ctx context.Context, clientId, prefix, phone string) error
+	CreateWithGmail(ctx context.Context, idToken, nonce, clientId string) (u *model.User, err error)
+	CreateWithApple(ctx context.Context, idToken, nonce, clientId string) (u *model.User, err error)
 	ChangePassword(ctx context.Context, clientId, uid, oldPass, newPass string) error
 	UpdateUser(ctx context.Context, usrUpdate *model.UserUpdate) (*model.User, error)
 	SetUsernamePassword(ctx context.Context, user *model.CredentialAndPassword) error
-	GenerateOTP(ctx context.Context, userFilter *model.UserFilter) (string, error)
+	GenerateOTP(ctx context.Context, userFilter *model.UserFilter) error
 	LoginWithOTP(ctx context.Context, userFilter *model.UserFilter) (*model.User, error)
 	LoginWithOtherCredentialAndPassword(ctx context.Context, credential *model.CredentialAndPassword) (*model.User, error)
 	Delete(ctx context.Context, clientId, uid string) error
+	ListRoles(ctx context.Context, clientId string) ([]model.Role, error)
+	SaveRole(ctx context.Context, role *model.Role) error
+	GetUserAccess(ctx context.Context, clientId, uid string) (*model.UserAccess, error)
+	AssignRole(ctx context.Context, clientId, uid, role string) error
+	UnassignRole(ctx context.Context, clientId, uid, role string) error
+	Unlock(ctx context.Context, uid string) error
+	EnrollTOTP(ctx context.Context, uid string, proof *model.Reauthentication) (*model.TOTPEnrollment, error)
+	ConfirmTOTP(ctx context.Context, uid string, confirmation *model.TOTPConfirmation) (*model.RecoveryCodes, error)
+	DisableTOTP(ctx context.Context, uid, code, recoveryCode string) error
+	LoginWithTOTP(ctx context.Context, uid, code string) (*model.User, error)
+	GenerateRecoveryCodes(ctx context.Context, uid, code string) (*model.RecoveryCodes, error)
+	CountRecoveryCodes(ctx context.Context, uid string) (int, error)
+	LoginWithRecoveryCode(ctx context.Context, uid, code string) (*model.User, error)
+	ListTrustedDevices(ctx context.Context, uid string) ([]model.TrustedDevice, error)
+	RevokeTrustedDevice(ctx context.Context, uid, deviceId string) error
+	SendEmailVerification(ctx context.Context, uid string) error
+	VerifyEmail(ctx context.Context, token string) (*model.User, error)
+	ForgotPassword(ctx context.Context, fp *model.ForgotPassword) error
+	ResetPassword(ctx context.Context, pr *model.PasswordReset) error
+	LoginWithIdentity(ctx context.Context, clientId string, identity *model.UserIdentity) (*model.User, error)
+	ListIdentities(ctx context.Context, uid string) ([]model.UserIdentity, error)
+	LinkIdentity(ctx context.Context, clientId, uid string, link *model.IdentityLink) (*model.UserIdentity, error)
+	UnlinkIdentity(ctx context.Context, uid, provider, subject string) error
+	BeginWebAuthnRegistration(ctx context.Context, clientId, uid string, proof *model.Reauthentication) (*protocol.CredentialCreation, string, error)
+	FinishWebAuthnRegistration(ctx context.Context, clientId, uid, session, name string, response *protocol.ParsedCredentialCreationData) (*model.WebAuthnCredential, error)
+	BeginWebAuthnLogin(ctx context.Context, clientId, uid string) (*protocol.CredentialAssertion, string, error)
+	BeginWebAuthnReauthentication(ctx context.Context, clientId, uid string) (*protocol.CredentialAssertion, string, error)
+	FinishWebAuthnLogin(ctx context.Context, clientId, session string, response *protocol.ParsedCredentialAssertionData) (*model.User, error)
+	ListWebAuthnCredentials(ctx context.Context, uid string) ([]model.WebAuthnCredential, error)
+	RemoveWebAuthnCredential(ctx context.Context, uid, credentialId string, proof *model.Reauthentication) error
+	TokenRevoked(ctx context.Context, uid string) error
 }
 
 func CheckTokenMiddleware(c *gin.Context) {
@@ -34,7 +67,7 @@ func CheckTokenMiddleware(c *gin.Context) {
 	token := fosite.AccessTokenFromRequest(r)
 
 	session := newSession("introspect")
-	_, ar, err := oauth2.(*fosite.Fosite).IntrospectToken(context.Background(), token, fosite.AccessToken, session.Clone())
+	_, ar, err := oauth2.IntrospectToken(c.Request.Context(), token, fosite.AccessToken, session.Clone())
 
 	if err != nil {
 		_ = c.AbortWithError(http.StatusUnauthorized, err)
@@ -42,7 +75,44 @@ func CheckTokenMiddleware(c *gin.Context) {
 	}
 
 	c.Set("client_id", ar.GetClient().GetID())
+	c.Set("subject", ar.GetSession().GetSubject())
+	c.Set("user_id", sessionUserID(ar))
 	c.Set("client", ar.GetClient())
+	c.Set("scopes", ar.GetGrantedScopes())
+	c.Next()
+}
+
+// RequireScopeMiddleware must be used after CheckTokenMiddleware,
+// it refuses access tokens which are not granted the scope
+func RequireScopeMiddleware(scope string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		granted, _ := c.Get("scopes")
+		scopes, _ := granted.(fosite.Arguments)
+
+		if !scopeStrategy()(scopes, scope) {
+			cErr := sdkcmn.ErrNotPermission(nil, common.ErrScopeNotGranted)
+			c.AbortWithStatusJSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RequireOwnerMiddleware must be used after CheckTokenMiddleware,
+// it refuses access tokens of another user than :id unless they are granted the root scope.
+// The user is the one of the login, the subject of a token without login (client_credentials) is not an user.
+func RequireOwnerMiddleware(c *gin.Context) {
+	userId, _ := c.Get("user_id")
+	granted, _ := c.Get("scopes")
+	scopes, _ := granted.(fosite.Arguments)
+
+	if uid, _ := userId.(string); (uid == "" || uid != c.Param("id")) && !scopeStrategy()(scopes, RootScope) {
+		cErr := sdkcmn.ErrNotPermission(nil, common.ErrTokenNotOwner)
+		c.AbortWithStatusJSON(cErr.StatusCode, cErr)
+		return
+	}
+
 	c.Next()
 }
 
@@ -93,9 +163,6 @@ func CreateUserHandler(ur UserRepo) func(c *gin.Context) {
 		case "facebook":
 			createUserByFacebook(ur, c)
 			return
-		case "account-kit":
-			createUserByAccountKit(ur, c)
-			return
 		case "gmail":
 			createUserByGmail(ur, c)
 			return
@@ -106,21 +173,27 @@ func CreateUserHandler(ur UserRepo) func(c *gin.Context) {
 	}
 }
 
+// createUserByFacebook trusts only the user access token checked with Facebook, not the fb_id of the request
 func createUserByFacebook(ur UserRepo, c *gin.Context) {
-	fbId := strings.TrimSpace(c.PostForm("fb_id"))
-	email := strings.TrimSpace(c.PostForm("email"))
+	accessToken := strings.TrimSpace(c.PostForm("access_token"))
 
 	cltId, _ := c.Get("client_id")
 	clientId := cltId.(string)
 
-	newUser, err := ur.CreateWithFacebook(context.Background(), fbId, email, clientId)
+	newUser, err := ur.CreateWithFacebook(c.Request.Context(), accessToken, clientId)
 	if err != nil {
+		recordAudit(c, &model.AuditEvent{Type: model.AuditLogin}, err)
 		cErr := err.(sdkcmn.AppError)
 		c.JSON(cErr.StatusCode, cErr)
 		return
 	}
 
-	responseUserToken(newUser, c)
+	// the provider is the first factor only, like a password
+	if !challengeMFA(c, newUser, clientId, c.PostForm("device_token")) {
+		return
+	}
+
+	responseUserToken(ur, newUser, c)
 }
 
 // Create user directly
@@ -146,67 +219,65 @@ func createUserDirectly(ur UserRepo, c *gin.Context) {
 	user.ClientId = clientId.(string)
 
 	user.AccountType = model.AccTypeInternal
-	newUser, err := ur.Create(context.Background(), &user)
+	newUser, err := ur.Create(c.Request.Context(), &user)
 	if err != nil {
+		recordAudit(c, &model.AuditEvent{Type: model.AuditUserCreated}, err)
 		cErr := err.(sdkcmn.AppError)
 		c.JSON(cErr.StatusCode, cErr)
 		return
 	}
 
-	responseUserToken(newUser, c)
+	responseUserToken(ur, newUser, c)
 }
 
-func createUserByAccountKit(ur UserRepo, c *gin.Context) {
-	akId := strings.TrimSpace(c.PostForm("ak_id"))
-	email := strings.TrimSpace(c.PostForm("email"))
-	prefix := strings.TrimSpace(c.PostForm("phone_prefix"))
-	phone := strings.TrimSpace(c.PostForm("phone"))
+// createUserByGmail trusts only the id token signed by Google, not the email of the request.
+// The nonce of the id token is issued by /oauth2/nonce.
+func createUserByGmail(ur UserRepo, c *gin.Context) {
+	idToken := strings.TrimSpace(c.PostForm("id_token"))
+	nonce := c.PostForm("nonce")
 
 	cltId, _ := c.Get("client_id")
 	clientId := cltId.(string)
 
-	newUser, err := ur.CreateWithAccountKit(context.Background(), akId, email, prefix, phone, clientId)
+	newUser, err := ur.CreateWithGmail(c.Request.Context(), idToken, nonce, clientId)
 	if err != nil {
+		recordAudit(c, &model.AuditEvent{Type: model.AuditLogin}, err)
 		cErr := err.(sdkcmn.AppError)
 		c.JSON(cErr.StatusCode, cErr)
 		return
 	}
 
-	responseUserToken(newUser, c)
-}
-
-func createUserByGmail(ur UserRepo, c *gin.Context) {
-
-	email := strings.TrimSpace(c.PostForm("email"))
-
-	cltId, _ := c.Get("client_id")
-	clientId := cltId.(string)
-
-	newUser, err := ur.CreateWithGmail(context.Background(), email, clientId)
-	if err != nil {
-		cErr := err.(sdkcmn.AppError)
-		c.JSON(cErr.StatusCode, cErr)
+	// the provider is the first factor only, like a password
+	if !challengeMFA(c, newUser, clientId, c.PostForm("device_token")) {
 		return
 	}
 
-	responseUserToken(newUser, c)
+	responseUserToken(ur, newUser, c)
 }
 
+// createUserByApple trusts only the id token signed by Apple, not the apple_id of the request.
+// The nonce of the id token is issued by /oauth2/nonce.
 func createUserByApple(ur UserRepo, c *gin.Context) {
-	appleId := strings.TrimSpace(c.PostForm("apple_id"))
-	email := strings.TrimSpace(c.PostForm("email"))
+	idToken := strings.TrimSpace(c.PostForm("id_token"))
+	nonce := c.PostForm("nonce")
 
 	cltId, _ := c.Get("client_id")
 	clientId := cltId.(string)
 
-	newUser, err := ur.CreateWithApple(context.Background(), appleId, email, clientId)
+	newUser, err := ur.CreateWithApple(c.Request.Context(), idToken, nonce, clientId)
 	if err != nil {
+		recordAudit(c, &model.AuditEvent{Type: model.AuditLogin}, err)
 		cErr := err.(sdkcmn.AppError)
 		c.JSON(cErr.StatusCode, cErr)
 		return
 	}
 
-	responseUserToken(newUser, c)
+	// the provider is the first factor only, like a password
+	if !challengeMFA(c, newUser, clientId, c.PostForm("device_token")) {
+		return
+	}
+
+	responseUserToken(ur, newUser, c)
 }
 
 // Change password of an user
@@ -229,7 +300,8 @@ func ChangePasswordHandler(ur UserRepo) func(c *gin.Context) {
 			return
 		}
 
-		err := ur.ChangePassword(context.Background(), clientId, uid, p.OldPassword, p.NewPassword)
+		err := ur.ChangePassword(c.Request.Context(), clientId, uid, p.OldPassword, p.NewPassword)
+		recordAudit(c, &model.AuditEvent{Type: model.AuditPasswordChanged, SubjectId: uid}, err)
 		if err != nil {
 			cErr := err.(sdkcmn.AppError)
 			c.JSON(cErr.StatusCode, cErr)
@@ -258,6 +330,12 @@ func UpdateUserHandler(ur UserRepo) func(c *gin.Context) {
 		p.ClientId = &clientId
 
 		user, err := ur.UpdateUser(c.Request.Context(), &p)
+		if p.Password != nil && *p.Password != "" {
+			recordAudit(c, &model.AuditEvent{Type: model.AuditPasswordChanged, SubjectId: uid}, err)
+		}
+		if p.Email != nil {
+			recordAudit(c, &model.AuditEvent{Type: model.AuditEmailChanged, SubjectId: uid}, err)
+		}
 		if err != nil {
 			cErr := err.(sdkcmn.AppError)
 			c.JSON(cErr.StatusCode, cErr)
@@ -287,6 +365,7 @@ func SetUsernamePasswordHandler(ur UserRepo) func(c *gin.Context) {
 		p.ClientId = clientId
 
 		err := ur.SetUsernamePassword(c.Request.Context(), &p)
+		recordAudit(c, &model.AuditEvent{Type: model.AuditPasswordChanged, SubjectId: uid}, err)
 		if err != nil {
 			cErr := err.(sdkcmn.AppError)
 			c.JSON(cErr.StatusCode, cErr)
@@ -305,7 +384,8 @@ func DeleteUserHandler(ur UserRepo) func(c *gin.Context) {
 
 		uid := c.Param("id")
 
-		err := ur.Delete(context.Background(), clientId, uid)
+		err := ur.Delete(c.Request.Context(), clientId, uid)
+		recordAudit(c, &model.AuditEvent{Type: model.AuditUserDeleted, SubjectId: uid}, err)
 		if err != nil {
 			cErr := err.(sdkcmn.AppError)
 			c.JSON(cErr.StatusCode, cErr)
@@ -316,9 +396,24 @@ func DeleteUserHandler(ur UserRepo) func(c *gin.Context) {
 	}
 }
 
-func responseUserToken(user *model.User, c *gin.Context) {
+func responseUserToken(ur UserRepo, user *model.User, c *gin.Context) {
+	responseUserTokenWithExtra(ur, user, c, nil)
+}
+
+// responseUserTokenWithExtra adds the extra fields to the token response
+func responseUserTokenWithExtra(ur UserRepo, user *model.User, c *gin.Context, extra gin.H) {
 	client := c.MustGet("client").(fosite.Client)
 
+	login := &model.AuditEvent{Type: model.AuditLogin, ActorId: user.UserId, SubjectId: user.UserId}
+
+	if emailVerificationRequired(client, user) {
+		cErr := sdkcmn.ErrCustom(nil, common.ErrEmailNotVerified)
+		cErr.StatusCode = http.StatusForbidden
+		recordAudit(c, login, cErr)
+		c.JSON(cErr.StatusCode, cErr)
+		return
+	}
+
 	session := newSession(user.UserId)
 
 	email := ""
@@ -327,6 +422,15 @@ func responseUserToken(user *model.User, c *gin.Context) {
 	}
 	session.SetUserEmail(email)
 	session.SetUserID(user.UserId)
+	setVerifiedClaims(session, user)
+
+	access, err := ur.GetUserAccess(c.Request.Context(), client.GetID(), user.UserId)
+	if err != nil {
+		cErr := err.(sdkcmn.AppError)
+		c.JSON(cErr.StatusCode, cErr)
+		return
+	}
+	session.SetUserAccess(access)
 
 	ar := fosite.NewAccessRequest(session)
 	ar.SetRequestedScopes([]string{"root", "offline"})
@@ -334,22 +438,33 @@ func responseUserToken(user *model.User, c *gin.Context) {
 	ar.GrantTypes = []string{"password"}
 	ar.Client = client
 
-	response, err := oauth2.NewAccessResponse(context.Background(), ar)
+	response, err := oauth2.NewAccessResponse(c.Request.Context(), ar)
+
+	if user.IsNew {
+		recordAudit(c, &model.AuditEvent{Type: model.AuditUserCreated, ActorId: user.UserId, SubjectId: user.UserId}, nil)
+	}
+	recordAudit(c, login, err)
 
 	if err != nil {
-		log.Printf("Error occurred in NewAccessResponse: %+v", err)
+		logging.FromContext(c.Request.Context()).WithError(err).Error("Error occurred in NewAccessResponse")
 		oauth2.WriteAccessError(c.Writer, ar, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	data := gin.H{
 		"oauth_id":              user.UserId,
 		"access_token":          response.GetAccessToken(),
 		"refresh_token":         response.GetExtra("refresh_token"),
 		"expires_in":            response.GetExtra("expires_in"),
 		"is_new":                user.IsNew,
 		"has_username_password": user.HasUsernamePassword,
-	})
+	}
+
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	c.JSON(http.StatusOK, data)
 }
 
 func LoginOtherCredential(ur UserRepo) func(c *gin.Context) {
@@ -366,15 +481,22 @@ func LoginOtherCredential(ur UserRepo) func(c *gin.Context) {
 
 		p.ClientId = clientId
 
-		user, err := ur.LoginWithOtherCredentialAndPassword(c.Request.Context(), &p)
+		// The client IP of the context is used to count failed logins (see clientip.Middleware)
+		ctx := c.Request.Context()
+		user, err := ur.LoginWithOtherCredentialAndPassword(ctx, &p)
 
 		if err != nil {
+			recordAudit(c, &model.AuditEvent{Type: model.AuditLogin}, err)
 			cErr := err.(sdkcmn.AppError)
 			c.JSON(cErr.StatusCode, cErr)
 			return
 		}
 
-		responseUserToken(user, c)
+		if !challengeMFA(c, user, clientId, p.DeviceToken) {
+			return
+		}
+
+		responseUserToken(ur, user, c)
 	}
 }
 
@@ -395,12 +517,33 @@ func LoginWithOTP(ur UserRepo) func(c *gin.Context) {
 		user, err := ur.LoginWithOTP(c.Request.Context(), &p)
 
 		if err != nil {
+			recordAudit(c, &model.AuditEvent{Type: model.AuditLogin}, err)
 			cErr := err.(sdkcmn.AppError)
 			c.JSON(cErr.StatusCode, cErr)
 			return
 		}
 
-		responseUserToken(user, c)
+		responseUserToken(ur, user, c)
+	}
+}
+
+// SignUpWithPhone sends a code to the phone of a new user, the code is exchanged at the login-otp route
+func SignUpWithPhone(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		cid, _ := c.Get("client_id")
+
+		prefix := strings.TrimSpace(c.PostForm("phone_prefix"))
+		phone := strings.TrimSpace(c.PostForm("phone"))
+
+		err := ur.SignUpWithPhone(c.Request.Context(), cid.(string), prefix, phone)
+		recordAudit(c, &model.AuditEvent{Type: model.AuditOTPGenerated, Detail: "sign-up"}, err)
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse("ok"))
 	}
 }
 
@@ -418,14 +561,28 @@ func GenerateOTP(ur UserRepo) func(c *gin.Context) {
 
 		p.ClientId = &clientId
 
-		otp, err := ur.GenerateOTP(c.Request.Context(), &p)
-
+		// the code is delivered to the user, never to the caller
+		err := ur.GenerateOTP(c.Request.Context(), &p)
+		recordAudit(c, &model.AuditEvent{Type: model.AuditOTPGenerated, Detail: "login"}, err)
 		if err != nil {
 			cErr := err.(sdkcmn.AppError)
 			c.JSON(cErr.StatusCode, cErr)
 			return
 		}
 
-		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(otp))
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse("ok"))
+	}
+}
+
+// Clear the failed login counters of an user, this handler must be protected by the root scope
+func UnlockUserHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := ur.Unlock(c.Request.Context(), c.Param("id")); err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse("ok"))
 	}
 }
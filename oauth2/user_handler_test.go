@@ -0,0 +1,102 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/storage"
+)
+
+// newOwnerRouter serves the token endpoint and a route of the user :id behind RequireOwnerMiddleware,
+// it returns a token of the login of the user 1
+func newOwnerRouter(t *testing.T) (*gin.Engine, string) {
+	t.Helper()
+	ctx := context.Background()
+
+	config := &compose.Config{HashCost: 4}
+	secret, err := (&fosite.BCrypt{WorkFactor: 4}).Hash(ctx, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fosite.DefaultClient{ID: "client", Secret: secret, GrantTypes: []string{"client_credentials"}}
+	store := storage.NewMemoryStore()
+	store.Clients["client"] = client
+
+	strategy := compose.NewOAuth2HMACStrategy(config, []byte("some-secret-of-thirty-two-bytes!"), nil)
+	oauth2 = tracedProvider{compose.Compose(config, store, strategy, nil,
+		compose.OAuth2ClientCredentialsGrantFactory,
+		compose.OAuth2TokenIntrospectionFactory,
+	).(*fosite.Fosite)}
+
+	// the token of a password login of the user 1
+	login := &fosite.Request{ID: "login", Client: client, RequestedAt: time.Now().UTC(), Session: newSessionForPasswordGrant("1", "1")}
+	token, signature, err := strategy.GenerateAccessToken(ctx, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateAccessTokenSession(ctx, signature, login); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/token", AccessTokenHandler)
+	router.GET("/users/:id/webauthn", CheckTokenMiddleware, RequireOwnerMiddleware, func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	return router, token
+}
+
+func getAsUser(router *gin.Engine, token string) int {
+	req := httptest.NewRequest(http.MethodGet, "/users/1/webauthn", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w.Code
+}
+
+func TestRequireOwnerRefusesClientToken(t *testing.T) {
+	router, userToken := newOwnerRouter(t)
+
+	// a client_credentials token posting the id of the user as username
+	req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(url.Values{
+		"grant_type": {"client_credentials"},
+		"username":   {"1"},
+	}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("client", "secret")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("token: status = %d, body = %s", w.Code, w.Body)
+	}
+
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := getAsUser(router, response.AccessToken); code != http.StatusForbidden {
+		t.Errorf("client token: status = %d, want %d", code, http.StatusForbidden)
+	}
+
+	if code := getAsUser(router, userToken); code != http.StatusOK {
+		t.Errorf("token of the user: status = %d, want %d", code, http.StatusOK)
+	}
+}
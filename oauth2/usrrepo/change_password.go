@@ -4,12 +4,13 @@ import (
 	"context"
 
 	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
 	"github.com/baozhenglab/oauth-service/secure"
 	"github.com/baozhenglab/sdkcm"
 )
 
 func (ur *userRepository) ChangePassword(ctx context.Context, clientId, uid, oldPass, newPass string) error {
-	oldUser, err := ur.storage.Find(context.Background(), map[string]interface{}{
+	oldUser, err := ur.storage.Find(ctx, map[string]interface{}{
 		"id":        uid,
 		"client_id": clientId,
 	})
@@ -19,18 +20,31 @@ func (ur *userRepository) ChangePassword(ctx context.Context, clientId, uid, old
 	}
 
 	// If user is external, password is empty, don't need to check
-	if oldUser.Password != "" && oldUser.Password != secure.ComputeHmac256(oldPass, oldUser.Salt, ur.sm.GetSystemSecret()) {
+	if oldUser.Password != "" && !secure.VerifyPassword(ctx, oldPass, oldUser.Password, oldUser.Salt, oldUser.PasswordAlgo, ur.sm.GetSystemSecret()) {
 		return sdkcm.ErrCustom(nil, common.ErrOldPassNotCorrect)
 	}
 
-	newSalt := secure.GenerateSalt()
-	newPassHash := secure.ComputeHmac256(newPass, newSalt, ur.sm.GetSystemSecret())
+	if err := ur.checkPassword(ctx, "new_password", newPass, oldUser); err != nil {
+		return err
+	}
+
+	newPassHash, newSalt, algo := secure.HashPassword(ctx, newPass)
+
+	if err := ur.storage.Transaction(ctx, func(tx Storage) error {
+		if err := tx.Update(
+			ctx,
+			map[string]interface{}{"id": uid},
+			map[string]interface{}{"salt": newSalt, "password": newPassHash, "password_algo": algo},
+		); err != nil {
+			return err
+		}
+
+		return emit(ctx, tx, clientId, userEvent{Type: model.EventUserPasswordChanged, UserId: uid})
+	}); err != nil {
+		return sdkcm.ErrDB(err)
+	}
 
-	if err := ur.storage.Update(
-		context.Background(),
-		map[string]interface{}{"id": uid},
-		map[string]interface{}{"salt": newSalt, "password": newPassHash},
-	); err != nil {
+	if err := ur.savePasswordHistory(ctx, oldUser); err != nil {
 		return sdkcm.ErrDB(err)
 	}
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/logging"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
 	"github.com/baozhenglab/oauth-service/oauth2/storage"
 	"github.com/baozhenglab/oauth-service/secure"
@@ -22,8 +23,20 @@ func (ur *userRepository) Create(ctx context.Context, user *model.User) (u *mode
 		condMap["username"] = user.Username
 	}
 
+	user.PhoneNumber = nil
 	if user.Phone != nil && *user.Phone != "" {
-		condMap["phone"] = user.Phone
+		prefix := ""
+		if user.PhonePrefix != nil {
+			prefix = *user.PhonePrefix
+		}
+
+		p, err := normalizePhone(prefix, *user.Phone)
+		if err != nil {
+			return nil, err
+		}
+
+		user.PhonePrefix, user.Phone, user.PhoneNumber = &p.Prefix, &p.National, &p.E164
+		condMap["phone_number"] = p.E164
 	}
 
 	//if user.Email != nil && *user.Email != "" {
@@ -61,15 +74,20 @@ func (ur *userRepository) Create(ctx context.Context, user *model.User) (u *mode
 	}
 
 	// prepare data for inserting
-	user.FBId = nil // dont allow set fb id here
+	// neither the verified flags nor the second factor, they are proven later
+	user.EmailVerified, user.PhoneVerified = false, false
+	user.MfaEnabled, user.MfaSecret = false, ""
 
 	if user.Password != "" {
-		user.Salt = secure.GenerateSalt()
-		user.Password = secure.ComputeHmac256(user.Password, user.Salt, ur.sm.GetSystemSecret())
+		if err := ur.checkPassword(ctx, "password", user.Password, nil); err != nil {
+			return nil, err
+		}
+
+		user.Password, user.Salt, user.PasswordAlgo = secure.HashPassword(ctx, user.Password)
 	}
 
 	userMgo := &storage.UserSql{User: *user}
-	newUser, err := ur.storage.Create(ctx, userMgo)
+	newUser, err := ur.createUser(ctx, userMgo)
 
 	if err != nil {
 		return nil, sdkcm.ErrDB(err)
@@ -78,5 +96,12 @@ func (ur *userRepository) Create(ctx context.Context, user *model.User) (u *mode
 	newUser.UserId = fmt.Sprintf("%d", newUser.ID)
 	newUser.IsNew = true
 
+	// the account is created even when the verification cannot be sent, it can be sent again
+	if newUser.GetEmail() != "" {
+		if err := ur.sendEmailVerification(ctx, newUser); err != nil {
+			logging.FromContext(ctx).WithError(err).Error("Error occurred in email verification")
+		}
+	}
+
 	return &newUser.User, nil
 }
@@ -2,71 +2,32 @@ package usrrepo
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/baozhenglab/oauth-service/common"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
-	"github.com/baozhenglab/oauth-service/oauth2/storage"
 	"github.com/baozhenglab/sdkcm"
 )
 
-func (ur *userRepository) CreateWithApple(ctx context.Context, appleId, email, clientId string) (u *model.User, err error) {
-	if appleId == "" {
-		return nil, sdkcm.ErrCustom(nil, common.ErrAppleIdCannotBeEmpty)
-	}
-
-	oldUser, err := ur.storage.FindWithAppleIdAndEmail(context.Background(), appleId, email)
-
-	if err != nil && err.Error() != common.ErrDataNotFound.Error() {
-		return nil, sdkcm.ErrCannotFetchData(err)
-	}
-
-	if oldUser != nil {
-		// update to db
-		if oldUser.AppleId != nil && *oldUser.AppleId != appleId ||
-			(oldUser.AccountType != model.AccTypeExternal && oldUser.AccountType != model.AccTypeBoth) {
-			updateData := map[string]interface{}{
-				"apple_id":     appleId,
-				"account_type": model.AccTypeBoth,
-			}
-
-			if email != "" && oldUser.Email != nil && *oldUser.Email != email {
-				updateData["email"] = email
-			}
-
-			if err := ur.storage.Update(context.Background(),
-				map[string]interface{}{"id": oldUser.ID},
-				updateData); err != nil {
-				return nil, sdkcm.ErrDB(err)
-			}
-			oldUser.AppleId = &appleId
-			oldUser.AccountType = model.AccTypeBoth
-		}
-		oldUser.UserId = fmt.Sprintf("%d", oldUser.ID)
-		oldUser.IsNew = false
-		oldUser.HasUsernamePassword = oldUser.Username != nil && oldUser.Password != ""
-
-		return &oldUser.User, nil
-	}
-
-	newUser := &storage.UserSql{
-		User: model.User{
-			AppleId:     &appleId,
-			Email:       &email,
-			AccountType: model.AccTypeExternal,
-			ClientId:    clientId,
-		},
+// CreateWithApple logs in with the id token of Sign in with Apple,
+// the Apple id is the subject of the verified claims and the email is only linked when Apple verified it
+func (ur *userRepository) CreateWithApple(ctx context.Context, idToken, nonce, clientId string) (u *model.User, err error) {
+	if idToken == "" {
+		return nil, sdkcm.ErrCustom(nil, common.ErrIdTokenCannotBeEmpty)
 	}
 
-	nu, err := ur.storage.Create(context.Background(), newUser)
-
+	claims, err := ur.verifyIDToken(ctx, ur.sm.GetAppleIDTokenVerifier(), clientId, idToken, nonce)
 	if err != nil {
-		return nil, sdkcm.ErrDB(err)
+		return nil, err
 	}
 
-	nu.UserId = fmt.Sprintf("%d", newUser.ID)
-	nu.IsNew = true
-	nu.HasUsernamePassword = nu.Username != nil && nu.Password != ""
+	if claims.Subject == "" {
+		return nil, sdkcm.ErrCustom(nil, common.ErrAppleIdCannotBeEmpty)
+	}
 
-	return &nu.User, nil
+	return ur.LoginWithIdentity(ctx, clientId, &model.UserIdentity{
+		Provider:      model.IdentityApple,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.IsEmailVerified() && claims.Email != "",
+	})
 }
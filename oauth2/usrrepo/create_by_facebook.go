@@ -2,78 +2,47 @@ package usrrepo
 
 import (
 	"context"
-	"fmt"
 	"strings"
 
 	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/logging"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
-	"github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/secure"
 	"github.com/baozhenglab/sdkcm"
+	"github.com/pkg/errors"
 )
 
-func (ur *userRepository) CreateWithFacebook(ctx context.Context, fbId, email, clientId string) (u *model.User, err error) {
-	if fbId == "" {
-		return nil, sdkcm.ErrCustom(nil, common.ErrFbIdCannotBeEmpty)
-	}
-
-	email = strings.TrimSpace(email)
-
-	oldUser, err := ur.storage.FindWithFbIdAndEmail(context.Background(), fbId, email)
-
-	if err != nil && err.Error() != common.ErrDataNotFound.Error() {
-		return nil, sdkcm.ErrCannotFetchData(err)
+// CreateWithFacebook logs in with a user access token of our Facebook app,
+// the Facebook id and the email are those of the token checked with the Graph API
+func (ur *userRepository) CreateWithFacebook(ctx context.Context, accessToken, clientId string) (u *model.User, err error) {
+	if accessToken == "" {
+		return nil, sdkcm.ErrCustom(nil, common.ErrFbAccessTokenCannotBeEmpty)
 	}
 
-	if oldUser != nil {
-		// update to db
-		if oldUser.FBId != nil && *oldUser.FBId != fbId ||
-			(oldUser.AccountType != model.AccTypeExternal && oldUser.AccountType != model.AccTypeBoth) {
-			updateData := map[string]interface{}{
-				"fb_id":        fbId,
-				"account_type": model.AccTypeBoth,
-			}
-
-			//if email != "" && oldUser.Email != nil && *oldUser.Email != email {
-			//	updateData["email"] = email
-			//}
-
-			if err := ur.storage.Update(context.Background(),
-				map[string]interface{}{"id": oldUser.ID},
-				updateData); err != nil {
-				return nil, sdkcm.ErrDB(err)
-			}
-			oldUser.FBId = &fbId
-			oldUser.AccountType = model.AccTypeBoth
-		}
-
-		oldUser.UserId = fmt.Sprintf("%d", oldUser.ID)
-		oldUser.IsNew = false
-		oldUser.HasUsernamePassword = oldUser.Username != nil && oldUser.Password != ""
-
-		return &oldUser.User, nil
+	fbUser, err := ur.sm.GetFacebookVerifier().Verify(ctx, accessToken)
+	if err != nil {
+		return nil, facebookError(ctx, err)
 	}
 
-	newUser := &storage.UserSql{
-		User: model.User{
-			FBId:        &fbId,
-			AccountType: model.AccTypeExternal,
-			ClientId:    clientId,
-		},
+	if fbUser.Id == "" {
+		return nil, sdkcm.ErrCustom(nil, common.ErrFbIdCannotBeEmpty)
 	}
 
-	//if email != "" {
-	//	newUser.User.Email = &email
-	//}
-
-	nu, err := ur.storage.Create(context.Background(), newUser)
+	// the email comes from Facebook, but Facebook does not tell if it was confirmed
+	return ur.LoginWithIdentity(ctx, clientId, &model.UserIdentity{
+		Provider: model.IdentityFacebook,
+		Subject:  fbUser.Id,
+		Email:    strings.ToLower(strings.TrimSpace(fbUser.Email)),
+	})
+}
 
-	if err != nil {
-		return nil, sdkcm.ErrDB(err)
+// facebookError answers a failed check of a token, only the refusals of Facebook are told to the caller:
+// the errors of the calls to the Graph API are logged
+func facebookError(ctx context.Context, err error) error {
+	if errors.Cause(err) == secure.ErrFacebookTokenInvalid {
+		return sdkcm.ErrCustom(err, common.ErrFbAccessTokenInvalid)
 	}
 
-	nu.UserId = fmt.Sprintf("%d", newUser.ID)
-	nu.IsNew = true
-	nu.HasUsernamePassword = nu.Username != nil && nu.Password != ""
-
-	return &nu.User, nil
+	logging.FromContext(ctx).WithError(err).Error("Error occurred in checking a facebook token")
+	return sdkcm.ErrServer(nil, common.ErrFbUnavailable)
 }
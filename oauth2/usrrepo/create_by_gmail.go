@@ -2,64 +2,34 @@ package usrrepo
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/baozhenglab/oauth-service/common"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
-	"github.com/baozhenglab/oauth-service/oauth2/storage"
 	"github.com/baozhenglab/sdkcm"
 )
 
-func (ur *userRepository) CreateWithGmail(ctx context.Context, email, clientId string) (u *model.User, err error) {
-	if email == "" {
-		return nil, sdkcm.ErrCustom(nil, common.ErrEmailCannotBeEmpty)
+// CreateWithGmail logs in with the id token of Sign in with Google, the email is taken from the verified claims.
+// An existing account with a password is only linked when it has proven the ownership of the email,
+// otherwise whoever registered the email first would keep a password on the account.
+func (ur *userRepository) CreateWithGmail(ctx context.Context, idToken, nonce, clientId string) (u *model.User, err error) {
+	if idToken == "" {
+		return nil, sdkcm.ErrCustom(nil, common.ErrIdTokenCannotBeEmpty)
 	}
 
-	oldUser, err := ur.storage.Find(context.Background(), map[string]interface{}{
-		"email": email,
-	})
-
-	if err != nil && err.Error() != common.ErrDataNotFound.Error() {
-		return nil, sdkcm.ErrCannotFetchData(err)
-	}
-
-	if oldUser != nil {
-		if oldUser.AccountType != model.AccTypeExternal && oldUser.AccountType != model.AccTypeBoth {
-			if err := ur.storage.Update(context.Background(),
-				map[string]interface{}{"id": oldUser.ID},
-				map[string]interface{}{
-					"email":        email,
-					"account_type": model.AccTypeBoth,
-				}); err != nil {
-				return nil, sdkcm.ErrDB(err)
-			}
-		}
-		oldUser.Email = &email
-		oldUser.UserId = fmt.Sprintf("%d", oldUser.ID)
-
-		oldUser.IsNew = false
-		oldUser.HasUsernamePassword = oldUser.Username != nil && oldUser.Password != ""
-
-		return &oldUser.User, nil
-	}
-
-	newUser := &storage.UserSql{
-		User: model.User{
-			Email:       &email,
-			AccountType: model.AccTypeExternal,
-			ClientId:    clientId,
-		},
-	}
-
-	nu, err := ur.storage.Create(context.Background(), newUser)
-
+	claims, err := ur.verifyIDToken(ctx, ur.sm.GetGoogleIDTokenVerifier(), clientId, idToken, nonce)
 	if err != nil {
-		return nil, sdkcm.ErrDB(err)
+		return nil, err
 	}
 
-	nu.UserId = fmt.Sprintf("%d", newUser.ID)
-	nu.IsNew = true
-	nu.HasUsernamePassword = nu.Username != nil && nu.Password != ""
+	// an unverified email of a Google account does not prove anything
+	if claims.Email == "" || !claims.IsEmailVerified() {
+		return nil, sdkcm.ErrCustom(nil, common.ErrEmailOwnershipUnverified)
+	}
 
-	return &nu.User, nil
+	return ur.LoginWithIdentity(ctx, clientId, &model.UserIdentity{
+		Provider:      model.IdentityGoogle,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: true,
+	})
 }
@@ -4,11 +4,12 @@ import (
 	"context"
 
 	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
 	"github.com/baozhenglab/sdkcm"
 )
 
 func (ur *userRepository) Delete(ctx context.Context, clientId, uid string) error {
-	_, err := ur.storage.Find(context.Background(), map[string]interface{}{
+	user, err := ur.storage.Find(ctx, map[string]interface{}{
 		"id":        uid,
 		"client_id": clientId,
 	})
@@ -17,10 +18,17 @@ func (ur *userRepository) Delete(ctx context.Context, clientId, uid string) erro
 		return sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
 	}
 
-	if err := ur.storage.Delete(
-		context.Background(),
-		uid,
-	); err != nil {
+	if err := ur.storage.Transaction(ctx, func(tx Storage) error {
+		if err := tx.Delete(ctx, uid); err != nil {
+			return err
+		}
+
+		// the tokens of the user are deleted with it
+		return emit(ctx, tx, user.ClientId,
+			userEvent{Type: model.EventUserDeleted, UserId: uid},
+			userEvent{Type: model.EventTokenRevoked, UserId: uid},
+		)
+	}); err != nil {
 		return sdkcm.ErrDB(err)
 	}
 
@@ -0,0 +1,115 @@
+package usrrepo
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/sender"
+	"github.com/baozhenglab/sdkcm"
+)
+
+// SendEmailVerification mails a link proving the ownership of the email of the user
+func (ur *userRepository) SendEmailVerification(ctx context.Context, uid string) error {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	if user.GetEmail() == "" {
+		return sdkcm.ErrCustom(nil, common.ErrEmailCannotBeEmpty)
+	}
+
+	if user.EmailVerified {
+		return sdkcm.ErrCustom(nil, common.ErrEmailAlreadyVerified)
+	}
+
+	return ur.sendEmailVerification(ctx, user)
+}
+
+func (ur *userRepository) sendEmailVerification(ctx context.Context, user *storage.UserSql) error {
+	uid := fmt.Sprintf("%d", user.ID)
+	ttl := ur.sm.GetEmailVerificationTTL()
+
+	token, err := secure.IssueActionToken(ur.sm.GetAES(), secure.PurposeVerifyEmail, uid, user.GetEmail(), ttl)
+	if err != nil {
+		return sdkcm.ErrInvalidRequest(err)
+	}
+
+	msg := &sender.MailMessage{
+		Template: sender.TemplateVerifyEmail,
+		To:       user.GetEmail(),
+		Link:     actionLink(ur.sm.GetEmailVerificationURL(), url.Values{"token": {token}}),
+		Token:    token,
+		TTL:      ttl,
+		ClientId: user.ClientId,
+		UserId:   uid,
+	}
+
+	if err := ur.sm.GetMailer().SendMail(ctx, msg); err != nil {
+		return sdkcm.ErrCustom(err, common.ErrEmailCannotBeSent)
+	}
+
+	return nil
+}
+
+// VerifyEmail confirms the email of the token, the token is refused when the email of the user has changed since
+func (ur *userRepository) VerifyEmail(ctx context.Context, token string) (*model.User, error) {
+	t, err := secure.ParseActionToken(ur.sm.GetAES(), token, secure.PurposeVerifyEmail)
+	if err != nil {
+		return nil, sdkcm.ErrCustom(err, common.ErrVerificationTokenInvalid)
+	}
+
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": t.UserId})
+	if err != nil {
+		return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	if user.GetEmail() != t.Email {
+		return nil, sdkcm.ErrCustom(nil, common.ErrVerificationTokenInvalid)
+	}
+
+	if !user.EmailVerified {
+		if err := ur.storage.Transaction(ctx, func(tx Storage) error {
+			if err := tx.Update(ctx,
+				map[string]interface{}{"id": t.UserId},
+				map[string]interface{}{"email_verified": true},
+			); err != nil {
+				return err
+			}
+
+			e, err := updatedEvent(ctx, tx, t.UserId)
+			if err != nil {
+				return err
+			}
+
+			return emit(ctx, tx, user.ClientId, e)
+		}); err != nil {
+			return nil, sdkcm.ErrDB(err)
+		}
+		user.EmailVerified = true
+	}
+
+	user.User.UserId = t.UserId
+	return &user.User, nil
+}
+
+// actionLink adds the parameters, like the token, to the page of the link
+func actionLink(page string, params url.Values) string {
+	u, err := url.Parse(page)
+	if err != nil {
+		return page + "?" + params.Encode()
+	}
+
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
@@ -8,7 +8,18 @@ import (
 )
 
 func (ur *userRepository) Find(ctx context.Context, filter *model.UserFilter) (u *model.User, err error) {
-	sqlUser, err := ur.storage.Find(ctx, filter.Map())
+	cond := phoneCond(filter.Map(), filter.PhonePrefix)
+
+	if provider, subject, ok := filter.Identity(); ok {
+		identity, err := ur.storage.FindIdentity(ctx, provider, subject)
+		if err != nil {
+			return nil, err
+		}
+
+		cond["id"] = identity.UserId
+	}
+
+	sqlUser, err := ur.storage.Find(ctx, cond)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,248 @@
+package usrrepo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/sdkcm"
+)
+
+// LoginWithIdentity signs in the user of an external identity, just in time:
+//   - a known identity logs in its user
+//   - an identity with a verified email is linked to the user of the email in the client, when the user verified it too
+//   - otherwise a new external user is created
+func (ur *userRepository) LoginWithIdentity(ctx context.Context, clientId string, identity *model.UserIdentity) (*model.User, error) {
+	linked, err := ur.storage.FindIdentity(ctx, identity.Provider, identity.Subject)
+	if err != nil && err.Error() != common.ErrDataNotFound.Error() {
+		return nil, sdkcm.ErrCannotFetchData(err)
+	}
+
+	if linked != nil {
+		user, err := ur.storage.Find(ctx, map[string]interface{}{"id": linked.UserId})
+		if err != nil {
+			return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+		}
+
+		return loggedInUser(user, false), nil
+	}
+
+	var user *storage.UserSql
+
+	if identity.Email != "" && identity.EmailVerified {
+		user, err = ur.storage.Find(ctx, map[string]interface{}{"email": identity.Email, "client_id": clientId})
+		if err != nil && err.Error() != common.ErrDataNotFound.Error() {
+			return nil, sdkcm.ErrCannotFetchData(err)
+		}
+	}
+
+	isNew := user == nil
+
+	if user != nil {
+		// the email of the provider proves nothing until the account proved it too: an unverified account,
+		// with or without password, may have been registered by someone else to take over the provider login
+		if !user.EmailVerified {
+			return nil, sdkcm.ErrCustom(nil, common.ErrEmailOwnershipUnverified)
+		}
+
+		if user.AccountType != model.AccTypeExternal && user.AccountType != model.AccTypeBoth {
+			if err := ur.storage.Update(ctx,
+				map[string]interface{}{"id": user.ID},
+				map[string]interface{}{"account_type": model.AccTypeBoth},
+			); err != nil {
+				return nil, sdkcm.ErrDB(err)
+			}
+		}
+	} else {
+		newUser := &storage.UserSql{
+			User: model.User{
+				AccountType:   model.AccTypeExternal,
+				ClientId:      clientId,
+				EmailVerified: identity.EmailVerified,
+			},
+		}
+
+		if identity.Email != "" {
+			newUser.Email = &identity.Email
+		}
+
+		if user, err = ur.createUser(ctx, newUser); err != nil {
+			return nil, sdkcm.ErrDB(err)
+		}
+	}
+
+	identity.UserId = fmt.Sprintf("%d", user.ID)
+	if err := ur.storage.AddIdentity(ctx, identity); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	return loggedInUser(user, isNew), nil
+}
+
+func loggedInUser(user *storage.UserSql, isNew bool) *model.User {
+	user.UserId = fmt.Sprintf("%d", user.ID)
+	user.IsNew = isNew
+	user.HasUsernamePassword = user.Username != nil && user.Password != ""
+
+	return &user.User
+}
+
+func (ur *userRepository) ListIdentities(ctx context.Context, uid string) ([]model.UserIdentity, error) {
+	identities, err := ur.storage.FindIdentities(ctx, uid)
+	if err != nil {
+		return nil, sdkcm.ErrCannotFetchData(err)
+	}
+
+	return identities, nil
+}
+
+// LinkIdentity adds the account of a provider to the user, the account is proven with a token of the provider.
+// Linking lets the account sign in as the user, so the user gives a fresh proof first, even without a password.
+func (ur *userRepository) LinkIdentity(ctx context.Context, clientId, uid string, link *model.IdentityLink) (*model.UserIdentity, error) {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid, "client_id": clientId})
+	if err != nil {
+		return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	if err := ur.reauthenticate(ctx, user, &link.Reauthentication); err != nil {
+		return nil, err
+	}
+
+	identity, err := ur.verifyIdentity(ctx, clientId, link)
+	if err != nil {
+		return nil, err
+	}
+
+	linked, err := ur.storage.FindIdentity(ctx, identity.Provider, identity.Subject)
+	if err != nil && err.Error() != common.ErrDataNotFound.Error() {
+		return nil, sdkcm.ErrCannotFetchData(err)
+	}
+
+	identity.UserId = fmt.Sprintf("%d", user.ID)
+
+	if linked != nil {
+		if linked.UserId != identity.UserId {
+			return nil, sdkcm.ErrCustom(nil, common.ErrIdentityAlreadyLinked)
+		}
+
+		return linked, nil
+	}
+
+	if err := ur.storage.AddIdentity(ctx, identity); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	if user.AccountType == model.AccTypeInternal {
+		if err := ur.storage.Update(ctx, map[string]interface{}{"id": user.ID}, map[string]interface{}{"account_type": model.AccTypeBoth}); err != nil {
+			return nil, sdkcm.ErrDB(err)
+		}
+	}
+
+	return identity, nil
+}
+
+// verifyIdentity checks the token of a built-in provider, the connectors are linked by their login
+func (ur *userRepository) verifyIdentity(ctx context.Context, clientId string, link *model.IdentityLink) (*model.UserIdentity, error) {
+	switch link.Provider {
+	case model.IdentityFacebook:
+		if link.AccessToken == "" {
+			return nil, sdkcm.ErrCustom(nil, common.ErrFbAccessTokenCannotBeEmpty)
+		}
+
+		fbUser, err := ur.sm.GetFacebookVerifier().Verify(ctx, link.AccessToken)
+		if err != nil {
+			return nil, facebookError(ctx, err)
+		}
+
+		if fbUser.Id == "" {
+			return nil, sdkcm.ErrCustom(nil, common.ErrFbAccessTokenInvalid)
+		}
+
+		return &model.UserIdentity{Provider: model.IdentityFacebook, Subject: fbUser.Id, Email: fbUser.Email}, nil
+	case model.IdentityGoogle, model.IdentityApple:
+		if link.IdToken == "" {
+			return nil, sdkcm.ErrCustom(nil, common.ErrIdTokenCannotBeEmpty)
+		}
+
+		verifier := ur.sm.GetGoogleIDTokenVerifier()
+		if link.Provider == model.IdentityApple {
+			verifier = ur.sm.GetAppleIDTokenVerifier()
+		}
+
+		claims, err := ur.verifyIDToken(ctx, verifier, clientId, link.IdToken, link.Nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		return &model.UserIdentity{
+			Provider:      link.Provider,
+			Subject:       claims.Subject,
+			Email:         claims.Email,
+			EmailVerified: claims.IsEmailVerified() && claims.Email != "",
+		}, nil
+	default:
+		return nil, sdkcm.ErrCustom(nil, common.ErrIdentityProviderNotLinkable)
+	}
+}
+
+// verifyIDToken checks an id token of Google or Apple, its nonce must be issued by /oauth2/nonce for the client.
+// The nonce is used up by a valid token only, a forged token does not spend the nonce of the client.
+func (ur *userRepository) verifyIDToken(ctx context.Context, verifier *secure.IDTokenVerifier, clientId, idToken, nonce string) (*secure.IDTokenClaims, error) {
+	claims, err := verifier.Verify(ctx, idToken, nonce)
+	if err != nil {
+		return nil, sdkcm.ErrCustom(err, common.ErrIdTokenInvalid)
+	}
+
+	if err := secure.UseLoginNonce(ctx, ur.sm.GetAES(), ur.sm.GetLockout().Counter, nonce, clientId); err != nil {
+		return nil, sdkcm.ErrCustom(err, common.ErrIdTokenInvalid)
+	}
+
+	return claims, nil
+}
+
+// UnlinkIdentity removes an external account of the user, unless the user could not sign in anymore:
+// it must keep a password, a passkey or another identity
+func (ur *userRepository) UnlinkIdentity(ctx context.Context, uid, provider, subject string) error {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	identities, err := ur.storage.FindIdentities(ctx, uid)
+	if err != nil {
+		return sdkcm.ErrCannotFetchData(err)
+	}
+
+	found, others := false, 0
+	for _, identity := range identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			found = true
+		} else {
+			others++
+		}
+	}
+
+	if !found {
+		return sdkcm.ErrCustom(nil, common.ErrDataNotFound)
+	}
+
+	if user.Password == "" && others == 0 {
+		credentials, err := ur.storage.FindWebAuthnCredentials(ctx, uid)
+		if err != nil {
+			return sdkcm.ErrCannotFetchData(err)
+		}
+
+		if len(credentials) == 0 {
+			return sdkcm.ErrCustom(nil, common.ErrLastLoginMethod)
+		}
+	}
+
+	if err := ur.storage.RemoveIdentity(ctx, uid, provider, subject); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
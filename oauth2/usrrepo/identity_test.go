@@ -0,0 +1,42 @@
+package usrrepo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+)
+
+func TestLinkIdentityRequiresReauthentication(t *testing.T) {
+	ur, s := newWebAuthnRepository(t)
+	ctx := context.Background()
+
+	// an external user has no password, the token of the new provider alone does not prove the user
+	s.user.Password = ""
+	link := &model.IdentityLink{Provider: model.IdentityFacebook, AccessToken: "token"}
+
+	if _, err := ur.LinkIdentity(ctx, testClientId, testUserId, link); errCode(err) != common.ErrReauthenticationRequired.Key() {
+		t.Errorf("without proof: err = %v, want %s", err, common.ErrReauthenticationRequired.Key())
+	}
+
+	link.Password = testPassword
+	if _, err := ur.LinkIdentity(ctx, testClientId, testUserId, link); errCode(err) != common.ErrReauthenticationRequired.Key() {
+		t.Errorf("password of an user without password: err = %v, want %s", err, common.ErrReauthenticationRequired.Key())
+	}
+}
+
+func TestLoginWithIdentityRefusesUnverifiedAccount(t *testing.T) {
+	ur, s := newWebAuthnRepository(t)
+	ctx := context.Background()
+
+	// an account registered with the email of the victim, without password, waits for the provider login
+	email := "alice@example.com"
+	s.user.Email = &email
+	s.user.Password = ""
+	identity := &model.UserIdentity{Provider: model.IdentityGoogle, Subject: "google-alice", Email: email, EmailVerified: true}
+
+	if _, err := ur.LoginWithIdentity(ctx, testClientId, identity); errCode(err) != common.ErrEmailOwnershipUnverified.Key() {
+		t.Errorf("unverified account: err = %v, want %s", err, common.ErrEmailOwnershipUnverified.Key())
+	}
+}
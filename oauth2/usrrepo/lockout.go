@@ -0,0 +1,86 @@
+package usrrepo
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/clientip"
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/sdkcm"
+)
+
+// credentialLockKeys returns the account and IP keys of a login with a credential and a password
+func credentialLockKeys(ctx context.Context, credential *model.CredentialAndPassword) []string {
+	identifier := credential.Username
+	if identifier == "" && credential.Email != nil {
+		identifier = *credential.Email
+	}
+	if identifier == "" && credential.Phone != nil {
+		identifier = *credential.Phone
+	}
+
+	keys := []string{secure.AccountLockKey(credential.ClientId, identifier)}
+
+	if ip := clientip.FromContext(ctx); ip != "" {
+		keys = append(keys, secure.IPLockKey(ip))
+	}
+
+	return keys
+}
+
+func (ur *userRepository) checkLockout(ctx context.Context, keys []string) error {
+	state, err := ur.sm.GetLockout().Check(ctx, keys...)
+	if err != nil {
+		return sdkcm.ErrCannotFetchData(err)
+	}
+
+	if state == nil {
+		return nil
+	}
+
+	if state.Locked {
+		return sdkcm.ErrCustom(nil, common.ErrAccountLocked)
+	}
+
+	return sdkcm.ErrCustom(nil, common.ErrTooManyLoginAttempts)
+}
+
+// Unlock clears the failed login counters of all the identifiers of an user
+func (ur *userRepository) Unlock(ctx context.Context, uid string) error {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	var keys []string
+	for _, identifier := range []*string{user.Username, user.Email, user.Phone} {
+		if identifier != nil && *identifier != "" {
+			keys = append(keys, secure.AccountLockKey(user.ClientId, *identifier))
+		}
+	}
+
+	keys = append(keys, secure.MFALockKey(uid))
+
+	if err := ur.sm.GetLockout().Reset(ctx, keys...); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
+
+// recordFailure counts a failed check, a failure which cannot be counted is logged and does not fail the login
+func (ur *userRepository) recordFailure(ctx context.Context, keys ...string) {
+	if err := ur.sm.GetLockout().Fail(ctx, keys...); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in recording a failed login")
+	}
+}
+
+// recordSuccess clears the counter of the account, the IP counter is kept
+// so an attacker cannot reset it with an account of its own
+func (ur *userRepository) recordSuccess(ctx context.Context, key string) {
+	if err := ur.sm.GetLockout().Reset(ctx, key); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in resetting the failed logins")
+	}
+}
@@ -0,0 +1,284 @@
+package usrrepo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/sdkcm"
+)
+
+// EnrollTOTP generates a new TOTP secret for the user after a fresh proof, MFA is enabled once a code is confirmed.
+// The secret is stored encrypted.
+func (ur *userRepository) EnrollTOTP(ctx context.Context, uid string, proof *model.Reauthentication) (*model.TOTPEnrollment, error) {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	if user.MfaEnabled {
+		return nil, sdkcm.ErrCustom(nil, common.ErrMFAAlreadyEnabled)
+	}
+
+	if err := ur.reauthenticate(ctx, user, proof); err != nil {
+		return nil, err
+	}
+
+	secret := secure.GenerateTOTPSecret()
+	encrypted, err := ur.sm.GetAES().Encrypt([]byte(secret))
+	if err != nil {
+		return nil, sdkcm.ErrInvalidRequest(err)
+	}
+
+	if err := ur.storage.Update(ctx,
+		map[string]interface{}{"id": uid},
+		map[string]interface{}{"mfa_secret": encrypted, "mfa_enabled": false, "mfa_last_step": 0},
+	); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	account := user.GetUsername()
+	if account == "" {
+		account = user.GetEmail()
+	}
+	if account == "" {
+		account = uid
+	}
+
+	return &model.TOTPEnrollment{
+		Secret: secret,
+		URI:    secure.TOTPURI(ur.sm.GetMFAIssuer(), account, secret),
+	}, nil
+}
+
+// ConfirmTOTP enables MFA with the first code of the enrolled authenticator,
+// the fresh proof of the user is required again and the first recovery codes are returned
+func (ur *userRepository) ConfirmTOTP(ctx context.Context, uid string, confirmation *model.TOTPConfirmation) (*model.RecoveryCodes, error) {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	if user.MfaEnabled {
+		return nil, sdkcm.ErrCustom(nil, common.ErrMFAAlreadyEnabled)
+	}
+
+	if err := ur.reauthenticate(ctx, user, &confirmation.Reauthentication); err != nil {
+		return nil, err
+	}
+
+	if err := ur.checkTOTP(ctx, user, confirmation.Code); err != nil {
+		return nil, err
+	}
+
+	if err := ur.storage.Update(ctx,
+		map[string]interface{}{"id": uid},
+		map[string]interface{}{"mfa_enabled": true},
+	); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	return ur.replaceRecoveryCodes(ctx, uid)
+}
+
+// DisableTOTP removes the second factor, the current factor is required:
+// a code of the authenticator, or a recovery code when the authenticator is lost
+func (ur *userRepository) DisableTOTP(ctx context.Context, uid, code, recoveryCode string) error {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	if !user.MfaEnabled {
+		return sdkcm.ErrCustom(nil, common.ErrMFANotEnrolled)
+	}
+
+	if code == "" && recoveryCode != "" {
+		err = ur.useRecoveryCode(ctx, user, uid, recoveryCode)
+	} else {
+		err = ur.checkTOTP(ctx, user, code)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := ur.storage.Update(ctx,
+		map[string]interface{}{"id": uid},
+		map[string]interface{}{"mfa_secret": "", "mfa_enabled": false, "mfa_last_step": 0},
+	); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if err := ur.storage.ReplaceRecoveryCodes(ctx, uid, nil); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if err := ur.storage.RemoveTrustedDevices(ctx, uid, ""); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
+
+// LoginWithTOTP is the second step of a login of an user enrolled in MFA
+func (ur *userRepository) LoginWithTOTP(ctx context.Context, uid, code string) (*model.User, error) {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	if !user.MfaEnabled {
+		return nil, sdkcm.ErrCustom(nil, common.ErrMFANotEnrolled)
+	}
+
+	if err := ur.checkTOTP(ctx, user, code); err != nil {
+		return nil, err
+	}
+
+	user.User.UserId = fmt.Sprintf("%d", user.ID)
+	return &user.User, nil
+}
+
+// checkTOTP validates a code of the user, wrong codes count for the account lockout
+func (ur *userRepository) checkTOTP(ctx context.Context, user *storage.UserSql, code string) error {
+	if user.MfaSecret == "" {
+		return sdkcm.ErrCustom(nil, common.ErrMFANotEnrolled)
+	}
+
+	lockKey := secure.MFALockKey(fmt.Sprintf("%d", user.ID))
+	if err := ur.checkLockout(ctx, []string{lockKey}); err != nil {
+		return err
+	}
+
+	step, ok, err := secure.CheckTOTP(ur.sm.GetAES(), user.MfaSecret, code, user.MfaLastStep)
+	if err != nil {
+		return sdkcm.ErrCannotFetchData(err)
+	}
+
+	if !ok {
+		ur.recordFailure(ctx, lockKey)
+		return sdkcm.ErrCustom(nil, common.ErrMFACodeInvalid)
+	}
+
+	// a code cannot be used twice, even by concurrent requests
+	used, err := ur.storage.UpdateIf(ctx,
+		map[string]interface{}{"id": fmt.Sprintf("%d", user.ID), "mfa_last_step": user.MfaLastStep},
+		map[string]interface{}{"mfa_last_step": step},
+	)
+	if err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if !used {
+		return sdkcm.ErrCustom(nil, common.ErrMFACodeInvalid)
+	}
+
+	ur.recordSuccess(ctx, lockKey)
+	return nil
+}
+
+// GenerateRecoveryCodes replaces the recovery codes of an user enrolled in MFA,
+// a code of the authenticator is required
+func (ur *userRepository) GenerateRecoveryCodes(ctx context.Context, uid, code string) (*model.RecoveryCodes, error) {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	if !user.MfaEnabled {
+		return nil, sdkcm.ErrCustom(nil, common.ErrMFANotEnrolled)
+	}
+
+	if err := ur.checkTOTP(ctx, user, code); err != nil {
+		return nil, err
+	}
+
+	return ur.replaceRecoveryCodes(ctx, uid)
+}
+
+func (ur *userRepository) replaceRecoveryCodes(ctx context.Context, uid string) (*model.RecoveryCodes, error) {
+	codes := secure.GenerateRecoveryCodes()
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = secure.HashRecoveryCode(code, uid, ur.sm.GetSystemSecret())
+	}
+
+	if err := ur.storage.ReplaceRecoveryCodes(ctx, uid, hashes); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	return &model.RecoveryCodes{Codes: codes}, nil
+}
+
+// LoginWithRecoveryCode is the second step of a login when the authenticator is lost,
+// the code cannot be used again
+func (ur *userRepository) LoginWithRecoveryCode(ctx context.Context, uid, code string) (*model.User, error) {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	if !user.MfaEnabled {
+		return nil, sdkcm.ErrCustom(nil, common.ErrMFANotEnrolled)
+	}
+
+	if err := ur.useRecoveryCode(ctx, user, uid, code); err != nil {
+		return nil, err
+	}
+
+	user.User.UserId = fmt.Sprintf("%d", user.ID)
+	return &user.User, nil
+}
+
+// useRecoveryCode consumes a recovery code of the user, wrong codes count for the account lockout
+func (ur *userRepository) useRecoveryCode(ctx context.Context, user *storage.UserSql, uid, code string) error {
+	lockKey := secure.MFALockKey(fmt.Sprintf("%d", user.ID))
+	if err := ur.checkLockout(ctx, []string{lockKey}); err != nil {
+		return err
+	}
+
+	ok, err := ur.storage.UseRecoveryCode(ctx, uid, secure.HashRecoveryCode(code, uid, ur.sm.GetSystemSecret()))
+	if err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if !ok {
+		ur.recordFailure(ctx, lockKey)
+		return sdkcm.ErrCustom(nil, common.ErrRecoveryCodeInvalid)
+	}
+
+	ur.recordSuccess(ctx, lockKey)
+	return nil
+}
+
+func (ur *userRepository) CountRecoveryCodes(ctx context.Context, uid string) (int, error) {
+	count, err := ur.storage.CountRecoveryCodes(ctx, uid)
+	if err != nil {
+		return 0, sdkcm.ErrCannotFetchData(err)
+	}
+
+	return count, nil
+}
+
+func (ur *userRepository) ListTrustedDevices(ctx context.Context, uid string) ([]model.TrustedDevice, error) {
+	devices, err := ur.storage.FindTrustedDevices(ctx, uid)
+	if err != nil {
+		return nil, sdkcm.ErrCannotFetchData(err)
+	}
+
+	return devices, nil
+}
+
+// RevokeTrustedDevice revokes a device, or all the devices of the user when deviceId is empty
+func (ur *userRepository) RevokeTrustedDevice(ctx context.Context, uid, deviceId string) error {
+	if err := ur.storage.RemoveTrustedDevices(ctx, uid, deviceId); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package usrrepo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+)
+
+func TestTOTPEnrollmentRequiresReauthentication(t *testing.T) {
+	ur, _ := newWebAuthnRepository(t)
+	ctx := context.Background()
+
+	if _, err := ur.EnrollTOTP(ctx, testUserId, &model.Reauthentication{}); errCode(err) != common.ErrReauthenticationRequired.Key() {
+		t.Errorf("enroll without proof: err = %v, want %s", err, common.ErrReauthenticationRequired.Key())
+	}
+
+	if _, err := ur.EnrollTOTP(ctx, testUserId, &model.Reauthentication{Password: "wrong"}); errCode(err) != common.ErrPasswordNotCorrect.Key() {
+		t.Errorf("enroll with a wrong password: err = %v, want %s", err, common.ErrPasswordNotCorrect.Key())
+	}
+
+	// the code of an authenticator enrolled by someone else does not prove the user
+	if _, err := ur.ConfirmTOTP(ctx, testUserId, &model.TOTPConfirmation{Code: "123456"}); errCode(err) != common.ErrReauthenticationRequired.Key() {
+		t.Errorf("confirm without proof: err = %v, want %s", err, common.ErrReauthenticationRequired.Key())
+	}
+}
@@ -0,0 +1,110 @@
+package usrrepo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/secure"
+)
+
+// userEvent is a change of an user announced to the webhooks of its client,
+// User is the user after the change when it still exists
+type userEvent struct {
+	Type   string
+	UserId string
+	User   *model.User
+}
+
+// emit writes the events to the outbox, one delivery per webhook of the client subscribing to the event.
+// It runs in the transaction of the change, so the events are committed or rolled back with it.
+func emit(ctx context.Context, tx Storage, clientId string, events ...userEvent) error {
+	webhooks, err := tx.FindWebhooks(ctx, clientId)
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	var deliveries []model.OutboxEvent
+	for _, e := range events {
+		// the ids are random hex strings
+		eventId := secure.GenerateSalt()
+		payload, err := json.Marshal(model.WebhookPayload{
+			Id:         eventId,
+			Type:       e.Type,
+			ClientId:   clientId,
+			UserId:     e.UserId,
+			OccurredAt: now,
+			Data:       e.User,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, w := range webhooks {
+			if !w.Accepts(e.Type) {
+				continue
+			}
+
+			deliveries = append(deliveries, model.OutboxEvent{
+				DeliveryId:    secure.GenerateSalt(),
+				EventId:       eventId,
+				Type:          e.Type,
+				ClientId:      clientId,
+				UserId:        e.UserId,
+				WebhookId:     w.WebhookId,
+				Payload:       string(payload),
+				State:         model.OutboxPending,
+				NextAttemptAt: now,
+				OccurredAt:    now,
+			})
+		}
+	}
+
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	return tx.AddOutboxEvents(ctx, deliveries)
+}
+
+// TokenRevoked announces a token of the user revoked by its client
+func (ur *userRepository) TokenRevoked(ctx context.Context, uid string) error {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return err
+	}
+
+	return ur.storage.Transaction(ctx, func(tx Storage) error {
+		return emit(ctx, tx, user.ClientId, userEvent{Type: model.EventTokenRevoked, UserId: uid})
+	})
+}
+
+// updatedEvent reads the user in the transaction of its change
+func updatedEvent(ctx context.Context, tx Storage, uid string) (userEvent, error) {
+	user, err := tx.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return userEvent{}, err
+	}
+
+	user.UserId = fmt.Sprintf("%d", user.ID)
+	return userEvent{Type: model.EventUserUpdated, UserId: user.UserId, User: &user.User}, nil
+}
+
+// createUser inserts the user and announces it in the same transaction
+func (ur *userRepository) createUser(ctx context.Context, input *storage.UserSql) (u *storage.UserSql, err error) {
+	err = ur.storage.Transaction(ctx, func(tx Storage) error {
+		if u, err = tx.Create(ctx, input); err != nil {
+			return err
+		}
+
+		u.UserId = fmt.Sprintf("%d", u.ID)
+		return emit(ctx, tx, u.ClientId, userEvent{Type: model.EventUserCreated, UserId: u.UserId, User: &u.User})
+	})
+
+	return u, err
+}
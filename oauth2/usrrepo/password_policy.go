@@ -0,0 +1,82 @@
+package usrrepo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/sdkcm"
+)
+
+// checkPassword validates a new password against the password policy.
+// When user is not nil, its current password and its password history cannot be reused.
+// Violations are returned as field errors of field.
+func (ur *userRepository) checkPassword(ctx context.Context, field, password string, user *storage.UserSql) error {
+	policy := ur.sm.GetPasswordPolicy()
+	if policy == nil {
+		return nil
+	}
+
+	violations, err := policy.Check(password)
+	if err != nil {
+		return sdkcm.ErrCannotFetchData(err)
+	}
+
+	if user != nil && policy.History > 0 && password != "" {
+		reused, err := ur.isPasswordReused(ctx, password, user, policy.History)
+		if err != nil {
+			return err
+		}
+
+		if reused {
+			violations = append(violations, common.ErrPasswordReused)
+		}
+	}
+
+	if len(violations) > 0 {
+		return sdkcm.ErrUnprocessableEntity(common.FieldErrors(field, violations...))
+	}
+
+	return nil
+}
+
+// isPasswordReused checks the current password and the last (limit - 1) previous ones
+func (ur *userRepository) isPasswordReused(ctx context.Context, password string, user *storage.UserSql, limit int) (bool, error) {
+	if user.Password != "" && secure.VerifyPassword(ctx, password, user.Password, user.Salt, user.PasswordAlgo, ur.sm.GetSystemSecret()) {
+		return true, nil
+	}
+
+	if limit <= 1 {
+		return false, nil
+	}
+
+	histories, err := ur.storage.FindPasswordHistory(ctx, fmt.Sprintf("%d", user.ID), limit-1)
+	if err != nil {
+		return false, sdkcm.ErrCannotFetchData(err)
+	}
+
+	for _, h := range histories {
+		if secure.VerifyPassword(ctx, password, h.Password, h.Salt, h.PasswordAlgo, ur.sm.GetSystemSecret()) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// savePasswordHistory keeps the replaced password of user in the history
+func (ur *userRepository) savePasswordHistory(ctx context.Context, user *storage.UserSql) error {
+	if user.Password == "" {
+		return nil
+	}
+
+	return ur.storage.AddPasswordHistory(ctx, &model.PasswordHistory{
+		UserId:       fmt.Sprintf("%d", user.ID),
+		Password:     user.Password,
+		Salt:         user.Salt,
+		PasswordAlgo: user.PasswordAlgo,
+	})
+}
@@ -0,0 +1,194 @@
+package usrrepo
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/sender"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/pkg/errors"
+)
+
+// ForgotPassword sends a reset token to the user: a link by email, or a code by SMS when the user is identified by phone.
+// Only the hash of the token is stored, the previous token is revoked.
+// Unknown users and failed deliveries are not reported so the accounts cannot be enumerated.
+func (ur *userRepository) ForgotPassword(ctx context.Context, fp *model.ForgotPassword) error {
+	if !fp.ByPhone() && (fp.Email == nil || *fp.Email == "") {
+		return sdkcm.ErrCustom(nil, common.ErrEmailOrPhoneRequired)
+	}
+
+	user, err := ur.storage.Find(ctx, phoneCond(fp.Map(), fp.PhonePrefix))
+	if err != nil {
+		return nil
+	}
+
+	uid := fmt.Sprintf("%d", user.ID)
+	ttl := ur.sm.GetPasswordResetTTL()
+
+	var token string
+
+	if fp.ByPhone() {
+		token = secure.GenerateOTP(ur.sm.GetOTPPolicy().Length)
+	} else {
+		token = secure.GenerateResetToken()
+	}
+
+	if err := ur.storage.Update(ctx,
+		map[string]interface{}{"id": uid},
+		map[string]interface{}{
+			"reset_token":            secure.HashOTP(token, uid, ur.sm.GetSystemSecret()),
+			"reset_token_expired_at": time.Now().UTC().Add(ttl),
+			"reset_attempts":         0,
+		},
+	); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if fp.ByPhone() {
+		if err := ur.sm.GetOTPSender().SendOTP(ctx, &sender.OTPMessage{
+			Channel:  sender.ChannelSMS,
+			Purpose:  sender.PurposeResetPassword,
+			To:       user.GetPhoneNumber(),
+			Code:     token,
+			TTL:      ttl,
+			ClientId: user.ClientId,
+			UserId:   uid,
+		}); err != nil {
+			logging.FromContext(ctx).WithError(err).Error("Error occurred in sending the password reset code")
+		}
+
+		return nil
+	}
+
+	if err := ur.sm.GetMailer().SendMail(ctx, &sender.MailMessage{
+		Template: sender.TemplateResetPassword,
+		To:       user.GetEmail(),
+		Link:     actionLink(ur.sm.GetPasswordResetURL(), url.Values{"token": {token}, "email": {user.GetEmail()}}),
+		Token:    token,
+		TTL:      ttl,
+		ClientId: user.ClientId,
+		UserId:   uid,
+	}); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Error occurred in sending the password reset email")
+	}
+
+	return nil
+}
+
+// errResetTokenUsed rolls back a reset whose token was used by a concurrent request
+var errResetTokenUsed = errors.New("reset token is already used")
+
+// ResetPassword sets a new password with a reset token, the token can only be used once
+// and is revoked after too many wrong attempts.
+// All the tokens and the trusted devices of the user are revoked.
+func (ur *userRepository) ResetPassword(ctx context.Context, pr *model.PasswordReset) error {
+	if pr.Token == "" {
+		return sdkcm.ErrCustom(nil, common.ErrResetTokenInvalid)
+	}
+
+	if pr.NewPassword != pr.PasswordConfirmation {
+		return sdkcm.ErrCustom(nil, common.ErrPassAndConfirmNotMatch)
+	}
+
+	user, err := ur.storage.Find(ctx, phoneCond(pr.Map(), pr.PhonePrefix))
+	if err != nil || (!pr.ByPhone() && (pr.Email == nil || *pr.Email == "")) {
+		return sdkcm.ErrCustom(err, common.ErrResetTokenInvalid)
+	}
+
+	uid := fmt.Sprintf("%d", user.ID)
+	revoke := map[string]interface{}{
+		"reset_token":            nil,
+		"reset_token_expired_at": nil,
+		"reset_attempts":         0,
+	}
+
+	if user.ResetToken == nil || *user.ResetToken == "" {
+		return sdkcm.ErrCustom(nil, common.ErrResetTokenInvalid)
+	}
+
+	// the writes only apply to the token which was read, a new or used token is left alone
+	where := map[string]interface{}{"id": uid, "reset_token": *user.ResetToken}
+	maxAttempts := ur.sm.GetOTPPolicy().MaxAttempts
+
+	if exp := user.ResetTokenExpiredAt; exp == nil || exp.Before(time.Now().UTC()) {
+		_, _ = ur.storage.UpdateIf(ctx, where, revoke)
+		return sdkcm.ErrCustom(nil, common.ErrResetTokenInvalid)
+	}
+
+	// the attempt is taken before the token is checked so concurrent guesses cannot go over the limit
+	taken, err := ur.storage.Increment(ctx, where, "reset_attempts", maxAttempts)
+	if err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if !taken {
+		_, _ = ur.storage.UpdateIf(ctx, where, revoke)
+		return sdkcm.ErrCustom(nil, common.ErrResetTokenInvalid)
+	}
+
+	if !secure.VerifyOTP(pr.Token, *user.ResetToken, uid, ur.sm.GetSystemSecret()) {
+		_, _ = ur.storage.UpdateIf(ctx, map[string]interface{}{"id": uid, "reset_token": *user.ResetToken, "reset_attempts": maxAttempts}, revoke)
+		return sdkcm.ErrCustom(nil, common.ErrResetTokenInvalid)
+	}
+
+	// the token is checked before the password so a weak password does not burn it
+	if err := ur.checkPassword(ctx, "new_password", pr.NewPassword, user); err != nil {
+		return err
+	}
+
+	password, salt, algo := secure.HashPassword(ctx, pr.NewPassword)
+
+	update := revoke
+	update["password"] = password
+	update["salt"] = salt
+	update["password_algo"] = algo
+
+	// the token proves the ownership of the channel it was sent to
+	if pr.ByPhone() {
+		update["phone_verified"] = true
+	} else {
+		update["email_verified"] = true
+	}
+
+	// a token is consumed once, a concurrent reset with the same token loses
+	if err := ur.storage.Transaction(ctx, func(tx Storage) error {
+		consumed, err := tx.UpdateIf(ctx, where, update)
+		if err != nil {
+			return err
+		}
+
+		if !consumed {
+			return errResetTokenUsed
+		}
+
+		if err := tx.RevokeTokens(ctx, uid); err != nil {
+			return err
+		}
+
+		return emit(ctx, tx, user.ClientId,
+			userEvent{Type: model.EventUserPasswordChanged, UserId: uid},
+			userEvent{Type: model.EventTokenRevoked, UserId: uid},
+		)
+	}); err == errResetTokenUsed {
+		return sdkcm.ErrCustom(nil, common.ErrResetTokenInvalid)
+	} else if err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if err := ur.savePasswordHistory(ctx, user); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if err := ur.storage.RemoveTrustedDevices(ctx, uid, ""); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	// the failed logins of the attacker must not keep the owner out
+	return ur.Unlock(ctx, uid)
+}
@@ -0,0 +1,85 @@
+package usrrepo
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/sender"
+	"github.com/baozhenglab/sdkcm"
+)
+
+func normalizePhone(prefix, phone string) (*common.Phone, error) {
+	p, err := common.NormalizePhone(prefix, phone)
+	if err != nil {
+		if ek, ok := err.(sdkcm.ErrorWithKey); ok {
+			return nil, sdkcm.ErrCustom(nil, ek)
+		}
+		return nil, sdkcm.ErrInvalidRequest(err)
+	}
+
+	return p, nil
+}
+
+// phoneCond looks up the phone of a condition by its E.164 number,
+// a number of an unknown region is matched as typed like the numbers saved before the normalization
+func phoneCond(cond map[string]interface{}, prefix *string) map[string]interface{} {
+	var phone string
+	switch v := cond["phone"].(type) {
+	case string:
+		phone = v
+	case *string:
+		if v != nil {
+			phone = *v
+		}
+	}
+
+	if phone == "" {
+		return cond
+	}
+
+	region := ""
+	if prefix != nil {
+		region = *prefix
+	}
+
+	if p, err := common.NormalizePhone(region, phone); err == nil {
+		delete(cond, "phone")
+		delete(cond, "phone_prefix")
+		cond["phone_number"] = p.E164
+	}
+
+	return cond
+}
+
+// SignUpWithPhone starts a sign-up by phone, the user is created with the number and a code is sent by SMS.
+// The code is exchanged with LoginWithOTP which proves the ownership of the phone.
+// An existing user gets a code too, so the numbers cannot be enumerated.
+func (ur *userRepository) SignUpWithPhone(ctx context.Context, clientId, prefix, phone string) error {
+	p, err := normalizePhone(prefix, phone)
+	if err != nil {
+		return err
+	}
+
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"phone_number": p.E164, "client_id": clientId})
+	if err != nil && err.Error() != common.ErrDataNotFound.Error() {
+		return sdkcm.ErrCannotFetchData(err)
+	}
+
+	if user == nil {
+		if user, err = ur.createUser(ctx, &storage.UserSql{
+			User: model.User{
+				AccountType: model.AccTypeExternal,
+				ClientId:    clientId,
+				PhonePrefix: &p.Prefix,
+				Phone:       &p.National,
+				PhoneNumber: &p.E164,
+			},
+		}); err != nil {
+			return sdkcm.ErrDB(err)
+		}
+	}
+
+	return ur.sendOTP(ctx, user, p.E164, sender.PurposeSignUp)
+}
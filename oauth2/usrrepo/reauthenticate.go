@@ -0,0 +1,99 @@
+package usrrepo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/duo-labs/webauthn/protocol"
+)
+
+// reauthenticate checks the fresh proof of the user before a sensitive change of the account,
+// an access token alone may have been stolen or refreshed long after the login.
+// Wrong passwords count for the lockout of the second factor of the user.
+func (ur *userRepository) reauthenticate(ctx context.Context, user *storage.UserSql, proof *model.Reauthentication) error {
+	if proof == nil {
+		return sdkcm.ErrCustom(nil, common.ErrReauthenticationRequired)
+	}
+
+	switch {
+	case proof.Password != "" && user.Password != "":
+		lockKey := secure.MFALockKey(fmt.Sprintf("%d", user.ID))
+		if err := ur.checkLockout(ctx, []string{lockKey}); err != nil {
+			return err
+		}
+
+		if !secure.VerifyPassword(ctx, proof.Password, user.Password, user.Salt, user.PasswordAlgo, ur.sm.GetSystemSecret()) {
+			ur.recordFailure(ctx, lockKey)
+			return sdkcm.ErrCustom(nil, common.ErrPasswordNotCorrect)
+		}
+
+		ur.recordSuccess(ctx, lockKey)
+		return nil
+	case proof.MfaCode != "" && user.MfaEnabled:
+		return ur.checkTOTP(ctx, user, proof.MfaCode)
+	case proof.OTPCode != "":
+		return ur.useOTP(ctx, user, proof.OTPCode, nil)
+	case proof.WebAuthnSession != "":
+		return ur.reauthenticateWithWebAuthn(ctx, user, proof)
+	case proof.IdentityProvider != "":
+		return ur.reauthenticateWithIdentity(ctx, user, proof)
+	default:
+		return sdkcm.ErrCustom(nil, common.ErrReauthenticationRequired)
+	}
+}
+
+// reauthenticateWithWebAuthn checks the assertion of a passkey of the user,
+// the ceremony is started by BeginWebAuthnReauthentication for the user
+func (ur *userRepository) reauthenticateWithWebAuthn(ctx context.Context, user *storage.UserSql, proof *model.Reauthentication) error {
+	w, err := ur.webAuthn()
+	if err != nil {
+		return err
+	}
+
+	ceremony, err := ur.openCeremony(ctx, proof.WebAuthnSession, webAuthnReauthentication, user.ClientId)
+	if err != nil {
+		return err
+	}
+
+	if ceremony.UserId != fmt.Sprintf("%d", user.ID) {
+		return sdkcm.ErrCustom(nil, common.ErrWebAuthnSessionInvalid)
+	}
+
+	response, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(proof.WebAuthnAssertion))
+	if err != nil {
+		return sdkcm.ErrCustom(err, common.ErrWebAuthnFailed)
+	}
+
+	_, err = ur.validateWebAuthnAssertion(ctx, w, ceremony, response)
+	return err
+}
+
+// reauthenticateWithIdentity checks the token of a provider already linked to the user
+func (ur *userRepository) reauthenticateWithIdentity(ctx context.Context, user *storage.UserSql, proof *model.Reauthentication) error {
+	identity, err := ur.verifyIdentity(ctx, user.ClientId, &model.IdentityLink{
+		Provider:    proof.IdentityProvider,
+		AccessToken: proof.IdentityAccessToken,
+		IdToken:     proof.IdentityIdToken,
+		Nonce:       proof.IdentityNonce,
+	})
+	if err != nil {
+		return err
+	}
+
+	linked, err := ur.storage.FindIdentity(ctx, identity.Provider, identity.Subject)
+	if err != nil && err.Error() != common.ErrDataNotFound.Error() {
+		return sdkcm.ErrCannotFetchData(err)
+	}
+
+	if linked == nil || linked.UserId != fmt.Sprintf("%d", user.ID) {
+		return sdkcm.ErrCustom(nil, common.ErrReauthenticationRequired)
+	}
+
+	return nil
+}
@@ -2,25 +2,77 @@ package usrrepo
 
 import (
 	"context"
+	"time"
 
 	"github.com/baozhenglab/oauth-service/oauth2/model"
 	"github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/sender"
+	"github.com/duo-labs/webauthn/webauthn"
 )
 
 type Storage interface {
 	Find(ctx context.Context, cond map[string]interface{}) (u *storage.UserSql, err error)
 	FindWithOrCond(ctx context.Context, cond map[string]interface{}, orCond map[string]interface{}) (u *storage.UserSql, err error)
-	FindWithFbIdAndEmail(ctx context.Context, fbId, email string) (u *storage.UserSql, err error)
-	FindWithAppleIdAndEmail(ctx context.Context, appleId, email string) (u *storage.UserSql, err error)
-	FindWithAccountKit(ctx context.Context, akId, prefix, phone, email string) (u *storage.UserSql, err error)
 	Create(ctx context.Context, input *storage.UserSql) (u *storage.UserSql, err error)
 	Update(ctx context.Context, cond, update map[string]interface{}) error
+	UpdateIf(ctx context.Context, cond, update map[string]interface{}) (bool, error)
+	Increment(ctx context.Context, cond map[string]interface{}, counter string, max int) (bool, error)
 	Updates(ctx context.Context, cond map[string]interface{}, update *model.UserUpdate) error
 	Delete(ctx context.Context, uid string) error
+
+	FindRoles(ctx context.Context, clientId string, names ...string) ([]model.Role, error)
+	SaveRole(ctx context.Context, role *model.Role) error
+	FindUserRoles(ctx context.Context, clientId, uid string) ([]string, error)
+	AddUserRole(ctx context.Context, clientId, uid, role string) error
+	RemoveUserRole(ctx context.Context, clientId, uid, role string) error
+
+	FindPasswordHistory(ctx context.Context, uid string, limit int) ([]model.PasswordHistory, error)
+	AddPasswordHistory(ctx context.Context, history *model.PasswordHistory) error
+
+	FindWebAuthnCredentials(ctx context.Context, uid string) ([]model.WebAuthnCredential, error)
+	AddWebAuthnCredential(ctx context.Context, credential *model.WebAuthnCredential) error
+	// UpdateWebAuthnSignCount raises the signature counter, it returns false when the counter is not below signCount
+	UpdateWebAuthnSignCount(ctx context.Context, credentialId string, signCount uint32) (bool, error)
+	RemoveWebAuthnCredential(ctx context.Context, uid, credentialId string) error
+
+	ReplaceRecoveryCodes(ctx context.Context, uid string, hashes []string) error
+	UseRecoveryCode(ctx context.Context, uid, hash string) (bool, error)
+	CountRecoveryCodes(ctx context.Context, uid string) (int, error)
+
+	FindTrustedDevices(ctx context.Context, uid string) ([]model.TrustedDevice, error)
+	RemoveTrustedDevices(ctx context.Context, uid, deviceId string) error
+
+	FindIdentity(ctx context.Context, provider, subject string) (*model.UserIdentity, error)
+	FindIdentities(ctx context.Context, uid string) ([]model.UserIdentity, error)
+	AddIdentity(ctx context.Context, identity *model.UserIdentity) error
+	RemoveIdentity(ctx context.Context, uid, provider, subject string) error
+
+	RevokeTokens(ctx context.Context, uid string) error
+
+	FindWebhooks(ctx context.Context, clientId string) ([]model.Webhook, error)
+	AddOutboxEvents(ctx context.Context, events []model.OutboxEvent) error
+	// Transaction runs fn on a storage bound to a transaction, the changes of fn are committed when it succeeds
+	Transaction(ctx context.Context, fn func(tx Storage) error) error
 }
 
 type SystemManager interface {
 	GetSystemSecret() string
+	GetPasswordPolicy() *secure.PasswordPolicy
+	GetLockout() *secure.Lockout
+	GetOTPPolicy() *secure.OTPPolicy
+	GetOTPSender() sender.OTPSender
+	GetMailer() sender.Mailer
+	GetEmailVerificationTTL() time.Duration
+	GetEmailVerificationURL() string
+	GetPasswordResetTTL() time.Duration
+	GetPasswordResetURL() string
+	GetAES() *secure.AES
+	GetMFAIssuer() string
+	GetWebAuthn() (*webauthn.WebAuthn, error)
+	GetGoogleIDTokenVerifier() *secure.IDTokenVerifier
+	GetAppleIDTokenVerifier() *secure.IDTokenVerifier
+	GetFacebookVerifier() *secure.FacebookVerifier
 }
 
 type userRepository struct {
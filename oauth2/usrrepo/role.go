@@ -0,0 +1,88 @@
+package usrrepo
+
+import (
+	"context"
+	"strings"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/sdkcm"
+)
+
+func (ur *userRepository) ListRoles(ctx context.Context, clientId string) ([]model.Role, error) {
+	roles, err := ur.storage.FindRoles(ctx, clientId)
+	if err != nil {
+		return nil, sdkcm.ErrCannotFetchData(err)
+	}
+
+	return roles, nil
+}
+
+func (ur *userRepository) SaveRole(ctx context.Context, role *model.Role) error {
+	role.Name = strings.TrimSpace(role.Name)
+	if role.Name == "" {
+		return sdkcm.ErrCustom(nil, common.ErrRoleNameCannotBeEmpty)
+	}
+
+	permissions := []string{}
+	for _, p := range role.Permissions {
+		if p = strings.TrimSpace(p); p != "" {
+			permissions = append(permissions, p)
+		}
+	}
+	role.Permissions = permissions
+
+	if err := ur.storage.SaveRole(ctx, role); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
+
+// GetUserAccess returns the roles and merged permissions of an user within a client
+func (ur *userRepository) GetUserAccess(ctx context.Context, clientId, uid string) (*model.UserAccess, error) {
+	names, err := ur.storage.FindUserRoles(ctx, clientId, uid)
+	if err != nil {
+		return nil, sdkcm.ErrCannotFetchData(err)
+	}
+
+	if len(names) == 0 {
+		return model.NewUserAccess(nil), nil
+	}
+
+	roles, err := ur.storage.FindRoles(ctx, clientId, names...)
+	if err != nil {
+		return nil, sdkcm.ErrCannotFetchData(err)
+	}
+
+	return model.NewUserAccess(roles), nil
+}
+
+func (ur *userRepository) AssignRole(ctx context.Context, clientId, uid, role string) error {
+	if _, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid}); err != nil {
+		return sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	roles, err := ur.storage.FindRoles(ctx, clientId, role)
+	if err != nil {
+		return sdkcm.ErrCannotFetchData(err)
+	}
+
+	if len(roles) == 0 {
+		return sdkcm.ErrCustom(nil, common.ErrRoleNotFound)
+	}
+
+	if err := ur.storage.AddUserRole(ctx, clientId, uid, role); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
+
+func (ur *userRepository) UnassignRole(ctx context.Context, clientId, uid, role string) error {
+	if err := ur.storage.RemoveUserRole(ctx, clientId, uid, role); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
@@ -6,12 +6,13 @@ import (
 
 	"github.com/baozhenglab/oauth-service/common"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
 	"github.com/baozhenglab/oauth-service/secure"
 	"github.com/baozhenglab/sdkcm"
 )
 
 func (ur *userRepository) SetUsernamePassword(ctx context.Context, user *model.CredentialAndPassword) error {
-	oldUser, err := ur.storage.Find(context.Background(), map[string]interface{}{
+	oldUser, err := ur.storage.Find(ctx, map[string]interface{}{
 		"username":  user.Username,
 		"client_id": user.ClientId,
 	})
@@ -24,18 +25,51 @@ func (ur *userRepository) SetUsernamePassword(ctx context.Context, user *model.C
 		return sdkcm.ErrCustom(nil, common.ErrUsernameExisted)
 	}
 
+	var current *storage.UserSql
+
 	if user.Password != nil {
-		salt := secure.GenerateSalt()
-		hashPass := secure.ComputeHmac256(*user.Password, salt, ur.sm.GetSystemSecret())
+		current, err = ur.storage.Find(ctx, map[string]interface{}{"id": user.Id})
+		if err != nil {
+			return sdkcm.ErrCannotFetchData(err)
+		}
+
+		if err := ur.checkPassword(ctx, "password", *user.Password, current); err != nil {
+			return err
+		}
+
+		hashPass, salt, algo := secure.HashPassword(ctx, *user.Password)
 		user.Salt = &salt
 		user.Password = &hashPass
+		user.PasswordAlgo = &algo
 	}
 
-	err = ur.storage.Update(ctx, map[string]interface{}{"id": user.Id}, user.Map())
+	err = ur.storage.Transaction(ctx, func(tx Storage) error {
+		if err := tx.Update(ctx, map[string]interface{}{"id": user.Id}, user.Map()); err != nil {
+			return err
+		}
+
+		e, err := updatedEvent(ctx, tx, user.Id)
+		if err != nil {
+			return err
+		}
+
+		events := []userEvent{e}
+		if user.Password != nil {
+			events = append(events, userEvent{Type: model.EventUserPasswordChanged, UserId: e.UserId})
+		}
+
+		return emit(ctx, tx, e.User.ClientId, events...)
+	})
 
 	if err != nil {
 		return sdkcm.ErrDB(err)
 	}
 
+	if current != nil {
+		if err := ur.savePasswordHistory(ctx, current); err != nil {
+			return sdkcm.ErrDB(err)
+		}
+	}
+
 	return nil
 }
@@ -4,7 +4,11 @@ import (
 	"context"
 
 	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
 	oauthStore "github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/tracing"
 	"github.com/baozhenglab/sdkcm"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
@@ -19,6 +23,8 @@ func NewMongo(s *mgo.Session) *mgoStorage {
 }
 
 func (s *mgoStorage) Find(ctx context.Context, cond map[string]interface{}) (u *oauthStore.UserMongo, err error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "Find")()
+
 	mgoSession := s.mgoSession.New()
 	defer mgoSession.Close()
 
@@ -38,111 +44,155 @@ func (s *mgoStorage) Find(ctx context.Context, cond map[string]interface{}) (u *
 	return &foundUser, nil
 }
 
-func (s *mgoStorage) FindWithFbIdAndEmail(ctx context.Context, fbId, email string) (u *oauthStore.UserMongo, err error) {
+func (s *mgoStorage) Create(ctx context.Context, input *oauthStore.UserMongo) (u *oauthStore.UserMongo, err error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "Create")()
+
 	mgoSession := s.mgoSession.New()
 	defer mgoSession.Close()
 
-	cond := bson.M{
-		"$or": []bson.M{{"fb_id": fbId}, {"email": email}},
-	}
-
-	var foundUser oauthStore.UserMongo
+	input.PrepareForInsert()
 
-	if err := mgoSession.DB("").C(oauthStore.UsersCollection).Find(cond).One(&foundUser); err != nil {
-		if err == mgo.ErrNotFound {
-			return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
-		}
+	if err := mgoSession.DB("").C(oauthStore.UsersCollection).Insert(input); err != nil {
 		return nil, err
 	}
-	return &foundUser, nil
+
+	return input, nil
 }
 
-func (s *mgoStorage) FindWithAccountKit(ctx context.Context, akId, prefix, phone, email string) (u *oauthStore.UserMongo, err error) {
+func (s *mgoStorage) Update(ctx context.Context, cond, update map[string]interface{}) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "Update")()
+
 	mgoSession := s.mgoSession.New()
 	defer mgoSession.Close()
 
-	or := []bson.M{{"account_kit_id": akId}}
-	if email != "" {
-		or = append(or, bson.M{"email": email})
+	if _, ok := cond["id"]; ok {
+		cond["_id"] = bson.ObjectIdHex(cond["id"].(string))
+		delete(cond, "id")
 	}
 
-	if prefix+phone != "" {
-		phoneCond := bson.M{
-			"$and": []bson.M{{"phone_prefix": prefix}, {"phone": phone}},
-		}
-		or = append(or, phoneCond)
-	}
+	return mgoSession.DB("").C(oauthStore.UsersCollection).Update(cond, bson.M{"$set": update})
+}
 
-	cond := bson.M{
-		"$or": or,
-	}
+// UpdateIf updates the user only while it matches cond, it returns false when another request changed it first
+func (s *mgoStorage) UpdateIf(ctx context.Context, cond, update map[string]interface{}) (bool, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "UpdateIf")()
 
-	var foundUser oauthStore.UserMongo
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
 
-	if err := mgoSession.DB("").C(oauthStore.UsersCollection).Find(cond).One(&foundUser); err != nil {
-		if err == mgo.ErrNotFound {
-			return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
-		}
-		return nil, err
+	err := mgoSession.DB("").C(oauthStore.UsersCollection).Update(userCond(cond), bson.M{"$set": update})
+	if err == mgo.ErrNotFound {
+		return false, nil
 	}
-	return &foundUser, nil
+
+	return err == nil, err
 }
 
-func (s *mgoStorage) FindWithAppleIdAndEmail(ctx context.Context, appleId, email string) (u *oauthStore.UserMongo, err error) {
+// Increment adds one to a counter of the user matching cond while the counter is below max,
+// it returns false when the counter already reached max
+func (s *mgoStorage) Increment(ctx context.Context, cond map[string]interface{}, counter string, max int) (bool, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "Increment")()
+
 	mgoSession := s.mgoSession.New()
 	defer mgoSession.Close()
 
-	cond := bson.M{
-		"$or": []bson.M{{"apple_id": appleId}, {"email": email}},
+	filter := userCond(cond)
+	filter[counter] = bson.M{"$lt": max}
+
+	err := mgoSession.DB("").C(oauthStore.UsersCollection).Update(filter, bson.M{"$inc": bson.M{counter: 1}})
+	if err == mgo.ErrNotFound {
+		return false, nil
 	}
 
-	var foundUser oauthStore.UserMongo
+	return err == nil, err
+}
 
-	if err := mgoSession.DB("").C(oauthStore.UsersCollection).Find(cond).One(&foundUser); err != nil {
-		if err == mgo.ErrNotFound {
-			return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+// userCond copies the condition with the id of the user as an ObjectId
+func userCond(cond map[string]interface{}) bson.M {
+	filter := bson.M{}
+	for k, v := range cond {
+		if k == "id" {
+			filter["_id"] = bson.ObjectIdHex(v.(string))
+			continue
 		}
-		return nil, err
+
+		filter[k] = v
 	}
-	return &foundUser, nil
+
+	return filter
 }
 
-func (s *mgoStorage) Create(ctx context.Context, input *oauthStore.UserMongo) (u *oauthStore.UserMongo, err error) {
+func (s *mgoStorage) Delete(ctx context.Context, uid string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "Delete")()
+
 	mgoSession := s.mgoSession.New()
 	defer mgoSession.Close()
 
-	input.PrepareForInsert()
+	userId := bson.ObjectIdHex(uid)
 
-	if err := mgoSession.DB("").C(oauthStore.UsersCollection).Insert(input); err != nil {
-		return nil, err
+	if err := mgoSession.DB("").C(oauthStore.UsersCollection).Remove(bson.M{"_id": userId}); err != nil {
+		return nil
 	}
 
-	return input, nil
+	// the data of the user is removed on a best effort, the user is already deleted
+	cascade := map[string]bson.M{
+		oauthStore.AccessTokensCollection:        {"owner": uid},
+		oauthStore.UserRolesCollection:           {"user_id": uid},
+		oauthStore.PasswordHistoriesCollection:   {"user_id": uid},
+		oauthStore.WebAuthnCredentialsCollection: {"user_id": uid},
+		oauthStore.MFARecoveryCodesCollection:    {"user_id": uid},
+		oauthStore.TrustedDevicesCollection:      {"user_id": uid},
+		oauthStore.UserIdentitiesCollection:      {"user_id": uid},
+	}
+
+	for collection, selector := range cascade {
+		if _, err := mgoSession.DB("").C(collection).RemoveAll(selector); err != nil {
+			logging.FromContext(ctx).With("collection", collection).WithError(err).Warn("Error occurred in deleting the data of a user")
+		}
+	}
+
+	return nil
 }
 
-func (s *mgoStorage) Update(ctx context.Context, cond, update map[string]interface{}) error {
+func (s *mgoStorage) FindPasswordHistory(ctx context.Context, uid string, limit int) ([]model.PasswordHistory, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "FindPasswordHistory")()
+
 	mgoSession := s.mgoSession.New()
 	defer mgoSession.Close()
 
-	if _, ok := cond["id"]; ok {
-		cond["_id"] = bson.ObjectIdHex(cond["id"].(string))
-		delete(cond, "id")
+	var rows []oauthStore.PasswordHistoryMongo
+	if err := mgoSession.DB("").C(oauthStore.PasswordHistoriesCollection).
+		Find(bson.M{"user_id": uid}).Sort("-created_at").Limit(limit).All(&rows); err != nil {
+		return nil, sdkcm.ErrDB(err)
 	}
 
-	return mgoSession.DB("").C(oauthStore.UsersCollection).Update(cond, bson.M{"$set": update})
+	histories := make([]model.PasswordHistory, len(rows))
+	for i := range rows {
+		histories[i] = rows[i].PasswordHistory
+	}
+
+	return histories, nil
 }
 
-func (s *mgoStorage) Delete(ctx context.Context, uid string) error {
+func (s *mgoStorage) AddPasswordHistory(ctx context.Context, history *model.PasswordHistory) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "AddPasswordHistory")()
+
 	mgoSession := s.mgoSession.New()
 	defer mgoSession.Close()
 
-	userId := bson.ObjectIdHex(uid)
+	data := oauthStore.PasswordHistoryMongo{PasswordHistory: *history}
+	data.PrepareForInsert()
 
-	if err := mgoSession.DB("").C(oauthStore.UsersCollection).Remove(bson.M{"_id": userId}); err != nil {
-		return nil
-	}
+	return mgoSession.DB("").C(oauthStore.PasswordHistoriesCollection).Insert(&data)
+}
 
-	_, _ = mgoSession.DB("").C(oauthStore.UsersCollection).RemoveAll(bson.M{"owner": uid})
+// RevokeTokens deletes the access and refresh tokens of the user
+func (s *mgoStorage) RevokeTokens(ctx context.Context, uid string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "RevokeTokens")()
 
-	return nil
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	_, err := mgoSession.DB("").C(oauthStore.AccessTokensCollection).RemoveAll(bson.M{"owner": uid})
+	return err
 }
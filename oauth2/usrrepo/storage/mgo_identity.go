@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	oauthStore "github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func (s *mgoStorage) FindIdentity(ctx context.Context, provider, subject string) (*model.UserIdentity, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "FindIdentity")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	var row oauthStore.UserIdentityMongo
+	if err := mgoSession.DB("").C(oauthStore.UserIdentitiesCollection).
+		Find(bson.M{"provider": provider, "subject": subject}).One(&row); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+		}
+		return nil, err
+	}
+
+	return &row.UserIdentity, nil
+}
+
+func (s *mgoStorage) AddIdentity(ctx context.Context, identity *model.UserIdentity) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "AddIdentity")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	data := oauthStore.UserIdentityMongo{UserIdentity: *identity}
+	data.PrepareForInsert()
+
+	return mgoSession.DB("").C(oauthStore.UserIdentitiesCollection).Insert(&data)
+}
+
+func (s *mgoStorage) FindIdentities(ctx context.Context, uid string) ([]model.UserIdentity, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "FindIdentities")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	var rows []oauthStore.UserIdentityMongo
+	if err := mgoSession.DB("").C(oauthStore.UserIdentitiesCollection).
+		Find(bson.M{"user_id": uid}).Sort("created_at").All(&rows); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	identities := make([]model.UserIdentity, len(rows))
+	for i := range rows {
+		identities[i] = rows[i].UserIdentity
+	}
+
+	return identities, nil
+}
+
+func (s *mgoStorage) RemoveIdentity(ctx context.Context, uid, provider, subject string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "RemoveIdentity")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	_, err := mgoSession.DB("").C(oauthStore.UserIdentitiesCollection).RemoveAll(bson.M{"user_id": uid, "provider": provider, "subject": subject})
+	return err
+}
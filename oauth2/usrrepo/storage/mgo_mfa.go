@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	oauthStore "github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func (s *mgoStorage) ReplaceRecoveryCodes(ctx context.Context, uid string, hashes []string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "ReplaceRecoveryCodes")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	c := mgoSession.DB("").C(oauthStore.MFARecoveryCodesCollection)
+
+	if _, err := c.RemoveAll(bson.M{"user_id": uid}); err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		data := oauthStore.RecoveryCodeMongo{RecoveryCode: model.RecoveryCode{UserId: uid, CodeHash: hash}}
+		data.PrepareForInsert()
+
+		if err := c.Insert(&data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UseRecoveryCode marks the code as used, it returns false when the code does not exist or is already used
+func (s *mgoStorage) UseRecoveryCode(ctx context.Context, uid, hash string) (bool, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "UseRecoveryCode")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	err := mgoSession.DB("").C(oauthStore.MFARecoveryCodesCollection).Update(
+		bson.M{"user_id": uid, "code_hash": hash, "used_at": nil},
+		bson.M{"$set": bson.M{"used_at": time.Now().UTC()}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (s *mgoStorage) CountRecoveryCodes(ctx context.Context, uid string) (int, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "CountRecoveryCodes")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	return mgoSession.DB("").C(oauthStore.MFARecoveryCodesCollection).Find(bson.M{"user_id": uid, "used_at": nil}).Count()
+}
+
+func (s *mgoStorage) FindTrustedDevices(ctx context.Context, uid string) ([]model.TrustedDevice, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "FindTrustedDevices")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	var rows []oauthStore.TrustedDeviceMongo
+	if err := mgoSession.DB("").C(oauthStore.TrustedDevicesCollection).
+		Find(bson.M{"user_id": uid, "expired_at": bson.M{"$gt": time.Now().UTC()}}).Sort("created_at").All(&rows); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	devices := make([]model.TrustedDevice, len(rows))
+	for i := range rows {
+		devices[i] = rows[i].TrustedDevice
+	}
+
+	return devices, nil
+}
+
+// RemoveTrustedDevices revokes a device of the user, or all of them when deviceId is empty
+func (s *mgoStorage) RemoveTrustedDevices(ctx context.Context, uid, deviceId string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "RemoveTrustedDevices")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	filter := bson.M{"user_id": uid}
+	if deviceId != "" {
+		filter["device_id"] = deviceId
+	}
+
+	_, err := mgoSession.DB("").C(oauthStore.TrustedDevicesCollection).RemoveAll(filter)
+	return err
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	oauthStore "github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/globalsign/mgo/bson"
+)
+
+func (s *mgoStorage) FindWebhooks(ctx context.Context, clientId string) ([]model.Webhook, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "FindWebhooks")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	var rows []oauthStore.WebhookMongo
+	if err := mgoSession.DB("").C(oauthStore.WebhooksCollection).Find(bson.M{"client_id": clientId}).All(&rows); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	webhooks := make([]model.Webhook, len(rows))
+	for i := range rows {
+		webhooks[i] = rows[i].Webhook
+		webhooks[i].Secret = ""
+	}
+
+	return webhooks, nil
+}
+
+// AddOutboxEvents writes the deliveries, mgo has no multi-document transaction so they are written after the change
+func (s *mgoStorage) AddOutboxEvents(ctx context.Context, events []model.OutboxEvent) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "AddOutboxEvents")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	docs := make([]interface{}, len(events))
+	for i := range events {
+		data := oauthStore.OutboxEventMongo{OutboxEvent: events[i]}
+		data.PrepareForInsert()
+		docs[i] = &data
+	}
+
+	if len(docs) == 0 {
+		return nil
+	}
+
+	return mgoSession.DB("").C(oauthStore.OutboxEventsCollection).Insert(docs...)
+}
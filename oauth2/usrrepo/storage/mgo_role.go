@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	oauthStore "github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/globalsign/mgo/bson"
+)
+
+func (s *mgoStorage) FindRoles(ctx context.Context, clientId string, names ...string) ([]model.Role, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "FindRoles")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	cond := bson.M{"client_id": clientId}
+	if len(names) > 0 {
+		cond["name"] = bson.M{"$in": names}
+	}
+
+	var rows []oauthStore.RoleMongo
+	if err := mgoSession.DB("").C(oauthStore.RolesCollection).Find(cond).Sort("name").All(&rows); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	roles := make([]model.Role, len(rows))
+	for i := range rows {
+		roles[i] = rows[i].ToRole()
+	}
+
+	return roles, nil
+}
+
+// SaveRole creates the role, or replaces the permissions of an existing one
+func (s *mgoStorage) SaveRole(ctx context.Context, role *model.Role) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "SaveRole")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	data := oauthStore.RoleMongo{Name: role.Name, ClientId: role.ClientId, Permissions: role.Permissions}
+	data.PrepareForInsert()
+
+	_, err := mgoSession.DB("").C(oauthStore.RolesCollection).Upsert(
+		bson.M{"client_id": role.ClientId, "name": role.Name},
+		bson.M{
+			"$set":         bson.M{"permissions": data.Permissions, "updated_at": data.UpdatedAt},
+			"$setOnInsert": bson.M{"_id": data.PK, "created_at": data.CreatedAt},
+		},
+	)
+
+	return err
+}
+
+func (s *mgoStorage) FindUserRoles(ctx context.Context, clientId, uid string) ([]string, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "FindUserRoles")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	names := []string{}
+	if err := mgoSession.DB("").C(oauthStore.UserRolesCollection).
+		Find(bson.M{"user_id": uid, "client_id": clientId}).Distinct("role", &names); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	return names, nil
+}
+
+func (s *mgoStorage) AddUserRole(ctx context.Context, clientId, uid, role string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "AddUserRole")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	data := oauthStore.UserRoleMongo{UserId: uid, ClientId: clientId, Role: role}
+	data.PrepareForInsert()
+
+	_, err := mgoSession.DB("").C(oauthStore.UserRolesCollection).Upsert(
+		bson.M{"user_id": uid, "client_id": clientId, "role": role},
+		bson.M{"$setOnInsert": data},
+	)
+
+	return err
+}
+
+func (s *mgoStorage) RemoveUserRole(ctx context.Context, clientId, uid, role string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "RemoveUserRole")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	_, err := mgoSession.DB("").C(oauthStore.UserRolesCollection).RemoveAll(bson.M{"user_id": uid, "client_id": clientId, "role": role})
+
+	return err
+}
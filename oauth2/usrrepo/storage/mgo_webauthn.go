@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	oauthStore "github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func (s *mgoStorage) FindWebAuthnCredentials(ctx context.Context, uid string) ([]model.WebAuthnCredential, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "FindWebAuthnCredentials")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	var rows []oauthStore.WebAuthnCredentialMongo
+	if err := mgoSession.DB("").C(oauthStore.WebAuthnCredentialsCollection).
+		Find(bson.M{"user_id": uid}).Sort("created_at").All(&rows); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	credentials := make([]model.WebAuthnCredential, len(rows))
+	for i := range rows {
+		credentials[i] = rows[i].WebAuthnCredential
+	}
+
+	return credentials, nil
+}
+
+func (s *mgoStorage) AddWebAuthnCredential(ctx context.Context, credential *model.WebAuthnCredential) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "AddWebAuthnCredential")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	data := oauthStore.WebAuthnCredentialMongo{WebAuthnCredential: *credential}
+	data.PrepareForInsert()
+
+	return mgoSession.DB("").C(oauthStore.WebAuthnCredentialsCollection).Insert(&data)
+}
+
+// UpdateWebAuthnSignCount raises the signature counter, it returns false when the counter is not below signCount
+func (s *mgoStorage) UpdateWebAuthnSignCount(ctx context.Context, credentialId string, signCount uint32) (bool, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "UpdateWebAuthnSignCount")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	err := mgoSession.DB("").C(oauthStore.WebAuthnCredentialsCollection).Update(
+		bson.M{"credential_id": credentialId, "sign_count": bson.M{"$lt": signCount}},
+		bson.M{"$set": bson.M{"sign_count": signCount}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (s *mgoStorage) RemoveWebAuthnCredential(ctx context.Context, uid, credentialId string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserMongo, "RemoveWebAuthnCredential")()
+
+	mgoSession := s.mgoSession.New()
+	defer mgoSession.Close()
+
+	_, err := mgoSession.DB("").C(oauthStore.WebAuthnCredentialsCollection).RemoveAll(bson.M{"user_id": uid, "credential_id": credentialId})
+	return err
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 
 	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/metrics"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
 	oauthStore "github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/tracing"
 	"github.com/baozhenglab/sdkcm"
 	"github.com/jinzhu/gorm"
 )
@@ -25,6 +28,8 @@ func NewSQL(db DbConnectionManager) *sqlStorage {
 }
 
 func (s *sqlStorage) Find(ctx context.Context, cond map[string]interface{}) (u *oauthStore.UserSql, err error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "Find")()
+
 	db := s.db.GetDB()
 
 	if s.db.GetRDB() != nil {
@@ -50,6 +55,8 @@ func (s *sqlStorage) FindWithOrCond(
 	cond map[string]interface{},
 	orCond map[string]interface{},
 ) (u *oauthStore.UserSql, err error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "FindWithOrCond")()
+
 	db := s.db.GetDB()
 
 	if s.db.GetRDB() != nil {
@@ -86,137 +93,130 @@ func (s *sqlStorage) FindWithOrCond(
 	return &foundUser, nil
 }
 
-func (s *sqlStorage) FindWithFbIdAndEmail(ctx context.Context, fbId, email string) (u *oauthStore.UserSql, err error) {
-	db := s.db.GetDB()
+func (s *sqlStorage) Create(ctx context.Context, input *oauthStore.UserSql) (u *oauthStore.UserSql, err error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "Create")()
 
-	if s.db.GetRDB() != nil {
-		db = s.db.GetRDB()
+	db := s.db.GetDB().New().Table(oauthStore.TbUser)
+
+	input.SQLModel = *sdkcm.NewSQLModelWithStatus(1)
+
+	if err := db.Create(input).Error; err != nil {
+		return nil, err
 	}
 
-	db = db.New()
+	return input, nil
+}
 
-	var foundUser oauthStore.UserSql
+func (s *sqlStorage) Update(ctx context.Context, cond, update map[string]interface{}) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "Update")()
 
-	//if email != "" {
-	//	if err := db.Table(oauthStore.TbUser).
-	//		Where("fb_id = ? or email = ?", fbId, email).First(&foundUser).Error; err != nil {
-	//		if err == gorm.ErrRecordNotFound {
-	//			return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
-	//		}
-	//		return nil, sdkcm.ErrDB(err)
-	//	}
-	//}
-
-	if err := db.Table(oauthStore.TbUser).
-		Where("fb_id = ?", fbId).First(&foundUser).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
-		}
-		return nil, sdkcm.ErrDB(err)
-	}
+	db := s.db.GetDB().New().Table(oauthStore.TbUser)
 
-	return &foundUser, nil
+	return db.Where(cond).Update(update).Error
 }
 
-func (s *sqlStorage) FindWithAccountKit(ctx context.Context, akId, prefix, phone, email string) (u *oauthStore.UserSql, err error) {
-	db := s.db.GetDB()
+// UpdateIf updates the user only while it matches cond, it returns false when another request changed it first
+func (s *sqlStorage) UpdateIf(ctx context.Context, cond, update map[string]interface{}) (bool, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "UpdateIf")()
 
-	if s.db.GetRDB() != nil {
-		db = s.db.GetRDB()
+	res := s.db.GetDB().New().Table(oauthStore.TbUser).Where(cond).Update(update)
+	if res.Error != nil {
+		return false, res.Error
 	}
 
-	db = db.New().Table(oauthStore.TbUser)
+	return res.RowsAffected > 0, nil
+}
 
-	db = db.Where("account_kit_id = ?", akId)
-	if email != "" && prefix+phone != "" {
-		db = db.Or("email = ? OR phone = ?", email, phone)
-	}
+// Increment adds one to a counter of the user matching cond while the counter is below max,
+// it returns false when the counter already reached max
+func (s *sqlStorage) Increment(ctx context.Context, cond map[string]interface{}, counter string, max int) (bool, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "Increment")()
 
-	if email != "" {
-		db = db.Or("email = ?", email)
+	res := s.db.GetDB().New().Table(oauthStore.TbUser).Where(cond).
+		Where(fmt.Sprintf("%s < ?", counter), max).
+		Update(counter, gorm.Expr(fmt.Sprintf("%s + 1", counter)))
+	if res.Error != nil {
+		return false, res.Error
 	}
 
-	if prefix+phone != "" {
-		db = db.Or("phone = ?", phone)
+	return res.RowsAffected > 0, nil
+}
+
+func (s *sqlStorage) Updates(ctx context.Context, cond map[string]interface{}, update *model.UserUpdate) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "Updates")()
+
+	db := s.db.GetDB().New().Table(oauthStore.TbUser)
+
+	return db.Where(cond).Update(update).Error
+}
+
+func (s *sqlStorage) Delete(ctx context.Context, uid string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "Delete")()
+
+	db := s.db.GetDB().New().Table(oauthStore.TbUser)
+
+	if err := db.Where("id = ?", uid).Delete(nil).Error; err != nil {
+		return err
 	}
 
-	var foundUser oauthStore.UserSql
+	// the data of the user is removed on a best effort, the user is already deleted
+	cascade := map[string]string{
+		oauthStore.TbAccessToken:        "owner",
+		oauthStore.TbUserRole:           "user_id",
+		oauthStore.TbPasswordHistory:    "user_id",
+		oauthStore.TbWebAuthnCredential: "user_id",
+		oauthStore.TbMFARecoveryCode:    "user_id",
+		oauthStore.TbTrustedDevice:      "user_id",
+		oauthStore.TbUserIdentity:       "user_id",
+	}
 
-	if err := db.First(&foundUser).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil, sdkcm.ErrDataNotFound
+	for table, column := range cascade {
+		if err := s.db.GetDB().New().Table(table).Where(column+" = ?", uid).Delete(nil).Error; err != nil {
+			logging.FromContext(ctx).With("table", table).WithError(err).Warn("Error occurred in deleting the data of a user")
 		}
-		return nil, err
 	}
 
-	return &foundUser, nil
+	return nil
 }
 
-func (s *sqlStorage) FindWithAppleIdAndEmail(ctx context.Context, appleId, email string) (u *oauthStore.UserSql, err error) {
+func (s *sqlStorage) FindPasswordHistory(ctx context.Context, uid string, limit int) ([]model.PasswordHistory, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "FindPasswordHistory")()
+
 	db := s.db.GetDB()
 
 	if s.db.GetRDB() != nil {
 		db = s.db.GetRDB()
 	}
 
-	db = db.New()
-
-	var foundUser oauthStore.UserSql
-
-	//if email != "" {
-	//	if err := db.Table(oauthStore.TbUser).
-	//		Where("apple_id = ? or email = ?", appleId, email).First(&foundUser).Error; err != nil {
-	//		if err == gorm.ErrRecordNotFound {
-	//			return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
-	//		}
-	//		return nil, sdkcm.ErrDB(err)
-	//	}
-	//}
-
-	if err := db.Table(oauthStore.TbUser).
-		Where("apple_id = ?", appleId).First(&foundUser).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
-		}
+	var rows []oauthStore.PasswordHistorySql
+	if err := db.New().Table(oauthStore.TbPasswordHistory).
+		Where("user_id = ?", uid).Order("id desc").Limit(limit).Find(&rows).Error; err != nil {
 		return nil, sdkcm.ErrDB(err)
 	}
 
-	return &foundUser, nil
-}
-
-func (s *sqlStorage) Create(ctx context.Context, input *oauthStore.UserSql) (u *oauthStore.UserSql, err error) {
-	db := s.db.GetDB().New().Table(oauthStore.TbUser)
-
-	input.SQLModel = *sdkcm.NewSQLModelWithStatus(1)
-
-	if err := db.Create(input).Error; err != nil {
-		return nil, err
+	histories := make([]model.PasswordHistory, len(rows))
+	for i := range rows {
+		histories[i] = rows[i].PasswordHistory
 	}
 
-	return input, nil
+	return histories, nil
 }
 
-func (s *sqlStorage) Update(ctx context.Context, cond, update map[string]interface{}) error {
-	db := s.db.GetDB().New().Table(oauthStore.TbUser)
+func (s *sqlStorage) AddPasswordHistory(ctx context.Context, history *model.PasswordHistory) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "AddPasswordHistory")()
 
-	return db.Where(cond).Update(update).Error
-}
+	db := s.db.GetDB().New().Table(oauthStore.TbPasswordHistory)
 
-func (s *sqlStorage) Updates(ctx context.Context, cond map[string]interface{}, update *model.UserUpdate) error {
-	db := s.db.GetDB().New().Table(oauthStore.TbUser)
+	data := oauthStore.PasswordHistorySql{PasswordHistory: *history, SQLModel: *sdkcm.NewSQLModelWithStatus(1)}
 
-	return db.Where(cond).Update(update).Error
+	return db.Create(&data).Error
 }
 
-func (s *sqlStorage) Delete(ctx context.Context, uid string) error {
-	db := s.db.GetDB().New().Table(oauthStore.TbUser)
-
-	if err := db.Where("id = ?", uid).Delete(nil).Error; err != nil {
-		return err
-	}
+// RevokeTokens deletes the access and refresh tokens of the user
+func (s *sqlStorage) RevokeTokens(ctx context.Context, uid string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "RevokeTokens")()
 
-	db = s.db.GetDB().New().Table(oauthStore.TbAccessToken)
-	db.Where("owner = ?", uid).Delete(nil)
+	db := s.db.GetDB().New().Table(oauthStore.TbAccessToken)
 
-	return nil
+	return db.Where("owner = ?", uid).Delete(nil).Error
 }
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	oauthStore "github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/jinzhu/gorm"
+)
+
+func (s *sqlStorage) FindIdentity(ctx context.Context, provider, subject string) (*model.UserIdentity, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "FindIdentity")()
+
+	db := s.db.GetDB()
+
+	if s.db.GetRDB() != nil {
+		db = s.db.GetRDB()
+	}
+
+	var row oauthStore.UserIdentitySql
+	if err := db.New().Table(oauthStore.TbUserIdentity).
+		Where("provider = ? AND subject = ?", provider, subject).First(&row).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+		}
+		return nil, err
+	}
+
+	return &row.UserIdentity, nil
+}
+
+func (s *sqlStorage) AddIdentity(ctx context.Context, identity *model.UserIdentity) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "AddIdentity")()
+
+	db := s.db.GetDB().New().Table(oauthStore.TbUserIdentity)
+
+	data := oauthStore.UserIdentitySql{UserIdentity: *identity, SQLModel: *sdkcm.NewSQLModelWithStatus(1)}
+
+	return db.Create(&data).Error
+}
+
+func (s *sqlStorage) FindIdentities(ctx context.Context, uid string) ([]model.UserIdentity, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "FindIdentities")()
+
+	db := s.db.GetDB()
+
+	if s.db.GetRDB() != nil {
+		db = s.db.GetRDB()
+	}
+
+	var rows []oauthStore.UserIdentitySql
+	if err := db.New().Table(oauthStore.TbUserIdentity).Where("user_id = ?", uid).Order("id").Find(&rows).Error; err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	identities := make([]model.UserIdentity, len(rows))
+	for i := range rows {
+		identities[i] = rows[i].UserIdentity
+	}
+
+	return identities, nil
+}
+
+func (s *sqlStorage) RemoveIdentity(ctx context.Context, uid, provider, subject string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "RemoveIdentity")()
+
+	db := s.db.GetDB().New().Table(oauthStore.TbUserIdentity)
+
+	return db.Where("user_id = ? AND provider = ? AND subject = ?", uid, provider, subject).Delete(nil).Error
+}
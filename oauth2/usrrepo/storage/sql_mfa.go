@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	oauthStore "github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+)
+
+func (s *sqlStorage) ReplaceRecoveryCodes(ctx context.Context, uid string, hashes []string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "ReplaceRecoveryCodes")()
+
+	db := s.db.GetDB().New().Begin()
+
+	if err := db.Table(oauthStore.TbMFARecoveryCode).Where("user_id = ?", uid).Delete(nil).Error; err != nil {
+		db.Rollback()
+		return err
+	}
+
+	for _, hash := range hashes {
+		data := oauthStore.RecoveryCodeSql{
+			RecoveryCode: model.RecoveryCode{UserId: uid, CodeHash: hash},
+			SQLModel:     *sdkcm.NewSQLModelWithStatus(1),
+		}
+
+		if err := db.Table(oauthStore.TbMFARecoveryCode).Create(&data).Error; err != nil {
+			db.Rollback()
+			return err
+		}
+	}
+
+	return db.Commit().Error
+}
+
+// UseRecoveryCode marks the code as used, it returns false when the code does not exist or is already used
+func (s *sqlStorage) UseRecoveryCode(ctx context.Context, uid, hash string) (bool, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "UseRecoveryCode")()
+
+	db := s.db.GetDB().New().Table(oauthStore.TbMFARecoveryCode)
+
+	res := db.Where("user_id = ? AND code_hash = ? AND used_at IS NULL", uid, hash).
+		Update(map[string]interface{}{"used_at": time.Now().UTC()})
+	if res.Error != nil {
+		return false, res.Error
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+func (s *sqlStorage) CountRecoveryCodes(ctx context.Context, uid string) (int, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "CountRecoveryCodes")()
+
+	db := s.db.GetDB()
+
+	if s.db.GetRDB() != nil {
+		db = s.db.GetRDB()
+	}
+
+	var count int
+	err := db.New().Table(oauthStore.TbMFARecoveryCode).Where("user_id = ? AND used_at IS NULL", uid).Count(&count).Error
+
+	return count, err
+}
+
+func (s *sqlStorage) FindTrustedDevices(ctx context.Context, uid string) ([]model.TrustedDevice, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "FindTrustedDevices")()
+
+	db := s.db.GetDB()
+
+	if s.db.GetRDB() != nil {
+		db = s.db.GetRDB()
+	}
+
+	var rows []oauthStore.TrustedDeviceSql
+	if err := db.New().Table(oauthStore.TbTrustedDevice).
+		Where("user_id = ? AND expired_at > ?", uid, time.Now().UTC()).Order("id").Find(&rows).Error; err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	devices := make([]model.TrustedDevice, len(rows))
+	for i := range rows {
+		devices[i] = rows[i].TrustedDevice
+	}
+
+	return devices, nil
+}
+
+// RemoveTrustedDevices revokes a device of the user, or all of them when deviceId is empty
+func (s *sqlStorage) RemoveTrustedDevices(ctx context.Context, uid, deviceId string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "RemoveTrustedDevices")()
+
+	db := s.db.GetDB().New().Table(oauthStore.TbTrustedDevice).Where("user_id = ?", uid)
+
+	if deviceId != "" {
+		db = db.Where("device_id = ?", deviceId)
+	}
+
+	return db.Delete(nil).Error
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	oauthStore "github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/oauth2/usrrepo"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/jinzhu/gorm"
+)
+
+// txConnection runs the storage on a transaction, the reads go to the transaction too so they see its writes
+type txConnection struct {
+	tx *gorm.DB
+}
+
+func (c txConnection) GetDB() *gorm.DB  { return c.tx }
+func (c txConnection) GetRDB() *gorm.DB { return nil }
+
+// Transaction runs fn on a storage bound to a transaction, which is committed when fn succeeds.
+// Within a transaction fn runs on the same one.
+func (s *sqlStorage) Transaction(ctx context.Context, fn func(tx usrrepo.Storage) error) error {
+	if _, ok := s.db.(txConnection); ok {
+		return fn(s)
+	}
+
+	tx := s.db.GetDB().New().Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := fn(&sqlStorage{txConnection{tx}}); err != nil {
+		if rbErr := tx.Rollback().Error; rbErr != nil {
+			logging.FromContext(ctx).WithError(rbErr).Error("Error occurred in rolling back a transaction")
+		}
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+func (s *sqlStorage) FindWebhooks(ctx context.Context, clientId string) ([]model.Webhook, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "FindWebhooks")()
+
+	db := s.db.GetDB()
+
+	if s.db.GetRDB() != nil {
+		db = s.db.GetRDB()
+	}
+
+	var rows []oauthStore.WebhookSql
+	if err := db.New().Table(oauthStore.TbWebhook).Where("client_id = ?", clientId).Find(&rows).Error; err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	webhooks := make([]model.Webhook, len(rows))
+	for i := range rows {
+		webhooks[i] = rows[i].ToWebhook()
+		webhooks[i].Secret = ""
+	}
+
+	return webhooks, nil
+}
+
+func (s *sqlStorage) AddOutboxEvents(ctx context.Context, events []model.OutboxEvent) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "AddOutboxEvents")()
+
+	for i := range events {
+		data := oauthStore.OutboxEventSql{OutboxEvent: events[i], SQLModel: *sdkcm.NewSQLModelWithStatus(1)}
+
+		if err := s.db.GetDB().New().Table(oauthStore.TbOutboxEvent).Create(&data).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	oauthStore "github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+)
+
+func (s *sqlStorage) FindRoles(ctx context.Context, clientId string, names ...string) ([]model.Role, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "FindRoles")()
+
+	db := s.db.GetDB()
+
+	if s.db.GetRDB() != nil {
+		db = s.db.GetRDB()
+	}
+
+	db = db.New().Table(oauthStore.TbRole).Where("client_id = ?", clientId)
+
+	if len(names) > 0 {
+		db = db.Where("name in (?)", names)
+	}
+
+	var rows []oauthStore.RoleSql
+	if err := db.Order("name").Find(&rows).Error; err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	roles := make([]model.Role, len(rows))
+	for i := range rows {
+		roles[i] = rows[i].ToRole()
+	}
+
+	return roles, nil
+}
+
+// SaveRole creates the role, or replaces the permissions of an existing one
+func (s *sqlStorage) SaveRole(ctx context.Context, role *model.Role) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "SaveRole")()
+
+	db := s.db.GetDB().New().Table(oauthStore.TbRole)
+	data := oauthStore.ToRoleSql(role)
+
+	var n int
+	if err := db.Where("client_id = ? AND name = ?", role.ClientId, role.Name).Count(&n).Error; err != nil {
+		return err
+	}
+
+	if n > 0 {
+		return s.db.GetDB().New().Table(oauthStore.TbRole).
+			Where("client_id = ? AND name = ?", role.ClientId, role.Name).
+			Update(map[string]interface{}{"permissions": data.Permissions}).Error
+	}
+
+	data.SQLModel = *sdkcm.NewSQLModelWithStatus(1)
+	return s.db.GetDB().New().Table(oauthStore.TbRole).Create(data).Error
+}
+
+func (s *sqlStorage) FindUserRoles(ctx context.Context, clientId, uid string) ([]string, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "FindUserRoles")()
+
+	db := s.db.GetDB()
+
+	if s.db.GetRDB() != nil {
+		db = s.db.GetRDB()
+	}
+
+	names := []string{}
+	if err := db.New().Table(oauthStore.TbUserRole).
+		Where("user_id = ? AND client_id = ?", uid, clientId).Order("role").Pluck("role", &names).Error; err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	return names, nil
+}
+
+func (s *sqlStorage) AddUserRole(ctx context.Context, clientId, uid, role string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "AddUserRole")()
+
+	db := s.db.GetDB().New().Table(oauthStore.TbUserRole)
+
+	var n int
+	if err := db.Where("user_id = ? AND client_id = ? AND role = ?", uid, clientId, role).Count(&n).Error; err != nil {
+		return err
+	}
+
+	if n > 0 {
+		return nil
+	}
+
+	data := oauthStore.UserRoleSql{UserId: uid, ClientId: clientId, Role: role}
+	data.SQLModel = *sdkcm.NewSQLModelWithStatus(1)
+
+	return s.db.GetDB().New().Table(oauthStore.TbUserRole).Create(&data).Error
+}
+
+func (s *sqlStorage) RemoveUserRole(ctx context.Context, clientId, uid, role string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "RemoveUserRole")()
+
+	db := s.db.GetDB().New().Table(oauthStore.TbUserRole)
+
+	return db.Where("user_id = ? AND client_id = ? AND role = ?", uid, clientId, role).Delete(nil).Error
+}
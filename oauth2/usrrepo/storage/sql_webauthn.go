@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	oauthStore "github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/tracing"
+	"github.com/baozhenglab/sdkcm"
+)
+
+func (s *sqlStorage) FindWebAuthnCredentials(ctx context.Context, uid string) ([]model.WebAuthnCredential, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "FindWebAuthnCredentials")()
+
+	db := s.db.GetDB()
+
+	if s.db.GetRDB() != nil {
+		db = s.db.GetRDB()
+	}
+
+	var rows []oauthStore.WebAuthnCredentialSql
+	if err := db.New().Table(oauthStore.TbWebAuthnCredential).Where("user_id = ?", uid).Order("id").Find(&rows).Error; err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	credentials := make([]model.WebAuthnCredential, len(rows))
+	for i := range rows {
+		credentials[i] = rows[i].WebAuthnCredential
+	}
+
+	return credentials, nil
+}
+
+func (s *sqlStorage) AddWebAuthnCredential(ctx context.Context, credential *model.WebAuthnCredential) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "AddWebAuthnCredential")()
+
+	db := s.db.GetDB().New().Table(oauthStore.TbWebAuthnCredential)
+
+	data := oauthStore.WebAuthnCredentialSql{WebAuthnCredential: *credential, SQLModel: *sdkcm.NewSQLModelWithStatus(1)}
+
+	return db.Create(&data).Error
+}
+
+// UpdateWebAuthnSignCount raises the signature counter, it returns false when the counter is not below signCount
+func (s *sqlStorage) UpdateWebAuthnSignCount(ctx context.Context, credentialId string, signCount uint32) (bool, error) {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "UpdateWebAuthnSignCount")()
+
+	db := s.db.GetDB().New().Table(oauthStore.TbWebAuthnCredential)
+
+	res := db.Where("credential_id = ? AND sign_count < ?", credentialId, signCount).
+		Update(map[string]interface{}{"sign_count": signCount})
+	if res.Error != nil {
+		return false, res.Error
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+func (s *sqlStorage) RemoveWebAuthnCredential(ctx context.Context, uid, credentialId string) error {
+	defer tracing.Storage(ctx, metrics.StoreUserSQL, "RemoveWebAuthnCredential")()
+
+	db := s.db.GetDB().New().Table(oauthStore.TbWebAuthnCredential)
+
+	return db.Where("user_id = ? AND credential_id = ?", uid, credentialId).Delete(nil).Error
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/baozhenglab/oauth-service/common"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
 	"github.com/baozhenglab/oauth-service/secure"
 	"github.com/baozhenglab/sdkcm"
 )
@@ -30,15 +31,15 @@ func (ur *userRepository) UpdateUser(ctx context.Context, update *model.UserUpda
 		}
 	}
 
-	// oldUser := &storage.UserSql{}
+	var current *storage.UserSql
 	var err error
 
 	if update.Id != "" {
-		_, err = ur.storage.Find(ctx, map[string]interface{}{
+		current, err = ur.storage.Find(ctx, map[string]interface{}{
 			"id": update.Id,
 		})
 	} else {
-		_, err = ur.storage.Find(ctx, map[string]interface{}{
+		current, err = ur.storage.Find(ctx, map[string]interface{}{
 			"username":  update.Username,
 			"client_id": update.ClientId,
 		})
@@ -52,25 +53,71 @@ func (ur *userRepository) UpdateUser(ctx context.Context, update *model.UserUpda
 	//	return nil, sdkcm.ErrCustom(nil, common.ErrUsernameExisted)
 	//}
 
+	update.PhoneNumber = nil
+	if update.Phone != nil && *update.Phone != "" {
+		if err := ur.normalizeUpdatePhone(ctx, update, current); err != nil {
+			return nil, err
+		}
+	}
+
 	if update.Password != nil && *update.Password != "" {
-		salt := secure.GenerateSalt()
-		update.Salt = &salt
+		if err := ur.checkPassword(ctx, "password", *update.Password, current); err != nil {
+			return nil, err
+		}
 
-		password := secure.ComputeHmac256(*update.Password, salt, ur.sm.GetSystemSecret())
+		password, salt, algo := secure.HashPassword(ctx, *update.Password)
+		update.Salt = &salt
 		update.Password = &password
+		update.PasswordAlgo = &algo
 	} else {
 		update.PasswordConfirmation = nil
 		update.Salt = nil
+		update.PasswordAlgo = nil
+	}
+
+	// a new email or phone has to be verified again
+	if current != nil {
+		if update.Email != nil && *update.Email != current.GetEmail() {
+			verified := false
+			update.EmailVerified = &verified
+		}
+
+		if update.PhoneNumber != nil && *update.PhoneNumber != current.GetPhoneNumber() {
+			verified := false
+			update.PhoneVerified = &verified
+		}
 	}
 
 	where := map[string]interface{}{
 		"id": update.Id,
 	}
 
-	if err := ur.storage.Updates(ctx, where, update); err != nil {
+	if err := ur.storage.Transaction(ctx, func(tx Storage) error {
+		if err := tx.Updates(ctx, where, update); err != nil {
+			return err
+		}
+
+		e, err := updatedEvent(ctx, tx, update.Id)
+		if err != nil {
+			return err
+		}
+
+		events := []userEvent{e}
+		if update.Password != nil && *update.Password != "" {
+			events = append(events, userEvent{Type: model.EventUserPasswordChanged, UserId: e.UserId})
+		}
+
+		return emit(ctx, tx, e.User.ClientId, events...)
+	}); err != nil {
 		return nil, sdkcm.ErrDB(err)
 	}
 
+	if current != nil && update.Password != nil && *update.Password != "" {
+		if err := ur.savePasswordHistory(ctx, current); err != nil {
+			return nil, sdkcm.ErrDB(err)
+		}
+	}
+
 	u, err := ur.storage.Find(ctx, where)
 	if err != nil {
 		return nil, sdkcm.ErrDB(err)
@@ -78,3 +125,38 @@ func (ur *userRepository) UpdateUser(ctx context.Context, update *model.UserUpda
 
 	return &u.User, nil
 }
+
+// normalizeUpdatePhone saves the new phone in its E.164 form, the region is the one of the current phone
+// when the update has no prefix. A phone can only belong to one user of a client.
+func (ur *userRepository) normalizeUpdatePhone(ctx context.Context, update *model.UserUpdate, current *storage.UserSql) error {
+	prefix := ""
+	if update.PhonePrefix != nil {
+		prefix = *update.PhonePrefix
+	} else if current != nil && current.PhonePrefix != nil {
+		prefix = *current.PhonePrefix
+	}
+
+	p, err := normalizePhone(prefix, *update.Phone)
+	if err != nil {
+		return err
+	}
+
+	cond := map[string]interface{}{"phone_number": p.E164}
+	if current != nil {
+		cond["client_id"] = current.ClientId
+	} else if update.ClientId != nil {
+		cond["client_id"] = *update.ClientId
+	}
+
+	owner, err := ur.storage.Find(ctx, cond)
+	if err != nil && err.Error() != common.ErrDataNotFound.Error() {
+		return sdkcm.ErrCannotFetchData(err)
+	}
+
+	if owner != nil && (current == nil || owner.ID != current.ID) {
+		return sdkcm.ErrCustom(nil, common.ErrPhoneExisted)
+	}
+
+	update.PhonePrefix, update.Phone, update.PhoneNumber = &p.Prefix, &p.National, &p.E164
+	return nil
+}
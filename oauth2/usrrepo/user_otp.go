@@ -3,89 +3,214 @@ package usrrepo
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"time"
 
 	"github.com/baozhenglab/oauth-service/common"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
 	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/oauth-service/sender"
 	"github.com/baozhenglab/sdkcm"
 )
 
-const (
-	minOtp             = 100000
-	maxOtp             = 999999
-	otpExpireInSeconds = 60
-)
+// GenerateOTP sends a new one-time password to the user, by SMS when the user is identified by phone,
+// otherwise by email. Only the hash of the code is stored, the previous code is revoked.
+func (ur *userRepository) GenerateOTP(ctx context.Context, userFilter *model.UserFilter) error {
+	userFilter.OTPCode = nil
 
-func (ur *userRepository) GenerateOTP(ctx context.Context, userFilter *model.UserFilter) (string, error) {
-	oldUser, err := ur.storage.Find(ctx, userFilter.Map())
+	oldUser, err := ur.storage.Find(ctx, phoneCond(userFilter.Map(), userFilter.PhonePrefix))
 
 	if err != nil {
-		return "", sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+		return sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	switch {
+	case userFilter.Phone == nil && oldUser.GetEmail() != "":
+		return ur.sendOTP(ctx, oldUser, "", sender.PurposeLogin)
+	case oldUser.GetPhoneNumber() != "":
+		return ur.sendOTP(ctx, oldUser, oldUser.GetPhoneNumber(), sender.PurposeLogin)
+	default:
+		return sdkcm.ErrCustom(nil, common.ErrOTPNoDeliveryChannel)
 	}
+}
 
-	otp := fmt.Sprintf("%d", rand.New(rand.NewSource(time.Now().UnixNano())).Intn(maxOtp-minOtp)+minOtp)
+// sendOTP sends a code by SMS to the phone, or by email without phone
+func (ur *userRepository) sendOTP(ctx context.Context, user *storage.UserSql, phone, purpose string) error {
+	uid := fmt.Sprintf("%d", user.ID)
+	policy := ur.sm.GetOTPPolicy()
+
+	msg := &sender.OTPMessage{
+		Channel:  sender.ChannelSMS,
+		Purpose:  purpose,
+		To:       phone,
+		Code:     secure.GenerateOTP(policy.Length),
+		TTL:      policy.TTL,
+		ClientId: user.ClientId,
+		UserId:   uid,
+	}
+
+	if phone == "" {
+		msg.Channel, msg.To = sender.ChannelEmail, user.GetEmail()
+	}
 
 	if err := ur.storage.Update(ctx,
-		map[string]interface{}{"id": oldUser.UserId},
+		map[string]interface{}{"id": uid},
 		map[string]interface{}{
-			"otp_code":            otp,
-			"otp_code_expired_at": time.Now().UTC().Add(time.Second * otpExpireInSeconds),
+			"otp_code":            secure.HashOTP(msg.Code, uid, ur.sm.GetSystemSecret()),
+			"otp_code_expired_at": time.Now().UTC().Add(policy.TTL),
+			"otp_attempts":        0,
+			"otp_channel":         msg.Channel,
+			"otp_sent_to":         msg.To,
 		},
 	); err != nil {
-		return "", sdkcm.ErrDB(err)
+		return sdkcm.ErrDB(err)
 	}
 
-	return otp, nil
+	if err := ur.sm.GetOTPSender().SendOTP(ctx, msg); err != nil {
+		return sdkcm.ErrCustom(err, common.ErrOTPCannotBeSent)
+	}
+
+	return nil
 }
 
+// LoginWithOTP checks the code of the user, a code can only be used once
+// and is revoked after too many wrong attempts.
 func (ur *userRepository) LoginWithOTP(ctx context.Context, userFilter *model.UserFilter) (*model.User, error) {
-	//if userFilter.OTPCode == nil {
-	//	return nil, sdkcm.ErrWithMessage(errors.New("otp code is blank"), common.ErrDataNotFound)
-	//}
+	if userFilter.OTPCode == nil || *userFilter.OTPCode == "" {
+		return nil, sdkcm.ErrCustom(nil, common.ErrOTPInvalid)
+	}
 
-	oldUser, err := ur.storage.Find(ctx, userFilter.Map())
+	code := *userFilter.OTPCode
+	userFilter.OTPCode = nil
+
+	oldUser, err := ur.storage.Find(ctx, phoneCond(userFilter.Map(), userFilter.PhonePrefix))
 
 	if err != nil {
 		return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
 	}
 
-	if otpExp := oldUser.OtpCodeExpiredAt; otpExp != nil {
-		if otpExp.Before(time.Now().UTC()) {
-			return nil, sdkcm.ErrWithMessage(err, common.ErrOTPExpired)
+	oldUser.User.UserId = fmt.Sprintf("%d", oldUser.ID)
+
+	// the code proves the ownership of the address it was sent to, if it is still the address of the user
+	verified := map[string]interface{}{}
+	if oldUser.OtpChannel != nil && oldUser.OtpSentTo != nil {
+		switch channel, sentTo := *oldUser.OtpChannel, *oldUser.OtpSentTo; {
+		case channel == sender.ChannelEmail && sentTo == oldUser.GetEmail():
+			verified["email_verified"] = true
+		case channel == sender.ChannelSMS && sentTo == oldUser.GetPhoneNumber():
+			verified["phone_verified"] = true
 		}
 	}
 
-	oldUser.User.UserId = fmt.Sprintf("%d", oldUser.ID)
+	if err := ur.useOTP(ctx, oldUser, code, verified); err != nil {
+		return nil, err
+	}
 
-	_ = ur.storage.Update(
-		ctx,
-		map[string]interface{}{"id": oldUser.UserId},
-		map[string]interface{}{
-			"otp_code":            nil,
-			"otp_code_expired_at": nil,
-		},
-	)
+	oldUser.EmailVerified = oldUser.EmailVerified || verified["email_verified"] != nil
+	oldUser.PhoneVerified = oldUser.PhoneVerified || verified["phone_verified"] != nil
 
 	return &oldUser.User, nil
 }
 
+// useOTP checks the code of the user, a code can only be used once and is revoked after too many wrong attempts.
+// The update is applied with the revocation of the used code.
+func (ur *userRepository) useOTP(ctx context.Context, user *storage.UserSql, code string, update map[string]interface{}) error {
+	uid := fmt.Sprintf("%d", user.ID)
+	revoke := map[string]interface{}{
+		"otp_code":            nil,
+		"otp_code_expired_at": nil,
+		"otp_attempts":        0,
+		"otp_channel":         nil,
+		"otp_sent_to":         nil,
+	}
+
+	if user.OtpCode == nil || *user.OtpCode == "" || code == "" {
+		return sdkcm.ErrCustom(nil, common.ErrOTPInvalid)
+	}
+
+	// the writes only apply to the code which was read, a new or used code is left alone
+	where := map[string]interface{}{"id": uid, "otp_code": *user.OtpCode}
+	maxAttempts := ur.sm.GetOTPPolicy().MaxAttempts
+
+	if otpExp := user.OtpCodeExpiredAt; otpExp == nil || otpExp.Before(time.Now().UTC()) {
+		_, _ = ur.storage.UpdateIf(ctx, where, revoke)
+		return sdkcm.ErrCustom(nil, common.ErrOTPExpired)
+	}
+
+	// the attempt is taken before the code is checked so concurrent guesses cannot go over the limit
+	taken, err := ur.storage.Increment(ctx, where, "otp_attempts", maxAttempts)
+	if err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if !taken {
+		if revoked, _ := ur.storage.UpdateIf(ctx, where, revoke); revoked {
+			return sdkcm.ErrCustom(nil, common.ErrOTPTooManyAttempts)
+		}
+
+		return sdkcm.ErrCustom(nil, common.ErrOTPInvalid)
+	}
+
+	if !secure.VerifyOTP(code, *user.OtpCode, uid, ur.sm.GetSystemSecret()) {
+		last := map[string]interface{}{"id": uid, "otp_code": *user.OtpCode, "otp_attempts": maxAttempts}
+		if revoked, _ := ur.storage.UpdateIf(ctx, last, revoke); revoked {
+			return sdkcm.ErrCustom(nil, common.ErrOTPTooManyAttempts)
+		}
+
+		return sdkcm.ErrCustom(nil, common.ErrOTPInvalid)
+	}
+
+	for k, v := range update {
+		revoke[k] = v
+	}
+
+	// a code is consumed once, a concurrent use of the same code loses
+	consumed, err := ur.storage.UpdateIf(ctx, where, revoke)
+	if err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	if !consumed {
+		return sdkcm.ErrCustom(nil, common.ErrOTPInvalid)
+	}
+
+	return nil
+}
+
 func (ur *userRepository) LoginWithOtherCredentialAndPassword(ctx context.Context, credential *model.CredentialAndPassword) (*model.User, error) {
 	password := *credential.Password
 	credential.Password = nil
 
-	oldUser, err := ur.storage.Find(ctx, credential.Map())
+	lockKeys := credentialLockKeys(ctx, credential)
+	if err := ur.checkLockout(ctx, lockKeys); err != nil {
+		return nil, err
+	}
+
+	// the phone of a credential has no prefix, it is normalized when typed in the international format
+	oldUser, err := ur.storage.Find(ctx, phoneCond(credential.Map(), nil))
 
 	if err != nil {
+		ur.recordFailure(ctx, lockKeys...)
 		return nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
 	}
 
-	if oldUser.Password != secure.ComputeHmac256(password, oldUser.Salt, ur.sm.GetSystemSecret()) {
+	if !secure.VerifyPassword(ctx, password, oldUser.Password, oldUser.Salt, oldUser.PasswordAlgo, ur.sm.GetSystemSecret()) {
+		ur.recordFailure(ctx, lockKeys...)
 		return nil, sdkcm.ErrCustom(nil, common.ErrCannotLogin)
 	}
 
+	ur.recordSuccess(ctx, lockKeys[0])
+
 	oldUser.User.UserId = fmt.Sprintf("%d", oldUser.ID)
 
+	// Legacy hashes are replaced on the next successful login
+	if secure.PasswordNeedsRehash(oldUser.PasswordAlgo) {
+		hash, salt, algo := secure.HashPassword(ctx, password)
+		_ = ur.storage.Update(ctx,
+			map[string]interface{}{"id": oldUser.UserId},
+			map[string]interface{}{"password": hash, "salt": salt, "password_algo": algo},
+		)
+	}
+
 	return &oldUser.User, nil
 }
@@ -0,0 +1,389 @@
+package usrrepo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
+)
+
+// WebAuthn registration and assertion ceremonies.
+// The ceremony session is given to the caller as an encrypted token, and must be sent back to finish the ceremony.
+// Its challenge is answered once, the used challenges are kept by the lockout counters until the session expires.
+
+const (
+	webAuthnRegistration     = "register"
+	webAuthnLogin            = "login"
+	webAuthnReauthentication = "reauthenticate"
+	webAuthnCeremonyTTL      = 5 * time.Minute
+)
+
+type webAuthnCeremony struct {
+	Purpose   string               `json:"p"`
+	UserId    string               `json:"uid,omitempty"`
+	ClientId  string               `json:"cid"`
+	ExpiresAt int64                `json:"exp"`
+	Session   webauthn.SessionData `json:"s"`
+}
+
+// webAuthnUser adapts an user and its credentials to the WebAuthn library
+type webAuthnUser struct {
+	id          string
+	name        string
+	credentials []model.WebAuthnCredential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(u.id)
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.name
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.name
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+
+	for _, c := range u.credentials {
+		id, err := base64.RawURLEncoding.DecodeString(c.CredentialId)
+		if err != nil {
+			continue
+		}
+
+		credentials = append(credentials, webauthn.Credential{
+			ID:              id,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Authenticator:   webauthn.Authenticator{AAGUID: c.AAGUID, SignCount: c.SignCount},
+		})
+	}
+
+	return credentials
+}
+
+func (ur *userRepository) findWebAuthnUser(ctx context.Context, uid string) (*storage.UserSql, *webAuthnUser, error) {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return nil, nil, sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	credentials, err := ur.storage.FindWebAuthnCredentials(ctx, uid)
+	if err != nil {
+		return nil, nil, sdkcm.ErrCannotFetchData(err)
+	}
+
+	name := user.GetUsername()
+	if name == "" {
+		name = user.GetEmail()
+	}
+	if name == "" {
+		name = uid
+	}
+
+	return user, &webAuthnUser{id: uid, name: name, credentials: credentials}, nil
+}
+
+func (ur *userRepository) webAuthn() (*webauthn.WebAuthn, error) {
+	w, err := ur.sm.GetWebAuthn()
+	if err != nil {
+		return nil, sdkcm.ErrCustom(err, common.ErrWebAuthnUnavailable)
+	}
+
+	return w, nil
+}
+
+func (ur *userRepository) sealCeremony(c *webAuthnCeremony) (string, error) {
+	c.ExpiresAt = time.Now().Add(webAuthnCeremonyTTL).Unix()
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", sdkcm.ErrInvalidRequest(err)
+	}
+
+	token, err := ur.sm.GetAES().Encrypt(data)
+	if err != nil {
+		return "", sdkcm.ErrInvalidRequest(err)
+	}
+
+	return token, nil
+}
+
+func (ur *userRepository) openCeremony(ctx context.Context, token, purpose, clientId string) (*webAuthnCeremony, error) {
+	data, err := ur.sm.GetAES().Decrypt(token)
+	if err != nil {
+		return nil, sdkcm.ErrCustom(err, common.ErrWebAuthnSessionInvalid)
+	}
+
+	var c webAuthnCeremony
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, sdkcm.ErrCustom(err, common.ErrWebAuthnSessionInvalid)
+	}
+
+	if c.Purpose != purpose || c.ClientId != clientId || time.Now().Unix() > c.ExpiresAt {
+		return nil, sdkcm.ErrCustom(nil, common.ErrWebAuthnSessionInvalid)
+	}
+
+	// a captured session and assertion cannot be replayed, the signature counter of most passkeys stays at 0
+	ttl := time.Until(time.Unix(c.ExpiresAt, 0)) + time.Second
+	if err := secure.MarkUsed(ctx, ur.sm.GetLockout().Counter, secure.UsedKey("webauthn", c.Session.Challenge), ttl); err == secure.ErrAlreadyUsed {
+		return nil, sdkcm.ErrCustom(nil, common.ErrWebAuthnSessionInvalid)
+	} else if err != nil {
+		return nil, sdkcm.ErrCannotFetchData(err)
+	}
+
+	return &c, nil
+}
+
+// BeginWebAuthnRegistration starts the registration of a new credential, after a fresh proof of the user.
+// Discoverable credentials (passkeys) are preferred so they can be used without an username.
+func (ur *userRepository) BeginWebAuthnRegistration(ctx context.Context, clientId, uid string, proof *model.Reauthentication) (*protocol.CredentialCreation, string, error) {
+	w, err := ur.webAuthn()
+	if err != nil {
+		return nil, "", err
+	}
+
+	user, wu, err := ur.findWebAuthnUser(ctx, uid)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := ur.reauthenticate(ctx, user, proof); err != nil {
+		return nil, "", err
+	}
+
+	var exclusions []protocol.CredentialDescriptor
+	for _, c := range wu.WebAuthnCredentials() {
+		exclusions = append(exclusions, protocol.CredentialDescriptor{Type: protocol.PublicKeyCredentialType, CredentialID: c.ID})
+	}
+
+	options, session, err := w.BeginRegistration(wu,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return nil, "", sdkcm.ErrCustom(err, common.ErrWebAuthnFailed)
+	}
+
+	token, err := ur.sealCeremony(&webAuthnCeremony{Purpose: webAuthnRegistration, UserId: uid, ClientId: clientId, Session: *session})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return options, token, nil
+}
+
+func (ur *userRepository) FinishWebAuthnRegistration(ctx context.Context, clientId, uid, token, name string, response *protocol.ParsedCredentialCreationData) (*model.WebAuthnCredential, error) {
+	w, err := ur.webAuthn()
+	if err != nil {
+		return nil, err
+	}
+
+	ceremony, err := ur.openCeremony(ctx, token, webAuthnRegistration, clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	if ceremony.UserId != uid {
+		return nil, sdkcm.ErrCustom(nil, common.ErrWebAuthnSessionInvalid)
+	}
+
+	_, wu, err := ur.findWebAuthnUser(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := w.CreateCredential(wu, ceremony.Session, response)
+	if err != nil {
+		return nil, sdkcm.ErrCustom(err, common.ErrWebAuthnFailed)
+	}
+
+	result := &model.WebAuthnCredential{
+		CredentialId:    base64.RawURLEncoding.EncodeToString(credential.ID),
+		UserId:          uid,
+		Name:            name,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+	}
+
+	if err := ur.storage.AddWebAuthnCredential(ctx, result); err != nil {
+		return nil, sdkcm.ErrDB(err)
+	}
+
+	return result, nil
+}
+
+// BeginWebAuthnLogin starts an assertion, for the credentials of an user when uid is given (second factor),
+// otherwise for any discoverable credential (passkey login)
+func (ur *userRepository) BeginWebAuthnLogin(ctx context.Context, clientId, uid string) (*protocol.CredentialAssertion, string, error) {
+	return ur.beginWebAuthnAssertion(ctx, webAuthnLogin, clientId, uid)
+}
+
+// BeginWebAuthnReauthentication starts an assertion with the credentials of the user,
+// the assertion is a fresh proof of the user (see model.Reauthentication)
+func (ur *userRepository) BeginWebAuthnReauthentication(ctx context.Context, clientId, uid string) (*protocol.CredentialAssertion, string, error) {
+	return ur.beginWebAuthnAssertion(ctx, webAuthnReauthentication, clientId, uid)
+}
+
+func (ur *userRepository) beginWebAuthnAssertion(ctx context.Context, purpose, clientId, uid string) (*protocol.CredentialAssertion, string, error) {
+	w, err := ur.webAuthn()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var options *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+
+	if uid == "" {
+		options, session, err = w.BeginDiscoverableLogin()
+	} else {
+		_, wu, findErr := ur.findWebAuthnUser(ctx, uid)
+		if findErr != nil {
+			return nil, "", findErr
+		}
+
+		if len(wu.credentials) == 0 {
+			return nil, "", sdkcm.ErrCustom(nil, common.ErrWebAuthnNoCredential)
+		}
+
+		options, session, err = w.BeginLogin(wu)
+	}
+
+	if err != nil {
+		return nil, "", sdkcm.ErrCustom(err, common.ErrWebAuthnFailed)
+	}
+
+	token, err := ur.sealCeremony(&webAuthnCeremony{Purpose: purpose, UserId: uid, ClientId: clientId, Session: *session})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return options, token, nil
+}
+
+// FinishWebAuthnLogin verifies the assertion and the signature counter of the credential
+func (ur *userRepository) FinishWebAuthnLogin(ctx context.Context, clientId, token string, response *protocol.ParsedCredentialAssertionData) (*model.User, error) {
+	w, err := ur.webAuthn()
+	if err != nil {
+		return nil, err
+	}
+
+	ceremony, err := ur.openCeremony(ctx, token, webAuthnLogin, clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := ur.validateWebAuthnAssertion(ctx, w, ceremony, response)
+	if err != nil {
+		return nil, err
+	}
+
+	user.User.UserId = fmt.Sprintf("%d", user.ID)
+	return &user.User, nil
+}
+
+// validateWebAuthnAssertion verifies the assertion of the ceremony and the signature counter of the credential,
+// it returns the user of the credential
+func (ur *userRepository) validateWebAuthnAssertion(ctx context.Context, w *webauthn.WebAuthn, ceremony *webAuthnCeremony, response *protocol.ParsedCredentialAssertionData) (*storage.UserSql, error) {
+	var err error
+	var user *storage.UserSql
+	var credential *webauthn.Credential
+
+	// the users of another client cannot sign in through the ceremony of this client
+	findUser := func(uid string) (*webAuthnUser, error) {
+		u, wu, err := ur.findWebAuthnUser(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+
+		if u.ClientId != ceremony.ClientId {
+			return nil, sdkcm.ErrCustom(nil, common.ErrWebAuthnFailed)
+		}
+
+		user = u
+		return wu, nil
+	}
+
+	if ceremony.UserId != "" {
+		var wu *webAuthnUser
+		if wu, err = findUser(ceremony.UserId); err != nil {
+			return nil, err
+		}
+
+		credential, err = w.ValidateLogin(wu, ceremony.Session, response)
+	} else {
+		credential, err = w.ValidateDiscoverableLogin(func(_, userHandle []byte) (webauthn.User, error) {
+			return findUser(string(userHandle))
+		}, ceremony.Session, response)
+	}
+
+	if err != nil {
+		return nil, sdkcm.ErrCustom(err, common.ErrWebAuthnFailed)
+	}
+
+	if credential.Authenticator.CloneWarning {
+		return nil, sdkcm.ErrCustom(nil, common.ErrWebAuthnCloned)
+	}
+
+	// an authenticator without counter always signs 0, otherwise the counter must grow,
+	// also against a concurrent assertion of the same counter
+	if credential.Authenticator.SignCount > 0 {
+		credentialId := base64.RawURLEncoding.EncodeToString(credential.ID)
+
+		updated, err := ur.storage.UpdateWebAuthnSignCount(ctx, credentialId, credential.Authenticator.SignCount)
+		if err != nil {
+			return nil, sdkcm.ErrDB(err)
+		}
+
+		if !updated {
+			return nil, sdkcm.ErrCustom(nil, common.ErrWebAuthnCloned)
+		}
+	}
+
+	return user, nil
+}
+
+func (ur *userRepository) ListWebAuthnCredentials(ctx context.Context, uid string) ([]model.WebAuthnCredential, error) {
+	credentials, err := ur.storage.FindWebAuthnCredentials(ctx, uid)
+	if err != nil {
+		return nil, sdkcm.ErrCannotFetchData(err)
+	}
+
+	return credentials, nil
+}
+
+// RemoveWebAuthnCredential removes a credential of the user, after a fresh proof of the user
+func (ur *userRepository) RemoveWebAuthnCredential(ctx context.Context, uid, credentialId string, proof *model.Reauthentication) error {
+	user, err := ur.storage.Find(ctx, map[string]interface{}{"id": uid})
+	if err != nil {
+		return sdkcm.ErrWithMessage(err, common.ErrDataNotFound)
+	}
+
+	if err := ur.reauthenticate(ctx, user, proof); err != nil {
+		return err
+	}
+
+	if err := ur.storage.RemoveWebAuthnCredential(ctx, uid, credentialId); err != nil {
+		return sdkcm.ErrDB(err)
+	}
+
+	return nil
+}
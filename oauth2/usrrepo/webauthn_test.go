@@ -0,0 +1,462 @@
+package usrrepo
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/oauth2/storage"
+	"github.com/baozhenglab/oauth-service/secure"
+	"github.com/baozhenglab/sdkcm"
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/protocol/webauthncbor"
+	"github.com/duo-labs/webauthn/protocol/webauthncose"
+	"github.com/duo-labs/webauthn/webauthn"
+)
+
+const (
+	testRPID     = "localhost"
+	testOrigin   = "https://localhost"
+	testClientId = "client"
+	testUserId   = "1"
+	testPassword = "correct horse battery staple"
+)
+
+// fakeStorage keeps one user and its credentials, the other methods of Storage are not used by the ceremonies
+type fakeStorage struct {
+	Storage
+
+	user        *storage.UserSql
+	credentials []model.WebAuthnCredential
+	// afterFindCredentials runs after the credentials are read, like a concurrent request would
+	afterFindCredentials func()
+}
+
+func (s *fakeStorage) Find(ctx context.Context, cond map[string]interface{}) (*storage.UserSql, error) {
+	id, byId := cond["id"]
+	email, byEmail := cond["email"]
+	clientId, byClient := cond["client_id"]
+
+	if (byId && id != testUserId) || (byEmail && (s.user.Email == nil || email != *s.user.Email)) ||
+		(byClient && clientId != s.user.ClientId) || (!byId && !byEmail) {
+		return nil, sdkcm.ErrWithMessage(nil, common.ErrDataNotFound)
+	}
+
+	u := *s.user
+	return &u, nil
+}
+
+// FindIdentity knows no identity, the logins with a provider look for the user of the email
+func (s *fakeStorage) FindIdentity(ctx context.Context, provider, subject string) (*model.UserIdentity, error) {
+	return nil, sdkcm.ErrWithMessage(nil, common.ErrDataNotFound)
+}
+
+func (s *fakeStorage) FindWebAuthnCredentials(ctx context.Context, uid string) ([]model.WebAuthnCredential, error) {
+	credentials := append([]model.WebAuthnCredential(nil), s.credentials...)
+
+	if s.afterFindCredentials != nil {
+		s.afterFindCredentials()
+	}
+
+	return credentials, nil
+}
+
+func (s *fakeStorage) AddWebAuthnCredential(ctx context.Context, credential *model.WebAuthnCredential) error {
+	s.credentials = append(s.credentials, *credential)
+	return nil
+}
+
+func (s *fakeStorage) UpdateWebAuthnSignCount(ctx context.Context, credentialId string, signCount uint32) (bool, error) {
+	for i := range s.credentials {
+		if s.credentials[i].CredentialId == credentialId && s.credentials[i].SignCount < signCount {
+			s.credentials[i].SignCount = signCount
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+type fakeSystem struct {
+	SystemManager
+
+	aes      *secure.AES
+	webAuthn *webauthn.WebAuthn
+	lockout  *secure.Lockout
+}
+
+func (f *fakeSystem) GetSystemSecret() string                  { return "system-secret" }
+func (f *fakeSystem) GetAES() *secure.AES                      { return f.aes }
+func (f *fakeSystem) GetWebAuthn() (*webauthn.WebAuthn, error) { return f.webAuthn, nil }
+func (f *fakeSystem) GetLockout() *secure.Lockout              { return f.lockout }
+
+func newWebAuthnRepository(t *testing.T) (*userRepository, *fakeStorage) {
+	t.Helper()
+
+	w, err := webauthn.New(&webauthn.Config{RPDisplayName: "test", RPID: testRPID, RPOrigin: testOrigin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, salt, algo := secure.HashPassword(context.Background(), testPassword)
+	username := "alice"
+
+	s := &fakeStorage{user: &storage.UserSql{
+		User: model.User{ClientId: testClientId, Username: &username, Password: hash, Salt: salt, PasswordAlgo: algo},
+	}}
+	s.user.ID = 1
+
+	return New(s, &fakeSystem{
+		aes:      secure.NewEAS([]byte("some-secret-of-thirty-two-bytes!")),
+		webAuthn: w,
+		lockout:  &secure.Lockout{Counter: secure.NewMemoryCounter()},
+	}), s
+}
+
+// softAuthenticator is a P-256 authenticator in memory
+type softAuthenticator struct {
+	key     *ecdsa.PrivateKey
+	id      []byte
+	counter uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+
+	return &softAuthenticator{key: key, id: id}
+}
+
+// authData is the authenticator data, the attested credential is added for a registration
+func (a *softAuthenticator) authData(t *testing.T, attested bool) []byte {
+	t.Helper()
+
+	rpIdHash := sha256.Sum256([]byte(testRPID))
+	flags := byte(protocol.FlagUserPresent | protocol.FlagUserVerified)
+	if attested {
+		flags |= byte(protocol.FlagAttestedCredentialData)
+	}
+
+	data := append(rpIdHash[:], flags)
+	data = append(data, uint32Bytes(a.counter)...)
+
+	if !attested {
+		return data
+	}
+
+	key, err := webauthncbor.Marshal(&webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{KeyType: int64(webauthncose.EllipticKey), Algorithm: int64(webauthncose.AlgES256)},
+		Curve:         1, // P-256
+		XCoord:        a.key.X.FillBytes(make([]byte, 32)),
+		YCoord:        a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = append(data, byte(len(a.id)>>8), byte(len(a.id)))
+	data = append(data, a.id...)
+
+	return append(data, key...)
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremony string, challenge protocol.Challenge) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// create answers a registration with a "none" attestation
+func (a *softAuthenticator) create(t *testing.T, options *protocol.CredentialCreation) *protocol.ParsedCredentialCreationData {
+	t.Helper()
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(t, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData(t, "webauthn.create", options.Response.Challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	})
+
+	response, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("ParseCredentialCreationResponseBody: %+v", err)
+	}
+
+	return response
+}
+
+// get answers an assertion, a passkey gives its user handle
+func (a *softAuthenticator) get(t *testing.T, options *protocol.CredentialAssertion, userHandle string) *protocol.ParsedCredentialAssertionData {
+	t.Helper()
+
+	response, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(a.assert(t, options, userHandle)))
+	if err != nil {
+		t.Fatalf("ParseCredentialRequestResponseBody: %+v", err)
+	}
+
+	return response
+}
+
+// assert answers the PublicKeyCredential of an assertion, as sent by the browsers
+func (a *softAuthenticator) assert(t *testing.T, options *protocol.CredentialAssertion, userHandle string) []byte {
+	t.Helper()
+
+	authData := a.authData(t, false)
+	clientData := a.clientData(t, "webauthn.get", options.Response.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString([]byte(userHandle)),
+		},
+	})
+
+	return body
+}
+
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func errCode(err error) string {
+	var appErr sdkcm.AppError
+	if errors.As(err, &appErr) {
+		return appErr.Code
+	}
+
+	return ""
+}
+
+func register(t *testing.T, ur *userRepository, a *softAuthenticator) {
+	t.Helper()
+	ctx := context.Background()
+
+	options, session, err := ur.BeginWebAuthnRegistration(ctx, testClientId, testUserId, &model.Reauthentication{Password: testPassword})
+	if err != nil {
+		t.Fatalf("BeginWebAuthnRegistration: %+v", err)
+	}
+
+	if _, err := ur.FinishWebAuthnRegistration(ctx, testClientId, testUserId, session, "key", a.create(t, options)); err != nil {
+		t.Fatalf("FinishWebAuthnRegistration: %+v", err)
+	}
+}
+
+// login runs a passkey login without uid, or the second factor of the user
+func login(t *testing.T, ur *userRepository, a *softAuthenticator, clientId, uid string) (*model.User, error) {
+	t.Helper()
+	ctx := context.Background()
+
+	options, session, err := ur.BeginWebAuthnLogin(ctx, clientId, uid)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnLogin: %+v", err)
+	}
+
+	return ur.FinishWebAuthnLogin(ctx, clientId, session, a.get(t, options, testUserId))
+}
+
+func TestWebAuthnRegistrationRequiresReauthentication(t *testing.T) {
+	ur, _ := newWebAuthnRepository(t)
+	ctx := context.Background()
+
+	if _, _, err := ur.BeginWebAuthnRegistration(ctx, testClientId, testUserId, &model.Reauthentication{}); errCode(err) != common.ErrReauthenticationRequired.Key() {
+		t.Errorf("without proof: err = %v, want %s", err, common.ErrReauthenticationRequired.Key())
+	}
+
+	if _, _, err := ur.BeginWebAuthnRegistration(ctx, testClientId, testUserId, &model.Reauthentication{Password: "wrong"}); errCode(err) != common.ErrPasswordNotCorrect.Key() {
+		t.Errorf("wrong password: err = %v, want %s", err, common.ErrPasswordNotCorrect.Key())
+	}
+}
+
+func TestWebAuthnPasskeyLogin(t *testing.T) {
+	ur, s := newWebAuthnRepository(t)
+	a := newSoftAuthenticator(t)
+	register(t, ur, a)
+
+	if len(s.credentials) != 1 {
+		t.Fatalf("%d credentials stored, want 1", len(s.credentials))
+	}
+
+	a.counter = 1
+	user, err := login(t, ur, a, testClientId, "")
+	if err != nil {
+		t.Fatalf("FinishWebAuthnLogin: %+v", err)
+	}
+
+	if user.UserId != testUserId {
+		t.Errorf("user = %s, want %s", user.UserId, testUserId)
+	}
+
+	if s.credentials[0].SignCount != 1 {
+		t.Errorf("sign count = %d, want 1", s.credentials[0].SignCount)
+	}
+
+	// the passkey of an user of another client
+	a.counter = 2
+	if _, err := login(t, ur, a, "other", ""); errCode(err) != common.ErrWebAuthnFailed.Key() {
+		t.Errorf("other client: err = %v, want %s", err, common.ErrWebAuthnFailed.Key())
+	}
+}
+
+func TestWebAuthnSecondFactor(t *testing.T) {
+	ur, _ := newWebAuthnRepository(t)
+	a := newSoftAuthenticator(t)
+	register(t, ur, a)
+
+	a.counter = 1
+	user, err := login(t, ur, a, testClientId, testUserId)
+	if err != nil {
+		t.Fatalf("FinishWebAuthnLogin: %+v", err)
+	}
+
+	if user.UserId != testUserId {
+		t.Errorf("user = %s, want %s", user.UserId, testUserId)
+	}
+
+	// another authenticator is not a credential of the user
+	other := newSoftAuthenticator(t)
+	other.counter = 1
+	if _, err := login(t, ur, other, testClientId, testUserId); errCode(err) != common.ErrWebAuthnFailed.Key() {
+		t.Errorf("unknown authenticator: err = %v, want %s", err, common.ErrWebAuthnFailed.Key())
+	}
+}
+
+func TestWebAuthnRejectsClonedCounter(t *testing.T) {
+	ur, s := newWebAuthnRepository(t)
+	a := newSoftAuthenticator(t)
+	register(t, ur, a)
+
+	a.counter = 5
+	if _, err := login(t, ur, a, testClientId, ""); err != nil {
+		t.Fatalf("FinishWebAuthnLogin: %+v", err)
+	}
+
+	// a copy of the authenticator is behind the original
+	a.counter = 3
+	if _, err := login(t, ur, a, testClientId, ""); errCode(err) != common.ErrWebAuthnCloned.Key() {
+		t.Errorf("lower counter: err = %v, want %s", err, common.ErrWebAuthnCloned.Key())
+	}
+
+	// a concurrent assertion raises the stored counter after it was read
+	s.afterFindCredentials = func() {
+		s.credentials[0].SignCount = 10
+		s.afterFindCredentials = nil
+	}
+
+	a.counter = 7
+	if _, err := login(t, ur, a, testClientId, ""); errCode(err) != common.ErrWebAuthnCloned.Key() {
+		t.Errorf("concurrent counter: err = %v, want %s", err, common.ErrWebAuthnCloned.Key())
+	}
+}
+
+func TestWebAuthnReauthentication(t *testing.T) {
+	ur, _ := newWebAuthnRepository(t)
+	a := newSoftAuthenticator(t)
+	register(t, ur, a)
+	ctx := context.Background()
+
+	options, session, err := ur.BeginWebAuthnReauthentication(ctx, testClientId, testUserId)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnReauthentication: %+v", err)
+	}
+
+	a.counter = 1
+	proof := &model.Reauthentication{WebAuthnSession: session, WebAuthnAssertion: a.assert(t, options, testUserId)}
+	if _, _, err := ur.BeginWebAuthnRegistration(ctx, testClientId, testUserId, proof); err != nil {
+		t.Errorf("passkey proof: %+v", err)
+	}
+
+	// the session of a login is not a proof
+	options, session, err = ur.BeginWebAuthnLogin(ctx, testClientId, testUserId)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnLogin: %+v", err)
+	}
+
+	a.counter = 2
+	proof = &model.Reauthentication{WebAuthnSession: session, WebAuthnAssertion: a.assert(t, options, testUserId)}
+	if _, _, err := ur.BeginWebAuthnRegistration(ctx, testClientId, testUserId, proof); errCode(err) != common.ErrWebAuthnSessionInvalid.Key() {
+		t.Errorf("login session: err = %v, want %s", err, common.ErrWebAuthnSessionInvalid.Key())
+	}
+}
+
+func TestWebAuthnRejectsReplayedSession(t *testing.T) {
+	ur, _ := newWebAuthnRepository(t)
+	a := newSoftAuthenticator(t)
+	register(t, ur, a)
+	ctx := context.Background()
+
+	options, session, err := ur.BeginWebAuthnLogin(ctx, testClientId, "")
+	if err != nil {
+		t.Fatalf("BeginWebAuthnLogin: %+v", err)
+	}
+
+	// most passkeys keep the signature counter at 0, the counter does not stop a replay
+	a.counter = 0
+	assertion := a.assert(t, options, testUserId)
+
+	for i, want := range []string{"", common.ErrWebAuthnSessionInvalid.Key()} {
+		response, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(assertion))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ur.FinishWebAuthnLogin(ctx, testClientId, session, response); errCode(err) != want || (want == "" && err != nil) {
+			t.Errorf("use %d: err = %v, want %q", i+1, err, want)
+		}
+	}
+}
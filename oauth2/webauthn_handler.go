@@ -0,0 +1,206 @@
+package oauth2
+
+// WebAuthn (passkeys and security keys).
+// Each ceremony has two steps, the begin step returns the options for navigator.credentials
+// and a session which is given back to the finish step with the response of the authenticator:
+//   - registration of a credential by a logged in user, the begin step takes a fresh proof of the user:
+//     POST /oauth2/users/:id/webauthn/register/{begin,finish}
+//   - passwordless login with a passkey: POST /oauth2/webauthn/login/{begin,finish}
+//   - second factor of a password login: POST /oauth2/webauthn/mfa/{begin,finish}, with the mfa_token
+//   - fresh proof of a logged in user: POST /oauth2/users/:id/webauthn/reauthenticate begins,
+//     the session and the assertion are given with the sensitive change (see model.Reauthentication)
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
+	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/gin-gonic/gin"
+)
+
+// BeginWebAuthnRegistrationHandler takes a fresh proof of the user in the body, see model.Reauthentication
+func BeginWebAuthnRegistrationHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		cid, _ := c.Get("client_id")
+
+		var p model.Reauthentication
+		if err := c.ShouldBind(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		options, session, err := ur.BeginWebAuthnRegistration(c.Request.Context(), cid.(string), c.Param("id"), &p)
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(gin.H{"options": options, "session": session}))
+	}
+}
+
+// FinishWebAuthnRegistrationHandler takes the session, the credential name and the PublicKeyCredential
+// created by the authenticator in the body, see model.WebAuthnFinish
+func FinishWebAuthnRegistrationHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		cid, _ := c.Get("client_id")
+
+		var p model.WebAuthnFinish
+		if err := c.ShouldBindJSON(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		response, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(p.Credential))
+		if err != nil {
+			cErr := sdkcmn.ErrCustom(err, common.ErrWebAuthnFailed)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		credential, err := ur.FinishWebAuthnRegistration(c.Request.Context(), cid.(string), c.Param("id"),
+			p.Session, p.Name, response)
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(credential))
+	}
+}
+
+func ListWebAuthnCredentialsHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		credentials, err := ur.ListWebAuthnCredentials(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(credentials))
+	}
+}
+
+// RemoveWebAuthnCredentialHandler takes a fresh proof of the user in the body, see model.Reauthentication
+func RemoveWebAuthnCredentialHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var p model.Reauthentication
+		if err := c.ShouldBind(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		if err := ur.RemoveWebAuthnCredential(c.Request.Context(), c.Param("id"), c.Param("credential_id"), &p); err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse("ok"))
+	}
+}
+
+// BeginWebAuthnLoginHandler starts a passwordless login with any passkey of the relying party
+func BeginWebAuthnLoginHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		cid, _ := c.Get("client_id")
+
+		options, session, err := ur.BeginWebAuthnLogin(c.Request.Context(), cid.(string), "")
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(gin.H{"options": options, "session": session}))
+	}
+}
+
+// BeginWebAuthnReauthenticationHandler starts an assertion with the credentials of the user
+func BeginWebAuthnReauthenticationHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		cid, _ := c.Get("client_id")
+
+		options, session, err := ur.BeginWebAuthnReauthentication(c.Request.Context(), cid.(string), c.Param("id"))
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(gin.H{"options": options, "session": session}))
+	}
+}
+
+// BeginWebAuthnMFAHandler starts the second step of a password login with a credential of the user
+func BeginWebAuthnMFAHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		cid, _ := c.Get("client_id")
+		clientId := cid.(string)
+
+		var p model.MFACode
+		if err := c.ShouldBind(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		token, err := secure.ParseMFAToken(mfaAES, p.MfaToken)
+		if err != nil || token.ClientId != clientId {
+			cErr := sdkcmn.ErrCustom(err, common.ErrMFATokenInvalid)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		options, session, err := ur.BeginWebAuthnLogin(c.Request.Context(), clientId, token.UserId)
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(gin.H{"options": options, "session": session}))
+	}
+}
+
+// FinishWebAuthnLoginHandler ends both the passwordless and the second factor logins,
+// the session and the assertion of the authenticator are in the body, see model.WebAuthnFinish
+func FinishWebAuthnLoginHandler(ur UserRepo) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		cid, _ := c.Get("client_id")
+
+		var p model.WebAuthnFinish
+		if err := c.ShouldBindJSON(&p); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		response, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(p.Credential))
+		if err != nil {
+			cErr := sdkcmn.ErrCustom(err, common.ErrWebAuthnFailed)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		user, err := ur.FinishWebAuthnLogin(c.Request.Context(), cid.(string), p.Session, response)
+		if err != nil {
+			recordAudit(c, &model.AuditEvent{Type: model.AuditLogin, Detail: "webauthn"}, err)
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		responseUserToken(ur, user, c)
+	}
+}
@@ -0,0 +1,97 @@
+package oauth2
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
+	sdkcmn "github.com/baozhenglab/sdkcm"
+	"github.com/gin-gonic/gin"
+)
+
+// WebhookStorage keeps the webhooks receiving the user events of the clients
+type WebhookStorage interface {
+	CreateWebhook(ctx context.Context, webhook *model.Webhook) error
+	FindWebhooks(ctx context.Context, clientId string) ([]model.Webhook, error)
+	DeleteWebhook(ctx context.Context, clientId, webhookId string) error
+}
+
+// List the webhooks of a client, their secrets are not shown
+func ListWebhooksHandler(ws WebhookStorage) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		webhooks, err := ws.FindWebhooks(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(webhooks))
+	}
+}
+
+// Add a webhook to a client, it receives every event when no event is given.
+// The secret signing its payloads is generated and shown only in this response.
+func CreateWebhookHandler(ws WebhookStorage) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var webhook model.Webhook
+		if err := c.ShouldBind(&webhook); err != nil {
+			cErr := sdkcmn.ErrInvalidRequest(err)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		webhook.URL = strings.TrimSpace(webhook.URL)
+		if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			cErr := sdkcmn.ErrCustom(err, common.ErrWebhookURLInvalid)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		for _, e := range webhook.Events {
+			if !isWebhookEvent(e) {
+				cErr := sdkcmn.ErrCustom(nil, common.ErrWebhookEventUnknown)
+				c.JSON(cErr.StatusCode, cErr)
+				return
+			}
+		}
+
+		webhook.WebhookId = secure.GenerateSalt()
+		webhook.ClientId = c.Param("id")
+		webhook.Secret = secure.GenerateSalt()
+
+		if err := ws.CreateWebhook(c.Request.Context(), &webhook); err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(webhook))
+	}
+}
+
+// Remove a webhook of a client, its pending events are dropped
+func DeleteWebhookHandler(ws WebhookStorage) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := ws.DeleteWebhook(c.Request.Context(), c.Param("id"), c.Param("webhook_id")); err != nil {
+			cErr := err.(sdkcmn.AppError)
+			c.JSON(cErr.StatusCode, cErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, sdkcmn.SimpleSuccessResponse(true))
+	}
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range model.WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package secure
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Purposes of the action tokens, a token cannot be used for another purpose
+const (
+	PurposeVerifyEmail = "verify-email"
+)
+
+var ErrActionTokenInvalid = errors.New("token is invalid or expired")
+
+// ActionToken is sent by email to prove the ownership of Email by the user
+type ActionToken struct {
+	Purpose   string `json:"p"`
+	UserId    string `json:"uid"`
+	Email     string `json:"email"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func IssueActionToken(aes *AES, purpose, userId, email string, ttl time.Duration) (string, error) {
+	data, err := json.Marshal(&ActionToken{
+		Purpose:   purpose,
+		UserId:    userId,
+		Email:     email,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return aes.Encrypt(data)
+}
+
+func ParseActionToken(aes *AES, token, purpose string) (*ActionToken, error) {
+	data, err := aes.Decrypt(token)
+	if err != nil {
+		return nil, ErrActionTokenInvalid
+	}
+
+	var t ActionToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, ErrActionTokenInvalid
+	}
+
+	if t.Purpose != purpose || t.UserId == "" || time.Now().Unix() > t.ExpiresAt {
+		return nil, ErrActionTokenInvalid
+	}
+
+	return &t, nil
+}
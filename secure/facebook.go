@@ -0,0 +1,117 @@
+package secure
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrFacebookTokenInvalid = errors.New("facebook access token is invalid")
+
+// FacebookUser is the user of a verified access token
+type FacebookUser struct {
+	Id    string `json:"id"`
+	Email string `json:"email"`
+}
+
+// FacebookVerifier checks the user access tokens with the debug_token endpoint of the Graph API,
+// a token must be issued to our app to be accepted.
+type FacebookVerifier struct {
+	graphURL  string
+	appId     string
+	appSecret string
+	client    *http.Client
+}
+
+func NewFacebookVerifier(graphURL, appId, appSecret string) *FacebookVerifier {
+	return &FacebookVerifier{
+		graphURL:  strings.TrimRight(graphURL, "/"),
+		appId:     appId,
+		appSecret: appSecret,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Verify checks that the token is valid and issued to our app, then fetches the user of the token
+func (v *FacebookVerifier) Verify(ctx context.Context, accessToken string) (*FacebookUser, error) {
+	if v.appId == "" || v.appSecret == "" {
+		return nil, errors.WithMessage(ErrFacebookTokenInvalid, "the facebook app is not configured")
+	}
+
+	var debug struct {
+		Data struct {
+			AppId   string `json:"app_id"`
+			UserId  string `json:"user_id"`
+			IsValid bool   `json:"is_valid"`
+		} `json:"data"`
+	}
+
+	if err := v.get(ctx, "/debug_token", url.Values{
+		"input_token":  {accessToken},
+		"access_token": {v.appId + "|" + v.appSecret},
+	}, &debug); err != nil {
+		return nil, err
+	}
+
+	if !debug.Data.IsValid || debug.Data.AppId != v.appId || debug.Data.UserId == "" {
+		return nil, errors.WithMessage(ErrFacebookTokenInvalid, "token of another app or expired")
+	}
+
+	mac := hmac.New(sha256.New, []byte(v.appSecret))
+	mac.Write([]byte(accessToken))
+
+	var user FacebookUser
+	if err := v.get(ctx, "/me", url.Values{
+		"fields":          {"id,email"},
+		"access_token":    {accessToken},
+		"appsecret_proof": {hex.EncodeToString(mac.Sum(nil))},
+	}, &user); err != nil {
+		return nil, err
+	}
+
+	if user.Id != debug.Data.UserId {
+		return nil, errors.WithMessage(ErrFacebookTokenInvalid, "user mismatch")
+	}
+
+	return &user, nil
+}
+
+func (v *FacebookVerifier) get(ctx context.Context, path string, params url.Values, dest interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, v.graphURL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return errors.Wrap(withoutURL(err), "invalid graph api url")
+	}
+
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(withoutURL(err), "cannot call the graph api")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.WithMessage(ErrFacebookTokenInvalid, "graph api: "+resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(dest); err != nil {
+		return errors.Wrap(err, "cannot decode the graph api response")
+	}
+
+	return nil
+}
+
+// withoutURL drops the url of a request error, its query holds the app secret
+func withoutURL(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+
+	return err
+}
@@ -0,0 +1,110 @@
+package secure
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testAppId     = "app-id"
+	testAppSecret = "app-secret"
+	testFbToken   = "user-access-token"
+)
+
+// graph serves debug_token and /me like the Graph API, the answers are set by the tests
+type graph struct {
+	debug map[string]interface{}
+	me    map[string]interface{}
+}
+
+func newGraph(t *testing.T, g *graph) *FacebookVerifier {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		switch r.URL.Path {
+		case "/debug_token":
+			if q.Get("input_token") != testFbToken || q.Get("access_token") != testAppId+"|"+testAppSecret {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": g.debug})
+		case "/me":
+			mac := hmac.New(sha256.New, []byte(testAppSecret))
+			mac.Write([]byte(testFbToken))
+
+			if q.Get("access_token") != testFbToken || q.Get("appsecret_proof") != hex.EncodeToString(mac.Sum(nil)) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			_ = json.NewEncoder(w).Encode(g.me)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return NewFacebookVerifier(server.URL+"/", testAppId, testAppSecret)
+}
+
+func validGraph() *graph {
+	return &graph{
+		debug: map[string]interface{}{"app_id": testAppId, "user_id": "42", "is_valid": true},
+		me:    map[string]interface{}{"id": "42", "email": "bob@example.com"},
+	}
+}
+
+func TestFacebookVerify(t *testing.T) {
+	user, err := newGraph(t, validGraph()).Verify(context.Background(), testFbToken)
+	if err != nil {
+		t.Fatalf("Verify: %+v", err)
+	}
+
+	if user.Id != "42" || user.Email != "bob@example.com" {
+		t.Errorf("user = %+v", user)
+	}
+}
+
+func TestFacebookVerifyRejects(t *testing.T) {
+	for name, change := range map[string]func(g *graph){
+		"token of another app": func(g *graph) { g.debug["app_id"] = "other-app" },
+		"invalid token":        func(g *graph) { g.debug["is_valid"] = false },
+		"token without user":   func(g *graph) { delete(g.debug, "user_id") },
+		"user mismatch":        func(g *graph) { g.me["id"] = "43" },
+	} {
+		g := validGraph()
+		change(g)
+
+		if _, err := newGraph(t, g).Verify(context.Background(), testFbToken); err == nil {
+			t.Errorf("%s: the token is accepted", name)
+		}
+	}
+}
+
+func TestFacebookVerifyWithoutApp(t *testing.T) {
+	if _, err := NewFacebookVerifier("http://127.0.0.1:0", "", "").Verify(context.Background(), testFbToken); err == nil {
+		t.Error("a token is accepted without a configured app")
+	}
+}
+
+func TestFacebookVerifyHidesAppSecret(t *testing.T) {
+	// nothing listens on the port, the call fails before the Graph API answers
+	_, err := NewFacebookVerifier("http://127.0.0.1:1", testAppId, testAppSecret).Verify(context.Background(), testFbToken)
+	if err == nil {
+		t.Fatal("a token is accepted without the Graph API")
+	}
+
+	if strings.Contains(err.Error(), testAppSecret) || strings.Contains(err.Error(), testFbToken) {
+		t.Errorf("the error discloses the request: %v", err)
+	}
+}
@@ -2,18 +2,19 @@ package secure
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
-	"math/rand"
-	"time"
 )
 
+// GenerateSalt returns 16 random bytes from crypto/rand, hex encoded
 func GenerateSalt() string {
-	rand.Seed(time.Now().UTC().UnixNano())
-	random := string(rand.Intn(1000 * 1000))
-	salt := sha256.Sum256([]byte(random))
-	return hex.EncodeToString(salt[12:])
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(salt)
 }
 
 func ComputeHmac256(password, salt, secretKey string) string {
@@ -0,0 +1,213 @@
+package secure
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Identity providers signing the id tokens of their users
+var (
+	GoogleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+	AppleIssuers  = []string{"https://appleid.apple.com"}
+)
+
+var ErrIDTokenInvalid = errors.New("id token is invalid")
+
+const (
+	// keys are refetched at most once per jwksMinRefresh when a token is signed by an unknown key
+	jwksMinRefresh = time.Minute
+	jwksTTL        = time.Hour
+)
+
+// IDTokenClaims are the verified claims of an id token.
+// Some providers (Apple) send the booleans as strings.
+type IDTokenClaims struct {
+	jwt.Claims
+	Email         string   `json:"email"`
+	EmailVerified flexBool `json:"email_verified"`
+	Nonce         string   `json:"nonce"`
+}
+
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	switch t := v.(type) {
+	case bool:
+		*b = flexBool(t)
+	case string:
+		parsed, _ := strconv.ParseBool(t)
+		*b = flexBool(parsed)
+	}
+
+	return nil
+}
+
+func (c *IDTokenClaims) IsEmailVerified() bool {
+	return bool(c.EmailVerified)
+}
+
+// IDTokenVerifier checks the id tokens of a provider against the keys of its JWKS url,
+// its issuers and our client ids at the provider.
+type IDTokenVerifier struct {
+	jwksURL   string
+	issuers   []string
+	audiences []string
+	client    *http.Client
+
+	mu        sync.Mutex
+	keys      *jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+func NewIDTokenVerifier(jwksURL string, issuers, audiences []string) *IDTokenVerifier {
+	return &IDTokenVerifier{
+		jwksURL:   jwksURL,
+		issuers:   issuers,
+		audiences: audiences,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Verify checks the signature, the issuer, the audience, the expiry and the nonce of the token.
+// The nonce is the value given to the provider by the login and is required, a token without nonce
+// could have been issued to any login of any site trusting the same client id.
+// The verified claims are also decoded into the extra destinations.
+func (v *IDTokenVerifier) Verify(ctx context.Context, token, nonce string, extra ...interface{}) (*IDTokenClaims, error) {
+	if len(v.audiences) == 0 {
+		return nil, errors.WithMessage(ErrIDTokenInvalid, "no client id is configured for the provider")
+	}
+
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil || len(parsed.Headers) != 1 {
+		return nil, errors.Wrap(ErrIDTokenInvalid, "malformed token")
+	}
+
+	header := parsed.Headers[0]
+	if header.Algorithm != string(jose.RS256) && header.Algorithm != string(jose.ES256) {
+		return nil, errors.WithMessage(ErrIDTokenInvalid, "unsupported algorithm "+header.Algorithm)
+	}
+
+	key, err := v.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims IDTokenClaims
+	if err := parsed.Claims(key, append([]interface{}{&claims}, extra...)...); err != nil {
+		return nil, errors.Wrap(ErrIDTokenInvalid, err.Error())
+	}
+
+	if err := claims.Validate(jwt.Expected{Time: time.Now()}); err != nil {
+		return nil, errors.Wrap(ErrIDTokenInvalid, err.Error())
+	}
+
+	if claims.Expiry == 0 || claims.Subject == "" {
+		return nil, errors.WithMessage(ErrIDTokenInvalid, "missing exp or sub")
+	}
+
+	if !contains(v.issuers, claims.Issuer) {
+		return nil, errors.WithMessage(ErrIDTokenInvalid, "unexpected issuer "+claims.Issuer)
+	}
+
+	audience := false
+	for _, aud := range v.audiences {
+		audience = audience || claims.Audience.Contains(aud)
+	}
+	if !audience {
+		return nil, errors.WithMessage(ErrIDTokenInvalid, "unexpected audience")
+	}
+
+	if !checkNonce(claims.Nonce, nonce) {
+		return nil, errors.WithMessage(ErrIDTokenInvalid, "nonce mismatch")
+	}
+
+	return &claims, nil
+}
+
+// checkNonce accepts the nonce or its SHA-256, which is what the native Apple SDKs send to the provider
+func checkNonce(claim, nonce string) bool {
+	if claim == "" || nonce == "" {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(nonce))
+	return claim == nonce || claim == hex.EncodeToString(sum[:])
+}
+
+// key returns the key of the id, the keys are refetched when they are stale or the key is unknown
+func (v *IDTokenVerifier) key(ctx context.Context, kid string) (*jose.JSONWebKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	stale := v.keys == nil || time.Since(v.fetchedAt) > jwksTTL
+	if !stale && len(v.keys.Key(kid)) == 0 && time.Since(v.fetchedAt) > jwksMinRefresh {
+		stale = true
+	}
+
+	if stale {
+		keys, err := v.fetch(ctx)
+		if err != nil && v.keys == nil {
+			return nil, err
+		}
+
+		if err == nil {
+			v.keys, v.fetchedAt = keys, time.Now()
+		}
+	}
+
+	found := v.keys.Key(kid)
+	if len(found) == 0 {
+		return nil, errors.WithMessage(ErrIDTokenInvalid, "unknown key "+kid)
+	}
+
+	return &found[0], nil
+}
+
+func (v *IDTokenVerifier) fetch(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	req, err := http.NewRequest(http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot fetch the provider keys")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("cannot fetch the provider keys: %s", resp.Status)
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, errors.Wrap(err, "cannot decode the provider keys")
+	}
+
+	return &keys, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
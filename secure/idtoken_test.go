@@ -0,0 +1,180 @@
+package secure
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	testIssuer   = "https://accounts.google.com"
+	testAudience = "client-id.apps.googleusercontent.com"
+	testKeyId    = "key-1"
+)
+
+// provider serves the JWKS of a key and signs the id tokens with it
+type provider struct {
+	key    *rsa.PrivateKey
+	server *httptest.Server
+}
+
+func newProvider(t *testing.T) *provider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &provider{key: key}
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: testKeyId, Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	}))
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *provider) verifier() *IDTokenVerifier {
+	return NewIDTokenVerifier(p.server.URL, []string{testIssuer}, []string{testAudience})
+}
+
+func (p *provider) sign(t *testing.T, claims *IDTokenClaims) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: p.key, KeyID: testKeyId}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func validClaims(nonce string) *IDTokenClaims {
+	now := time.Now()
+
+	return &IDTokenClaims{
+		Claims: jwt.Claims{
+			Issuer:   testIssuer,
+			Subject:  "1234567890",
+			Audience: jwt.Audience{testAudience},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		Nonce:         nonce,
+	}
+}
+
+func TestIDTokenVerify(t *testing.T) {
+	p := newProvider(t)
+
+	claims, err := p.verifier().Verify(context.Background(), p.sign(t, validClaims("nonce")), "nonce")
+	if err != nil {
+		t.Fatalf("Verify: %+v", err)
+	}
+
+	if claims.Subject != "1234567890" || claims.Email != "alice@example.com" || !claims.IsEmailVerified() {
+		t.Errorf("claims = %+v", claims)
+	}
+}
+
+func TestIDTokenVerifyHashedNonce(t *testing.T) {
+	p := newProvider(t)
+
+	sum := sha256.Sum256([]byte("nonce"))
+	if _, err := p.verifier().Verify(context.Background(), p.sign(t, validClaims(hex.EncodeToString(sum[:]))), "nonce"); err != nil {
+		t.Errorf("Verify: %+v", err)
+	}
+}
+
+func TestIDTokenVerifyNonce(t *testing.T) {
+	p := newProvider(t)
+
+	for name, tc := range map[string]struct{ claim, nonce string }{
+		"without nonce":       {"", ""},
+		"nonce not requested": {"", "nonce"},
+		"nonce not given":     {"nonce", ""},
+		"other nonce":         {"nonce", "other"},
+	} {
+		if _, err := p.verifier().Verify(context.Background(), p.sign(t, validClaims(tc.claim)), tc.nonce); err == nil {
+			t.Errorf("%s: the token is accepted", name)
+		}
+	}
+}
+
+func TestIDTokenVerifyClaims(t *testing.T) {
+	p := newProvider(t)
+
+	for name, change := range map[string]func(c *IDTokenClaims){
+		"other issuer":   func(c *IDTokenClaims) { c.Issuer = "https://evil.example.com" },
+		"other audience": func(c *IDTokenClaims) { c.Audience = jwt.Audience{"other-client"} },
+		"expired":        func(c *IDTokenClaims) { c.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour)) },
+		"without sub":    func(c *IDTokenClaims) { c.Subject = "" },
+	} {
+		claims := validClaims("nonce")
+		change(claims)
+
+		if _, err := p.verifier().Verify(context.Background(), p.sign(t, claims), "nonce"); err == nil {
+			t.Errorf("%s: the token is accepted", name)
+		}
+	}
+}
+
+func TestIDTokenVerifyUnknownKey(t *testing.T) {
+	p := newProvider(t)
+	other := newProvider(t)
+
+	// same key id, signed by another key
+	if _, err := p.verifier().Verify(context.Background(), other.sign(t, validClaims("nonce")), "nonce"); err == nil {
+		t.Error("a token signed by another key is accepted")
+	}
+}
+
+func TestLoginNonce(t *testing.T) {
+	aes := NewEAS([]byte("some-secret-of-thirty-two-bytes!"))
+	counter := NewMemoryCounter()
+	ctx := context.Background()
+
+	nonce, err := IssueLoginNonce(aes, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UseLoginNonce(ctx, aes, counter, nonce, "other"); err == nil {
+		t.Error("the nonce of another client is accepted")
+	}
+
+	if err := UseLoginNonce(ctx, aes, counter, "chosen-by-the-client", "client"); err == nil {
+		t.Error("a nonce not issued by the server is accepted")
+	}
+
+	if err := UseLoginNonce(ctx, aes, counter, nonce, "client"); err != nil {
+		t.Errorf("UseLoginNonce: %v", err)
+	}
+
+	if err := UseLoginNonce(ctx, aes, counter, nonce, "client"); err == nil {
+		t.Error("a used nonce is accepted again")
+	}
+}
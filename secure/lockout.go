@@ -0,0 +1,217 @@
+package secure
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginAttempts is the failure counter of a login key (an account or an IP address)
+type LoginAttempts struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+}
+
+// AttemptCounter stores the failure counters.
+// A shared backend (SQL, MongoDB...) must be used when several replicas are running.
+type AttemptCounter interface {
+	// GetAttempts returns the counter of key, a zero counter when there is none
+	GetAttempts(ctx context.Context, key string) (*LoginAttempts, error)
+	// AddFailure increments the counter of key, the counter is dropped after ttl without failures
+	AddFailure(ctx context.Context, key string, ttl time.Duration) (*LoginAttempts, error)
+	ResetAttempts(ctx context.Context, key string) error
+}
+
+// LockoutPolicy describes when a login key is blocked.
+// After each failure the next attempt is delayed by Backoff, doubled for every new failure,
+// after MaxAttempts failures the key is locked for Duration.
+type LockoutPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	Duration    time.Duration
+}
+
+// Lockout protects the password checks against brute-force attacks
+type Lockout struct {
+	Account LockoutPolicy
+	IP      LockoutPolicy
+	Counter AttemptCounter
+}
+
+// LockState tells why and how long a login key is blocked
+type LockState struct {
+	Key        string
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+// AccountLockKey is the key of an identifier of the accounts of a client, the same username
+// is another account within another client
+func AccountLockKey(clientId, identifier string) string {
+	return "account:" + clientId + ":" + strings.ToLower(strings.TrimSpace(identifier))
+}
+
+// MFALockKey is the key of the second factor of an user, whatever the client
+func MFALockKey(uid string) string {
+	return "mfa:" + uid
+}
+
+func IPLockKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns the state of the first blocked key, nil if all keys are allowed to try
+func (l *Lockout) Check(ctx context.Context, keys ...string) (*LockState, error) {
+	now := time.Now().UTC()
+
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+
+		attempts, err := l.Counter.GetAttempts(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if state := l.policy(key).state(attempts, now); state != nil {
+			return state, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Fail records a failed password check for all keys
+func (l *Lockout) Fail(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+
+		if _, err := l.Counter.AddFailure(ctx, key, l.policy(key).Duration); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reset clears the counters of keys, after a successful login or by an administrator
+func (l *Lockout) Reset(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+
+		if err := l.Counter.ResetAttempts(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *Lockout) policy(key string) LockoutPolicy {
+	if strings.HasPrefix(key, "ip:") {
+		return l.IP
+	}
+
+	return l.Account
+}
+
+func (p LockoutPolicy) state(attempts *LoginAttempts, now time.Time) *LockState {
+	if p.MaxAttempts <= 0 || attempts == nil || attempts.Failures == 0 {
+		return nil
+	}
+
+	if attempts.Failures >= p.MaxAttempts {
+		if wait := attempts.LastFailure.Add(p.Duration).Sub(now); wait > 0 {
+			return &LockState{Key: attempts.Key, Locked: true, RetryAfter: wait}
+		}
+
+		return nil
+	}
+
+	if p.Backoff <= 0 {
+		return nil
+	}
+
+	delay := p.Backoff << uint(attempts.Failures-1)
+	if delay <= 0 || delay > p.Duration {
+		delay = p.Duration
+	}
+
+	if wait := attempts.LastFailure.Add(delay).Sub(now); wait > 0 {
+		return &LockState{Key: attempts.Key, RetryAfter: wait}
+	}
+
+	return nil
+}
+
+// NewMemoryCounter keeps the counters in memory, it is only suitable for a single replica
+func NewMemoryCounter() AttemptCounter {
+	return &memoryCounter{attempts: map[string]*memoryAttempts{}}
+}
+
+type memoryAttempts struct {
+	LoginAttempts
+	expiresAt time.Time
+}
+
+type memoryCounter struct {
+	sync.Mutex
+	attempts map[string]*memoryAttempts
+}
+
+func (m *memoryCounter) GetAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.attempts[key]
+	if !ok || time.Now().After(a.expiresAt) {
+		return &LoginAttempts{Key: key}, nil
+	}
+
+	result := a.LoginAttempts
+	return &result, nil
+}
+
+func (m *memoryCounter) AddFailure(ctx context.Context, key string, ttl time.Duration) (*LoginAttempts, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now().UTC()
+
+	a, ok := m.attempts[key]
+	if !ok || now.After(a.expiresAt) {
+		a = &memoryAttempts{LoginAttempts: LoginAttempts{Key: key}}
+		m.attempts[key] = a
+	}
+
+	a.Failures++
+	a.LastFailure = now
+	a.expiresAt = now.Add(ttl)
+
+	// drop the expired counters from time to time
+	if len(m.attempts) > 10000 {
+		for k, v := range m.attempts {
+			if now.After(v.expiresAt) {
+				delete(m.attempts, k)
+			}
+		}
+	}
+
+	result := a.LoginAttempts
+	return &result, nil
+}
+
+func (m *memoryCounter) ResetAttempts(ctx context.Context, key string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.attempts, key)
+	return nil
+}
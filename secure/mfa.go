@@ -0,0 +1,229 @@
+package secure
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TOTP (https://tools.ietf.org/html/rfc6238) with the parameters supported by all authenticator apps:
+// HMAC-SHA1, 6 digits and a 30 seconds period.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// accepted clock skew, in periods
+	totpSkew = 1
+)
+
+var ErrMFATokenInvalid = errors.New("mfa token is invalid or expired")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns 20 random bytes, base32 encoded
+func GenerateTOTPSecret() string {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(secret)
+}
+
+// TOTPURI returns the otpauth:// URI shown as a QR code to enroll an authenticator app
+func TOTPURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// ValidateTOTP checks code against the secret at now, it returns the matched time step.
+// Steps up to lastStep are refused so a code cannot be used twice.
+func ValidateTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// CheckTOTP validates code against a secret encrypted with aes
+func CheckTOTP(aes *AES, encryptedSecret, code string, lastStep int64) (int64, bool, error) {
+	if encryptedSecret == "" {
+		return 0, false, nil
+	}
+
+	secret, err := aes.Decrypt(encryptedSecret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	step, ok := ValidateTOTP(string(secret), code, time.Now(), lastStep)
+	return step, ok, nil
+}
+
+// MFAToken is given after a successful password check to an user enrolled in MFA,
+// it is exchanged with a TOTP code for the access token
+type MFAToken struct {
+	UserId    string `json:"uid"`
+	ClientId  string `json:"cid"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func IssueMFAToken(aes *AES, userId, clientId string, ttl time.Duration) (string, error) {
+	data, err := json.Marshal(&MFAToken{
+		UserId:    userId,
+		ClientId:  clientId,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return aes.Encrypt(data)
+}
+
+func ParseMFAToken(aes *AES, token string) (*MFAToken, error) {
+	data, err := aes.Decrypt(token)
+	if err != nil {
+		return nil, ErrMFATokenInvalid
+	}
+
+	var t MFAToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, ErrMFATokenInvalid
+	}
+
+	if t.UserId == "" || time.Now().Unix() > t.ExpiresAt {
+		return nil, ErrMFATokenInvalid
+	}
+
+	return &t, nil
+}
+
+// Recovery codes let an user enrolled in MFA log in without the authenticator, each code can be used once
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+// 32 symbols without the look-alike letters i, l and o
+var recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz123456789"
+
+// GenerateRecoveryCodes returns new random codes formatted as xxxxx-xxxxx
+func GenerateRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		b := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+
+		for j := range b {
+			b[j] = recoveryCodeAlphabet[b[j]&31]
+		}
+
+		codes[i] = string(b[:recoveryCodeLength/2]) + "-" + string(b[recoveryCodeLength/2:])
+	}
+
+	return codes
+}
+
+// HashRecoveryCode hashes a code of the user, the case, spaces and dashes typed by the user are ignored
+func HashRecoveryCode(code, userId, secretKey string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return HashOTP(code, userId, secretKey)
+}
+
+// DeviceToken is given to a device trusted by an user enrolled in MFA,
+// the second factor is skipped on this device until it expires or is revoked
+type DeviceToken struct {
+	DeviceId  string `json:"did"`
+	UserId    string `json:"uid"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// GenerateDeviceId returns a random id of a trusted device
+func GenerateDeviceId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+func IssueDeviceToken(aes *AES, deviceId, userId string, expiresAt time.Time) (string, error) {
+	data, err := json.Marshal(&DeviceToken{
+		DeviceId:  deviceId,
+		UserId:    userId,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return aes.Encrypt(data)
+}
+
+// ParseDeviceToken returns the device of the token when it is trusted by userId
+func ParseDeviceToken(aes *AES, token, userId string) (*DeviceToken, bool) {
+	if token == "" {
+		return nil, false
+	}
+
+	data, err := aes.Decrypt(token)
+	if err != nil {
+		return nil, false
+	}
+
+	var t DeviceToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, false
+	}
+
+	if t.DeviceId == "" || t.UserId != userId || time.Now().Unix() > t.ExpiresAt {
+		return nil, false
+	}
+
+	return &t, true
+}
@@ -0,0 +1,62 @@
+package secure
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LoginNonceTTL is how long a client has to sign in with the provider after asking for a nonce
+const LoginNonceTTL = 10 * time.Minute
+
+var ErrLoginNonceInvalid = errors.New("nonce is not issued for this client, is expired or is already used")
+
+// loginNonce is issued by the server before a login with the id token of a provider.
+// The client gives it to the provider, the id token is then bound to a login started here and lately.
+type loginNonce struct {
+	ClientId  string `json:"cid"`
+	ExpiresAt int64  `json:"exp"`
+	Random    string `json:"r"`
+}
+
+func IssueLoginNonce(aes *AES, clientId string) (string, error) {
+	data, err := json.Marshal(&loginNonce{
+		ClientId:  clientId,
+		ExpiresAt: time.Now().Add(LoginNonceTTL).Unix(),
+		Random:    GenerateResetToken(),
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return aes.Encrypt(data)
+}
+
+// UseLoginNonce accepts the nonces issued for the client which are not expired, once:
+// the uses are recorded by the counters until the nonce expires, an id token cannot be replayed
+func UseLoginNonce(ctx context.Context, aes *AES, counter AttemptCounter, nonce, clientId string) error {
+	data, err := aes.Decrypt(nonce)
+	if err != nil {
+		return ErrLoginNonceInvalid
+	}
+
+	var n loginNonce
+	if err := json.Unmarshal(data, &n); err != nil {
+		return ErrLoginNonceInvalid
+	}
+
+	if n.ClientId != clientId || time.Now().Unix() > n.ExpiresAt {
+		return ErrLoginNonceInvalid
+	}
+
+	ttl := time.Until(time.Unix(n.ExpiresAt, 0)) + time.Second
+	if err := MarkUsed(ctx, counter, UsedKey("nonce", nonce), ttl); err == ErrAlreadyUsed {
+		return ErrLoginNonceInvalid
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
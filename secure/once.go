@@ -0,0 +1,38 @@
+package secure
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrAlreadyUsed = errors.New("value is already used")
+
+// UsedKey is the key of a single-use value (a nonce, a challenge) in the counters,
+// the value is hashed: the counters are not meant to keep secrets
+func UsedKey(kind, value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "used:" + kind + ":" + hex.EncodeToString(sum[:])
+}
+
+// MarkUsed records the use of a single-use value until it expires, the counters are shared by the replicas.
+// ErrAlreadyUsed is returned when the value was used before, the first use wins a concurrent use.
+func MarkUsed(ctx context.Context, counter AttemptCounter, key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrAlreadyUsed
+	}
+
+	attempts, err := counter.AddFailure(ctx, key, ttl)
+	if err != nil {
+		return err
+	}
+
+	if attempts.Failures > 1 {
+		return ErrAlreadyUsed
+	}
+
+	return nil
+}
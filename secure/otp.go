@@ -0,0 +1,54 @@
+package secure
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"math/big"
+	"time"
+)
+
+// OTPPolicy is the lifecycle of the one-time passwords sent to the users
+type OTPPolicy struct {
+	// Length is the number of digits of a code
+	Length int
+	TTL    time.Duration
+	// MaxAttempts is the number of wrong codes before the current code is revoked
+	MaxAttempts int
+}
+
+// GenerateResetToken returns a random token of 32 bytes, base64url encoded, sent in the password reset links
+func GenerateResetToken() string {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// GenerateOTP returns a random code of length digits from crypto/rand
+func GenerateOTP(length int) string {
+	if length <= 0 {
+		length = 6
+	}
+
+	code := make([]byte, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			panic(err)
+		}
+		code[i] = byte('0' + n.Int64())
+	}
+
+	return string(code)
+}
+
+// HashOTP hashes a code for storage, the code is bound to the user it has been sent to
+func HashOTP(code, userId, secretKey string) string {
+	return ComputeHmac256(code, ":"+userId, secretKey)
+}
+
+func VerifyOTP(code, hash, userId, secretKey string) bool {
+	return hmac.Equal([]byte(HashOTP(code, userId, secretKey)), []byte(hash))
+}
@@ -0,0 +1,104 @@
+package secure
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/baozhenglab/oauth-service/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/argon2"
+)
+
+// Password hash algorithms, stored next to each password hash.
+// Hashes stored without algorithm are legacy HMAC-SHA256 hashes.
+const (
+	PasswordAlgHmacSHA256 = "hmac-sha256"
+	PasswordAlgArgon2id   = "argon2id"
+)
+
+// Argon2id parameters for new hashes (second recommended option of RFC 9106).
+// The parameters are encoded into each hash, so they can be raised without breaking stored hashes.
+var (
+	Argon2Time    uint32 = 3
+	Argon2Memory  uint32 = 64 * 1024
+	Argon2Threads uint8  = 4
+	Argon2KeyLen  uint32 = 32
+)
+
+// HashPassword hashes a password with argon2id and a new random salt.
+// The hash is encoded as $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func HashPassword(ctx context.Context, password string) (hash, salt, algorithm string) {
+	_, span := tracing.Start(ctx, "secure.HashPassword", attribute.String("password.algorithm", PasswordAlgArgon2id))
+	defer span.End()
+
+	salt = GenerateSalt()
+	key := argon2.IDKey([]byte(password), []byte(salt), Argon2Time, Argon2Memory, Argon2Threads, Argon2KeyLen)
+
+	hash = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, Argon2Memory, Argon2Time, Argon2Threads,
+		base64.RawStdEncoding.EncodeToString([]byte(salt)),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return hash, salt, PasswordAlgArgon2id
+}
+
+// VerifyPassword checks a password against a stored hash of the given algorithm.
+// secretKey is only used by legacy HMAC-SHA256 hashes.
+func VerifyPassword(ctx context.Context, password, hash, salt, algorithm, secretKey string) bool {
+	_, span := tracing.Start(ctx, "secure.VerifyPassword", attribute.String("password.algorithm", algorithm))
+	defer span.End()
+
+	if hash == "" {
+		return false
+	}
+
+	switch algorithm {
+	case PasswordAlgArgon2id:
+		return verifyArgon2id(password, hash)
+	case "", PasswordAlgHmacSHA256:
+		return hmac.Equal([]byte(hash), []byte(ComputeHmac256(password, salt, secretKey)))
+	}
+
+	return false
+}
+
+// PasswordNeedsRehash tells if a hash should be replaced by a new one on the next successful login
+func PasswordNeedsRehash(algorithm string) bool {
+	return algorithm != PasswordAlgArgon2id
+}
+
+func verifyArgon2id(password, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != PasswordAlgArgon2id {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
@@ -0,0 +1,130 @@
+package secure
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/pkg/errors"
+)
+
+// PasswordPolicy is the set of rules new passwords must follow
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// BreachedList is the path of a file of breached passwords, one per line
+	BreachedList string
+	// History is the number of last passwords (the current one included) which cannot be reused
+	History int
+
+	once     sync.Once
+	breached map[string]bool
+	loadErr  error
+}
+
+// Check returns all the rules broken by the password
+func (p *PasswordPolicy) Check(password string) ([]error, error) {
+	if password == "" {
+		return []error{common.ErrPasswordCannotBeEmpty}, nil
+	}
+
+	var violations []error
+
+	if len([]rune(password)) < p.MinLength {
+		violations = append(violations, common.ErrPasswordTooShort)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	if p.RequireUpper && !upper {
+		violations = append(violations, common.ErrPasswordNeedsUpper)
+	}
+
+	if p.RequireLower && !lower {
+		violations = append(violations, common.ErrPasswordNeedsLower)
+	}
+
+	if p.RequireDigit && !digit {
+		violations = append(violations, common.ErrPasswordNeedsDigit)
+	}
+
+	if p.RequireSymbol && !symbol {
+		violations = append(violations, common.ErrPasswordNeedsSymbol)
+	}
+
+	breached, err := p.isBreached(password)
+	if err != nil {
+		return nil, err
+	}
+
+	if breached {
+		violations = append(violations, common.ErrPasswordBreached)
+	}
+
+	return violations, nil
+}
+
+// Load reads the breached list, once: the service loads it at startup and does not start without it,
+// so the password checks do not depend on the file afterwards
+func (p *PasswordPolicy) Load() error {
+	p.once.Do(func() {
+		if p.BreachedList == "" {
+			return
+		}
+
+		f, err := os.Open(p.BreachedList)
+		if err != nil {
+			p.loadErr = errors.WithStack(err)
+			return
+		}
+		defer f.Close()
+
+		breached := map[string]bool{}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				breached[strings.ToLower(line)] = true
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			p.loadErr = errors.WithStack(err)
+			return
+		}
+
+		p.breached = breached
+	})
+
+	return p.loadErr
+}
+
+// The comparison is case insensitive
+func (p *PasswordPolicy) isBreached(password string) (bool, error) {
+	if p.BreachedList == "" {
+		return false, nil
+	}
+
+	if err := p.Load(); err != nil {
+		return false, err
+	}
+
+	return p.breached[strings.ToLower(password)], nil
+}
@@ -0,0 +1,111 @@
+package secure
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RateLimit is a token bucket of Limit tokens, refilled with Limit tokens every Period.
+// A zero RateLimit is disabled.
+type RateLimit struct {
+	Limit  int
+	Period time.Duration
+}
+
+// ParseRateLimit parses a "<limit>/<period>" value where period is s, m, h or a duration, e.g. "10/m" or "100/15m".
+// An empty value or "0" disables the limit.
+func ParseRateLimit(s string) (RateLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return RateLimit{}, nil
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, errors.Errorf(`rate limit "%s" must be formatted as <limit>/<period>`, s)
+	}
+
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil || limit < 0 {
+		return RateLimit{}, errors.Errorf(`rate limit "%s" has an invalid limit`, s)
+	}
+
+	period := parts[1]
+	if period == "s" || period == "m" || period == "h" {
+		period = "1" + period
+	}
+
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return RateLimit{}, errors.Errorf(`rate limit "%s" has an invalid period`, s)
+	}
+
+	return RateLimit{Limit: limit, Period: d}, nil
+}
+
+func (r RateLimit) Enabled() bool {
+	return r.Limit > 0 && r.Period > 0
+}
+
+// Allow applies the limit to a bucket, stored as its theoretical arrival time (tat):
+// the time at which the bucket will be full again.
+// It returns the new tat of the bucket, or the wait before a token is available when the bucket is empty.
+func (r RateLimit) Allow(tat, now time.Time) (time.Time, time.Duration) {
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTat := tat.Add(r.Period / time.Duration(r.Limit))
+
+	if allowAt := newTat.Add(-r.Period); allowAt.After(now) {
+		return tat, allowAt.Sub(now)
+	}
+
+	return newTat, 0
+}
+
+// RateLimitStore keeps the token buckets.
+// A shared backend (SQL, MongoDB...) must be used when several replicas are running.
+type RateLimitStore interface {
+	// Take takes a token from the bucket of key, it returns the wait before a token is available when the bucket is empty
+	Take(ctx context.Context, key string, limit RateLimit) (time.Duration, error)
+}
+
+// NewMemoryRateLimitStore keeps the buckets in memory, it is only suitable for a single replica
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{tats: map[string]time.Time{}}
+}
+
+type memoryRateLimitStore struct {
+	sync.Mutex
+	tats map[string]time.Time
+}
+
+func (m *memoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (time.Duration, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now().UTC()
+
+	tat, wait := limit.Allow(m.tats[key], now)
+	if wait > 0 {
+		return wait, nil
+	}
+	m.tats[key] = tat
+
+	// full buckets are dropped from time to time
+	if len(m.tats) > 10000 {
+		for k, v := range m.tats {
+			if v.Before(now) {
+				delete(m.tats, k)
+			}
+		}
+	}
+
+	return 0, nil
+}
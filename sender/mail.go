@@ -0,0 +1,74 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/pkg/errors"
+)
+
+// Templates of the emails sent to the users
+const (
+	TemplateVerifyEmail   = "verify-email"
+	TemplateResetPassword = "reset-password"
+)
+
+// MailMessage is an email to deliver to an user, the mailer renders Template with Link
+type MailMessage struct {
+	Template string        `json:"template"`
+	To       string        `json:"to"`
+	Link     string        `json:"link"`
+	Token    string        `json:"token"`
+	TTL      time.Duration `json:"ttl"`
+	ClientId string        `json:"client_id"`
+	UserId   string        `json:"user_id"`
+}
+
+// Mailer delivers the emails through an email provider
+type Mailer interface {
+	SendMail(ctx context.Context, msg *MailMessage) error
+}
+
+// NewConsoleMailer logs the emails with the secrets of their links redacted, for development only, the file mailer keeps the links
+func NewConsoleMailer() Mailer {
+	return consoleMailer{}
+}
+
+type consoleMailer struct{}
+
+func (consoleMailer) SendMail(ctx context.Context, msg *MailMessage) error {
+	logging.FromContext(ctx).Withs(logging.Fields{
+		"template": msg.Template,
+		"to":       msg.To,
+		"link":     msg.Link,
+		"ttl":      msg.TTL.String(),
+	}).Info("Mail sent to the console")
+	return nil
+}
+
+// NewFileMailer appends the emails to a file as JSON lines, for development and tests
+func NewFileMailer(path string) Mailer {
+	return &fileMailer{path: path}
+}
+
+type fileMailer struct {
+	sync.Mutex
+	path string
+}
+
+func (m *fileMailer) SendMail(_ context.Context, msg *MailMessage) error {
+	m.Lock()
+	defer m.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	return errors.WithStack(json.NewEncoder(f).Encode(msg))
+}
@@ -0,0 +1,81 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/pkg/errors"
+)
+
+// Delivery channels of a one-time password
+const (
+	ChannelSMS   = "sms"
+	ChannelEmail = "email"
+)
+
+// Purposes of a one-time password, the providers can adapt the message
+const (
+	PurposeLogin         = "login"
+	PurposeResetPassword = "reset-password"
+	PurposeSignUp        = "sign-up"
+)
+
+// OTPMessage is a one-time password to deliver to an user
+type OTPMessage struct {
+	Channel  string        `json:"channel"`
+	Purpose  string        `json:"purpose"`
+	To       string        `json:"to"`
+	Code     string        `json:"code"`
+	TTL      time.Duration `json:"ttl"`
+	ClientId string        `json:"client_id"`
+	UserId   string        `json:"user_id"`
+}
+
+// OTPSender delivers one-time passwords through SMS or email providers
+type OTPSender interface {
+	SendOTP(ctx context.Context, msg *OTPMessage) error
+}
+
+// NewConsoleSender logs the messages without their codes, for development only, the file sender keeps the codes
+func NewConsoleSender() OTPSender {
+	return consoleSender{}
+}
+
+type consoleSender struct{}
+
+func (consoleSender) SendOTP(ctx context.Context, msg *OTPMessage) error {
+	logging.FromContext(ctx).Withs(logging.Fields{
+		"to":      msg.To,
+		"channel": msg.Channel,
+		"purpose": msg.Purpose,
+		"ttl":     msg.TTL.String(),
+	}).Info("OTP sent to the console")
+	return nil
+}
+
+// NewFileSender appends the codes to a file as JSON lines, for development and tests
+func NewFileSender(path string) OTPSender {
+	return &fileSender{path: path}
+}
+
+type fileSender struct {
+	sync.Mutex
+	path string
+}
+
+func (s *fileSender) SendOTP(_ context.Context, msg *OTPMessage) error {
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	return errors.WithStack(json.NewEncoder(f).Encode(msg))
+}
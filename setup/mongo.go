@@ -3,8 +3,11 @@ package setup
 import (
 	"context"
 	"strings"
+	"time"
 
+	"github.com/baozhenglab/oauth-service/common"
 	"github.com/baozhenglab/oauth-service/config"
+	"github.com/baozhenglab/oauth-service/logging"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
 	"github.com/baozhenglab/oauth-service/oauth2/storage"
 	"github.com/baozhenglab/oauth-service/secure"
@@ -75,8 +78,20 @@ func (init *initMongo) Run() error {
 	}{
 		{ColName: storage.ClientsCollection, IndexKeys: []string{"id", "secret", "owner_id"}},
 		{ColName: storage.AuthCodesCollection, IndexKeys: []string{"code", "client_id"}},
-		{ColName: storage.UsersCollection, IndexKeys: []string{"username", "fb_id", "account_kit_id", "apple_id", "email", "phone", "phone_prefix"}},
+		{ColName: storage.UsersCollection, IndexKeys: []string{"username", "email", "phone", "phone_prefix"}},
 		{ColName: storage.AccessTokensCollection, IndexKeys: []string{"signature", "request_id", "client_id", "owner", "expired_at"}},
+		{ColName: storage.ScopesCollection, IndexKeys: []string{"name"}},
+		{ColName: storage.RolesCollection, IndexKeys: []string{"client_id", "name"}},
+		{ColName: storage.UserRolesCollection, IndexKeys: []string{"user_id", "client_id"}},
+		{ColName: storage.PasswordHistoriesCollection, IndexKeys: []string{"user_id"}},
+		{ColName: storage.LoginAttemptsCollection, IndexKeys: []string{"key"}},
+		{ColName: storage.WebAuthnCredentialsCollection, IndexKeys: []string{"credential_id", "user_id"}},
+		{ColName: storage.MFARecoveryCodesCollection, IndexKeys: []string{"user_id"}},
+		{ColName: storage.TrustedDevicesCollection, IndexKeys: []string{"device_id", "user_id"}},
+		{ColName: storage.UserIdentitiesCollection, IndexKeys: []string{"user_id", "email"}},
+		{ColName: storage.AuditEventsCollection, IndexKeys: []string{"actor_id", "subject_id", "client_id", "type", "occurred_at"}},
+		{ColName: storage.WebhooksCollection, IndexKeys: []string{"webhook_id", "client_id"}},
+		{ColName: storage.OutboxEventsCollection, IndexKeys: []string{"delivery_id", "webhook_id", "state", "next_attempt_at"}},
 	}
 
 	for _, idx := range indexes {
@@ -87,6 +102,38 @@ func (init *initMongo) Run() error {
 		}
 	}
 
+	// Expired login counters, full rate limit buckets and expired trusted devices are dropped by MongoDB
+	for _, colName := range []string{storage.LoginAttemptsCollection, storage.RateLimitsCollection, storage.TrustedDevicesCollection} {
+		if err := db.DB("").C(colName).EnsureIndex(mgo.Index{
+			Key:         []string{"expired_at"},
+			ExpireAfter: time.Second,
+		}); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if err := db.DB("").C(storage.RateLimitsCollection).EnsureIndex(mgo.Index{Key: []string{"key"}, Unique: true}); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// an external account is linked to one user only
+	if err := db.DB("").C(storage.UserIdentitiesCollection).EnsureIndex(mgo.Index{Key: []string{"provider", "subject"}, Unique: true}); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Insert scope catalog
+	for _, scope := range initScopes {
+		if n, _ := db.DB("").C(storage.ScopesCollection).Find(bson.M{"name": scope.Name}).Count(); n > 0 {
+			continue
+		}
+
+		data := storage.ScopeMongo{Scope: scope}
+		data.PrepareForInsert()
+		if err := db.DB("").C(storage.ScopesCollection).Insert(&data); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
 	mgoModel := storage.MgoModel{}
 	mgoModel.PrepareForInsert()
 
@@ -109,19 +156,20 @@ func (init *initMongo) Run() error {
 	}
 
 	// Insert root user
-	salt := secure.GenerateSalt()
+	password, salt, algo := secure.HashPassword(context.Background(), init.cfg.GetRootPassword())
 
 	runame := init.cfg.GetRootUsername()
 	email := "core@200lab.io"
 	rootUser := storage.UserMongo{
 		User: model.User{
 			//ID:          common.NewUID(int(mgoModel.PK.Counter()), 1, 1).String(),
-			Username:    &runame,
-			Password:    secure.ComputeHmac256(init.cfg.GetRootPassword(), salt, init.cfg.GetSystemSecret()),
-			Salt:        salt,
-			AccountType: model.AccTypeInternal,
-			Email:       &email,
-			ClientId:    init.cfg.GetInitClientID(),
+			Username:     &runame,
+			Password:     password,
+			Salt:         salt,
+			PasswordAlgo: algo,
+			AccountType:  model.AccTypeInternal,
+			Email:        &email,
+			ClientId:     init.cfg.GetInitClientID(),
 		},
 		MgoModel: mgoModel,
 	}
@@ -134,3 +182,117 @@ func (init *initMongo) Run() error {
 
 	return nil
 }
+
+func (init *initMongo) Migrate() error {
+	for _, step := range []func() error{init.migrateIdentities, init.migratePhoneNumbers} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateIdentities moves the external ids of the users to the user identities
+func (init *initMongo) migrateIdentities() error {
+	db := init.s.New()
+	defer db.Close()
+
+	users := db.DB("").C(storage.UsersCollection)
+	identities := db.DB("").C(storage.UserIdentitiesCollection)
+
+	for provider, field := range legacyIdentityFields {
+		iter := users.Find(bson.M{field: bson.M{"$nin": []interface{}{nil, ""}}}).Select(bson.M{"_id": 1, field: 1, "email": 1}).Iter()
+
+		for row := (bson.M{}); iter.Next(&row); row = (bson.M{}) {
+			subject, _ := row[field].(string)
+			pk, ok := row["_id"].(bson.ObjectId)
+			if subject == "" || !ok {
+				continue
+			}
+
+			email, _ := row["email"].(string)
+			identity := storage.UserIdentityMongo{UserIdentity: model.UserIdentity{
+				Provider: provider,
+				Subject:  subject,
+				UserId:   pk.Hex(),
+				Email:    email,
+			}}
+			identity.PrepareForInsert()
+
+			// the identity of a previous run is kept
+			if _, err := identities.Upsert(bson.M{"provider": provider, "subject": subject}, bson.M{"$setOnInsert": &identity}); err != nil {
+				iter.Close()
+				return errors.WithStack(err)
+			}
+		}
+
+		if err := iter.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if _, err := users.UpdateAll(bson.M{field: bson.M{"$exists": true}}, bson.M{"$unset": bson.M{field: ""}}); err != nil {
+			return errors.WithStack(err)
+		}
+
+		// the index of the field is not needed anymore
+		_ = users.DropIndex(field)
+	}
+
+	return nil
+}
+
+// migratePhoneNumbers saves the phones of the users in their E.164 form, unique by client.
+// A number which cannot be normalized or is already used by another user of the client is left as typed.
+func (init *initMongo) migratePhoneNumbers() error {
+	db := init.s.New()
+	defer db.Close()
+
+	users := db.DB("").C(storage.UsersCollection)
+
+	type phoneRow struct {
+		PK          bson.ObjectId `bson:"_id"`
+		ClientId    string        `bson:"client_id"`
+		PhonePrefix string        `bson:"phone_prefix"`
+		Phone       string        `bson:"phone"`
+	}
+
+	iter := users.Find(bson.M{"phone": bson.M{"$nin": []interface{}{nil, ""}}, "phone_number": bson.M{"$exists": false}}).Iter()
+
+	for row := (phoneRow{}); iter.Next(&row); row = (phoneRow{}) {
+		p, err := common.NormalizePhone(row.PhonePrefix, row.Phone)
+		if err != nil {
+			logging.Base().With("user_id", row.PK.Hex()).WithError(err).Warn("Phone of user is left as typed")
+			continue
+		}
+
+		if n, _ := users.Find(bson.M{"client_id": row.ClientId, "phone_number": p.E164}).Count(); n > 0 {
+			logging.Base().With("user_id", row.PK.Hex()).Warn("Phone of user is left as typed: it is used by another user")
+			continue
+		}
+
+		if err := users.UpdateId(row.PK, bson.M{"$set": bson.M{
+			"phone_prefix": p.Prefix,
+			"phone":        p.National,
+			"phone_number": p.E164,
+		}}); err != nil {
+			iter.Close()
+			return errors.WithStack(err)
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// users without phone have no phone_number field
+	if err := users.EnsureIndex(mgo.Index{
+		Key:           []string{"client_id", "phone_number"},
+		Unique:        true,
+		PartialFilter: bson.M{"phone_number": bson.M{"$exists": true}},
+	}); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
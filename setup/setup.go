@@ -1,6 +1,11 @@
 package setup
 
-import "github.com/go-errors/errors"
+import (
+	"sync/atomic"
+
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/go-errors/errors"
+)
 
 var (
 	ErrRootUsernameIsEmpty = errors.New("init root username can not be empty")
@@ -9,6 +14,12 @@ var (
 	ErrClientSecretIsEmpty = errors.New("init client secret can not be empty")
 )
 
+// Scope catalog created by the init script, the root client is registered with these scopes
+var initScopes = []model.Scope{
+	{Name: "root", Description: "Manage users and clients of the OAuth service", ConsentRequired: true},
+	{Name: "offline", Description: "Keep you signed in with a refresh token", IsDefault: true},
+}
+
 type InitConfig interface {
 	GetSystemSecret() string
 	GetRootUsername() string
@@ -23,3 +34,36 @@ type Initializer interface {
 	CanRunInitScript() bool
 	Run() error
 }
+
+// Migrator is optionally implemented by an Initializer,
+// Migrate upgrades the data of a previous version and does nothing when up to date
+type Migrator interface {
+	Migrate() error
+}
+
+// finished is set once Migrate succeeded, the last step of the setup on every start
+var finished int32
+
+// Finished tells whether the setup of the storage finished, the service is not ready before
+func Finished() bool {
+	return atomic.LoadInt32(&finished) == 1
+}
+
+// Migrate runs the migration of the initializer when it has one, then the setup is finished
+func Migrate(init Initializer) error {
+	if m, ok := init.(Migrator); ok {
+		if err := m.Migrate(); err != nil {
+			return err
+		}
+	}
+
+	atomic.StoreInt32(&finished, 1)
+	return nil
+}
+
+// legacyIdentityFields are the external ids once stored on the users, by provider
+var legacyIdentityFields = map[string]string{
+	model.IdentityFacebook:   "fb_id",
+	model.IdentityAccountKit: "account_kit_id",
+	model.IdentityApple:      "apple_id",
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/baozhenglab/oauth-service/common"
 	"github.com/baozhenglab/oauth-service/config"
+	"github.com/baozhenglab/oauth-service/logging"
 	"github.com/baozhenglab/oauth-service/oauth2/model"
 	"github.com/baozhenglab/oauth-service/oauth2/storage"
 	"github.com/baozhenglab/oauth-service/secure"
@@ -69,18 +71,19 @@ func (init *initSQL) Run() error {
 	db := init.db.GetDB().New()
 
 	// Insert root user
-	salt := secure.GenerateSalt()
+	password, salt, algo := secure.HashPassword(context.Background(), init.cfg.GetRootPassword())
 	runame := init.cfg.GetRootUsername()
 	email := "core@200lab.io"
 	rootUser := storage.UserSql{
 
 		User: model.User{
-			Username:    &runame,
-			Password:    secure.ComputeHmac256(init.cfg.GetRootPassword(), salt, init.cfg.GetSystemSecret()),
-			Salt:        salt,
-			AccountType: model.AccTypeInternal,
-			Email:       &email,
-			ClientId:    init.cfg.GetInitClientID(),
+			Username:     &runame,
+			Password:     password,
+			Salt:         salt,
+			PasswordAlgo: algo,
+			AccountType:  model.AccTypeInternal,
+			Email:        &email,
+			ClientId:     init.cfg.GetInitClientID(),
 		},
 		SQLModel: *sdkcm.NewSQLModelWithStatus(1),
 	}
@@ -89,6 +92,20 @@ func (init *initSQL) Run() error {
 		return errors.WithStack(err)
 	}
 
+	// Insert scope catalog
+	for _, scope := range initScopes {
+		var n int
+		db.Table(storage.TbScope).Where("name = ?", scope.Name).Count(&n)
+		if n > 0 {
+			continue
+		}
+
+		data := storage.ScopeSQL{Scope: scope, SQLModel: *sdkcm.NewSQLModelWithStatus(1)}
+		if err := db.Table(storage.TbScope).Create(&data).Error; err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
 	// Insert root client
 	var n int
 	db.Table(storage.TbClient).Where("client_id = ?", init.cfg.GetInitClientID()).Count(&n)
@@ -114,3 +131,129 @@ func (init *initSQL) Run() error {
 	init.cfg.SetInitRootOAuthId(fmt.Sprintf("%d", rootUser.ID))
 	return nil
 }
+
+func (init *initSQL) Migrate() error {
+	for _, step := range []func() error{init.migrateIdentities, init.migratePhoneNumbers} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateIdentities moves the external ids of the users to the user identities then drops their columns
+func (init *initSQL) migrateIdentities() error {
+	db := init.db.GetDB().New()
+
+	for provider, column := range legacyIdentityFields {
+		if !db.Dialect().HasColumn(storage.TbUser, column) {
+			continue
+		}
+
+		var rows []struct {
+			ID      uint32
+			Subject string
+			Email   *string
+		}
+
+		if err := db.Table(storage.TbUser).
+			Select(fmt.Sprintf("id, %s AS subject, email", column)).
+			Where(fmt.Sprintf("%s IS NOT NULL AND %s <> ''", column, column)).
+			Scan(&rows).Error; err != nil {
+			return errors.WithStack(err)
+		}
+
+		for _, row := range rows {
+			var n int
+			if err := db.Table(storage.TbUserIdentity).Where("provider = ? AND subject = ?", provider, row.Subject).Count(&n).Error; err != nil {
+				return errors.WithStack(err)
+			}
+
+			if n > 0 {
+				continue
+			}
+
+			identity := storage.UserIdentitySql{
+				UserIdentity: model.UserIdentity{Provider: provider, Subject: row.Subject, UserId: fmt.Sprintf("%d", row.ID)},
+				SQLModel:     *sdkcm.NewSQLModelWithStatus(1),
+			}
+
+			if row.Email != nil {
+				identity.Email = *row.Email
+			}
+
+			if err := db.Table(storage.TbUserIdentity).Create(&identity).Error; err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		if err := db.Table(storage.TbUser).DropColumn(column).Error; err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// migratePhoneNumbers saves the phones of the users in their E.164 form, unique by client.
+// A number which cannot be normalized or is already used by another user of the client is left as typed.
+func (init *initSQL) migratePhoneNumbers() error {
+	db := init.db.GetDB().New()
+
+	if !db.Dialect().HasColumn(storage.TbUser, "phone_number") {
+		if err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD phone_number VARCHAR(20) NULL", storage.TbUser)).Error; err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	var rows []struct {
+		ID          uint32
+		ClientId    string
+		PhonePrefix *string
+		Phone       string
+	}
+
+	if err := db.Table(storage.TbUser).
+		Select("id, client_id, phone_prefix, phone").
+		Where("phone IS NOT NULL AND phone <> '' AND phone_number IS NULL").
+		Scan(&rows).Error; err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, row := range rows {
+		prefix := ""
+		if row.PhonePrefix != nil {
+			prefix = *row.PhonePrefix
+		}
+
+		p, err := common.NormalizePhone(prefix, row.Phone)
+		if err != nil {
+			logging.Base().With("user_id", row.ID).WithError(err).Warn("Phone of user is left as typed")
+			continue
+		}
+
+		var n int
+		db.Table(storage.TbUser).Where("client_id = ? AND phone_number = ?", row.ClientId, p.E164).Count(&n)
+		if n > 0 {
+			logging.Base().With("user_id", row.ID).Warn("Phone of user is left as typed: it is used by another user")
+			continue
+		}
+
+		if err := db.Table(storage.TbUser).Where("id = ?", row.ID).Updates(map[string]interface{}{
+			"phone_prefix": p.Prefix,
+			"phone":        p.National,
+			"phone_number": p.E164,
+		}).Error; err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if !db.Dialect().HasIndex(storage.TbUser, "uix_users_client_phone_number") {
+		if err := db.Table(storage.TbUser).AddUniqueIndex("uix_users_client_phone_number", "client_id", "phone_number").Error; err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+// Package tracing records OpenTelemetry spans of the requests, the fosite calls, the storage calls and the password hashing.
+//
+// The trace context of the callers (traceparent header) is continued. The spans are exported to stdout,
+// for local use, or to an OTLP collector. Span names and attributes never hold tokens, passwords or user input.
+package tracing
+
+import (
+	"context"
+
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/metrics"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/baozhenglab/oauth-service"
+
+// Exporters of the spans
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Config selects the exporter of the spans
+type Config struct {
+	Exporter string
+	// host:port of the OTLP/HTTP collector
+	Endpoint string
+	// plain HTTP to the collector
+	Insecure bool
+	// share of the traces started here that are sampled, the decision of the caller is followed
+	SampleRatio float64
+	ServiceName string
+}
+
+// Init installs the tracer provider of the config, the returned func flushes the pending spans.
+// Without exporter the trace context is still continued, so the logs carry the trace id of the callers.
+func Init(cfg *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+
+	switch cfg.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, errors.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName)))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span, child of the span of the context
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends the span, an error marks it as failed with its redacted message
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, logging.Redact(err.Error()))
+	}
+
+	span.End()
+}
+
+// Storage starts the span and the latency timer of a storage call, the returned func ends both:
+//
+//	defer tracing.Storage(ctx, metrics.StoreSQL, "GetClient")()
+func Storage(ctx context.Context, store, method string) func() {
+	_, span := Start(ctx, store+"."+method, attribute.String("storage", store))
+	observe := metrics.StorageTimer(store, method)
+
+	return func() {
+		observe()
+		span.End()
+	}
+}
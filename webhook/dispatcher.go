@@ -0,0 +1,244 @@
+// Package webhook delivers the user events of the outbox to the webhooks of the clients.
+//
+// The events are written to the outbox by usrrepo in the transaction of their change,
+// the dispatcher polls the due deliveries and posts them:
+//
+//	POST <url>
+//	Content-Type: application/json
+//	X-Webhook-Id: <event id, the same for every delivery of the event>
+//	X-Webhook-Event: user.created
+//	X-Webhook-Timestamp: <unix seconds>
+//	X-Webhook-Signature: sha256=<base64 HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook secret>
+//
+//	{"id": "...", "type": "user.created", "client_id": "...", "user_id": "...", "occurred_at": "...", "data": {...}}
+//
+// A 2xx response acknowledges the delivery, anything else is retried with an exponential backoff
+// until the attempts are exhausted. The deliveries are at least once: the receivers drop the ids they already saw.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/baozhenglab/oauth-service/common"
+	"github.com/baozhenglab/oauth-service/logging"
+	"github.com/baozhenglab/oauth-service/oauth2/model"
+	"github.com/baozhenglab/oauth-service/secure"
+)
+
+const (
+	batchSize  = 100
+	maxBackoff = 12 * time.Hour
+)
+
+// Storage holds the webhooks and their outbox
+type Storage interface {
+	FindWebhook(ctx context.Context, webhookId string) (*model.Webhook, error)
+	FindDueOutboxEvents(ctx context.Context, now time.Time, limit int) ([]model.OutboxEvent, error)
+	ClaimOutboxEvent(ctx context.Context, deliveryId string, now, until time.Time) (bool, error)
+	SaveOutboxAttempt(ctx context.Context, event *model.OutboxEvent) error
+}
+
+// Policy tunes the delivery of the events
+type Policy struct {
+	// how often the outbox is polled
+	PollInterval time.Duration
+	// timeout of a request to a webhook
+	Timeout time.Duration
+	// attempts before a delivery is given up
+	MaxAttempts int
+	// delay before the first retry, doubled for every failure
+	Backoff time.Duration
+}
+
+// RetryAt returns the time of the next attempt after the given number of failed attempts
+func (p *Policy) RetryAt(attempts int, now time.Time) time.Time {
+	delay := p.Backoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	return now.Add(delay)
+}
+
+type Dispatcher struct {
+	store  Storage
+	policy *Policy
+	client *http.Client
+	// the background run between Start and Stop
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewDispatcher(store Storage, policy *Policy) *Dispatcher {
+	return &Dispatcher{
+		store:  store,
+		policy: policy,
+		client: &http.Client{Timeout: policy.Timeout},
+	}
+}
+
+// Run dispatches the outbox until the context is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.policy.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.Dispatch(ctx); err != nil {
+			logging.FromContext(ctx).WithError(err).Error("Error occurred in webhook dispatch")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Start runs the dispatcher in the background until Stop
+func (d *Dispatcher) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel, d.done = cancel, make(chan struct{})
+
+	go func() {
+		defer close(d.done)
+		d.Run(ctx)
+	}()
+}
+
+// Stop ends the background run and waits for it, or until ctx is done.
+// A delivery interrupted by Stop is not counted as an attempt, it is due again when its claim expires.
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	if d.cancel == nil {
+		return nil
+	}
+
+	d.cancel()
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Dispatch delivers the due events once.
+// Every delivery is claimed first so the dispatchers of several replicas do not post it twice.
+func (d *Dispatcher) Dispatch(ctx context.Context) error {
+	now := time.Now().UTC()
+
+	events, err := d.store.FindDueOutboxEvents(ctx, now, batchSize)
+	if err != nil {
+		return err
+	}
+
+	for i := range events {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		event := &events[i]
+
+		// the claim outlives the attempt, a dispatcher stopped meanwhile leaves the delivery due again
+		ok, err := d.store.ClaimOutboxEvent(ctx, event.DeliveryId, now, now.Add(2*d.policy.Timeout))
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		d.attempt(ctx, event)
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err := d.store.SaveOutboxAttempt(ctx, event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// attempt posts the event and records the outcome on it
+func (d *Dispatcher) attempt(ctx context.Context, event *model.OutboxEvent) {
+	event.Attempts++
+
+	err := d.deliver(ctx, event)
+	now := time.Now().UTC()
+
+	switch {
+	case err == nil:
+		event.State = model.OutboxDelivered
+		event.DeliveredAt = &now
+		event.LastError = ""
+	case event.Attempts >= d.policy.MaxAttempts:
+		event.State = model.OutboxFailed
+		event.LastError = err.Error()
+	default:
+		event.NextAttemptAt = d.policy.RetryAt(event.Attempts, now)
+		event.LastError = err.Error()
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, event *model.OutboxEvent) error {
+	webhook, err := d.store.FindWebhook(ctx, event.WebhookId)
+	if err != nil {
+		if err.Error() == common.ErrDataNotFound.Error() {
+			// the webhook is removed, its deliveries are given up
+			event.Attempts = d.policy.MaxAttempts
+		}
+		return err
+	}
+
+	body := []byte(event.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		event.Attempts = d.policy.MaxAttempts
+		return err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", event.EventId)
+	req.Header.Set("X-Webhook-Event", event.Type)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+Sign(webhook.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Sign returns the base64 HMAC-SHA256 of "<timestamp>.<body>" keyed with the secret,
+// the receivers compute it again to check the origin and the integrity of the payload
+func Sign(secret, timestamp string, body []byte) string {
+	return secure.ComputeHmac256(timestamp+".", string(body), secret)
+}